@@ -25,17 +25,18 @@
  * POSSIBILITY OF SUCH DAMAGE.
  */
 
-// Package log implements a simple set of leveled logging wrappers around the
-// standard log package.
+// Package log configures the dispatcher's logger and provides helpers for
+// logging connections safely. Everything is logged through golog, one JSON
+// object per line.
 package log
 
 import (
 	"fmt"
-	"io/ioutil"
-	"log"
 	"net"
 	"os"
 	"strings"
+
+	"github.com/kataras/golog"
 )
 
 const (
@@ -57,24 +58,34 @@ const (
 	LevelNone
 )
 
-var logLevel = LevelInfo
-var ipcLogLevel = LevelNone
-var enableLogging bool
 var unsafeLogging bool
 
-// Init initializes logging with the given path, and log safety options.
-func Init(enable bool, logFilePath string, ipcLog int) error {
-	if enable {
-		f, err := os.OpenFile(logFilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
-		if err != nil {
-			return err
-		}
-		log.SetOutput(f)
-	} else {
-		log.SetOutput(ioutil.Discard)
+// fileLevel is the level of the entries written to the log output. golog's
+// own level can be more verbose, so that the IPC log gets every entry it asks
+// for.
+var fileLevel = golog.DebugLevel
+
+// Init sends logs to the file at logFilePath at the given level, or, when
+// logging is not enabled, only fatal errors to stderr. Nothing is logged to
+// stdout, which belongs to the PT IPC protocol.
+func Init(enable bool, logFilePath string, logLevelStr string) error {
+	if !enable {
+		golog.SetOutput(os.Stderr)
+		fileLevel = golog.FatalLevel
+		applyLevels()
+		return nil
 	}
-	enableLogging = enable
-	ipcLogLevel = ipcLog
+
+	if err := SetLogLevel(logLevelStr); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(logFilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	golog.SetOutput(f)
+
 	return nil
 }
 
@@ -82,94 +93,48 @@ func Init(enable bool, logFilePath string, ipcLog int) error {
 // (case-insensitive).
 func SetLogLevel(logLevelStr string) error {
 	switch strings.ToUpper(logLevelStr) {
-	case "ERROR":
-		logLevel = LevelError
-	case "WARN":
-		logLevel = LevelWarn
-	case "INFO":
-		logLevel = LevelInfo
-	case "DEBUG":
-		logLevel = LevelDebug
+	case "ERROR", "WARN", "INFO", "DEBUG":
+		fileLevel = golog.ParseLevel(logLevelStr)
+		applyLevels()
 	default:
 		return fmt.Errorf("invalid log level '%s'", logLevelStr)
 	}
 	return nil
 }
 
-func ipcLogMessage(logLevel int, message string) {
-	var logLevelStr string
-	switch logLevel {
-	case LevelNone:
-		logLevelStr = "NONE"
-	case LevelError:
-		logLevelStr = "ERROR"
-	case LevelWarn:
-		logLevelStr = "WARN"
-	case LevelInfo:
-		logLevelStr = "INFO"
-	case LevelDebug:
-		logLevelStr = "DEBUG"
-	default:
-		return
+// applyLevels sets golog's level to the more verbose of the file and IPC
+// levels.
+func applyLevels() {
+	level := fileLevel
+	if ipc := gologLevel(ipcLevel); ipc > level {
+		level = ipc
 	}
-	println("LOG "+logLevelStr+" "+message)
+	golog.SetLevel(level.String())
 }
 
-// Noticef logs the given format string/arguments at the NOTICE log level.
-// Unless logging is disabled, Noticef logs are always emitted.
+// Noticef logs the given format string/arguments at the INFO log level.
 func Noticef(format string, a ...interface{}) {
-	if enableLogging {
-		msg := fmt.Sprintf(format, a...)
-		log.Print("[NOTICE]: " + msg)
-	}
+	golog.Infof(format, a...)
 }
 
 // Errorf logs the given format string/arguments at the ERROR log level.
 func Errorf(format string, a ...interface{}) {
-	if enableLogging && logLevel >= LevelError {
-		msg := fmt.Sprintf(format, a...)
-		log.Print("[ERROR]: " + msg)
-	}
-	if ipcLogLevel != LevelNone && ipcLogLevel >= LevelError {
-		msg := fmt.Sprintf(format, a...)
-		ipcLogMessage(LevelError, msg)
-	}
+	golog.Errorf(format, a...)
 }
 
 // Warnf logs the given format string/arguments at the WARN log level.
 func Warnf(format string, a ...interface{}) {
-	if enableLogging && logLevel >= LevelWarn {
-		msg := fmt.Sprintf(format, a...)
-		log.Print("[WARN]: " + msg)
-	}
-	if ipcLogLevel != LevelNone && ipcLogLevel >= LevelWarn {
-		msg := fmt.Sprintf(format, a...)
-		ipcLogMessage(LevelWarn, msg)
-	}
+	golog.Warnf(format, a...)
 }
 
 // Infof logs the given format string/arguments at the INFO log level.
 func Infof(format string, a ...interface{}) {
-	if enableLogging && logLevel >= LevelInfo {
-		msg := fmt.Sprintf(format, a...)
-		log.Print("[INFO]: " + msg)
-	}
-	if ipcLogLevel != LevelNone && ipcLogLevel >= LevelInfo {
-		msg := fmt.Sprintf(format, a...)
-		ipcLogMessage(LevelInfo, msg)
-	}
+	golog.Infof(format, a...)
 }
 
 // Debugf logs the given format string/arguments at the DEBUG log level.
 func Debugf(format string, a ...interface{}) {
-	if enableLogging && logLevel >= LevelDebug {
-		msg := fmt.Sprintf(format, a...)
-		log.Print("[DEBUG]: " + msg)
-	}
-	if ipcLogLevel != LevelNone && ipcLogLevel >= LevelDebug {
-		msg := fmt.Sprintf(format, a...)
-		ipcLogMessage(LevelDebug, msg)
-	}
+	golog.Debugf(format, a...)
 }
 
 // ElideError transforms the string representation of the provided error
@@ -0,0 +1,249 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package log
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+// Fields are the structured fields attached to a log entry.
+type Fields = golog.Fields
+
+// The field names used across the dispatcher, so entries can be filtered the
+// same way whichever part of the code logged them.
+const (
+	FieldSession    = "session"
+	FieldListener   = "listener"
+	FieldTransport  = "transport"
+	FieldMode       = "mode"
+	FieldPeer       = "peer"
+	FieldTarget     = "target"
+	FieldError      = "error"
+	FieldErrorClass = "errorClass"
+)
+
+func init() {
+	golog.SetOutput(os.Stderr)
+	golog.Default.RegisterFormatter(new(jsonFormatter))
+	golog.SetFormat(jsonFormatterName)
+	golog.Default.Handle(sendIPC)
+}
+
+const jsonFormatterName = "dispatcher-json"
+
+// jsonFormatter writes each entry as a single line of JSON, with its fields
+// next to the time, level and message.
+type jsonFormatter struct{}
+
+func (formatter *jsonFormatter) String() string {
+	return jsonFormatterName
+}
+
+func (formatter *jsonFormatter) Options(...interface{}) golog.Formatter {
+	return formatter
+}
+
+func (formatter *jsonFormatter) Format(dest io.Writer, entry *golog.Log) bool {
+	if entry.Level > fileLevel {
+		// The entry was only logged for the IPC log.
+		return true
+	}
+
+	record := make(map[string]interface{}, len(entry.Fields)+3)
+	for key, value := range entry.Fields {
+		record[key] = value
+	}
+	record["time"] = entry.Time.UTC().Format(time.RFC3339Nano)
+	record["level"] = entry.Level
+	record["msg"] = entry.Message
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return false
+	}
+	_, err = dest.Write(append(line, '\n'))
+
+	return err == nil
+}
+
+// ipcLevel is the level of the entries sent to the parent process as PT IPC
+// LOG lines, and ipcSend sends them.
+var ipcLevel = LevelNone
+var ipcSend func(level int, message string)
+
+// InitIPC sends entries at or above level to send, which writes them as PT IPC
+// LOG lines. LevelNone turns this off.
+func InitIPC(level int, send func(level int, message string)) {
+	ipcLevel = level
+	ipcSend = send
+	applyLevels()
+}
+
+// IPCLevel returns the level set by InitIPC.
+func IPCLevel() int {
+	return ipcLevel
+}
+
+func sendIPC(entry *golog.Log) bool {
+	if ipcSend == nil || entry.Level == golog.DisableLevel || entry.Level > gologLevel(ipcLevel) {
+		return false
+	}
+
+	// The fields are added to the message as key=value, in a stable order.
+	message := entry.Message
+	keys := make([]string, 0, len(entry.Fields))
+	for key := range entry.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		message += fmt.Sprintf(" %s=%v", key, entry.Fields[key])
+	}
+
+	switch entry.Level {
+	case golog.FatalLevel, golog.ErrorLevel:
+		ipcSend(LevelError, message)
+	case golog.WarnLevel:
+		ipcSend(LevelWarn, message)
+	case golog.InfoLevel:
+		ipcSend(LevelInfo, message)
+	default:
+		ipcSend(LevelDebug, message)
+	}
+
+	// Let golog go on to write the entry to the log output.
+	return false
+}
+
+func gologLevel(level int) golog.Level {
+	switch level {
+	case LevelError:
+		return golog.ErrorLevel
+	case LevelWarn:
+		return golog.WarnLevel
+	case LevelInfo:
+		return golog.InfoLevel
+	case LevelDebug:
+		return golog.DebugLevel
+	default:
+		return golog.DisableLevel
+	}
+}
+
+// A Logger adds the same fields to everything it logs, such as the ID,
+// transport and mode of the session it belongs to.
+type Logger struct {
+	fields Fields
+}
+
+// With returns a Logger that adds fields to its entries.
+func With(fields Fields) *Logger {
+	return &Logger{fields: fields}
+}
+
+// With returns a copy of the Logger that also adds key and value.
+func (logger *Logger) With(key string, value interface{}) *Logger {
+	fields := make(Fields, len(logger.fields)+1)
+	for k, v := range logger.fields {
+		fields[k] = v
+	}
+	fields[key] = value
+
+	return &Logger{fields: fields}
+}
+
+// WithError returns a copy of the Logger that also adds err, elided, and its
+// class.
+func (logger *Logger) WithError(err error) *Logger {
+	if err == nil {
+		return logger
+	}
+
+	return logger.With(FieldError, ElideError(err)).With(FieldErrorClass, ErrorClass(err))
+}
+
+// Errorf logs the given format string/arguments at the ERROR log level.
+func (logger *Logger) Errorf(format string, a ...interface{}) {
+	golog.Errorf(format, append(a, logger.fields)...)
+}
+
+// Warnf logs the given format string/arguments at the WARN log level.
+func (logger *Logger) Warnf(format string, a ...interface{}) {
+	golog.Warnf(format, append(a, logger.fields)...)
+}
+
+// Infof logs the given format string/arguments at the INFO log level.
+func (logger *Logger) Infof(format string, a ...interface{}) {
+	golog.Infof(format, append(a, logger.fields)...)
+}
+
+// Debugf logs the given format string/arguments at the DEBUG log level.
+func (logger *Logger) Debugf(format string, a ...interface{}) {
+	golog.Debugf(format, append(a, logger.fields)...)
+}
+
+// ErrorClass sorts an error into a broad class that can be counted and
+// filtered on without parsing the message: "eof", "closed", "timeout",
+// "refused", "reset", "unreachable", "dns", "network" or "other".
+func ErrorClass(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.Is(err, net.ErrClosed):
+		return "closed"
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNABORTED), errors.Is(err, syscall.EPIPE):
+		return "reset"
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return "unreachable"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.As(err, &netErr):
+		if netErr.Timeout() {
+			return "timeout"
+		}
+		return "network"
+	default:
+		return "other"
+	}
+}
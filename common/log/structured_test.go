@@ -0,0 +1,127 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/kataras/golog"
+)
+
+func TestLoggerWritesJSONLines(t *testing.T) {
+	var buf bytes.Buffer
+	golog.SetOutput(&buf)
+	golog.SetLevel("debug")
+	defer func() {
+		golog.SetOutput(os.Stderr)
+		golog.SetLevel("info")
+	}()
+
+	sessionLog := With(Fields{FieldSession: 7, FieldTransport: "shadow", FieldMode: "socks5"})
+	sessionLog.WithError(io.EOF).Warnf("closed %s", "connection")
+	sessionLog.Infof("done")
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", buf.String())
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(lines[0], &entry); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"level":         "warn",
+		"msg":           "closed connection",
+		FieldSession:    float64(7),
+		FieldTransport:  "shadow",
+		FieldMode:       "socks5",
+		FieldError:      "EOF",
+		FieldErrorClass: "eof",
+	}
+	for key, value := range expected {
+		if entry[key] != value {
+			t.Errorf("%s = %v, expected %v", key, entry[key], value)
+		}
+	}
+	if _, ok := entry["time"]; !ok {
+		t.Error("the entry has no time")
+	}
+
+	// WithError returns a copy, so the error is not added to later entries.
+	entry = nil
+	if err := json.Unmarshal(lines[1], &entry); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := entry[FieldError]; ok {
+		t.Errorf("unexpected error field in %s", lines[1])
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	tests := []struct {
+		err   error
+		class string
+	}{
+		{nil, ""},
+		{io.EOF, "eof"},
+		{fmt.Errorf("read: %w", io.ErrUnexpectedEOF), "eof"},
+		{net.ErrClosed, "closed"},
+		{os.ErrDeadlineExceeded, "timeout"},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, "refused"},
+		{&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, "reset"},
+		{&net.DNSError{Err: "no such host", Name: "example.invalid"}, "dns"},
+		{errors.New("bad options"), "other"},
+	}
+
+	for _, test := range tests {
+		if class := ErrorClass(test.err); class != test.class {
+			t.Errorf("ErrorClass(%v) = %q, expected %q", test.err, class, test.class)
+		}
+	}
+}
+
+func TestIPCLevel(t *testing.T) {
+	var buf bytes.Buffer
+	golog.SetOutput(&buf)
+	var sent []string
+	InitIPC(LevelInfo, func(level int, message string) {
+		sent = append(sent, fmt.Sprintf("%d %s", level, message))
+	})
+	if err := SetLogLevel("ERROR"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		InitIPC(LevelNone, nil)
+		fileLevel = golog.DebugLevel
+		golog.SetLevel("info")
+		golog.SetOutput(os.Stderr)
+	}()
+
+	transportLog := With(Fields{FieldTransport: "shadow", FieldMode: "socks5"})
+	transportLog.Errorf("failed")
+	transportLog.Warnf("slow")
+	transportLog.Infof("listening")
+	transportLog.Debugf("details")
+
+	expected := []string{
+		fmt.Sprintf("%d failed mode=socks5 transport=shadow", LevelError),
+		fmt.Sprintf("%d slow mode=socks5 transport=shadow", LevelWarn),
+		fmt.Sprintf("%d listening mode=socks5 transport=shadow", LevelInfo),
+	}
+	if fmt.Sprint(sent) != fmt.Sprint(expected) {
+		t.Errorf("sent %q, expected %q", sent, expected)
+	}
+
+	// Only the error is at the file level.
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 1 || !bytes.Contains(lines[0], []byte(`"msg":"failed"`)) {
+		t.Errorf("unexpected log output %q", buf.String())
+	}
+}
@@ -0,0 +1,375 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+// Package metrics keeps counters, gauges and histograms and serves them over
+// HTTP in the Prometheus text format. It implements only what the dispatcher
+// needs, so that it does not depend on the Prometheus client library.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the histogram buckets, in seconds, used for latencies.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// metric is one metric family that can write itself in the text format.
+type metric interface {
+	write(w io.Writer)
+}
+
+var registry = struct {
+	sync.Mutex
+	metrics []metric
+}{}
+
+func register(m metric) {
+	registry.Lock()
+	registry.metrics = append(registry.metrics, m)
+	registry.Unlock()
+}
+
+// family holds the label names of a metric and one value per combination of
+// label values.
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mutex  sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	// Histograms only.
+	buckets []uint64
+	count   uint64
+}
+
+func newFamily(name string, help string, kind string, labels []string) family {
+	return family{name: name, help: help, kind: kind, labels: labels, series: make(map[string]*series)}
+}
+
+// get returns the series for labelValues, creating it if needed. It must be
+// called with the mutex held.
+func (f *family) get(labelValues []string) *series {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, got %d values", f.name, len(f.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		f.series[key] = s
+	}
+
+	return s
+}
+
+// sorted returns the series ordered by their label values, so that the
+// output is stable. It must be called with the mutex held.
+func (f *family) sorted() []*series {
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := make([]*series, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, f.series[key])
+	}
+
+	return result
+}
+
+func (f *family) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, strings.ReplaceAll(f.help, "\n", " "))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+}
+
+func (f *family) writeValues(w io.Writer) {
+	f.writeHeader(w)
+	for _, s := range f.sorted() {
+		fmt.Fprintf(w, "%s%s %s\n", f.name, formatLabels(f.labels, s.labelValues, "", ""), formatValue(s.value))
+	}
+}
+
+// Counter is a value that only goes up, with one value per combination of
+// label values.
+type Counter struct {
+	family
+}
+
+// NewCounter registers a counter with the given label names.
+func NewCounter(name string, help string, labels ...string) *Counter {
+	counter := &Counter{newFamily(name, help, "counter", labels)}
+	register(counter)
+
+	return counter
+}
+
+// Add adds value, which must not be negative, to the counter for labelValues.
+func (counter *Counter) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		panic("metrics: counters cannot decrease")
+	}
+
+	counter.mutex.Lock()
+	counter.get(labelValues).value += value
+	counter.mutex.Unlock()
+}
+
+// Inc adds one to the counter for labelValues.
+func (counter *Counter) Inc(labelValues ...string) {
+	counter.Add(1, labelValues...)
+}
+
+// Value returns the current value of the counter for labelValues.
+func (counter *Counter) Value(labelValues ...string) float64 {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+
+	return counter.get(labelValues).value
+}
+
+func (counter *Counter) write(w io.Writer) {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+
+	counter.writeValues(w)
+}
+
+// Gauge is a value that can go up and down, with one value per combination
+// of label values.
+type Gauge struct {
+	family
+}
+
+// NewGauge registers a gauge with the given label names.
+func NewGauge(name string, help string, labels ...string) *Gauge {
+	gauge := &Gauge{newFamily(name, help, "gauge", labels)}
+	register(gauge)
+
+	return gauge
+}
+
+// Add adds value to the gauge for labelValues.
+func (gauge *Gauge) Add(value float64, labelValues ...string) {
+	gauge.mutex.Lock()
+	gauge.get(labelValues).value += value
+	gauge.mutex.Unlock()
+}
+
+// Inc adds one to the gauge for labelValues.
+func (gauge *Gauge) Inc(labelValues ...string) {
+	gauge.Add(1, labelValues...)
+}
+
+// Dec subtracts one from the gauge for labelValues.
+func (gauge *Gauge) Dec(labelValues ...string) {
+	gauge.Add(-1, labelValues...)
+}
+
+// Value returns the current value of the gauge for labelValues.
+func (gauge *Gauge) Value(labelValues ...string) float64 {
+	gauge.mutex.Lock()
+	defer gauge.mutex.Unlock()
+
+	return gauge.get(labelValues).value
+}
+
+func (gauge *Gauge) write(w io.Writer) {
+	gauge.mutex.Lock()
+	defer gauge.mutex.Unlock()
+
+	gauge.writeValues(w)
+}
+
+// GaugeFunc is a gauge whose values are collected when it is scraped.
+type GaugeFunc struct {
+	family
+	collect func(set func(value float64, labelValues ...string))
+}
+
+// NewGaugeFunc registers a gauge whose values come from collect. collect is
+// called on every scrape, and calls set once for each combination of label
+// values it has a value for.
+func NewGaugeFunc(name string, help string, collect func(set func(value float64, labelValues ...string)), labels ...string) *GaugeFunc {
+	gauge := &GaugeFunc{newFamily(name, help, "gauge", labels), collect}
+	register(gauge)
+
+	return gauge
+}
+
+func (gauge *GaugeFunc) write(w io.Writer) {
+	gauge.mutex.Lock()
+	defer gauge.mutex.Unlock()
+
+	gauge.series = make(map[string]*series)
+	gauge.collect(func(value float64, labelValues ...string) {
+		gauge.get(labelValues).value += value
+	})
+	gauge.writeValues(w)
+}
+
+// Histogram counts observations in buckets, with one set of buckets per
+// combination of label values.
+type Histogram struct {
+	family
+	upperBounds []float64
+}
+
+// NewHistogram registers a histogram with the given bucket upper bounds,
+// which must be sorted, and label names.
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	histogram := &Histogram{newFamily(name, help, "histogram", labels), buckets}
+	register(histogram)
+
+	return histogram
+}
+
+// Observe records value in the histogram for labelValues.
+func (histogram *Histogram) Observe(value float64, labelValues ...string) {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	s := histogram.get(labelValues)
+	if s.buckets == nil {
+		s.buckets = make([]uint64, len(histogram.upperBounds))
+	}
+	for index, upperBound := range histogram.upperBounds {
+		if value <= upperBound {
+			s.buckets[index]++
+		}
+	}
+	s.count++
+	s.value += value
+}
+
+// Count returns the number of observations in the histogram for labelValues.
+func (histogram *Histogram) Count(labelValues ...string) uint64 {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	return histogram.get(labelValues).count
+}
+
+func (histogram *Histogram) write(w io.Writer) {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	histogram.writeHeader(w)
+	for _, s := range histogram.sorted() {
+		for index, upperBound := range histogram.upperBounds {
+			var count uint64
+			if s.buckets != nil {
+				count = s.buckets[index]
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", histogram.name, formatLabels(histogram.labels, s.labelValues, "le", formatValue(upperBound)), count)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", histogram.name, formatLabels(histogram.labels, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", histogram.name, formatLabels(histogram.labels, s.labelValues, "", ""), formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", histogram.name, formatLabels(histogram.labels, s.labelValues, "", ""), s.count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels writes label pairs as {name="value",...}, followed by an
+// extra label if extraName is set.
+func formatLabels(names []string, values []string, extraName string, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(names)+1)
+	for index, name := range names {
+		pairs = append(pairs, name+`="`+labelEscaper.Replace(values[index])+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+labelEscaper.Replace(extraValue)+`"`)
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+// WriteTo writes every registered metric in the Prometheus text format.
+func WriteTo(w io.Writer) {
+	registry.Lock()
+	metrics := append([]metric(nil), registry.metrics...)
+	registry.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// Handler serves the registered metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteTo(w)
+	})
+}
+
+// Serve listens on addr and serves the metrics at /metrics. It returns once
+// the listener is open, or with the error if it could not be opened.
+func Serve(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	go func() {
+		_ = http.Serve(ln, mux)
+	}()
+
+	return ln, nil
+}
@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scrape(t *testing.T) string {
+	server := httptest.NewServer(Handler())
+	defer server.Close()
+
+	response, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	if contentType := response.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain") {
+		t.Errorf("unexpected content type %s", contentType)
+	}
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(body)
+}
+
+func TestScrape(t *testing.T) {
+	counter := NewCounter("test_requests_total", "Requests.", "transport", "result")
+	counter.Inc("shadow", "succeeded")
+	counter.Add(2, "shadow", "succeeded")
+	counter.Inc("replicant", "general_failure")
+
+	gauge := NewGauge("test_sessions", "Sessions.", "transport")
+	gauge.Inc("shadow")
+	gauge.Inc("shadow")
+	gauge.Dec("shadow")
+
+	_ = NewGaugeFunc("test_flows", "Flows.", func(set func(value float64, labelValues ...string)) {
+		set(3, "shadow")
+	}, "transport")
+
+	histogram := NewHistogram("test_latency_seconds", "Latency.", []float64{0.1, 1}, "transport")
+	histogram.Observe(0.05, "shadow")
+	histogram.Observe(0.5, "shadow")
+	histogram.Observe(5, "shadow")
+
+	quoted := NewCounter("test_quoted_total", "Quoting.", "peer")
+	quoted.Inc("a\"b\\c\nd")
+
+	body := scrape(t)
+	for _, line := range []string{
+		"# TYPE test_requests_total counter",
+		`test_requests_total{transport="shadow",result="succeeded"} 3`,
+		`test_requests_total{transport="replicant",result="general_failure"} 1`,
+		"# TYPE test_sessions gauge",
+		`test_sessions{transport="shadow"} 1`,
+		`test_flows{transport="shadow"} 3`,
+		"# TYPE test_latency_seconds histogram",
+		`test_latency_seconds_bucket{transport="shadow",le="0.1"} 1`,
+		`test_latency_seconds_bucket{transport="shadow",le="1"} 2`,
+		`test_latency_seconds_bucket{transport="shadow",le="+Inf"} 3`,
+		`test_latency_seconds_sum{transport="shadow"} 5.55`,
+		`test_latency_seconds_count{transport="shadow"} 3`,
+		`test_quoted_total{peer="a\"b\\c\nd"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, body)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pt_extras
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// TargetAllowlist is the set of destinations a server is willing to connect
+// to on behalf of a client that requested a specific target.
+//
+// Each rule has the form host:port. The host may be "*", a literal IP
+// address, a CIDR block (IPv6 blocks must be bracketed), a hostname, or a
+// hostname with a leading "*." wildcard. The port may be "*" or a number.
+type TargetAllowlist []targetRule
+
+type targetRule struct {
+	anyHost bool
+	network *net.IPNet
+	ip      net.IP
+	host    string
+	suffix  string
+	port    int // 0 means any port
+}
+
+// ParseTargetAllowlist parses a comma-separated list of allowlist rules.
+func ParseTargetAllowlist(spec string) (TargetAllowlist, error) {
+	var result TargetAllowlist
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if entry == "*" {
+			result = append(result, targetRule{anyHost: true})
+			continue
+		}
+
+		hostStr, portStr, err := net.SplitHostPort(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowlist entry %q: %s", entry, err)
+		}
+
+		var rule targetRule
+		if portStr != "*" {
+			port, portErr := strconv.ParseUint(portStr, 10, 16)
+			if portErr != nil || port == 0 {
+				return nil, fmt.Errorf("invalid allowlist entry %q: bad port", entry)
+			}
+			rule.port = int(port)
+		}
+
+		switch {
+		case hostStr == "*":
+			rule.anyHost = true
+		case strings.Contains(hostStr, "/"):
+			_, network, cidrErr := net.ParseCIDR(hostStr)
+			if cidrErr != nil {
+				return nil, fmt.Errorf("invalid allowlist entry %q: %s", entry, cidrErr)
+			}
+			rule.network = network
+		case net.ParseIP(hostStr) != nil:
+			rule.ip = net.ParseIP(hostStr)
+		case strings.HasPrefix(hostStr, "*."):
+			rule.suffix = strings.ToLower(hostStr[1:])
+		case hostStr == "":
+			return nil, fmt.Errorf("invalid allowlist entry %q: missing host", entry)
+		default:
+			rule.host = strings.ToLower(hostStr)
+		}
+
+		result = append(result, rule)
+	}
+
+	return result, nil
+}
+
+// Allows reports whether the target host and port match a rule. The host is
+// matched by name, and ips holds the addresses the host resolved to, which are
+// checked against address and CIDR rules.
+func (allowlist TargetAllowlist) Allows(host string, port int, ips []net.IP) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	for _, rule := range allowlist {
+		if rule.port != 0 && rule.port != port {
+			continue
+		}
+
+		if rule.matchesHost(host, ips) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (rule targetRule) matchesHost(host string, ips []net.IP) bool {
+	switch {
+	case rule.anyHost:
+		return true
+	case rule.host != "":
+		return rule.host == host
+	case rule.suffix != "":
+		return strings.HasSuffix(host, rule.suffix)
+	}
+
+	// Address rules must hold for every address the name resolved to,
+	// otherwise the dialer could be steered to one that is not allowed.
+	if len(ips) == 0 {
+		return false
+	}
+	for _, ip := range ips {
+		if rule.network != nil && !rule.network.Contains(ip) {
+			return false
+		}
+		if rule.ip != nil && !rule.ip.Equal(ip) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,52 @@
+package pt_extras
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTargetAllowlist(t *testing.T) {
+	allowlist, err := ParseTargetAllowlist("example.com:443, *.example.org:*, 10.0.0.0/8:22, [2001:db8::/32]:80, 192.0.2.1:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host    string
+		port    int
+		ips     []net.IP
+		allowed bool
+	}{
+		{"example.com", 443, nil, true},
+		{"EXAMPLE.com.", 443, nil, true},
+		{"example.com", 80, nil, false},
+		{"www.example.org", 8080, nil, true},
+		{"example.org", 80, nil, false},
+		{"10.1.2.3", 22, []net.IP{net.ParseIP("10.1.2.3")}, true},
+		{"10.1.2.3", 23, []net.IP{net.ParseIP("10.1.2.3")}, false},
+		{"internal", 22, []net.IP{net.ParseIP("10.1.2.3")}, true},
+		{"mixed", 22, []net.IP{net.ParseIP("10.1.2.3"), net.ParseIP("192.168.1.1")}, false},
+		{"2001:db8::1", 80, []net.IP{net.ParseIP("2001:db8::1")}, true},
+		{"192.0.2.1", 9999, []net.IP{net.ParseIP("192.0.2.1")}, true},
+		{"192.0.2.2", 9999, []net.IP{net.ParseIP("192.0.2.2")}, false},
+	}
+
+	for _, test := range tests {
+		if allowed := allowlist.Allows(test.host, test.port, test.ips); allowed != test.allowed {
+			t.Errorf("Allows(%s, %d, %v) = %v, expected %v", test.host, test.port, test.ips, allowed, test.allowed)
+		}
+	}
+}
+
+func TestTargetAllowlistInvalid(t *testing.T) {
+	for _, spec := range []string{"example.com", "example.com:0", "example.com:http", "10.0.0.0/33:22", ":80"} {
+		if _, err := ParseTargetAllowlist(spec); err == nil {
+			t.Errorf("ParseTargetAllowlist(%q) succeeded", spec)
+		}
+	}
+
+	allowlist, err := ParseTargetAllowlist("")
+	if err != nil || len(allowlist) != 0 {
+		t.Errorf("ParseTargetAllowlist(\"\") = %v, %v", allowlist, err)
+	}
+}
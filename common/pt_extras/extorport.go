@@ -0,0 +1,257 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pt_extras
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// The Extended ORPort protocol is described in tor's
+// proposals/196-transport-control-ports.txt and
+// proposals/217-ext-orport-auth.txt.
+
+const (
+	extOrAuthTypeSafeCookie = 1
+
+	extOrCookieHeader     = "! Extended ORPort Auth Cookie !\x0a"
+	extOrCookieLength     = 32
+	extOrNonceLength      = 32
+	extOrHashLength       = sha256.Size
+	extOrServerHashString = "ExtORPort authentication server-to-client hash"
+	extOrClientHashString = "ExtORPort authentication client-to-server hash"
+
+	extOrCmdDone      = 0x0000
+	extOrCmdUserAddr  = 0x0001
+	extOrCmdTransport = 0x0002
+	extOrCmdOkay      = 0x1000
+	extOrCmdDeny      = 0x1001
+
+	extOrHandshakeTimeout = 5 * time.Second
+)
+
+var (
+	ErrExtOrAuthFailed = errors.New("extended ORPort authentication failed")
+	ErrExtOrDenied     = errors.New("extended ORPort denied the connection")
+)
+
+// ReadAuthCookieFile reads the 32-byte cookie tor writes for authenticating to
+// the Extended ORPort.
+func ReadAuthCookieFile(path string) ([]byte, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return readAuthCookie(contents)
+}
+
+func readAuthCookie(contents []byte) ([]byte, error) {
+	if len(contents) != len(extOrCookieHeader)+extOrCookieLength {
+		return nil, fmt.Errorf("auth cookie file is %d bytes long, expected %d", len(contents), len(extOrCookieHeader)+extOrCookieLength)
+	}
+	if !bytes.HasPrefix(contents, []byte(extOrCookieHeader)) {
+		return nil, errors.New("auth cookie file has the wrong header")
+	}
+
+	return contents[len(extOrCookieHeader):], nil
+}
+
+func extOrHash(cookie []byte, label string, clientNonce []byte, serverNonce []byte) []byte {
+	mac := hmac.New(sha256.New, cookie)
+	mac.Write([]byte(label))
+	mac.Write(clientNonce)
+	mac.Write(serverNonce)
+
+	return mac.Sum(nil)
+}
+
+// extOrAuthenticate runs the SAFE_COOKIE handshake.
+func extOrAuthenticate(conn io.ReadWriter, cookie []byte) error {
+	// The server lists the authentication types it supports.
+	//  uint8_t auth_types[] (terminated by 0x00)
+	supported := false
+	for {
+		var authType [1]byte
+		if _, err := io.ReadFull(conn, authType[:]); err != nil {
+			return err
+		}
+		if authType[0] == 0 {
+			break
+		}
+		if authType[0] == extOrAuthTypeSafeCookie {
+			supported = true
+		}
+	}
+	if !supported {
+		return errors.New("extended ORPort does not support SAFE_COOKIE authentication")
+	}
+
+	// The client picks SAFE_COOKIE and sends its nonce.
+	//  uint8_t auth_type (0x01)
+	//  uint8_t client_nonce[32]
+	clientNonce := make([]byte, extOrNonceLength)
+	if _, err := rand.Read(clientNonce); err != nil {
+		return err
+	}
+	if _, err := conn.Write(append([]byte{extOrAuthTypeSafeCookie}, clientNonce...)); err != nil {
+		return err
+	}
+
+	// The server proves it knows the cookie.
+	//  uint8_t server_hash[32]
+	//  uint8_t server_nonce[32]
+	serverReply := make([]byte, extOrHashLength+extOrNonceLength)
+	if _, err := io.ReadFull(conn, serverReply); err != nil {
+		return err
+	}
+	serverHash := serverReply[:extOrHashLength]
+	serverNonce := serverReply[extOrHashLength:]
+	if !hmac.Equal(serverHash, extOrHash(cookie, extOrServerHashString, clientNonce, serverNonce)) {
+		return ErrExtOrAuthFailed
+	}
+
+	// The client proves it knows the cookie, and the server reports the result.
+	//  uint8_t client_hash[32]
+	//  uint8_t status (0x01 on success)
+	if _, err := conn.Write(extOrHash(cookie, extOrClientHashString, clientNonce, serverNonce)); err != nil {
+		return err
+	}
+
+	var status [1]byte
+	if _, err := io.ReadFull(conn, status[:]); err != nil {
+		return err
+	}
+	if status[0] != 1 {
+		return ErrExtOrAuthFailed
+	}
+
+	return nil
+}
+
+// Commands are sent in both directions as:
+//
+//	uint16_t command
+//	uint16_t body_len
+//	uint8_t  body[body_len]
+func extOrWriteCommand(conn io.Writer, command uint16, body string) error {
+	if len(body) > 65535 {
+		return errors.New("extended ORPort command body is too long")
+	}
+
+	message := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint16(message, command)
+	binary.BigEndian.PutUint16(message[2:], uint16(len(body)))
+	message = append(message, body...)
+
+	_, err := conn.Write(message)
+	return err
+}
+
+func extOrReadCommand(conn io.Reader) (uint16, []byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(header[2:]))
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return 0, nil, err
+	}
+
+	return binary.BigEndian.Uint16(header[:]), body, nil
+}
+
+// extOrSendMetadata tells the server where the client connected from and which
+// transport it used, then waits for the server to accept the connection.
+func extOrSendMetadata(conn io.ReadWriter, addr string, methodName string) error {
+	if addr != "" {
+		if err := extOrWriteCommand(conn, extOrCmdUserAddr, addr); err != nil {
+			return err
+		}
+	}
+	if methodName != "" {
+		if err := extOrWriteCommand(conn, extOrCmdTransport, methodName); err != nil {
+			return err
+		}
+	}
+	if err := extOrWriteCommand(conn, extOrCmdDone, ""); err != nil {
+		return err
+	}
+
+	command, _, err := extOrReadCommand(conn)
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case extOrCmdOkay:
+		return nil
+	case extOrCmdDeny:
+		return ErrExtOrDenied
+	default:
+		return fmt.Errorf("unexpected extended ORPort reply 0x%04x", command)
+	}
+}
+
+func dialExtOr(info *ServerInfo, addr string, methodName string) (*net.TCPConn, error) {
+	cookie, err := ReadAuthCookieFile(info.AuthCookiePath)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialTCP("tcp", nil, info.ExtendedOrAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = conn.SetDeadline(time.Now().Add(extOrHandshakeTimeout)); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if err = extOrAuthenticate(conn, cookie); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if err = extOrSendMetadata(conn, addr, methodName); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if err = conn.SetDeadline(time.Time{}); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
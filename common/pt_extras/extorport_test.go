@@ -0,0 +1,140 @@
+package pt_extras
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type extOrMetadata struct {
+	userAddr  string
+	transport string
+}
+
+// startExtOrStub runs a one-connection Extended ORPort server that
+// authenticates with cookie, collects the metadata commands, and answers DONE
+// with reply.
+func startExtOrStub(t *testing.T, cookie []byte, reply uint16) (*net.TCPAddr, chan extOrMetadata) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	metadata := make(chan extOrMetadata, 1)
+	go func() {
+		conn, acceptErr := ln.Accept()
+		if acceptErr != nil {
+			return
+		}
+		defer conn.Close()
+
+		_, _ = conn.Write([]byte{extOrAuthTypeSafeCookie, 0})
+
+		clientMessage := make([]byte, 1+extOrNonceLength)
+		if _, readErr := io.ReadFull(conn, clientMessage); readErr != nil || clientMessage[0] != extOrAuthTypeSafeCookie {
+			return
+		}
+		clientNonce := clientMessage[1:]
+		serverNonce := make([]byte, extOrNonceLength)
+		_, _ = rand.Read(serverNonce)
+		_, _ = conn.Write(append(extOrHash(cookie, extOrServerHashString, clientNonce, serverNonce), serverNonce...))
+
+		clientHash := make([]byte, extOrHashLength)
+		if _, readErr := io.ReadFull(conn, clientHash); readErr != nil {
+			return
+		}
+		if !bytes.Equal(clientHash, extOrHash(cookie, extOrClientHashString, clientNonce, serverNonce)) {
+			_, _ = conn.Write([]byte{0})
+			return
+		}
+		_, _ = conn.Write([]byte{1})
+
+		var received extOrMetadata
+		for {
+			command, body, readErr := extOrReadCommand(conn)
+			if readErr != nil {
+				return
+			}
+			switch command {
+			case extOrCmdUserAddr:
+				received.userAddr = string(body)
+			case extOrCmdTransport:
+				received.transport = string(body)
+			case extOrCmdDone:
+				metadata <- received
+				_ = extOrWriteCommand(conn, reply, "")
+				_, _ = io.Copy(conn, conn)
+				return
+			}
+		}
+	}()
+
+	return ln.Addr().(*net.TCPAddr), metadata
+}
+
+func writeCookieFile(t *testing.T, cookie []byte) string {
+	path := filepath.Join(t.TempDir(), "extended_orport_auth_cookie")
+	if err := os.WriteFile(path, append([]byte(extOrCookieHeader), cookie...), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestDialOrExtendedORPort(t *testing.T) {
+	cookie := bytes.Repeat([]byte{0x42}, extOrCookieLength)
+	addr, metadata := startExtOrStub(t, cookie, extOrCmdOkay)
+	info := &ServerInfo{ExtendedOrAddr: addr, AuthCookiePath: writeCookieFile(t, cookie)}
+
+	conn, err := DialOr(info, "[2001:db8::1]:4242", "shadow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	received := <-metadata
+	if received.userAddr != "[2001:db8::1]:4242" || received.transport != "shadow" {
+		t.Errorf("unexpected metadata %+v", received)
+	}
+
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	echo := make([]byte, 4)
+	if _, err = io.ReadFull(conn, echo); err != nil || string(echo) != "ping" {
+		t.Errorf("unexpected echo %q: %v", echo, err)
+	}
+}
+
+func TestDialOrExtendedORPortDeny(t *testing.T) {
+	cookie := bytes.Repeat([]byte{0x42}, extOrCookieLength)
+	addr, _ := startExtOrStub(t, cookie, extOrCmdDeny)
+	info := &ServerInfo{ExtendedOrAddr: addr, AuthCookiePath: writeCookieFile(t, cookie)}
+
+	if _, err := DialOr(info, "192.0.2.1:4242", "shadow"); !errors.Is(err, ErrExtOrDenied) {
+		t.Errorf("expected a denied connection, got %v", err)
+	}
+}
+
+func TestDialOrExtendedORPortWrongCookie(t *testing.T) {
+	addr, _ := startExtOrStub(t, bytes.Repeat([]byte{0x42}, extOrCookieLength), extOrCmdOkay)
+	info := &ServerInfo{ExtendedOrAddr: addr, AuthCookiePath: writeCookieFile(t, bytes.Repeat([]byte{0x24}, extOrCookieLength))}
+
+	if _, err := DialOr(info, "192.0.2.1:4242", "shadow"); !errors.Is(err, ErrExtOrAuthFailed) {
+		t.Errorf("expected an authentication failure, got %v", err)
+	}
+}
+
+func TestReadAuthCookieInvalid(t *testing.T) {
+	for _, contents := range [][]byte{nil, []byte(extOrCookieHeader), bytes.Repeat([]byte{'!'}, len(extOrCookieHeader)+extOrCookieLength)} {
+		if _, err := readAuthCookie(contents); err == nil {
+			t.Errorf("readAuthCookie(%q) succeeded", contents)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pt_extras
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+)
+
+// A parent process that manages the dispatcher reads its stdout for PT IPC
+// messages. Besides the CMETHOD and SMETHOD lines, the dispatcher reports log
+// messages on LOG lines and per-transport events on STATUS lines.
+
+var ipcMutex sync.Mutex
+
+// ipcOutput is where IPC messages are written. Tests replace it.
+var ipcOutput io.Writer = syncWriter{os.Stdout}
+
+// SetIPCOutput sends IPC messages to w instead of stdout, so that tests can
+// check them. It returns a function that restores the previous output.
+func SetIPCOutput(w io.Writer) (restore func()) {
+	ipcMutex.Lock()
+	defer ipcMutex.Unlock()
+	previous := ipcOutput
+	ipcOutput = w
+
+	return func() {
+		ipcMutex.Lock()
+		defer ipcMutex.Unlock()
+		ipcOutput = previous
+	}
+}
+
+// writeIPC writes one IPC message. Lines are written whole, so messages from
+// different goroutines do not interleave.
+func writeIPC(keyword string, args ...string) {
+	line := keyword
+	if len(args) > 0 {
+		line += " " + strings.Join(args, " ")
+	}
+
+	ipcMutex.Lock()
+	defer ipcMutex.Unlock()
+	_, _ = ipcOutput.Write([]byte(line + "\n"))
+}
+
+// PtLog sends a log message to the parent process.
+//
+//	LOG SEVERITY=<severity> MESSAGE=<message>
+func PtLog(level int, message string) {
+	var severity string
+	switch level {
+	case log.LevelError:
+		severity = "error"
+	case log.LevelWarn:
+		severity = "warning"
+	case log.LevelInfo:
+		severity = "info"
+	case log.LevelDebug:
+		severity = "debug"
+	default:
+		return
+	}
+
+	writeIPC("LOG", "SEVERITY="+severity, "MESSAGE="+encodeCString(message))
+}
+
+// PtStatus sends the status of a transport to the parent process. keyValues
+// holds the keys and values of the status in turn.
+//
+//	STATUS TRANSPORT=<transport> <key>=<value> ...
+func PtStatus(transport string, keyValues ...string) {
+	args := []string{"TRANSPORT=" + encodeValue(transport)}
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		args = append(args, keyValues[i]+"="+encodeValue(keyValues[i+1]))
+	}
+
+	writeIPC("STATUS", args...)
+}
+
+// encodeValue leaves simple values as they are, and quotes any that contain
+// spaces, quotes, equals signs or special characters.
+func encodeValue(value string) string {
+	for _, c := range []byte(value) {
+		if c <= ' ' || c > '~' || c == '"' || c == '\\' || c == '=' {
+			return encodeCString(value)
+		}
+	}
+	if value == "" {
+		return `""`
+	}
+
+	return value
+}
+
+// encodeCString quotes s as a C string, with octal escapes for any byte that
+// is not printable ASCII, and for quotes and backslashes.
+func encodeCString(s string) string {
+	var result strings.Builder
+	result.WriteByte('"')
+	for _, c := range []byte(s) {
+		if c >= ' ' && c <= '~' && c != '"' && c != '\\' {
+			result.WriteByte(c)
+		} else {
+			_, _ = fmt.Fprintf(&result, "\\%03o", c)
+		}
+	}
+	result.WriteByte('"')
+
+	return result.String()
+}
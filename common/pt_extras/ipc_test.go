@@ -0,0 +1,25 @@
+package pt_extras
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+)
+
+func TestIPCMessages(t *testing.T) {
+	var buf bytes.Buffer
+	ipcOutput = &buf
+	defer func() { ipcOutput = syncWriter{os.Stdout} }()
+
+	PtLog(log.LevelWarn, "closed \"conn\"\n\\ é")
+	PtLog(log.LevelNone, "not sent")
+	PtStatus("shadow", "EVENT", "dial-failed", "ERROR", "connection refused", "EMPTY", "")
+
+	expected := "LOG SEVERITY=warning MESSAGE=\"closed \\042conn\\042\\012\\134 \\303\\251\"\n" +
+		"STATUS TRANSPORT=shadow EVENT=dial-failed ERROR=\"connection refused\" EMPTY=\"\"\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected IPC output:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
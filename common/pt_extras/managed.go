@@ -0,0 +1,210 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pt_extras
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// supportedVersions are the managed-mode protocol versions the dispatcher
+// speaks.
+var supportedVersions = []string{"1", "2", "2.1"}
+
+// PtVersion tells the parent process which protocol version was chosen.
+func PtVersion(version string) {
+	writeIPC("VERSION", version)
+}
+
+// PtVersionError tells the parent process that none of the versions it offered
+// are supported.
+func PtVersionError(msg string) error {
+	writeIPC("VERSION-ERROR", msg)
+	return errors.New(msg)
+}
+
+// PtEnvError tells the parent process that the environment it set up is
+// missing or invalid.
+func PtEnvError(msg string) error {
+	writeIPC("ENV-ERROR", msg)
+	return errors.New(msg)
+}
+
+// PtCmethod tells the parent process that the client transport called name
+// is listening on addr, and speaks protocol to the application. Unix socket
+// addresses are written as unix:/path.
+func PtCmethod(name string, protocol string, addr net.Addr) {
+	if addr.Network() == "unix" {
+		writeIPC("CMETHOD", name, protocol, "unix:"+addr.String())
+		return
+	}
+	writeIPC("CMETHOD", name, protocol, addr.String())
+}
+
+// PtSmethod tells the parent process that the server transport called name is
+// listening on addr. args are the options clients need to connect to it.
+//
+//	SMETHOD <name> <address> ARGS:<key>=<value>,...
+func PtSmethod(name string, addr net.Addr, args map[string]string) {
+	if len(args) == 0 {
+		writeIPC("SMETHOD", name, addr.String())
+		return
+	}
+
+	keys := make([]string, 0, len(args))
+	for key := range args {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, escapeArg(key)+"="+escapeArg(args[key]))
+	}
+
+	writeIPC("SMETHOD", name, addr.String(), "ARGS:"+strings.Join(pairs, ","))
+}
+
+// PtCmethodError tells the parent process that the client transport called
+// name could not be launched.
+func PtCmethodError(name string, msg string) {
+	writeIPC("CMETHOD-ERROR", name, msg)
+}
+
+// PtSmethodError tells the parent process that the server transport called
+// name could not be launched.
+func PtSmethodError(name string, msg string) {
+	writeIPC("SMETHOD-ERROR", name, msg)
+}
+
+// NegotiateVersion picks a version from versions, the comma-separated list
+// offered in TOR_PT_MANAGED_TRANSPORT_VER. The parent's order is kept, so the
+// first offered version the dispatcher supports wins.
+func NegotiateVersion(versions string) (string, bool) {
+	for _, offered := range strings.Split(versions, ",") {
+		offered = strings.TrimSpace(offered)
+		for _, supported := range supportedVersions {
+			if offered == supported {
+				return offered, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// ParseServerTransportOptions converts TOR_PT_SERVER_TRANSPORT_OPTIONS into the
+// JSON object keyed by transport name that TransportOptions reads. The
+// variable is a list of transport:key=value pairs separated by semicolons, in
+// which a backslash escapes the next character:
+//
+//	shadow:password=a\;b;shadow:cipherName=CHACHA20-IETF-POLY1305;replicant:config=...
+//
+// Every value is passed to the transport as a string.
+func ParseServerTransportOptions(s string) (string, error) {
+	perTransport := make(map[string]map[string]string)
+	if s == "" {
+		return "", nil
+	}
+
+	for _, pair := range splitEscaped(s, ';') {
+		nameAndOption := splitEscapedN(pair, ':', 2)
+		if len(nameAndOption) != 2 || nameAndOption[0] == "" {
+			return "", fmt.Errorf("%q: doesn't contain a transport name", pair)
+		}
+		keyAndValue := splitEscapedN(nameAndOption[1], '=', 2)
+		if len(keyAndValue) != 2 || keyAndValue[0] == "" {
+			return "", fmt.Errorf("%q: doesn't contain key=value", pair)
+		}
+
+		name := unescape(nameAndOption[0])
+		if perTransport[name] == nil {
+			perTransport[name] = make(map[string]string)
+		}
+		perTransport[name][unescape(keyAndValue[0])] = unescape(keyAndValue[1])
+	}
+
+	options, err := json.Marshal(perTransport)
+	if err != nil {
+		return "", err
+	}
+
+	return string(options), nil
+}
+
+// escapeArg escapes the characters that separate SMETHOD ARGS with a
+// backslash.
+func escapeArg(s string) string {
+	var result strings.Builder
+	for _, c := range []byte(s) {
+		if c == '\\' || c == '=' || c == ',' {
+			result.WriteByte('\\')
+		}
+		result.WriteByte(c)
+	}
+
+	return result.String()
+}
+
+func splitEscaped(s string, separator byte) []string {
+	return splitEscapedN(s, separator, -1)
+}
+
+// splitEscapedN splits s at separators that are not escaped with a backslash,
+// into at most n parts if n is positive. Escapes are left in the parts.
+func splitEscapedN(s string, separator byte, n int) []string {
+	var parts []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		if n > 0 && len(parts) == n-1 {
+			break
+		}
+		switch s[i] {
+		case '\\':
+			i++
+		case separator:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, s[start:])
+}
+
+func unescape(s string) string {
+	var result strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		result.WriteByte(s[i])
+	}
+
+	return result.String()
+}
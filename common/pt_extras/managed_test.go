@@ -0,0 +1,139 @@
+package pt_extras
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net"
+	"os"
+	"testing"
+
+	shadowsocks "github.com/OperatorFoundation/go-shadowsocks2/darkstar"
+	"github.com/aead/ecdh"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		offered  string
+		version  string
+		resolved bool
+	}{
+		{"1", "1", true},
+		{"3,2.1,1", "2.1", true},
+		{"1,2.1", "1", true},
+		{"3", "", false},
+		{"", "", false},
+	}
+
+	for _, test := range tests {
+		version, ok := NegotiateVersion(test.offered)
+		if version != test.version || ok != test.resolved {
+			t.Errorf("NegotiateVersion(%q) = %q, %v, expected %q, %v", test.offered, version, ok, test.version, test.resolved)
+		}
+	}
+}
+
+func TestParseServerTransportOptions(t *testing.T) {
+	requireTransports(t, "shadow", "Replicant")
+	options, err := ParseServerTransportOptions(`shadow:password=a\;b\=c;shadow:cipherName=CHACHA20-IETF-POLY1305;replicant:config=x\\y`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"replicant":{"config":"x\\y"},"shadow":{"cipherName":"CHACHA20-IETF-POLY1305","password":"a;b=c"}}`
+	if options != expected {
+		t.Errorf("unexpected options %s, expected %s", options, expected)
+	}
+
+	shadowOptions, err := TransportOptions(options, "shadow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shadowOptions != `{"cipherName":"CHACHA20-IETF-POLY1305","password":"a;b=c"}` {
+		t.Errorf("unexpected shadow options %s", shadowOptions)
+	}
+
+	for _, invalid := range []string{"shadow", "shadow:password", ":password=a", "shadow:=a", `shadow\:password=a`} {
+		if _, err := ParseServerTransportOptions(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestManagedMessages(t *testing.T) {
+	var buf bytes.Buffer
+	ipcOutput = &buf
+	defer func() { ipcOutput = syncWriter{os.Stdout} }()
+
+	PtVersion("1")
+	_ = PtVersionError("no-version")
+	_ = PtEnvError("no TOR_PT_STATE_LOCATION environment variable")
+	PtCmethod("shadow", "socks5", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080})
+	PtCmethod("replicant", "socks5", &net.UnixAddr{Name: "/run/dispatcher/replicant.sock", Net: "unix"})
+	PtSmethod("starbridge", &net.TCPAddr{IP: net.IPv4(0, 0, 0, 0), Port: 2345}, nil)
+	PtSmethod("shadow", &net.TCPAddr{IP: net.IPv4(0, 0, 0, 0), Port: 1234}, map[string]string{"serverPublicKey": "AB+c=", "cipherName": "darkstar", "odd,key": `a\b`})
+	PtCmethodError("shadow", "invalid transport options")
+	PtSmethodError("replicant", "could not listen")
+
+	expected := "VERSION 1\n" +
+		"VERSION-ERROR no-version\n" +
+		"ENV-ERROR no TOR_PT_STATE_LOCATION environment variable\n" +
+		"CMETHOD shadow socks5 127.0.0.1:1080\n" +
+		"CMETHOD replicant socks5 unix:/run/dispatcher/replicant.sock\n" +
+		"SMETHOD starbridge 0.0.0.0:2345\n" +
+		"SMETHOD shadow 0.0.0.0:1234 ARGS:cipherName=darkstar,odd\\,key=a\\\\b,serverPublicKey=AB+c\\=\n" +
+		"CMETHOD-ERROR shadow invalid transport options\n" +
+		"SMETHOD-ERROR replicant could not listen\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected IPC output:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestArgsToClientArgs(t *testing.T) {
+	requireTransports(t, "shadow")
+	privateKey, publicKey, err := ecdh.Generic(elliptic.P256()).GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKeyBytes, err := shadowsocks.PublicKeyToKeychainFormatBytes(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Configs hold private keys with a leading key type byte.
+	serverPrivateKey := base64.StdEncoding.EncodeToString(append([]byte{2}, privateKey.([]byte)...))
+	options := `{"serverAddress": "127.0.0.1:1234", "serverPrivateKey": "` + serverPrivateKey + `", "cipherName": "darkstar", "transport": "shadow"}`
+
+	args, err := ArgsToClientArgs("Shadow", options, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args["serverPublicKey"] != base64.StdEncoding.EncodeToString(publicKeyBytes) || args["cipherName"] != "darkstar" {
+		t.Errorf("unexpected client args %v", args)
+	}
+
+	if _, err = ArgsToClientArgs("unknown", options, ""); err != ErrUnknownTransport {
+		t.Errorf("expected ErrUnknownTransport, got %v", err)
+	}
+}
+
+func TestCheckTransport(t *testing.T) {
+	requireTransports(t, "shadow", "Optimizer")
+	if err := CheckTransport("SHADOW", "socks5", true); err != nil {
+		t.Error(err)
+	}
+	if err := CheckTransport("optimizer", "transparent-tcp", false); err != nil {
+		t.Error(err)
+	}
+	if err := CheckTransport("Optimizer", "transparent-tcp", true); err == nil {
+		t.Error("expected an error running Optimizer as a server")
+	}
+	if err := CheckTransport("shadow", "sctp", false); err == nil {
+		t.Error("expected an error for an unsupported mode")
+	}
+	if err := CheckTransport("obfs2", "socks5", false); !errors.Is(err, ErrUnknownTransport) {
+		t.Errorf("expected ErrUnknownTransport, got %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pt_extras
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/transports"
+)
+
+// TransportOptions returns the options for the transport called name.
+//
+// options is either the config for a single transport, which is used for
+// every transport, or a JSON object with a config for each transport, keyed by
+// transport name:
+//
+//	{
+//	  "shadow": {"serverAddress": "0.0.0.0:1234", ...},
+//	  "replicant": {"serverAddress": "0.0.0.0:2345", ...}
+//	}
+//
+// Options are keyed by transport name when every value is an object and at
+// least one key is the name of a transport this build has, so a single config
+// whose options are all objects, such as Replicant's toneburst and polish, is
+// not mistaken for them. Once options are keyed by transport name, any other
+// key is an error, which catches a misspelled transport name.
+func TransportOptions(options string, name string) (string, error) {
+	perTransport, ok := splitTransportOptions(options)
+	if !ok {
+		return options, nil
+	}
+
+	var found string
+	for transportName, transportOptions := range perTransport {
+		if !isTransportName(transportName) {
+			return "", fmt.Errorf("%w: options for unknown transport %s", ErrInvalidOptions, transportName)
+		}
+		if strings.EqualFold(transportName, name) {
+			found = string(transportOptions)
+		}
+	}
+	if found == "" {
+		return "", fmt.Errorf("%w: no options for transport %s", ErrMissingOptions, name)
+	}
+
+	return found, nil
+}
+
+// splitTransportOptions reports whether options is keyed by transport name,
+// and if so returns the config for each transport.
+func splitTransportOptions(options string) (map[string]json.RawMessage, bool) {
+	var perTransport map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(options), &perTransport); err != nil || len(perTransport) == 0 {
+		return nil, false
+	}
+
+	namesTransport := false
+	for key, transportOptions := range perTransport {
+		if !strings.HasPrefix(strings.TrimSpace(string(transportOptions)), "{") {
+			return nil, false
+		}
+		namesTransport = namesTransport || isTransportName(key)
+	}
+
+	return perTransport, namesTransport
+}
+
+func isTransportName(name string) bool {
+	_, ok := transports.Lookup(name)
+	return ok
+}
@@ -0,0 +1,66 @@
+package pt_extras
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/transports"
+)
+
+// requireTransports skips a test that needs transports this build was made
+// without.
+func requireTransports(t *testing.T, names ...string) {
+	for _, name := range names {
+		if _, ok := transports.Lookup(name); !ok {
+			t.Skipf("built without %s", name)
+		}
+	}
+}
+
+func TestTransportOptions(t *testing.T) {
+	requireTransports(t, "shadow", "Replicant")
+
+	single := `{"serverAddress": "127.0.0.1:1234", "password": "secret", "cipherName": "darkstar"}`
+	perTransport := `{
+		"shadow": {"serverAddress": "127.0.0.1:1234", "password": "secret"},
+		"Replicant": {"serverAddress": "127.0.0.1:2345"}
+	}`
+
+	tests := []struct {
+		options  string
+		name     string
+		expected string
+	}{
+		{single, "shadow", single},
+		{single, "replicant", single},
+		{"", "shadow", ""},
+		{perTransport, "shadow", `{"serverAddress": "127.0.0.1:1234", "password": "secret"}`},
+		{perTransport, "replicant", `{"serverAddress": "127.0.0.1:2345"}`},
+	}
+
+	for _, test := range tests {
+		options, err := TransportOptions(test.options, test.name)
+		if err != nil {
+			t.Errorf("TransportOptions(%q, %s) failed: %s", test.options, test.name, err)
+		} else if options != test.expected {
+			t.Errorf("TransportOptions(%q, %s) = %q, expected %q", test.options, test.name, options, test.expected)
+		}
+	}
+
+	if _, err := TransportOptions(perTransport, "starbridge"); !errors.Is(err, ErrMissingOptions) {
+		t.Errorf("expected missing options for starbridge, got %v", err)
+	}
+
+	// A misspelled transport name is reported instead of the whole object
+	// being taken as a single config.
+	misspelled := `{"shadow": {"serverAddress": "127.0.0.1:1234"}, "shadwo": {"serverAddress": "127.0.0.1:2345"}}`
+	if _, err := TransportOptions(misspelled, "shadow"); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("expected invalid options for a misspelled transport, got %v", err)
+	}
+
+	// A single config whose options are all objects names no transport.
+	objects := `{"toneburst": {"type": "whalesong"}, "polish": {"type": "silver"}}`
+	if options, err := TransportOptions(objects, "replicant"); err != nil || options != objects {
+		t.Errorf("TransportOptions(%q, replicant) = %q, %v", objects, options, err)
+	}
+}
@@ -25,9 +25,10 @@ SOFTWARE.
 package pt_extras
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net"
-	"strings"
 
 	Optimizer "github.com/OperatorFoundation/Optimizer-go/Optimizer/v3"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/transports"
@@ -35,73 +36,112 @@ import (
 	"golang.org/x/net/proxy"
 )
 
-// target is the server address string
-func ArgsToDialer(name string, args string, dialer proxy.Dialer, enableLocket bool, logDir string) (Optimizer.TransportDialer, error) {
-	switch strings.ToLower(name) {
-	case "shadow":
-		transport, err := transports.ParseArgsShadow(args, enableLocket, logDir)
-		if err != nil {
-			golog.Errorf("Could not parse options %s", err.Error())
-			return nil, err
-		} else {
-			return transport, nil
-		}
-	case "optimizer":
-		transport, err := transports.ParseArgsOptimizer(args, dialer, enableLocket, logDir)
-		if err != nil {
-			golog.Errorf("Could not parse options %s", err.Error())
-			return nil, err
-		} else {
-			return transport, nil
-		}
-	case "replicant":
-		transport, err := transports.ParseArgsReplicantClient(args, dialer)
-		if err != nil {
-			golog.Errorf("Could not parse options %s", err.Error())
-			return nil, err
-		} else {
-			return transport, nil
+var (
+	// ErrMissingOptions is returned when no transport options were provided.
+	ErrMissingOptions = errors.New("no transport options were provided")
+
+	// ErrInvalidOptions is returned when the transport options could not be parsed.
+	ErrInvalidOptions = errors.New("invalid transport options")
+
+	// ErrInvalidServerAddress is returned when the transport options name a server address that is not host:port.
+	ErrInvalidServerAddress = errors.New("invalid transport server address")
+
+	// ErrUnknownTransport is returned for a transport name that is not supported.
+	ErrUnknownTransport = errors.New("unknown transport")
+)
+
+// ArgsFromSocks converts the PT 2.x per-connection arguments received in the
+// SOCKS authentication block into a transport options string.
+func ArgsFromSocks(args map[string]interface{}) (string, error) {
+	if len(args) == 0 {
+		return "", ErrMissingOptions
+	}
+
+	if untypedAddress, ok := args["serverAddress"]; ok {
+		address, isString := untypedAddress.(string)
+		if !isString {
+			return "", ErrInvalidServerAddress
 		}
-	case "starbridge":
-		transport, err := transports.ParseArgsStarbridgeClient(args, dialer)
-		if err != nil {
-			golog.Errorf("Could not parse options %s", err.Error())
-			return nil, err
-		} else {
-			return transport, nil
+		if host, port, err := net.SplitHostPort(address); err != nil || host == "" || port == "" {
+			return "", ErrInvalidServerAddress
 		}
+	}
+
+	argsBytes, marshalError := json.Marshal(args)
+	if marshalError != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidOptions, marshalError)
+	}
+
+	return string(argsBytes), nil
+}
 
-	default:
+// CheckTransport checks that the transport called name is compiled in, can
+// run as a server if server is set or a client if not, and supports mode.
+func CheckTransport(name string, mode string, server bool) error {
+	transport, ok := transports.Lookup(name)
+	if !ok {
+		return ErrUnknownTransport
+	}
+	if server && transport.NewServer == nil {
+		return fmt.Errorf("%s does not run as a server", transport.Name)
+	}
+	if !server && transport.NewClient == nil {
+		return fmt.Errorf("%s does not run as a client", transport.Name)
+	}
+	if !transport.Supports(mode) {
+		return fmt.Errorf("%s does not support %s mode", transport.Name, mode)
+	}
+
+	return nil
+}
+
+// target is the server address string
+func ArgsToDialer(name string, args string, dialer proxy.Dialer, enableLocket bool, logDir string) (Optimizer.TransportDialer, error) {
+	if args == "" {
+		return nil, ErrMissingOptions
+	}
+
+	transport, ok := transports.Lookup(name)
+	if !ok || transport.NewClient == nil {
 		golog.Errorf("Unknown transport: %s", name)
-		return nil, errors.New("unknown transport")
+		return nil, ErrUnknownTransport
 	}
+
+	if err := transports.CheckOptions(args, transport.ClientOptions); err != nil {
+		golog.Errorf("Could not parse options %s", err.Error())
+		return nil, fmt.Errorf("%w: %s", ErrInvalidOptions, err)
+	}
+
+	transportDialer, err := transport.NewClient(args, dialer, enableLocket, logDir)
+	if err != nil {
+		golog.Errorf("Could not parse options %s", err.Error())
+		return nil, fmt.Errorf("%w: %s", ErrInvalidOptions, err)
+	}
+
+	return transportDialer, nil
 }
 
 func ArgsToListener(name string, stateDir string, options string, enableLocket bool, logDir string) (func() (net.Listener, error), error) {
-	switch strings.ToLower(name) {
-	case "replicant":
-		config, err := transports.ParseArgsReplicantServer(options)
-		if err != nil {
-			return nil, errors.New("could not parse Replicant options")
-		}
+	transport, ok := transports.Lookup(name)
+	if !ok || transport.NewServer == nil {
+		return nil, ErrUnknownTransport
+	}
 
-		return config.Listen, nil
-	case "starbridge":
-		config, err := transports.ParseArgsStarbridgeServer(options)
-		if err != nil {
-			return nil, errors.New("could not parse Starbridge options")
-		}
+	if err := transports.CheckOptions(options, transport.ServerOptions); err != nil {
+		return nil, err
+	}
 
-		return config.Listen, nil
-	case "shadow":
-		config, err := transports.ParseArgsShadowServer(options, enableLocket, logDir)
-		if err != nil {
-			return nil, err
-		}
+	return transport.NewServer(options, stateDir, enableLocket, logDir)
+}
 
-		return config.Listen, nil
-	default:
-		println("unsupported transport name: ", name)
-		return nil, errors.New("unknown transport")
+// ArgsToClientArgs returns the options a client needs to connect to a server
+// for the transport called name that was started with options. Servers
+// announce them in the ARGS of their SMETHOD lines.
+func ArgsToClientArgs(name string, options string, stateDir string) (map[string]string, error) {
+	transport, ok := transports.Lookup(name)
+	if !ok || transport.ClientArgs == nil {
+		return nil, ErrUnknownTransport
 	}
+
+	return transport.ClientArgs(options, stateDir)
 }
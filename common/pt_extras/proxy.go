@@ -0,0 +1,219 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pt_extras
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"golang.org/x/net/proxy"
+)
+
+// golang.org/x/net/proxy only knows about SOCKS5, so register dialers for the
+// other upstream proxy types allowed by PtGetProxy.
+func init() {
+	proxy.RegisterDialerType("http", newHTTPConnectDialer)
+	proxy.RegisterDialerType("socks4a", newSocks4aDialer)
+}
+
+// ProxyDialer returns the dialer transports use to reach the Internet: a
+// direct dialer, or one that goes through the upstream proxy if one is set.
+func ProxyDialer(proxyURI *url.URL) (proxy.Dialer, error) {
+	if proxyURI == nil {
+		return proxy.Direct, nil
+	}
+
+	return proxy.FromURL(proxyURI, proxy.Direct)
+}
+
+// httpConnectDialer tunnels connections through an HTTP proxy using CONNECT.
+type httpConnectDialer struct {
+	proxyAddr  string
+	authHeader string
+	forward    proxy.Dialer
+}
+
+func newHTTPConnectDialer(proxyURI *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	dialer := &httpConnectDialer{proxyAddr: proxyURI.Host, forward: forward}
+	if proxyURI.User != nil {
+		password, _ := proxyURI.User.Password()
+		credentials := proxyURI.User.Username() + ":" + password
+		dialer.authHeader = "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+	}
+
+	return dialer, nil
+}
+
+func (dialer *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("http proxy: unsupported network %s", network)
+	}
+
+	conn, err := dialer.forward.Dial("tcp", dialer.proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if dialer.authHeader != "" {
+		request.Header.Set("Proxy-Authorization", dialer.authHeader)
+	}
+	if err = request.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("http proxy: CONNECT failed: %s", response.Status)
+	}
+
+	// The proxy may already have sent data from the target along with the
+	// response, so hand the buffered bytes to the caller first.
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+
+	return conn, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
+
+// socks4aDialer tunnels connections through a SOCKS4a proxy.
+type socks4aDialer struct {
+	proxyAddr string
+	userID    string
+	forward   proxy.Dialer
+}
+
+const (
+	socks4Version        = 0x04
+	socks4CommandConnect = 0x01
+	socks4Granted        = 0x5a
+)
+
+func newSocks4aDialer(proxyURI *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	dialer := &socks4aDialer{proxyAddr: proxyURI.Host, forward: forward}
+	if proxyURI.User != nil {
+		dialer.userID = proxyURI.User.Username()
+	}
+
+	return dialer, nil
+}
+
+func (dialer *socks4aDialer) Dial(network, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" {
+		return nil, fmt.Errorf("socks4a proxy: unsupported network %s", network)
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("socks4a proxy: invalid port %q", portStr)
+	}
+
+	// The client sends the request.
+	//  uint8_t vn (0x04)
+	//  uint8_t cd (0x01)
+	//  uint16_t dstport
+	//  uint8_t dstip[4] (0.0.0.x for a SOCKS4a hostname)
+	//  uint8_t userid[] (NUL terminated)
+	//  uint8_t hostname[] (NUL terminated, SOCKS4a only)
+	request := []byte{socks4Version, socks4CommandConnect, 0, 0}
+	binary.BigEndian.PutUint16(request[2:], uint16(port))
+	ip := net.ParseIP(host)
+	if ip != nil {
+		ip4 := ip.To4()
+		if ip4 == nil {
+			return nil, errors.New("socks4a proxy: IPv6 targets are not supported")
+		}
+		request = append(request, ip4...)
+	} else {
+		request = append(request, 0, 0, 0, 1)
+	}
+	request = append(request, dialer.userID...)
+	request = append(request, 0)
+	if ip == nil {
+		request = append(request, host...)
+		request = append(request, 0)
+	}
+
+	conn, err := dialer.forward.Dial("tcp", dialer.proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = conn.Write(request); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	// The proxy sends the reply.
+	//  uint8_t vn (0x00)
+	//  uint8_t cd
+	//  uint16_t dstport
+	//  uint8_t dstip[4]
+	var reply [8]byte
+	if _, err = io.ReadFull(conn, reply[:]); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if reply[1] != socks4Granted {
+		_ = conn.Close()
+		return nil, fmt.Errorf("socks4a proxy: request rejected with code 0x%02x", reply[1])
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,141 @@
+package pt_extras
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// startEcho runs a TCP echo server and returns its address.
+func startEcho(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, acceptErr := ln.Accept()
+			if acceptErr != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// startProxy runs a single-connection proxy stub. handshake reads the proxy
+// request from the client and returns the target to connect to.
+func startProxy(t *testing.T, handshake func(conn net.Conn, reader *bufio.Reader) string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, acceptErr := ln.Accept()
+		if acceptErr != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		target := handshake(conn, reader)
+		if target == "" {
+			return
+		}
+
+		targetConn, dialErr := net.Dial("tcp", target)
+		if dialErr != nil {
+			return
+		}
+		defer targetConn.Close()
+
+		go func() { _, _ = io.Copy(targetConn, reader) }()
+		_, _ = io.Copy(conn, targetConn)
+	}()
+
+	return ln.Addr().String()
+}
+
+func checkEcho(t *testing.T, proxyURL string, target string) {
+	proxyURI, err := url.Parse(proxyURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dialer, err := ProxyDialer(proxyURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := dialer.Dial("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	message := []byte("through the proxy")
+	if _, err = conn.Write(message); err != nil {
+		t.Fatal(err)
+	}
+	response := make([]byte, len(message))
+	if _, err = io.ReadFull(conn, response); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(message, response) {
+		t.Errorf("unexpected echo %q", response)
+	}
+}
+
+func TestHTTPConnectDialer(t *testing.T) {
+	echoAddr := startEcho(t)
+	proxyAddr := startProxy(t, func(conn net.Conn, reader *bufio.Reader) string {
+		request, err := http.ReadRequest(reader)
+		if err != nil || request.Method != http.MethodConnect {
+			return ""
+		}
+		if request.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+			_, _ = conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			return ""
+		}
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		return request.Host
+	})
+
+	checkEcho(t, "http://user:pass@"+proxyAddr, echoAddr)
+}
+
+func TestSocks4aDialer(t *testing.T) {
+	echoAddr := startEcho(t)
+	_, echoPort, _ := net.SplitHostPort(echoAddr)
+	proxyAddr := startProxy(t, func(conn net.Conn, reader *bufio.Reader) string {
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(reader, header); err != nil || header[0] != 4 || header[1] != 1 {
+			return ""
+		}
+		if _, err := reader.ReadString(0); err != nil {
+			return ""
+		}
+		host, err := reader.ReadString(0)
+		if err != nil || host != "localhost\x00" {
+			_, _ = conn.Write([]byte{0, 0x5b, 0, 0, 0, 0, 0, 0})
+			return ""
+		}
+		_, _ = conn.Write([]byte{0, 0x5a, 0, 0, 0, 0, 0, 0})
+		return "127.0.0.1:" + echoPort
+	})
+
+	checkEcho(t, "socks4a://"+proxyAddr, "localhost:"+echoPort)
+}
@@ -31,27 +31,31 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"net"
 	"net/url"
 	"os"
 	"strconv"
 	"strings"
-	"time"
 )
 
 // This file contains things that probably should be in goptlib but are not
 // yet or are not finalized.
 
 func ptProxyError(msg string) error {
-	line := []byte(fmt.Sprintf("PROXY-ERROR %s\n", msg))
-	_, _ = io.Writer.Write(syncWriter{os.Stdout}, line)
+	writeIPC("PROXY-ERROR", msg)
 	return errors.New(msg)
 }
 
 func PtProxyDone() {
-	line := []byte("PROXY DONE\n")
-	_, _ = io.Writer.Write(syncWriter{os.Stdout}, line)
+	writeIPC("PROXY", "DONE")
+}
+
+func PtCmethodsDone() {
+	writeIPC("CMETHODS", "DONE")
+}
+
+func PtSmethodsDone() {
+	writeIPC("SMETHODS", "DONE")
 }
 
 func PtGetProxy(proxy *string) (*url.URL, error) {
@@ -157,6 +161,10 @@ type ServerInfo struct {
 	OrAddr         *net.TCPAddr
 	ExtendedOrAddr *net.TCPAddr
 	AuthCookiePath string
+	AllowedTargets TargetAllowlist
+	// ProxyURL is the upstream proxy used to reach the next hop of a chain
+	// server, if set.
+	ProxyURL *url.URL
 }
 
 type Bindaddr struct {
@@ -218,19 +226,15 @@ func FilterBindaddrs(addrs []Bindaddr, methodNames []string) []Bindaddr {
 	return result
 }
 
+// DialOr connects to the ORPort. If an Extended ORPort and auth cookie are
+// configured, it connects there instead, authenticates, and reports the
+// client address addr and the transport methodName.
 func DialOr(info *ServerInfo, addr, methodName string) (*net.TCPConn, error) {
 	if info.ExtendedOrAddr == nil || info.AuthCookiePath == "" {
 		return net.DialTCP("tcp", nil, info.OrAddr)
 	}
 
-	s, err := net.DialTCP("tcp", nil, info.ExtendedOrAddr)
-	if err != nil {
-		return nil, err
-	}
-	s.SetDeadline(time.Now().Add(5 * time.Second))
-	s.SetDeadline(time.Time{})
-
-	return s, nil
+	return dialExtOr(info, addr, methodName)
 }
 
 func parsePort(portStr string) (int, error) {
@@ -250,8 +254,7 @@ func ParsePT2ClientParameters(s string) (map[string]interface{}, error) {
 	decoder := json.NewDecoder(strings.NewReader(s))
 	var result map[string]interface{}
 	if err := decoder.Decode(&result); err != nil {
-		fmt.Errorf("Error decoding JSON %q", err)
-		return nil, err
+		return nil, fmt.Errorf("error decoding JSON %q", err)
 	}
 	return result, nil
 }
\ No newline at end of file
@@ -28,9 +28,8 @@
 package socks5
 
 import (
+	"encoding/json"
 	"fmt"
-
-	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
 )
 
 func (req *Request) authPT2() (err error) {
@@ -52,11 +51,10 @@ func (req *Request) authPT2() (err error) {
 		return
 	}
 
-	var result = string(data)
-
-	// Parse the authentication data according to the PT 2.0 specification
-	if req.Args, err = pt_extras.ParsePT2ClientParameters(result); err != nil {
-		fmt.Println("Error parsing PT2 client parameters", err)
+	// Parse the authentication data according to the PT 2.0 specification,
+	// as a JSON object.
+	if err = json.Unmarshal(data, &req.Args); err != nil {
+		err = fmt.Errorf("error decoding JSON %q", err)
 		return
 	}
 
@@ -46,6 +46,7 @@ import (
 	"net"
 	"syscall"
 	"time"
+
 	"github.com/kataras/golog"
 )
 
@@ -82,6 +83,27 @@ const (
 	ReplyAddressNotSupported
 )
 
+var replyCodeNames = []string{
+	"succeeded",
+	"general_failure",
+	"connection_not_allowed",
+	"network_unreachable",
+	"host_unreachable",
+	"connection_refused",
+	"ttl_expired",
+	"command_not_supported",
+	"address_not_supported",
+}
+
+// String returns the name of the reply code, as used in metrics.
+func (code ReplyCode) String() string {
+	if int(code) < len(replyCodeNames) {
+		return replyCodeNames[code]
+	}
+
+	return fmt.Sprintf("reply_0x%02x", byte(code))
+}
+
 // Version returns a string suitable to be included in a call to Cmethod.
 func Version() string {
 	return "socks5"
@@ -235,7 +257,6 @@ func (req *Request) NegotiateAuth(needOptions bool) (byte, error) {
 	if _, err = req.rw.Write(msg); err != nil {
 		return 0, err
 	}
-	println("this is the authentication method the socks server is sending: ", version, method)
 
 	return method, req.flushBuffers()
 }
@@ -0,0 +1,643 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	commonLog "github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/control"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/pt_socks5"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/stun_udp"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/transparent_tcp"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/transparent_udp"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/transports"
+	"gopkg.in/yaml.v3"
+)
+
+// DispatcherConfig describes a whole dispatcher instance. It is read from the
+// file given with -config, in YAML, or in JSON if the file name ends in .json.
+type DispatcherConfig struct {
+	// Role is "client" or "server".
+	Role             string `yaml:"role" json:"role"`
+	StateDir         string `yaml:"stateDir" json:"stateDir"`
+	ExitOnStdinClose bool   `yaml:"exitOnStdinClose" json:"exitOnStdinClose"`
+	// ShutdownGrace is how long open connections may continue after the
+	// dispatcher is told to stop.
+	ShutdownGrace string        `yaml:"shutdownGrace" json:"shutdownGrace"`
+	Logging       LoggingConfig `yaml:"logging" json:"logging"`
+	// MetricsAddr is the local address metrics are served on, if set.
+	MetricsAddr string `yaml:"metricsAddr" json:"metricsAddr"`
+	// ControlAddr is the local address of the control API, if set.
+	ControlAddr string `yaml:"controlAddr" json:"controlAddr"`
+	// Proxy is the upstream proxy clients use to reach the server, and chain
+	// servers use to reach the next hop.
+	Proxy string `yaml:"proxy" json:"proxy"`
+	// Transports holds the options for each transport, keyed by name.
+	Transports map[string]interface{} `yaml:"transports" json:"transports"`
+	Listeners  []ListenerConfig       `yaml:"listeners" json:"listeners"`
+	UDP        UDPConfig              `yaml:"udp" json:"udp"`
+
+	// This is filled in by validate.
+	shutdownGrace time.Duration
+}
+
+type LoggingConfig struct {
+	Enable   bool   `yaml:"enable" json:"enable"`
+	Level    string `yaml:"level" json:"level"`
+	IPCLevel string `yaml:"ipcLevel" json:"ipcLevel"`
+	Locket   bool   `yaml:"locket" json:"locket"`
+}
+
+// ListenerConfig describes one proxy listener. Clients use the listen
+// address, servers use the bind address and target.
+type ListenerConfig struct {
+	Mode      string `yaml:"mode" json:"mode"`
+	Transport string `yaml:"transport" json:"transport"`
+
+	ListenAddr string `yaml:"listenAddr" json:"listenAddr"`
+	ListenHost string `yaml:"listenHost" json:"listenHost"`
+	ListenPort string `yaml:"listenPort" json:"listenPort"`
+
+	BindAddr       string `yaml:"bindAddr" json:"bindAddr"`
+	BindHost       string `yaml:"bindHost" json:"bindHost"`
+	BindPort       string `yaml:"bindPort" json:"bindPort"`
+	Target         string `yaml:"target" json:"target"`
+	TargetHost     string `yaml:"targetHost" json:"targetHost"`
+	TargetPort     string `yaml:"targetPort" json:"targetPort"`
+	ExtORPort      string `yaml:"extORPort" json:"extORPort"`
+	AuthCookie     string `yaml:"authCookie" json:"authCookie"`
+	AllowedTargets string `yaml:"allowedTargets" json:"allowedTargets"`
+	SocketMode     string `yaml:"socketMode" json:"socketMode"`
+	SendTarget     bool   `yaml:"sendTarget" json:"sendTarget"`
+
+	// These are filled in by validate.
+	mode       int
+	options    string
+	listenAddr string
+	socketMode os.FileMode
+	serverInfo pt_extras.ServerInfo
+}
+
+// UDPConfig holds the client settings for the UDP modes. Unset values use
+// the same defaults as the flags.
+type UDPConfig struct {
+	QueuePackets *int   `yaml:"queuePackets" json:"queuePackets"`
+	QueueAge     string `yaml:"queueAge" json:"queueAge"`
+	IdleTimeout  string `yaml:"idleTimeout" json:"idleTimeout"`
+	MaxFlows     *int   `yaml:"maxFlows" json:"maxFlows"`
+
+	// This is filled in by validate.
+	config modes.UDPConfig
+}
+
+// ConfigErrors lists every problem found in a config file.
+type ConfigErrors []error
+
+func (errs ConfigErrors) Error() string {
+	messages := make([]string, len(errs))
+	for index, err := range errs {
+		messages[index] = err.Error()
+	}
+
+	return strings.Join(messages, "\n")
+}
+
+// LoadConfig reads and validates a config file.
+func LoadConfig(configPath string) (*DispatcherConfig, error) {
+	contents, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseConfig(contents, strings.EqualFold(filepath.Ext(configPath), ".json"))
+}
+
+func parseConfig(contents []byte, isJSON bool) (*DispatcherConfig, error) {
+	var config DispatcherConfig
+	if isJSON {
+		decoder := json.NewDecoder(bytes.NewReader(contents))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&config); err != nil {
+			return nil, fmt.Errorf("could not parse config: %s", err)
+		}
+	} else {
+		decoder := yaml.NewDecoder(bytes.NewReader(contents))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&config); err != nil {
+			return nil, fmt.Errorf("could not parse config: %s", err)
+		}
+	}
+
+	if errs := config.validate(); len(errs) > 0 {
+		return nil, errs
+	}
+
+	return &config, nil
+}
+
+func (config *DispatcherConfig) isClient() bool {
+	return config.Role == "client"
+}
+
+func (config *DispatcherConfig) validate() ConfigErrors {
+	var errs ConfigErrors
+
+	switch config.Role {
+	case "client", "server":
+	case "":
+		errs = append(errs, errors.New("role: you must specify client or server"))
+	default:
+		errs = append(errs, fmt.Errorf("role: invalid role %q, expected client or server", config.Role))
+	}
+
+	if config.StateDir == "" {
+		config.StateDir = "state"
+	}
+
+	config.shutdownGrace = defaultShutdownGrace
+	if config.ShutdownGrace != "" {
+		grace, err := time.ParseDuration(config.ShutdownGrace)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("shutdownGrace: %s", err))
+		} else if grace < 0 {
+			errs = append(errs, errors.New("shutdownGrace: cannot be negative"))
+		} else {
+			config.shutdownGrace = grace
+		}
+	}
+
+	if config.Logging.Level == "" {
+		config.Logging.Level = "ERROR"
+	}
+	switch strings.ToUpper(config.Logging.Level) {
+	case "ERROR", "WARN", "INFO", "DEBUG":
+	default:
+		errs = append(errs, fmt.Errorf("logging.level: invalid log level %q", config.Logging.Level))
+	}
+
+	if config.Logging.IPCLevel == "" {
+		config.Logging.IPCLevel = "NONE"
+	}
+	if _, err := validateIPCLogLevel(config.Logging.IPCLevel); err != nil {
+		errs = append(errs, fmt.Errorf("logging.ipcLevel: %s", err))
+	}
+
+	if config.Proxy != "" {
+		if err := validateProxyURL(config.Proxy); err != nil {
+			errs = append(errs, fmt.Errorf("proxy: %s", err))
+		}
+	}
+
+	if config.MetricsAddr != "" {
+		if _, _, err := net.SplitHostPort(config.MetricsAddr); err != nil {
+			errs = append(errs, fmt.Errorf("metricsAddr: %s", err))
+		}
+	}
+
+	if config.ControlAddr != "" {
+		if err := control.ValidateAddr(config.ControlAddr); err != nil {
+			errs = append(errs, fmt.Errorf("controlAddr: %s", err))
+		}
+	}
+
+	for name := range config.Transports {
+		if !isTransportName(name) {
+			errs = append(errs, fmt.Errorf("transports.%s: unknown transport", name))
+		}
+	}
+
+	errs = append(errs, config.UDP.validate()...)
+
+	if len(config.Listeners) == 0 {
+		errs = append(errs, errors.New("listeners: you must specify at least one listener"))
+	}
+	for index := range config.Listeners {
+		listener := &config.Listeners[index]
+		for _, err := range config.validateListener(listener) {
+			errs = append(errs, fmt.Errorf("listeners[%d]: %s", index, err))
+		}
+	}
+
+	return errs
+}
+
+func (config *DispatcherConfig) validateListener(listener *ListenerConfig) ConfigErrors {
+	var errs ConfigErrors
+
+	noFlag := false
+	if err := validateMode(&listener.Mode, &noFlag, &noFlag); err != nil {
+		errs = append(errs, fmt.Errorf("mode: %s", err))
+	} else if listener.Mode == "" {
+		errs = append(errs, errors.New("mode: you must specify socks5, transparent-TCP, transparent-UDP, or STUN"))
+	} else {
+		listener.mode, _ = determineMode(listener.Mode, false, false)
+	}
+
+	noTransports := ""
+	if err := validateTransports(&listener.Transport, &noTransports); err != nil {
+		errs = append(errs, fmt.Errorf("transport: %s", err))
+	} else if !isTransportName(listener.Transport) {
+		errs = append(errs, fmt.Errorf("transport: unknown transport %q", listener.Transport))
+	} else {
+		if err := pt_extras.CheckTransport(listener.Transport, modeName(listener.mode), !config.isClient()); err != nil {
+			errs = append(errs, fmt.Errorf("transport: %s", err))
+		}
+
+		options, err := config.transportOptions(listener.Transport)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("transports.%s: %s", listener.Transport, err))
+		}
+		// Only a socks5 client may leave the options to each connection.
+		if options == "" && err == nil && !(config.isClient() && listener.mode == socks5) {
+			errs = append(errs, fmt.Errorf("transport: no options for transport %s under transports", listener.Transport))
+		}
+		listener.options = options
+	}
+
+	if config.isClient() {
+		errs = append(errs, listener.validateClient()...)
+	} else if config.Role == "server" {
+		errs = append(errs, listener.validateServer()...)
+	}
+
+	return errs
+}
+
+func (listener *ListenerConfig) validateClient() ConfigErrors {
+	var errs ConfigErrors
+
+	if listener.BindAddr != "" || listener.BindHost != "" || listener.BindPort != "" {
+		errs = append(errs, errors.New("bindAddr: cannot specify a bind address in client mode"))
+	}
+	if err := validatetarget(true, &listener.TargetHost, &listener.TargetPort, &listener.Target); err != nil {
+		errs = append(errs, fmt.Errorf("target: %s", err))
+	}
+	if listener.ExtORPort != "" || listener.AuthCookie != "" || listener.AllowedTargets != "" {
+		errs = append(errs, errors.New("cannot specify extORPort, authCookie, or allowedTargets in client mode"))
+	}
+	if listener.SendTarget && listener.mode != socks5 {
+		errs = append(errs, errors.New("sendTarget: only socks5 clients send targets"))
+	}
+
+	if err := validateProxyListenAddr(&listener.ListenHost, &listener.ListenPort, &listener.ListenAddr); err != nil {
+		errs = append(errs, fmt.Errorf("listenAddr: %s", err))
+		return errs
+	}
+
+	listener.listenAddr = listener.ListenAddr
+	if listener.ListenHost != "" {
+		listener.listenAddr = listener.ListenHost + ":" + listener.ListenPort
+	}
+	if modes.IsUnixAddr(listener.listenAddr) && (listener.mode == transparentUDP || listener.mode == stunUDP) {
+		errs = append(errs, errors.New("listenAddr: Unix sockets are only supported in socks5 and transparent-TCP modes"))
+	}
+
+	socketMode, err := modes.ParseSocketMode(listener.SocketMode)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("socketMode: %s", err))
+	}
+	listener.socketMode = socketMode
+
+	return errs
+}
+
+func (listener *ListenerConfig) validateServer() ConfigErrors {
+	var errs ConfigErrors
+
+	if listener.ListenAddr != "" || listener.ListenHost != "" || listener.ListenPort != "" {
+		errs = append(errs, errors.New("listenAddr: cannot specify a listen address in server mode"))
+	}
+	if listener.SocketMode != "" {
+		errs = append(errs, errors.New("socketMode: cannot specify a socket mode in server mode"))
+	}
+	if listener.SendTarget {
+		errs = append(errs, errors.New("sendTarget: cannot send targets in server mode"))
+	}
+
+	info := pt_extras.ServerInfo{}
+
+	if err := validateServerBindAddr(&listener.Transport, &listener.BindHost, &listener.BindPort, &listener.BindAddr); err != nil {
+		errs = append(errs, fmt.Errorf("bindAddr: %s", err))
+	} else {
+		bindAddr := listener.BindAddr
+		if bindAddr == "" {
+			bindAddr = listener.BindHost + ":" + listener.BindPort
+		}
+		addr, err := pt_extras.ResolveAddr(bindAddr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("bindAddr: %s", err))
+		}
+		info.Bindaddrs = []pt_extras.Bindaddr{{MethodName: listener.Transport, Addr: addr, Options: listener.options}}
+	}
+
+	// A socks5 server with an allowlist connects to the targets clients ask
+	// for, so it does not need a fixed target.
+	needsTarget := !(listener.mode == socks5 && listener.AllowedTargets != "")
+	if needsTarget || listener.Target != "" || listener.TargetHost != "" {
+		if err := validatetarget(false, &listener.TargetHost, &listener.TargetPort, &listener.Target); err != nil {
+			errs = append(errs, fmt.Errorf("target: %s", err))
+		} else {
+			target := listener.Target
+			if target == "" {
+				target = listener.TargetHost + ":" + listener.TargetPort
+			}
+			addr, err := pt_extras.ResolveAddr(target)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("target: %s", err))
+			}
+			info.OrAddr = addr
+		}
+	}
+
+	if (listener.ExtORPort == "") != (listener.AuthCookie == "") {
+		errs = append(errs, errors.New("extORPort: you must specify both extORPort and authCookie"))
+	} else if listener.ExtORPort != "" {
+		addr, err := pt_extras.ResolveAddr(listener.ExtORPort)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("extORPort: %s", err))
+		}
+		info.ExtendedOrAddr = addr
+		info.AuthCookiePath = listener.AuthCookie
+	}
+
+	if listener.AllowedTargets != "" {
+		if listener.mode != socks5 {
+			errs = append(errs, errors.New("allowedTargets: only socks5 servers connect to requested targets"))
+		}
+		allowlist, err := pt_extras.ParseTargetAllowlist(listener.AllowedTargets)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("allowedTargets: %s", err))
+		}
+		info.AllowedTargets = allowlist
+	}
+
+	listener.serverInfo = info
+
+	return errs
+}
+
+func (udp *UDPConfig) validate() ConfigErrors {
+	var errs ConfigErrors
+
+	udp.config = modes.UDPConfig{Pending: modes.DefaultPendingLimits, Flows: modes.DefaultFlowLimits}
+	if udp.QueuePackets != nil {
+		udp.config.Pending.MaxPackets = *udp.QueuePackets
+	}
+	if udp.MaxFlows != nil {
+		udp.config.Flows.MaxFlows = *udp.MaxFlows
+	}
+
+	for _, duration := range []struct {
+		name  string
+		value string
+		field *time.Duration
+	}{
+		{"udp.queueAge", udp.QueueAge, &udp.config.Pending.MaxAge},
+		{"udp.idleTimeout", udp.IdleTimeout, &udp.config.Flows.IdleTimeout},
+	} {
+		if duration.value == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(duration.value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", duration.name, err))
+			continue
+		}
+		*duration.field = parsed
+	}
+
+	if err := validateUDPQueueLimits(&udp.config.Pending.MaxPackets, &udp.config.Pending.MaxAge); err != nil {
+		errs = append(errs, fmt.Errorf("udp: %s", err))
+	}
+	if err := validateUDPFlowLimits(&udp.config.Flows.IdleTimeout, &udp.config.Flows.MaxFlows); err != nil {
+		errs = append(errs, fmt.Errorf("udp: %s", err))
+	}
+
+	return errs
+}
+
+// reloadConfig reads the config file again and switches the listeners to its
+// transport options. Other changes to the file take effect on restart.
+func reloadConfig(configPath string) error {
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	options, err := json.Marshal(config.Transports)
+	if err != nil {
+		return err
+	}
+
+	return modes.ReloadOptions(string(options))
+}
+
+var modeNames = map[int]string{
+	socks5:         "socks5",
+	transparentTCP: "transparent-TCP",
+	transparentUDP: "transparent-UDP",
+	stunUDP:        "STUN",
+}
+
+// redacted returns a copy of the config that can be shown through the control
+// API, without transport options or proxy credentials.
+func (config *DispatcherConfig) redacted() *DispatcherConfig {
+	result := *config
+	result.Transports = make(map[string]interface{}, len(config.Transports))
+	for name := range config.Transports {
+		result.Transports[name] = "redacted"
+	}
+	if proxyURI, err := url.Parse(config.Proxy); err == nil && config.Proxy != "" {
+		result.Proxy = proxyURI.Redacted()
+	}
+
+	return &result
+}
+
+// flagListeners describes the listeners started from flags in the config file
+// format. Server listeners copy their target settings from server.
+func flagListeners(isClient bool, mode int, transportsList string, socksAddr string, sendTarget bool, bindaddrs string, server ListenerConfig) []ListenerConfig {
+	var listeners []ListenerConfig
+	if isClient {
+		names := strings.Split(transportsList, ",")
+		listenAddrs, _ := modes.ClientListenAddrs(socksAddr, names)
+		for _, name := range names {
+			listenAddr := listenAddrs[name]
+			if mode == socks5 && modes.SharedListenAddr(socksAddr, names) {
+				listenAddr = socksAddr
+			}
+			listeners = append(listeners, ListenerConfig{Mode: modeNames[mode], Transport: name, ListenAddr: listenAddr, SendTarget: sendTarget})
+		}
+
+		return listeners
+	}
+
+	for _, bindaddr := range strings.Split(bindaddrs, ",") {
+		listener := server
+		listener.Mode = modeNames[mode]
+		listener.Transport, listener.BindAddr, _ = strings.Cut(bindaddr, "-")
+		listeners = append(listeners, listener)
+	}
+
+	return listeners
+}
+
+// transportOptions returns the options for a transport as a JSON string, or
+// "" if there are none.
+func (config *DispatcherConfig) transportOptions(name string) (string, error) {
+	for transportName, options := range config.Transports {
+		if !strings.EqualFold(transportName, name) {
+			continue
+		}
+		if _, isObject := options.(map[string]interface{}); !isObject {
+			return "", errors.New("transport options must be an object")
+		}
+
+		optionsBytes, err := json.Marshal(options)
+		if err != nil {
+			return "", err
+		}
+
+		return string(optionsBytes), nil
+	}
+
+	return "", nil
+}
+
+func validateProxyURL(proxy string) error {
+	proxyURI, err := url.Parse(proxy)
+	if err != nil {
+		return err
+	}
+
+	switch proxyURI.Scheme {
+	case "http", "socks4a", "socks5":
+	default:
+		return fmt.Errorf("unsupported proxy scheme %q", proxyURI.Scheme)
+	}
+
+	if proxyURI.Host == "" {
+		return errors.New("the proxy URL must include a host")
+	}
+
+	return nil
+}
+
+func isTransportName(name string) bool {
+	_, ok := transports.Lookup(name)
+	return ok
+}
+
+// launchConfig starts every listener in a validated config.
+func launchConfig(config *DispatcherConfig) bool {
+	var err error
+	if stateDir, err = makeStateDir(config.StateDir); err != nil {
+		commonLog.Errorf("could not create the state directory %s: %s", config.StateDir, err)
+		return false
+	}
+
+	if err = commonLog.Init(config.Logging.Enable, path.Join(stateDir, dispatcherLogFile), config.Logging.Level); err != nil {
+		commonLog.Errorf("could not set up logging: %s", err)
+		return false
+	}
+	if err = initIPCLogging(config.Logging.IPCLevel); err != nil {
+		commonLog.Errorf("could not set up IPC logging: %s", err)
+		return false
+	}
+
+	if config.MetricsAddr != "" && !startMetrics(config.MetricsAddr) {
+		return false
+	}
+
+	var proxyURI *url.URL
+	if config.isClient() && config.Proxy != "" {
+		if proxyURI, err = pt_extras.PtGetProxy(&config.Proxy); err != nil {
+			commonLog.Errorf("could not use the upstream proxy: %s", err)
+			return false
+		}
+		pt_extras.PtProxyDone()
+	} else if config.Proxy != "" {
+		// Servers only use the upstream proxy to reach the next hop of a
+		// chain, so there is no PROXY line to send.
+		proxyURI, _ = url.Parse(config.Proxy)
+	}
+
+	enableLocket := config.Logging.Locket
+	for index, listener := range config.Listeners {
+		var launched bool
+		names := []string{listener.Transport}
+
+		if config.isClient() {
+			switch listener.mode {
+			case socks5:
+				launched = pt_socks5.ClientSetup(listener.listenAddr, listener.socketMode, proxyURI, names, listener.options, listener.SendTarget, enableLocket, stateDir)
+			case transparentTCP:
+				launched = transparent_tcp.ClientSetup(listener.listenAddr, listener.socketMode, proxyURI, names, listener.options, enableLocket, stateDir)
+			case transparentUDP:
+				launched = transparent_udp.ClientSetup(listener.listenAddr, proxyURI, names, listener.options, config.UDP.config)
+			case stunUDP:
+				launched = stun_udp.ClientSetup(listener.listenAddr, proxyURI, names, listener.options, config.UDP.config)
+			}
+		} else {
+			serverInfo := listener.serverInfo
+			serverInfo.ProxyURL = proxyURI
+			switch listener.mode {
+			case socks5:
+				launched = pt_socks5.ServerSetup(serverInfo, stateDir, enableLocket)
+			case transparentTCP:
+				launched = transparent_tcp.ServerSetup(serverInfo, stateDir, enableLocket)
+			case transparentUDP:
+				launched = transparent_udp.ServerSetup(serverInfo, stateDir)
+			case stunUDP:
+				launched = stun_udp.ServerSetup(serverInfo, stateDir)
+			}
+		}
+
+		if !launched {
+			commonLog.Errorf("listeners[%d]: could not launch the %s %s listener", index, listener.Transport, listener.Mode)
+			return false
+		}
+	}
+	if config.isClient() {
+		pt_extras.PtCmethodsDone()
+	} else {
+		pt_extras.PtSmethodsDone()
+	}
+
+	return true
+}
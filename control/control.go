@@ -0,0 +1,273 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+// Package control serves a local HTTP API for managing a running dispatcher:
+// listing and closing sessions, pausing and resuming listeners, reading the
+// effective configuration, and reloading transport options.
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
+)
+
+// Server answers control requests.
+type Server struct {
+	// Config returns the effective configuration, with secrets removed.
+	Config func() interface{}
+	// Reload replaces the transport options, as SIGHUP does. It is nil if
+	// there is nothing to reload.
+	Reload func() error
+}
+
+// ValidateAddr checks that addr is a Unix socket path prefixed with "unix:",
+// or a loopback host and port. The control API has no authentication, so it
+// must not be reachable from other machines.
+func ValidateAddr(addr string) error {
+	if modes.IsUnixAddr(addr) {
+		if strings.TrimPrefix(addr, modes.UnixPrefix) == "" {
+			return errors.New("the Unix socket path is empty")
+		}
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if !isLoopbackHost(host) {
+		return fmt.Errorf("%s is not a loopback address", host)
+	}
+
+	return nil
+}
+
+// Listen opens the control listener. A Unix socket is only accessible to the
+// user the dispatcher runs as, and is removed when the listener is closed.
+func Listen(addr string) (net.Listener, error) {
+	if err := ValidateAddr(addr); err != nil {
+		return nil, err
+	}
+
+	return modes.Listen(addr, modes.DefaultSocketMode)
+}
+
+// Serve answers control requests on ln until it is closed.
+func (server *Server) Serve(ln net.Listener) error {
+	return http.Serve(ln, server.Handler())
+}
+
+// Handler returns the HTTP handler for the control API:
+//
+//	GET    /sessions               list open sessions
+//	DELETE /sessions/{id}          close a session
+//	GET    /listeners              list listeners
+//	POST   /listeners/{id}/pause   stop taking new connections on a listener
+//	POST   /listeners/{id}/resume  take new connections again
+//	GET    /config                 show the effective configuration
+//	POST   /reload                 reload the transport options
+//
+// Requests are checked so that web pages the operator visits cannot use the
+// API: over TCP the Host header must name a loopback address, which defeats
+// DNS rebinding, and POST and DELETE requests must have the Content-Type
+// application/json, which browsers only send cross-origin after a preflight
+// request that the API does not answer.
+func (server *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", server.handleSessions)
+	mux.HandleFunc("/sessions/", server.handleSession)
+	mux.HandleFunc("/listeners", server.handleListeners)
+	mux.HandleFunc("/listeners/", server.handleListener)
+	mux.HandleFunc("/config", server.handleConfig)
+	mux.HandleFunc("/reload", server.handleReload)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := checkRequest(r); err != nil {
+			writeError(w, http.StatusForbidden, err)
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// checkRequest rejects requests that could have been made by a browser on
+// behalf of another site.
+func checkRequest(r *http.Request) error {
+	// Browsers cannot connect to Unix sockets, so any Host is fine there.
+	localAddr, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if localAddr == nil || localAddr.Network() != "unix" {
+		host := r.Host
+		if splitHost, _, err := net.SplitHostPort(host); err == nil {
+			host = splitHost
+		}
+		if !isLoopbackHost(host) {
+			return fmt.Errorf("the Host %q is not a loopback address", r.Host)
+		}
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType != "application/json" {
+			return fmt.Errorf("%s requests must have the Content-Type application/json", r.Method)
+		}
+	}
+
+	return nil
+}
+
+func isLoopbackHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"))
+
+	return ip != nil && ip.IsLoopback()
+}
+
+func (server *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, modes.Sessions())
+}
+
+func (server *Server) handleSession(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodDelete) {
+		return
+	}
+
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/sessions/"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusNotFound, errors.New("invalid session ID"))
+		return
+	}
+
+	if err = modes.CloseSession(id); err != nil {
+		writeModesError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (server *Server) handleListeners(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, modes.Listeners())
+}
+
+func (server *Server) handleListener(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	// The path is /listeners/{id}/pause or /listeners/{id}/resume.
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/listeners/"), "/")
+	if len(parts) != 2 || (parts[1] != "pause" && parts[1] != "resume") {
+		writeError(w, http.StatusNotFound, errors.New("unknown listener action"))
+		return
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		writeError(w, http.StatusNotFound, errors.New("invalid listener ID"))
+		return
+	}
+
+	if err = modes.SetListenerPaused(id, parts[1] == "pause"); err != nil {
+		writeModesError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (server *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	var config interface{}
+	if server.Config != nil {
+		config = server.Config()
+	}
+	writeJSON(w, http.StatusOK, config)
+}
+
+func (server *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	if server.Reload == nil {
+		writeError(w, http.StatusConflict, errors.New("there are no transport options to reload"))
+		return
+	}
+	if err := server.Reload(); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+
+	w.Header().Set("Allow", method)
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("use %s", method))
+	return false
+}
+
+func writeModesError(w http.ResponseWriter, err error) {
+	switch err {
+	case modes.ErrNotFound:
+		writeError(w, http.StatusNotFound, err)
+	default:
+		writeError(w, http.StatusConflict, err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
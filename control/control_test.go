@@ -0,0 +1,291 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
+)
+
+func request(t *testing.T, server *httptest.Server, method string, path string, result interface{}) int {
+	req, err := http.NewRequest(method, server.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if method != http.MethodGet {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	response, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	if result != nil {
+		if err = json.NewDecoder(response.Body).Decode(result); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return response.StatusCode
+}
+
+func TestSessions(t *testing.T) {
+	server := httptest.NewServer((&Server{}).Handler())
+	defer server.Close()
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	untrack := modes.TrackSession("control-test", modes.ModeSocks5, conn)
+	defer untrack()
+
+	var sessions []modes.SessionInfo
+	if status := request(t, server, http.MethodGet, "/sessions", &sessions); status != http.StatusOK {
+		t.Fatalf("unexpected status %d", status)
+	}
+	var found *modes.SessionInfo
+	for index := range sessions {
+		if sessions[index].Transport == "control-test" {
+			found = &sessions[index]
+		}
+	}
+	if found == nil || found.Mode != modes.ModeSocks5 {
+		t.Fatalf("session not listed in %+v", sessions)
+	}
+
+	path := fmt.Sprintf("/sessions/%d", found.ID)
+	if status := request(t, server, http.MethodDelete, path, nil); status != http.StatusNoContent {
+		t.Fatalf("unexpected status %d closing the session", status)
+	}
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Error("the session was not closed")
+	}
+
+	untrack()
+	if status := request(t, server, http.MethodDelete, path, nil); status != http.StatusNotFound {
+		t.Errorf("unexpected status %d closing a missing session", status)
+	}
+	if status := request(t, server, http.MethodPost, "/sessions", nil); status != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected status %d for the wrong method", status)
+	}
+}
+
+// Closing a session ends its CopyLoop, which is blocked reading both sides.
+func TestCloseRelayedSession(t *testing.T) {
+	server := httptest.NewServer((&Server{}).Handler())
+	defer server.Close()
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	target, remote := net.Pipe()
+	defer target.Close()
+	untrack := modes.TrackSession("control-relay", modes.ModeTransparentTCP, conn)
+
+	ended := make(chan struct{})
+	go func() {
+		defer close(ended)
+		defer untrack()
+		_ = modes.CopyLoop(remote, conn)
+	}()
+
+	var sessions []modes.SessionInfo
+	request(t, server, http.MethodGet, "/sessions", &sessions)
+	var id uint64
+	for _, session := range sessions {
+		if session.Transport == "control-relay" {
+			id = session.ID
+		}
+	}
+	if id == 0 {
+		t.Fatalf("session not listed in %+v", sessions)
+	}
+
+	if status := request(t, server, http.MethodDelete, fmt.Sprintf("/sessions/%d", id), nil); status != http.StatusNoContent {
+		t.Fatalf("unexpected status %d closing the session", status)
+	}
+	select {
+	case <-ended:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session did not end after it was closed")
+	}
+
+	request(t, server, http.MethodGet, "/sessions", &sessions)
+	for _, session := range sessions {
+		if session.ID == id {
+			t.Errorf("the closed session is still listed: %+v", session)
+		}
+	}
+}
+
+func TestPauseListener(t *testing.T) {
+	server := httptest.NewServer((&Server{}).Handler())
+	defer server.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	tracked := modes.TrackListener("control-test", modes.ModeTransparentTCP, ln)
+	defer tracked.Untrack()
+
+	var listeners []modes.ListenerInfo
+	request(t, server, http.MethodGet, "/listeners", &listeners)
+	var id uint64
+	for _, listener := range listeners {
+		if listener.Transport == "control-test" && listener.Addr == ln.Addr().String() {
+			id = listener.ID
+		}
+	}
+	if id == 0 {
+		t.Fatalf("listener not listed in %+v", listeners)
+	}
+
+	if status := request(t, server, http.MethodPost, fmt.Sprintf("/listeners/%d/pause", id), nil); status != http.StatusNoContent {
+		t.Fatalf("unexpected status %d pausing", status)
+	}
+	if !tracked.Paused() {
+		t.Error("the listener was not paused")
+	}
+	if status := request(t, server, http.MethodPost, fmt.Sprintf("/listeners/%d/resume", id), nil); status != http.StatusNoContent {
+		t.Fatalf("unexpected status %d resuming", status)
+	}
+	if tracked.Paused() {
+		t.Error("the listener was not resumed")
+	}
+	if status := request(t, server, http.MethodPost, fmt.Sprintf("/listeners/%d/stop", id), nil); status != http.StatusNotFound {
+		t.Errorf("unexpected status %d for an unknown action", status)
+	}
+}
+
+func TestConfigAndReload(t *testing.T) {
+	reloadErr := errors.New("invalid options")
+	control := &Server{
+		Config: func() interface{} { return map[string]string{"role": "client"} },
+		Reload: func() error { return reloadErr },
+	}
+	server := httptest.NewServer(control.Handler())
+	defer server.Close()
+
+	var config map[string]string
+	if status := request(t, server, http.MethodGet, "/config", &config); status != http.StatusOK || config["role"] != "client" {
+		t.Errorf("unexpected config %v (%d)", config, status)
+	}
+
+	var failure map[string]string
+	if status := request(t, server, http.MethodPost, "/reload", &failure); status != http.StatusUnprocessableEntity || failure["error"] != reloadErr.Error() {
+		t.Errorf("unexpected reload failure %v (%d)", failure, status)
+	}
+	reloadErr = nil
+	if status := request(t, server, http.MethodPost, "/reload", nil); status != http.StatusNoContent {
+		t.Errorf("unexpected status %d reloading", status)
+	}
+}
+
+func TestValidateAddr(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:9000", "[::1]:9000", "localhost:9000", "unix:/tmp/dispatcher.sock"} {
+		if err := ValidateAddr(addr); err != nil {
+			t.Errorf("ValidateAddr(%q) = %v", addr, err)
+		}
+	}
+	for _, addr := range []string{"0.0.0.0:9000", "192.0.2.1:9000", "example.com:9000", "127.0.0.1", "unix:"} {
+		if err := ValidateAddr(addr); err == nil {
+			t.Errorf("ValidateAddr(%q) succeeded", addr)
+		}
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "control.sock")
+	ln, err := Listen("unix:" + socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("unexpected socket permissions %v", info.Mode().Perm())
+	}
+
+	ln.Close()
+	if _, err = os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Errorf("the socket was not removed: %v", err)
+	}
+}
+
+func TestRejectsBrowserRequests(t *testing.T) {
+	server := httptest.NewServer((&Server{Reload: func() error { return nil }}).Handler())
+	defer server.Close()
+
+	send := func(host string, contentType string) int {
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/reload", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = host
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		response, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+
+		return response.StatusCode
+	}
+
+	tests := []struct {
+		host        string
+		contentType string
+		expected    int
+	}{
+		{"localhost:9000", "application/json", http.StatusNoContent},
+		{"[::1]:9000", "application/json; charset=utf-8", http.StatusNoContent},
+		{"rebound.example.com:9000", "application/json", http.StatusForbidden},
+		{"127.0.0.1:9000", "", http.StatusForbidden},
+		{"127.0.0.1:9000", "text/plain", http.StatusForbidden},
+		{"127.0.0.1:9000", "application/x-www-form-urlencoded", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		if status := send(test.host, test.contentType); status != test.expected {
+			t.Errorf("Host %q, Content-Type %q: got status %d, expected %d", test.host, test.contentType, status, test.expected)
+		}
+	}
+}
+
+func TestUnixSocketAnyHost(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "control.sock")
+	ln, err := Listen("unix:" + socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() { _ = (&Server{}).Serve(ln) }()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+		},
+	}}
+	response, err := client.Get("http://dispatcher/sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("unexpected status %d", response.StatusCode)
+	}
+}
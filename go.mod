@@ -3,6 +3,7 @@ module github.com/OperatorFoundation/shapeshifter-dispatcher
 go 1.19
 
 require (
+	filippo.io/edwards25519 v1.0.0
 	github.com/OperatorFoundation/Optimizer-go/Optimizer/v3 v3.0.2
 	github.com/OperatorFoundation/Replicant-go/Replicant/v3 v3.0.23
 	github.com/OperatorFoundation/Shadow-go/shadow/v3 v3.0.24
@@ -12,13 +13,14 @@ require (
 	github.com/aead/ecdh v0.2.0
 	github.com/kataras/golog v0.1.9
 	github.com/willscott/goturn v0.0.0-20170802220503-19f41278d0c9
+	golang.org/x/crypto v0.19.0
 	golang.org/x/net v0.21.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/OperatorFoundation/ghostwriter-go v1.0.6 // indirect
 	github.com/OperatorFoundation/go-bloom v1.0.1 // indirect
 	github.com/kataras/pio v0.0.12 // indirect
-	golang.org/x/crypto v0.19.0 // indirect
 	golang.org/x/sys v0.17.0 // indirect
 )
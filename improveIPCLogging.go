@@ -2,7 +2,9 @@ package main
 
 import (
 	"errors"
+
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
 )
 
 func validateIPCLogLevel(ipcLogLevel string) (int, error) {
@@ -27,21 +29,15 @@ func validateIPCLogLevel(ipcLogLevel string) (int, error) {
 	}
 }
 
-func ipcLogMessage(logLevel int, message string) {
-	var logLevelStr string
-	switch logLevel {
-	case log.LevelNone:
-		logLevelStr = "NONE"
-	case log.LevelError:
-		logLevelStr = "ERROR"
-	case log.LevelWarn:
-		logLevelStr = "WARN"
-	case log.LevelInfo:
-		logLevelStr = "INFO"
-	case log.LevelDebug:
-		logLevelStr = "DEBUG"
-	default:
-		return
+// initIPCLogging sends log messages at or above ipcLogLevel to the parent
+// process on PT IPC LOG lines, along with STATUS lines for transport events.
+func initIPCLogging(ipcLogLevel string) error {
+	level, err := validateIPCLogLevel(ipcLogLevel)
+	if err != nil {
+		return err
 	}
-	println("LOG "+logLevelStr+" "+message)
+
+	log.InitIPC(level, pt_extras.PtLog)
+
+	return nil
 }
@@ -37,13 +37,20 @@ import (
 	"io/ioutil"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"strings"
+	"syscall"
+	"time"
 
+	commonLog "github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/metrics"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/control"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/transports"
 	"github.com/kataras/golog"
 
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/pt_socks5"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/stun_udp"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes/transparent_tcp"
@@ -53,6 +60,8 @@ import (
 const (
 	dispatcherVersion = "0.0.7-dev"
 	dispatcherLogFile = "dispatcher.log"
+
+	defaultShutdownGrace = 30 * time.Second
 )
 
 var stateDir string
@@ -87,6 +96,7 @@ func main() {
 
 	statePath := flag.String("state", "state", "Specify the directory to use to store state information required by the transports")
 	exitOnStdinClose := flag.Bool("exit-on-stdin-close", false, "Set to true to force the dispatcher to close when the stdin pipe is closed")
+	shutdownGrace := flag.Duration("shutdownGrace", defaultShutdownGrace, "Specify how long open connections may continue after SIGTERM, SIGINT, or stdin closing before they are closed")
 
 	transportsList := flag.String("transports", "", "Specify transports to enable")
 
@@ -106,17 +116,17 @@ func main() {
 
 	// PT 2.1 specification, 3.3.1.3. Pluggable PT Server Environment Variables
 	options := flag.String("options", "", "Specify the transport options for the server")
-	if *options != "" {
-		println("--> -options flag found: ", *options)
-	}
 
 	bindAddr := flag.String("bindaddr", "", "Specify the bind address for transparent server")
 	extorport := flag.String("extorport", "", "Specify the address of a server implementing the Extended OR Port protocol, which is used for per-connection metadata")
 	authcookie := flag.String("authcookie", "", "Specify an authentication cookie, for use in authenticating with the Extended OR Port")
+	allowedTargets := flag.String("allowedTargets", "", "Specify a comma-separated list of host:port destinations the socks5 server may connect to on behalf of clients")
+	sendTarget := flag.Bool("sendTarget", false, "Send the SOCKS CONNECT target to the server, which must be started with -allowedTargets")
 
 	// Experimental flags under consideration for PT 2.1
 	socksAddr := flag.String("proxylistenaddr", "", "Specify the bind address for the local SOCKS server provided by the client")
 	optionsFile := flag.String("optionsFile", "", "store all the options in a single file")
+	configFile := flag.String("config", "", "Specify a YAML or JSON file describing the whole dispatcher instance, used instead of the other flags")
 
 	// Additional command line flags inherited from obfs4proxy
 	showVer := flag.Bool("showVersion", false, "Print version and exit")
@@ -137,48 +147,60 @@ func main() {
 	udp := flag.Bool("udp", false, "Enable UDP proxy mode. The default is TCP proxy mode.")
 	target := flag.String("target", "", "Specify transport server destination address")
 	enableLocket := flag.Bool("enableLocket", false, "Log to [state]/"+dispatcherLogFile+" using Locket")
+	udpQueuePackets := flag.Int("udpQueuePackets", modes.DefaultPendingLimits.MaxPackets, "Specify how many UDP packets per flow the client holds while the transport connection opens")
+	udpQueueAge := flag.Duration("udpQueueAge", modes.DefaultPendingLimits.MaxAge, "Specify how long a UDP packet may wait for the transport connection to open")
+	udpIdleTimeout := flag.Duration("udpIdleTimeout", modes.DefaultFlowLimits.IdleTimeout, "Specify how long a UDP flow may be idle before the client closes its transport connection")
+	udpMaxFlows := flag.Int("udpMaxFlows", modes.DefaultFlowLimits.MaxFlows, "Specify how many UDP flows the client keeps open at once")
+	metricsAddr := flag.String("metricsAddr", "", "Specify a local address to serve metrics on, at /metrics in the Prometheus text format")
+	socketModeStr := flag.String("socketMode", "", "Specify the permissions, in octal, for client listeners on unix:/path addresses (default 0600)")
+	controlAddr := flag.String("controlAddr", "", "Specify a loopback address, or unix:/path for a Unix socket, to serve the control API on")
 	flag.Parse() // Flag variables are set to actual values here.
 
 	// Start validation of command line arguments
 
 	if *generateConfig {
-		switch strings.ToLower(*transport) {
-			case "shadow":
-				transports.CreateShadowConfigs(*serverAddress, bindAddr)
-			case "starbridge":
-				transports.CreateStarbridgeConfigs(*serverAddress, bindAddr)
-			case "replicant":
-				transports.CreateReplicantConfigs(*serverAddress, *toneburst, *polish, bindAddr)
-			default:
-				// FIXME: add print/log in case of wrong name
-				return
+		generator, ok := transports.Lookup(*transport)
+		if !ok || generator.GenerateConfigs == nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%s - cannot generate a config for transport %q\n", execName, *transport)
+			return
 		}
-	} 
+
+		settings := transports.ConfigSettings{ServerAddress: *serverAddress, BindAddress: bindAddr, Toneburst: *toneburst, Polish: *polish}
+		if err := generator.GenerateConfigs(settings); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%s - could not generate a config for %s: %s\n", execName, generator.Name, err)
+		}
+		return
+	}
 
 	if *showVer {
 		fmt.Printf("%s\n", getVersion())
 		os.Exit(0)
 	}
 
-	logPath := path.Join(stateDir, dispatcherLogFile)
-	logFile, logFileErr := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if logFileErr != nil {
-		println("could open logFile")
-	}
+	if *configFile != "" {
+		config, configErr := LoadConfig(*configFile)
+		if configErr != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "%s - invalid config %s:\n%s\n", execName, *configFile, configErr)
+			os.Exit(-1)
+		}
 
-	golog.SetOutput(logFile)
+		reload := func() error { return reloadConfig(*configFile) }
+		launched := launchConfig(config)
+		if launched && config.ControlAddr != "" {
+			launched = startControl(config.ControlAddr, config.redacted(), reload, execName)
+		}
+		waitForExit(launched, reload, config.ExitOnStdinClose, config.shutdownGrace, execName)
+		return
+	}
 
-	if enableLogging != nil {
-		lowerCaseLogLevelStr := strings.ToLower(*logLevelStr)
-		golog.SetLevel(lowerCaseLogLevelStr)
-	} else {
-		golog.SetLevel("fatal")
+	// In managed mode the parent process configures the dispatcher through
+	// environment variables, which fill in any flags that were not given.
+	if managedErr := applyManagedEnvironment(flag.CommandLine, os.Getenv); managedErr != nil {
+		golog.Fatalf("[ERROR]: %s - %s", execName, managedErr)
 	}
 
-	ipcLogLevel, ipcLogLevelError := validateIPCLogLevel(*ipcLogLevelStr)
-	if ipcLogLevelError != nil {
-		println(ipcLogLevel)
-		golog.Errorf("could not validate IPC log level %s", ipcLogLevelError)
+	if ipcLogLevelError := initIPCLogging(*ipcLogLevelStr); ipcLogLevelError != nil {
+		commonLog.Errorf("could not validate IPC log level %s", ipcLogLevelError)
 		return
 	}
 
@@ -193,26 +215,34 @@ func main() {
 		flag.Usage()
 		golog.Fatalf("[ERROR]: %s - No state directory: Use --state", execName)
 	}
+	if err = commonLog.Init(*enableLogging, path.Join(stateDir, dispatcherLogFile), *logLevelStr); err != nil {
+		golog.Fatalf("[ERROR]: %s - could not set up logging: %s", execName, err)
+	}
 	if *options != "" && *optionsFile != "" {
 		golog.Fatal("You should not specify -options and -optionsFile at the same time.")
 	}
 	if *optionsFile != "" {
 		_, err := os.Stat(*optionsFile)
 		if err != nil {
-			golog.Errorf("Received an error while attempting to parse the options file %s: %s", *optionsFile, err.Error())
+			commonLog.Errorf("Received an error while attempting to parse the options file %s: %s", *optionsFile, err.Error())
 		} else {
 			contents, readErr := ioutil.ReadFile(*optionsFile)
 			if readErr != nil {
-				golog.Errorf("Failed to open the optionsFile: %s", *optionsFile)
+				commonLog.Errorf("Failed to open the optionsFile: %s", *optionsFile)
 			} else {
 				*options = string(contents)
 			}
 		}
 	}
 
+	if *shutdownGrace < 0 {
+		commonLog.Errorf("could not validate: --shutdownGrace cannot be negative")
+		return
+	}
+
 	transportValidationError := validateTransports(transport, transportsList)
 	if transportValidationError != nil {
-		golog.Errorf("Failed to validate transports: %s", transportValidationError)
+		commonLog.Errorf("Failed to validate transports: %s", transportValidationError)
 		return
 	}
 
@@ -222,23 +252,29 @@ func main() {
 
 	modeValidationError := validateMode(modeName, transparent, udp)
 	if modeValidationError != nil {
-		golog.Errorf("Failed to validate the mode: %s", modeValidationError)
+		commonLog.Errorf("Failed to validate the mode: %s", modeValidationError)
 		return
 	}
 
 	mode, modeError := determineMode(*modeName, *transparent, *udp)
 	if modeError != nil {
-		golog.Errorf("Invalid mode name: %s", *modeName)
+		commonLog.Errorf("Invalid mode name: %s", *modeName)
 		return
 	}
 
+	if *sendTarget && !(isClient && mode == socks5) {
+		commonLog.Errorf("could not validate: -sendTarget only applies to socks5 clients")
+		return
+	}
+
+	socketMode := modes.DefaultSocketMode
 	if isClient {
 		proxyListenValidationError := validateProxyListenAddr(proxyListenHost, proxyListenPort, socksAddr)
 		if proxyListenValidationError != nil {
-			golog.Errorf("could not validate: %s", proxyListenValidationError)
-			golog.Infof("proxylistenhost: %s", *proxyListenHost)
-			golog.Infof("proxylistenport: %s", *proxyListenPort)
-			golog.Infof("proxylistenaddr: %s", *socksAddr)
+			commonLog.Errorf("could not validate: %s", proxyListenValidationError)
+			commonLog.Infof("proxylistenhost: %s", *proxyListenHost)
+			commonLog.Infof("proxylistenport: %s", *proxyListenPort)
+			commonLog.Infof("proxylistenaddr: %s", *socksAddr)
 			return
 		}
 
@@ -248,21 +284,39 @@ func main() {
 		}
 
 		if *socksAddr == "" {
-			*socksAddr = "127.0.0.1:0"
+			*socksAddr = modes.DefaultListenAddr
+		}
+
+		udpQueueValidationError := validateUDPQueueLimits(udpQueuePackets, udpQueueAge)
+		if udpQueueValidationError != nil {
+			commonLog.Errorf("could not validate: %s", udpQueueValidationError)
+			return
+		}
+
+		udpFlowValidationError := validateUDPFlowLimits(udpIdleTimeout, udpMaxFlows)
+		if udpFlowValidationError != nil {
+			commonLog.Errorf("could not validate: %s", udpFlowValidationError)
+			return
+		}
+
+		var socketModeError error
+		socketMode, socketModeError = modes.ParseSocketMode(*socketModeStr)
+		if socketModeError != nil {
+			commonLog.Errorf("could not validate: --socketMode: %s", socketModeError)
+			return
 		}
 
 		if mode == socks5 {
 			targetValidationError := validatetargetSocks5(targetHost, targetPort, target)
 			if targetValidationError != nil {
-				golog.Errorf("could not validate: %s", targetValidationError)
+				commonLog.Errorf("could not validate: %s", targetValidationError)
 				return
 			}
 
 		} else {
 			targetValidationError := validatetarget(isClient, targetHost, targetPort, target)
 			if targetValidationError != nil {
-				println("could not validate: ", targetValidationError.Error())
-				golog.Errorf("could not validate: %s", targetValidationError)
+				commonLog.Errorf("could not validate: %s", targetValidationError)
 				return
 			}
 			if *targetHost != "" && *targetPort != "" && *target == "" {
@@ -275,13 +329,13 @@ func main() {
 		if mode == socks5 {
 			serverBindValidationError := validateSocksServerBindAddr(serverBindHost, serverBindPort, bindAddr)
 			if serverBindValidationError != nil {
-				golog.Errorf("could not validate: %s", serverBindValidationError)
+				commonLog.Errorf("could not validate: %s", serverBindValidationError)
 				return
 			}
 		} else {
 			serverBindValidationError := validateServerBindAddr(transport, serverBindHost, serverBindPort, bindAddr)
 			if serverBindValidationError != nil {
-				golog.Errorf("could not validate: %s", serverBindValidationError)
+				commonLog.Errorf("could not validate: %s", serverBindValidationError)
 				return
 			}
 
@@ -293,82 +347,277 @@ func main() {
 	}
 	// Finished validation of command line arguments
 
-	golog.Infof("%s - launched", getVersion())
+	commonLog.Infof("%s - launched", getVersion())
+
+	if *controlAddr != "" {
+		if err := control.ValidateAddr(*controlAddr); err != nil {
+			commonLog.Errorf("could not validate: -controlAddr: %s", err)
+			return
+		}
+	}
+
+	if *metricsAddr != "" && !startMetrics(*metricsAddr) {
+		return
+	}
 
 	if isClient {
-		golog.Infof("%s - initializing client transport listeners", execName)
+		commonLog.Infof("%s - initializing client transport listeners", execName)
+
+		udpConfig := modes.UDPConfig{
+			Pending: modes.PendingLimits{MaxPackets: *udpQueuePackets, MaxAge: *udpQueueAge},
+			Flows:   modes.FlowLimits{IdleTimeout: *udpIdleTimeout, MaxFlows: *udpMaxFlows},
+		}
 
 		switch mode {
 		case socks5:
-			golog.Infof("%s - initializing client transport listeners", execName)
+			commonLog.Infof("%s - initializing client transport listeners", execName)
 			ptClientProxy, names, nameErr := getClientNames(ptversion, transportsList, proxy)
 			if nameErr != nil {
-				golog.Errorf("must specify -version and -transports")
+				commonLog.Errorf("must specify -version and -transports")
 				return
 			}
-			launched = pt_socks5.ClientSetup(*socksAddr, ptClientProxy, names, *options, *enableLocket, stateDir)
+			launched = pt_socks5.ClientSetup(*socksAddr, socketMode, ptClientProxy, names, *options, *sendTarget, *enableLocket, stateDir)
 		case transparentTCP:
 			ptClientProxy, names, nameErr := getClientNames(ptversion, transportsList, proxy)
 			if nameErr != nil {
-				golog.Errorf("must specify -version and -transports")
+				commonLog.Errorf("must specify -version and -transports")
 				return
 			}
-			launched = transparent_tcp.ClientSetup(*socksAddr, ptClientProxy, names, *options, *enableLocket, stateDir)
+			launched = transparent_tcp.ClientSetup(*socksAddr, socketMode, ptClientProxy, names, *options, *enableLocket, stateDir)
 		case transparentUDP:
 			ptClientProxy, names, nameErr := getClientNames(ptversion, transportsList, proxy)
 			if nameErr != nil {
-				golog.Errorf("must specify -version and -transports")
+				commonLog.Errorf("must specify -version and -transports")
 				return
 			}
-			launched = transparent_udp.ClientSetup(*socksAddr, ptClientProxy, names, *options)
+			launched = transparent_udp.ClientSetup(*socksAddr, ptClientProxy, names, *options, udpConfig)
 		case stunUDP:
 			ptClientProxy, names, nameErr := getClientNames(ptversion, transportsList, proxy)
 			if nameErr != nil {
-				golog.Errorf("must specify -version and -transports")
+				commonLog.Errorf("must specify -version and -transports")
 				return
 			}
-			launched = stun_udp.ClientSetup(*socksAddr, ptClientProxy, names, *options)
+			launched = stun_udp.ClientSetup(*socksAddr, ptClientProxy, names, *options, udpConfig)
 		default:
-			golog.Errorf("unsupported mode %d", mode)
+			commonLog.Errorf("unsupported mode %d", mode)
 		}
+		pt_extras.PtCmethodsDone()
 	} else {
-		golog.Infof("initializing server transport listeners")
+		commonLog.Infof("initializing server transport listeners")
+
+		// Servers only use the upstream proxy to reach the next hop of a
+		// chain.
+		var serverProxy *url.URL
+		if *proxy != "" {
+			if err = validateProxyURL(*proxy); err != nil {
+				commonLog.Errorf("could not validate: proxy: %s", err)
+				return
+			}
+			serverProxy, _ = url.Parse(*proxy)
+		}
 
 		switch mode {
 		case socks5:
-			golog.Infof("%s - initializing socks5 server transport listeners", execName)
-			ptServerInfo := getServerInfo(bindAddr, options, transportsList, target, extorport, authcookie)
-			launched = pt_socks5.ServerSetup(ptServerInfo, stateDir, *options, *enableLocket)
+			commonLog.Infof("%s - initializing socks5 server transport listeners", execName)
+			ptServerInfo := getServerInfo(bindAddr, options, transportsList, target, extorport, authcookie, serverProxy)
+			ptServerInfo.AllowedTargets, err = pt_extras.ParseTargetAllowlist(*allowedTargets)
+			if err != nil {
+				commonLog.Errorf("could not validate: %s", err)
+				return
+			}
+			launched = pt_socks5.ServerSetup(ptServerInfo, stateDir, *enableLocket)
 		case transparentTCP:
-			golog.Infof("%s - initializing transparentTCP server transport listeners", execName)
-			ptServerInfo := getServerInfo(bindAddr, options, transportsList, target, extorport, authcookie)
-			launched = transparent_tcp.ServerSetup(ptServerInfo, stateDir, *options, *enableLocket)
+			commonLog.Infof("%s - initializing transparentTCP server transport listeners", execName)
+			ptServerInfo := getServerInfo(bindAddr, options, transportsList, target, extorport, authcookie, serverProxy)
+			launched = transparent_tcp.ServerSetup(ptServerInfo, stateDir, *enableLocket)
 		case transparentUDP:
 			// launched = transparent_udp.ServerSetup(termMon, *bindAddr, *target)
-			ptServerInfo := getServerInfo(bindAddr, options, transportsList, target, extorport, authcookie)
-			launched = transparent_udp.ServerSetup(ptServerInfo, stateDir, *options)
+			ptServerInfo := getServerInfo(bindAddr, options, transportsList, target, extorport, authcookie, serverProxy)
+			launched = transparent_udp.ServerSetup(ptServerInfo, stateDir)
 		case stunUDP:
-			ptServerInfo := getServerInfo(bindAddr, options, transportsList, target, extorport, authcookie)
-			launched = stun_udp.ServerSetup(ptServerInfo, stateDir, *options)
+			ptServerInfo := getServerInfo(bindAddr, options, transportsList, target, extorport, authcookie, serverProxy)
+			launched = stun_udp.ServerSetup(ptServerInfo, stateDir)
 		default:
-			golog.Errorf("unsupported mode %d", mode)
+			commonLog.Errorf("unsupported mode %d", mode)
+		}
+		pt_extras.PtSmethodsDone()
+	}
+
+	// Only options read from a file can change, so there is nothing to
+	// reload without one.
+	var reload func() error
+	if *optionsFile != "" {
+		reload = func() error {
+			contents, readErr := os.ReadFile(*optionsFile)
+			if readErr != nil {
+				return readErr
+			}
+
+			return modes.ReloadOptions(string(contents))
 		}
 	}
 
+	if launched && *controlAddr != "" {
+		role := "server"
+		if isClient {
+			role = "client"
+		}
+		transportNames := make(map[string]interface{})
+		for _, name := range strings.Split(*transportsList, ",") {
+			transportNames[name] = nil
+		}
+		serverListener := ListenerConfig{Target: *target, ExtORPort: *extorport, AuthCookie: *authcookie, AllowedTargets: *allowedTargets}
+
+		effective := &DispatcherConfig{
+			Role:             role,
+			StateDir:         stateDir,
+			ExitOnStdinClose: *exitOnStdinClose,
+			ShutdownGrace:    shutdownGrace.String(),
+			Logging:          LoggingConfig{Enable: *enableLogging, Level: *logLevelStr, IPCLevel: *ipcLogLevelStr, Locket: *enableLocket},
+			MetricsAddr:      *metricsAddr,
+			ControlAddr:      *controlAddr,
+			Proxy:            *proxy,
+			Transports:       transportNames,
+			Listeners:        flagListeners(isClient, mode, *transportsList, *socksAddr, *sendTarget, *bindAddr, serverListener),
+		}
+		if isClient {
+			effective.UDP = UDPConfig{QueuePackets: udpQueuePackets, QueueAge: udpQueueAge.String(), IdleTimeout: udpIdleTimeout.String(), MaxFlows: udpMaxFlows}
+		}
+
+		launched = startControl(*controlAddr, effective.redacted(), reload, execName)
+	}
+
+	waitForExit(launched, reload, *exitOnStdinClose, *shutdownGrace, execName)
+}
+
+// startMetrics serves the metrics on addr. It returns false if the listener
+// could not be opened.
+func startMetrics(addr string) bool {
+	ln, err := metrics.Serve(addr)
+	if err != nil {
+		commonLog.Errorf("could not serve metrics on %s: %s", addr, err)
+		return false
+	}
+	commonLog.Infof("serving metrics on %s", ln.Addr())
+
+	return true
+}
+
+// startControl serves the control API on addr. config is shown as the
+// effective configuration, and reload is called when a reload is requested.
+// It returns false if the listener could not be opened.
+func startControl(addr string, config *DispatcherConfig, reload func() error, execName string) bool {
+	ln, err := control.Listen(addr)
+	if err != nil {
+		commonLog.Errorf("could not serve the control API on %s: %s", addr, err)
+		return false
+	}
+	exitClosers = append(exitClosers, ln)
+
+	server := &control.Server{Config: func() interface{} { return config }}
+	if reload != nil {
+		server.Reload = func() error { return logReload(reload, execName) }
+	}
+	go func() {
+		_ = server.Serve(ln)
+	}()
+	commonLog.Infof("serving the control API on %s", ln.Addr())
+
+	return true
+}
+
+// logReload calls reload and logs the outcome.
+func logReload(reload func() error, execName string) error {
+	err := reload()
+	if err != nil {
+		commonLog.Errorf("%s - could not reload the transport options, keeping the current ones: %s", execName, err)
+	} else {
+		commonLog.Infof("%s - reloaded the transport options", execName)
+	}
+
+	return err
+}
+
+// exitClosers are closed just before the process exits. Closing the control
+// listener removes its Unix socket.
+var exitClosers []io.Closer
+
+func exit(code int) {
+	for _, closer := range exitClosers {
+		_ = closer.Close()
+	}
+
+	os.Exit(code)
+}
+
+// waitForExit runs until the dispatcher is told to stop by SIGTERM, SIGINT, or
+// (if requested) stdin closing. It then stops accepting connections, gives
+// open connections shutdownGrace to finish, and exits. A second signal exits
+// right away. If reload is set, SIGHUP calls it to replace the transport
+// options; a failed reload leaves the current options in place.
+func waitForExit(launched bool, reload func() error, exitOnStdinClose bool, shutdownGrace time.Duration, execName string) {
 	if !launched {
 		// Initialization failed, the client or server setup routines should
 		// have logged, so just exit here.
-		println("no pluggable transports were launched")
-		os.Exit(-1)
+		golog.Fatalf("%s - no pluggable transports were launched", execName)
 	}
 
-	golog.Infof("%s - accepting connections", execName)
+	commonLog.Infof("%s - accepting connections", execName)
 
-	if *exitOnStdinClose {
-		_, _ = io.Copy(ioutil.Discard, os.Stdin)
-		os.Exit(-1)
-	} else {
-		select {}
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	hangups := make(chan os.Signal, 1)
+	if reload != nil {
+		signal.Notify(hangups, syscall.SIGHUP)
+	}
+
+	stdinClosed := make(chan struct{})
+	if exitOnStdinClose || os.Getenv("TOR_PT_EXIT_ON_STDIN_CLOSE") == "1" {
+		go func() {
+			_, _ = io.Copy(ioutil.Discard, os.Stdin)
+			close(stdinClosed)
+		}()
+	}
+
+	for stopping := false; !stopping; {
+		select {
+		case <-hangups:
+			_ = logReload(reload, execName)
+		case received := <-signals:
+			commonLog.Infof("%s - received %s, shutting down", execName, received)
+			stopping = true
+		case <-stdinClosed:
+			commonLog.Infof("%s - stdin closed, shutting down", execName)
+			stopping = true
+		}
+	}
+
+	go func() {
+		<-signals
+		commonLog.Warnf("%s - received a second signal, exiting now", execName)
+		exit(-1)
+	}()
+
+	if closed := modes.Shutdown(shutdownGrace); closed > 0 {
+		commonLog.Warnf("%s - closed %d connections that were still open after %s", execName, closed, shutdownGrace)
+	}
+
+	exit(0)
+}
+
+// modeName returns the name the modes package and the transports use for
+// mode.
+func modeName(mode int) string {
+	switch mode {
+	case transparentTCP:
+		return modes.ModeTransparentTCP
+	case transparentUDP:
+		return modes.ModeTransparentUDP
+	case stunUDP:
+		return modes.ModeSTUNUDP
+	default:
+		return modes.ModeSocks5
 	}
 }
 
@@ -388,18 +637,18 @@ func determineMode(mode string, isTransparent bool, isUDP bool) (int, error) {
 		}
 	}
 	if isTransparent && isUDP {
-		golog.Infof("initializing transparent proxy")
-		golog.Infof("initializing UDP transparent proxy")
+		commonLog.Infof("initializing transparent proxy")
+		commonLog.Infof("initializing UDP transparent proxy")
 		return transparentUDP, nil
 	} else if isTransparent {
-		golog.Infof("initializing transparent proxy")
-		golog.Infof("initializing TCP transparent proxy")
+		commonLog.Infof("initializing transparent proxy")
+		commonLog.Infof("initializing TCP transparent proxy")
 		return transparentTCP, nil
 	} else if isUDP {
-		golog.Infof("initializing STUN UDP proxy")
+		commonLog.Infof("initializing STUN UDP proxy")
 		return stunUDP, nil
 	} else {
-		golog.Infof("initializing PT 2.1 socks5 proxy")
+		commonLog.Infof("initializing PT 2.1 socks5 proxy")
 		return socks5, nil
 	}
 }
@@ -442,22 +691,22 @@ func getClientNames(ptversion *string, transportsList *string, proxy *string) (c
 	return ptClientProxy, ptClientInfo.MethodNames, nil
 }
 
-func getServerInfo(bindaddrList *string, options *string, transportList *string, target *string, extorport *string, authcookie *string) pt_extras.ServerInfo {
+func getServerInfo(bindaddrList *string, options *string, transportList *string, target *string, extorport *string, authcookie *string, proxyURL *url.URL) pt_extras.ServerInfo {
 	var ptServerInfo pt_extras.ServerInfo
 	var err error
 	var bindaddrs []pt_extras.Bindaddr
 
 	bindaddrs, err = getServerBindaddrs(bindaddrList, options, transportList)
 	if err != nil {
-		golog.Errorf(err.Error())
-		golog.Errorf("Error parsing bindaddrs %q %q %q", *bindaddrList, *options, *transportList)
+		commonLog.Errorf(err.Error())
+		commonLog.Errorf("Error parsing bindaddrs %q %q %q", *bindaddrList, *options, *transportList)
 		return ptServerInfo
 	}
 
-	ptServerInfo = pt_extras.ServerInfo{Bindaddrs: bindaddrs}
+	ptServerInfo = pt_extras.ServerInfo{Bindaddrs: bindaddrs, ProxyURL: proxyURL}
 	ptServerInfo.OrAddr, err = pt_extras.ResolveAddr(*target)
 	if err != nil {
-		golog.Errorf("Error resolving OR address %q %q", *target, err)
+		commonLog.Errorf("Error resolving OR address %q %q", *target, err)
 		return ptServerInfo
 	}
 
@@ -468,7 +717,7 @@ func getServerInfo(bindaddrList *string, options *string, transportList *string,
 	if *extorport != "" {
 		ptServerInfo.ExtendedOrAddr, err = pt_extras.ResolveAddr(*extorport)
 		if err != nil {
-			golog.Errorf("Error resolving Extended OR address %q %q", *extorport, err)
+			commonLog.Errorf("Error resolving Extended OR address %q %q", *extorport, err)
 			return ptServerInfo
 		}
 	}
@@ -500,7 +749,6 @@ func getServerBindaddrs(bindaddrList *string, options *string, transports *strin
 			return nil, fmt.Errorf("-bindaddr: %q: %s", spec, err.Error())
 		}
 		bindaddr.Addr = addr
-		bindaddr.Options = *options
 		result = append(result, bindaddr)
 	}
 
@@ -510,8 +758,24 @@ func getServerBindaddrs(bindaddrList *string, options *string, transports *strin
 		serverTransports = *transports
 	}
 	result = pt_extras.FilterBindaddrs(result, strings.Split(serverTransports, ","))
+
+	// Each listener gets its own transport's options. A transport without
+	// valid options is reported and left out, and the others still start.
+	withOptions := result[:0]
+	for _, bindaddr := range result {
+		var err error
+		bindaddr.Options, err = pt_extras.TransportOptions(*options, bindaddr.MethodName)
+		if err != nil {
+			commonLog.Errorf("-options: %s", err.Error())
+			pt_extras.PtSmethodError(bindaddr.MethodName, "invalid transport options: "+err.Error())
+			continue
+		}
+		withOptions = append(withOptions, bindaddr)
+	}
+	result = withOptions
+
 	if len(result) == 0 {
-		golog.Errorf("no valid bindaddrs")
+		commonLog.Errorf("no valid bindaddrs")
 	}
 	return result, nil
 }
@@ -0,0 +1,165 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
+)
+
+// managedVariable is an environment variable that a parent process such as
+// tor sets in managed mode, and the flags it stands in for. The variable is
+// only used when none of its flags were given on the command line.
+type managedVariable struct {
+	name  string
+	flags []string
+}
+
+var managedClientVariables = []managedVariable{
+	{"TOR_PT_PROXY", []string{"proxy"}},
+}
+
+var managedServerVariables = []managedVariable{
+	{"TOR_PT_SERVER_BINDADDR", []string{"bindaddr", "bindhost", "bindport"}},
+	{"TOR_PT_ORPORT", []string{"target", "targethost", "targetport"}},
+	{"TOR_PT_EXTENDED_SERVER_PORT", []string{"extorport"}},
+	{"TOR_PT_AUTH_COOKIE_FILE", []string{"authcookie"}},
+}
+
+// applyManagedEnvironment configures flags from the PT environment variables
+// when TOR_PT_MANAGED_TRANSPORT_VER is set.
+// Flags given on the command line take precedence over the environment.
+//
+// The chosen version is sent to the parent process on a VERSION line, and
+// problems with the environment on VERSION-ERROR and ENV-ERROR lines.
+func applyManagedEnvironment(flags *flag.FlagSet, getenv func(string) string) error {
+	offered := getenv("TOR_PT_MANAGED_TRANSPORT_VER")
+	if offered == "" {
+		return nil
+	}
+
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	anyGiven := func(names ...string) bool {
+		for _, name := range names {
+			if given[name] {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if given["ptversion"] {
+		offered = flags.Lookup("ptversion").Value.String()
+	}
+	version, ok := pt_extras.NegotiateVersion(offered)
+	if !ok {
+		return pt_extras.PtVersionError("no-version")
+	}
+	pt_extras.PtVersion(version)
+	if err := flags.Set("ptversion", version); err != nil {
+		return err
+	}
+
+	if !given["state"] {
+		stateLocation := getenv("TOR_PT_STATE_LOCATION")
+		if stateLocation == "" {
+			return pt_extras.PtEnvError("no TOR_PT_STATE_LOCATION environment variable")
+		}
+		if err := flags.Set("state", stateLocation); err != nil {
+			return err
+		}
+	}
+
+	clientTransports := getenv("TOR_PT_CLIENT_TRANSPORTS")
+	serverTransports := getenv("TOR_PT_SERVER_TRANSPORTS")
+	isClient := given["client"]
+	if !anyGiven("client", "server") {
+		switch {
+		case clientTransports != "" && serverTransports != "":
+			return pt_extras.PtEnvError("TOR_PT_CLIENT_TRANSPORTS and TOR_PT_SERVER_TRANSPORTS are both set")
+		case clientTransports != "":
+			isClient = true
+		case serverTransports == "":
+			return pt_extras.PtEnvError("no TOR_PT_CLIENT_TRANSPORTS or TOR_PT_SERVER_TRANSPORTS environment variable")
+		}
+		role := "server"
+		if isClient {
+			role = "client"
+		}
+		if err := flags.Set(role, "true"); err != nil {
+			return err
+		}
+	}
+
+	transportsVariable, transportsList, variables := "TOR_PT_SERVER_TRANSPORTS", serverTransports, managedServerVariables
+	if isClient {
+		transportsVariable, transportsList, variables = "TOR_PT_CLIENT_TRANSPORTS", clientTransports, managedClientVariables
+	}
+	if !anyGiven("transport", "transports") {
+		if transportsList == "" {
+			return pt_extras.PtEnvError(fmt.Sprintf("no %s environment variable", transportsVariable))
+		}
+		if err := flags.Set("transports", transportsList); err != nil {
+			return err
+		}
+	}
+
+	for _, variable := range variables {
+		value := getenv(variable.name)
+		if value == "" || anyGiven(variable.flags...) {
+			continue
+		}
+		if err := flags.Set(variable.flags[0], value); err != nil {
+			return err
+		}
+	}
+
+	if isClient {
+		return nil
+	}
+
+	if !anyGiven("options", "optionsFile") {
+		options, err := pt_extras.ParseServerTransportOptions(getenv("TOR_PT_SERVER_TRANSPORT_OPTIONS"))
+		if err != nil {
+			return pt_extras.PtEnvError(fmt.Sprintf("TOR_PT_SERVER_TRANSPORT_OPTIONS: %s", err))
+		}
+		if err = flags.Set("options", options); err != nil {
+			return err
+		}
+	}
+
+	if flags.Lookup("bindaddr").Value.String() == "" && !anyGiven("bindhost", "bindport") {
+		return pt_extras.PtEnvError("no TOR_PT_SERVER_BINDADDR environment variable")
+	}
+	if flags.Lookup("target").Value.String() == "" && flags.Lookup("extorport").Value.String() == "" && !anyGiven("targethost", "targetport") {
+		return pt_extras.PtEnvError("no TOR_PT_ORPORT or TOR_PT_EXTENDED_SERVER_PORT environment variable")
+	}
+
+	return nil
+}
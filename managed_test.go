@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
+)
+
+func managedFlags() *flag.FlagSet {
+	flags := flag.NewFlagSet("dispatcher", flag.ContinueOnError)
+	for _, name := range []string{"ptversion", "state", "transport", "transports", "proxy", "options", "optionsFile", "bindaddr", "bindhost", "bindport", "target", "targethost", "targetport", "extorport", "authcookie"} {
+		flags.String(name, "", "")
+	}
+	flags.Bool("client", false, "")
+	flags.Bool("server", false, "")
+
+	return flags
+}
+
+func environment(variables map[string]string) func(string) string {
+	return func(name string) string { return variables[name] }
+}
+
+// captureIPC collects the IPC messages sent during a test.
+func captureIPC(t *testing.T) *bytes.Buffer {
+	var ipc bytes.Buffer
+	t.Cleanup(pt_extras.SetIPCOutput(&ipc))
+
+	return &ipc
+}
+
+func TestManagedServerEnvironment(t *testing.T) {
+	ipc := captureIPC(t)
+	flags := managedFlags()
+	if err := flags.Parse([]string{"-target", "127.0.0.1:9000"}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := applyManagedEnvironment(flags, environment(map[string]string{
+		"TOR_PT_MANAGED_TRANSPORT_VER":    "3,1",
+		"TOR_PT_STATE_LOCATION":           "/var/lib/tor/pt_state",
+		"TOR_PT_SERVER_TRANSPORTS":        "shadow",
+		"TOR_PT_SERVER_BINDADDR":          "shadow-0.0.0.0:2345",
+		"TOR_PT_ORPORT":                   "127.0.0.1:9001",
+		"TOR_PT_SERVER_TRANSPORT_OPTIONS": "shadow:password=1234",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"ptversion":  "1",
+		"server":     "true",
+		"client":     "false",
+		"state":      "/var/lib/tor/pt_state",
+		"transports": "shadow",
+		"bindaddr":   "shadow-0.0.0.0:2345",
+		"target":     "127.0.0.1:9000",
+		"options":    `{"shadow":{"password":"1234"}}`,
+	}
+	for name, value := range expected {
+		if actual := flags.Lookup(name).Value.String(); actual != value {
+			t.Errorf("-%s is %q, expected %q", name, actual, value)
+		}
+	}
+	if ipc.String() != "VERSION 1\n" {
+		t.Errorf("unexpected IPC output %q", ipc.String())
+	}
+}
+
+func TestManagedClientEnvironment(t *testing.T) {
+	ipc := captureIPC(t)
+	flags := managedFlags()
+	if err := flags.Parse([]string{"-state", "state", "-transport", "replicant"}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := applyManagedEnvironment(flags, environment(map[string]string{
+		"TOR_PT_MANAGED_TRANSPORT_VER": "2.1",
+		"TOR_PT_CLIENT_TRANSPORTS":     "shadow",
+		"TOR_PT_PROXY":                 "socks5://127.0.0.1:1080",
+		"TOR_PT_ORPORT":                "127.0.0.1:9001",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"ptversion":  "2.1",
+		"client":     "true",
+		"state":      "state",
+		"transport":  "replicant",
+		"transports": "",
+		"proxy":      "socks5://127.0.0.1:1080",
+		"target":     "",
+	}
+	for name, value := range expected {
+		if actual := flags.Lookup(name).Value.String(); actual != value {
+			t.Errorf("-%s is %q, expected %q", name, actual, value)
+		}
+	}
+	if ipc.String() != "VERSION 2.1\n" {
+		t.Errorf("unexpected IPC output %q", ipc.String())
+	}
+}
+
+func TestManagedEnvironmentErrors(t *testing.T) {
+	ipc := captureIPC(t)
+	tests := []struct {
+		variables map[string]string
+		message   string
+	}{
+		{map[string]string{"TOR_PT_MANAGED_TRANSPORT_VER": "3", "TOR_PT_STATE_LOCATION": "state", "TOR_PT_CLIENT_TRANSPORTS": "shadow"},
+			"VERSION-ERROR no-version\n"},
+		{map[string]string{"TOR_PT_MANAGED_TRANSPORT_VER": "1", "TOR_PT_CLIENT_TRANSPORTS": "shadow"},
+			"VERSION 1\nENV-ERROR no TOR_PT_STATE_LOCATION environment variable\n"},
+		{map[string]string{"TOR_PT_MANAGED_TRANSPORT_VER": "1", "TOR_PT_STATE_LOCATION": "state"},
+			"VERSION 1\nENV-ERROR no TOR_PT_CLIENT_TRANSPORTS or TOR_PT_SERVER_TRANSPORTS environment variable\n"},
+		{map[string]string{"TOR_PT_MANAGED_TRANSPORT_VER": "1", "TOR_PT_STATE_LOCATION": "state", "TOR_PT_CLIENT_TRANSPORTS": "shadow", "TOR_PT_SERVER_TRANSPORTS": "shadow"},
+			"VERSION 1\nENV-ERROR TOR_PT_CLIENT_TRANSPORTS and TOR_PT_SERVER_TRANSPORTS are both set\n"},
+		{map[string]string{"TOR_PT_MANAGED_TRANSPORT_VER": "1", "TOR_PT_STATE_LOCATION": "state", "TOR_PT_SERVER_TRANSPORTS": "shadow", "TOR_PT_ORPORT": "127.0.0.1:9001"},
+			"VERSION 1\nENV-ERROR no TOR_PT_SERVER_BINDADDR environment variable\n"},
+		{map[string]string{"TOR_PT_MANAGED_TRANSPORT_VER": "1", "TOR_PT_STATE_LOCATION": "state", "TOR_PT_SERVER_TRANSPORTS": "shadow", "TOR_PT_SERVER_BINDADDR": "shadow-0.0.0.0:2345"},
+			"VERSION 1\nENV-ERROR no TOR_PT_ORPORT or TOR_PT_EXTENDED_SERVER_PORT environment variable\n"},
+		{map[string]string{"TOR_PT_MANAGED_TRANSPORT_VER": "1", "TOR_PT_STATE_LOCATION": "state", "TOR_PT_SERVER_TRANSPORTS": "shadow", "TOR_PT_SERVER_BINDADDR": "shadow-0.0.0.0:2345", "TOR_PT_ORPORT": "127.0.0.1:9001", "TOR_PT_SERVER_TRANSPORT_OPTIONS": "shadow"},
+			"VERSION 1\nENV-ERROR TOR_PT_SERVER_TRANSPORT_OPTIONS: "},
+	}
+
+	for _, test := range tests {
+		ipc.Reset()
+		if err := applyManagedEnvironment(managedFlags(), environment(test.variables)); err == nil {
+			t.Errorf("expected an error for %v", test.variables)
+		}
+		if !strings.HasPrefix(ipc.String(), test.message) {
+			t.Errorf("unexpected IPC output %q for %v, expected %q", ipc.String(), test.variables, test.message)
+		}
+	}
+}
+
+func TestUnmanagedEnvironment(t *testing.T) {
+	ipc := captureIPC(t)
+	flags := managedFlags()
+	if err := applyManagedEnvironment(flags, environment(map[string]string{"TOR_PT_STATE_LOCATION": "/var/lib/tor/pt_state"})); err != nil {
+		t.Fatal(err)
+	}
+	if state := flags.Lookup("state").Value.String(); state != "" {
+		t.Errorf("-state was set to %q without TOR_PT_MANAGED_TRANSPORT_VER", state)
+	}
+	if ipc.Len() != 0 {
+		t.Errorf("unexpected IPC output %q", ipc.String())
+	}
+}
@@ -25,103 +25,157 @@ SOFTWARE.
 package modes
 
 import (
-	"fmt"
+	"errors"
 	"net"
 	"net/url"
+	"time"
 
 	locketgo "github.com/OperatorFoundation/locket-go"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
-	"github.com/kataras/golog"
-	"golang.org/x/net/proxy"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/transports"
 )
 
 type ConnState struct {
 	Conn    net.Conn
 	Waiting bool
+	Pending *PendingQueue
+	// Log logs with the ID of the flow.
+	Log *log.Logger
 }
 
-type ConnTracker map[string]ConnState
-
 type ClientHandlerTCP func(name string, options string, conn net.Conn, proxyURI *url.URL, enableLocket bool, logDir string)
 
-type ClientHandlerUDP func(name string, options string, conn *net.UDPConn, proxyURI *url.URL)
+type ClientHandlerUDP func(name string, options *LiveOptions, conn *net.UDPConn, proxyURI *url.URL, config UDPConfig)
 
 type ServerHandler func(name string, remote net.Conn, info *pt_extras.ServerInfo)
 
-func NewConnState() ConnState {
-	return ConnState{nil, true}
+func NewConnState(limits PendingLimits) ConnState {
+	return ConnState{Waiting: true, Pending: NewPendingQueue(limits)}
+}
+
+// ConnectedHandler is called once the transport connection for a flow is open,
+// and relays traffic coming back from the server to the local peer.
+type ConnectedHandler func(remote net.Conn, peer *net.UDPAddr, flowLog *log.Logger)
+
+// UDPRelay describes how a UDP mode carries datagrams over transport
+// connections.
+type UDPRelay struct {
+	Mode        string
+	Limits      PendingLimits
+	WriteFrame  func(conn net.Conn, datagram []byte) error
+	OnConnected ConnectedHandler
 }
 
-func OpenConnection(tracker *ConnTracker, addr string, name string, options string, proxyURI *url.URL, enableLocket bool, logDir string) {
-	newConn := NewConnState()
-	(*tracker)[addr] = newConn
+// OpenConnection starts dialing a transport connection for a flow. The
+// datagram that started the flow is queued and sent once the connection is
+// open.
+func OpenConnection(flows *FlowTable, peer *net.UDPAddr, datagram []byte, name string, options string, proxyURI *url.URL, enableLocket bool, logDir string, relay UDPRelay) {
+	newConn := NewConnState(relay.Limits)
+	newConn.Log = NewFlowLog(name, relay.Mode, peer)
+	newConn.Pending.Push(datagram)
+	if !flows.Add(peer.String(), newConn) {
+		return
+	}
+	RecordAccepted(name, relay.Mode)
+	newConn.Log.Infof("new flow")
 
-	go dialConn(tracker, addr, name, options, proxyURI, enableLocket, logDir)
+	go dialConn(flows, peer, newConn.Pending, newConn.Log, name, options, proxyURI, enableLocket, logDir, relay)
 }
 
-func dialConn(tracker *ConnTracker, addr string, name string, options string, proxyURI *url.URL, enableLocket bool, logDir string) {
-	// Obtain the proxy dialer if any, and create the outgoing TCP connection.
-	var dialer proxy.Dialer
-	dialer = proxy.Direct
-	if proxyURI != nil {
-		var err error
-		dialer, err = proxy.FromURL(proxyURI, proxy.Direct)
-		if err != nil {
-			// This should basically never happen, since config protocol
-			// verifies this.
-			fmt.Println("failed to obtain dialer", proxyURI, proxy.Direct)
-			golog.Error("(%s) - failed to obtain proxy dialer")
-			return
+func dialConn(flows *FlowTable, peer *net.UDPAddr, pending *PendingQueue, flowLog *log.Logger, name string, options string, proxyURI *url.URL, enableLocket bool, logDir string, relay UDPRelay) {
+	addr := peer.String()
+
+	started := time.Now()
+	remote, dialError := dialTransport(name, options, proxyURI, enableLocket, logDir)
+	RecordDial(name, relay.Mode, started, dialError)
+	if dialError != nil {
+		flowLog.WithError(dialError).Errorf("outgoing connection failed")
+		if dropped := pending.Discard(); dropped > 0 {
+			flowLog.Warnf("dropped %d queued packets", dropped)
+			RecordDroppedDatagrams(name, relay.Mode, DropQueue, dropped)
 		}
+		flows.RemoveIf(addr, pending)
+		return
+	}
 
+	stillOpen := false
+	dropped, flushError := pending.Flush(func(datagram []byte) error {
+		return relay.WriteFrame(remote, datagram)
+	}, func() {
+		stillOpen = flows.Update(addr, pending, ConnState{Conn: remote, Pending: pending, Log: flowLog})
+	})
+	if dropped > 0 {
+		flowLog.Warnf("dropped %d queued packets", dropped)
+		RecordDroppedDatagrams(name, relay.Mode, DropQueue, dropped)
+	}
+	if flushError != nil {
+		flowLog.WithError(flushError).Errorf("failed to write to the transport")
+		_ = remote.Close()
+		flows.RemoveIf(addr, pending)
+		return
+	}
+	if !stillOpen {
+		// The flow was closed while the connection was being dialed.
+		_ = remote.Close()
+		return
 	}
 
-	println("Dialing....")
+	if relay.OnConnected != nil {
+		go func() {
+			relay.OnConnected(&flowConn{remote, flows, addr}, peer, flowLog)
+			flows.RemoveIf(addr, pending)
+		}()
+	}
+}
+
+func dialTransport(name string, options string, proxyURI *url.URL, enableLocket bool, logDir string) (net.Conn, error) {
+	// Obtain the proxy dialer if any, and create the outgoing TCP connection.
+	dialer, err := pt_extras.ProxyDialer(proxyURI)
+	if err != nil {
+		// This should basically never happen, since config protocol
+		// verifies this.
+		return nil, err
+	}
 
 	// Deal with arguments.
 	transport, argsToDialerErr := pt_extras.ArgsToDialer(name, options, dialer, enableLocket, logDir)
-
 	if argsToDialerErr != nil {
-		log.Errorf("Error creating a transport with the provided options: %s", options)
-		log.Errorf("Error: %s", argsToDialerErr)
-		return
-	}
-	fmt.Println("Dialing ")
-	remote, dialError := transport.Dial()
-	if dialError != nil {
-		fmt.Println("outgoing connection failed: ", dialError)
-		golog.Error("(%s) - outgoing connection failed")
-		println("Failed")
-		delete(*tracker, addr)
-		return
+		return nil, argsToDialerErr
 	}
 
-	println("Success")
-
-	(*tracker)[addr] = ConnState{remote, false}
+	return transport.Dial()
 }
 
-func ServerAcceptLoop(name string, ln net.Listener, info *pt_extras.ServerInfo, serverHandler ServerHandler, enableLocket bool, stateDir string) {
+func ServerAcceptLoop(listener *TrackedListener, ln net.Listener, info *pt_extras.ServerInfo, serverHandler ServerHandler, enableLocket bool, stateDir string) {
+	name, mode := listener.name, listener.mode
 	for {
 		conn, err := ln.Accept()
-		fmt.Println("accepted")
 		if err != nil {
-			print("Received an error while attempting to accept a connection:")
-			print(err.Error())
-
 			if e, ok := err.(net.Error); ok && !e.Temporary() {
-				log.Errorf("ServerAcceptLoop failed")
+				if !errors.Is(err, net.ErrClosed) {
+					listener.Log().WithError(err).Errorf("the listener failed")
+				}
 				_ = ln.Close()
 				return
 			}
+			listener.Log().WithError(err).Warnf("failed to accept a connection")
 			continue
 		}
+		if listener.Paused() {
+			listener.Log().Debugf("closed a new connection, the listener is paused")
+			_ = conn.Close()
+			continue
+		}
+
+		// A server that passes its clients on to another hop is relayed
+		// there instead of being handled by the mode.
+		next, chained := conn.(transports.NextHopConn)
 
 		if enableLocket {
 			locketConn, locketError := locketgo.NewLocketConn(conn, stateDir, "DispatcherServer")
 			if locketError != nil {
-				golog.Error("server failed to enable Locket")
+				listener.Log().WithError(locketError).Errorf("failed to enable Locket")
 				conn.Close()
 				return
 			}
@@ -129,6 +183,46 @@ func ServerAcceptLoop(name string, ln net.Listener, info *pt_extras.ServerInfo,
 			conn = locketConn
 		}
 
-		go serverHandler(name, conn, info)
+		RecordAccepted(name, mode)
+
+		go func() {
+			untrack := TrackSession(name, mode, conn)
+			defer untrack()
+
+			if chained {
+				relayToNextHop(name, mode, conn, next, info)
+				return
+			}
+			serverHandler(name, conn, info)
+		}()
+	}
+}
+
+// relayToNextHop connects to the next hop of next, through the upstream proxy
+// if one is set, and copies conn to it.
+func relayToNextHop(name string, mode string, conn net.Conn, next transports.NextHopConn, info *pt_extras.ServerInfo) {
+	sessionLog := SessionLog(name, mode, conn)
+	sessionLog.Infof("new connection")
+
+	dialer, err := pt_extras.ProxyDialer(info.ProxyURL)
+	if err != nil {
+		sessionLog.WithError(err).Errorf("could not use the upstream proxy")
+		conn.Close()
+		return
+	}
+
+	started := time.Now()
+	remote, err := next.DialNext(dialer)
+	RecordDial(name, mode, started, err)
+	if err != nil {
+		sessionLog.WithError(err).Errorf("failed to connect to the next hop")
+		conn.Close()
+		return
+	}
+
+	if err = CopyLoop(remote, conn); err != nil {
+		sessionLog.WithError(err).Warnf("closed connection")
+	} else {
+		sessionLog.Infof("closed connection")
 	}
 }
@@ -0,0 +1,289 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+)
+
+// FlowLimits bounds the UDP flows a client keeps open.
+type FlowLimits struct {
+	// IdleTimeout is how long a flow may go without traffic in either
+	// direction before it is closed.
+	IdleTimeout time.Duration
+	// MaxFlows is the largest number of flows kept open. When it is reached,
+	// the least recently used flow is closed to make room for a new one.
+	MaxFlows int
+}
+
+// DefaultFlowLimits is used when no limits are configured.
+var DefaultFlowLimits = FlowLimits{IdleTimeout: 2 * time.Minute, MaxFlows: 1024}
+
+// FlowCloseHandler is called after a flow has been removed from a FlowTable
+// and its transport connection closed.
+type FlowCloseHandler func(key string, state ConnState)
+
+type flowEntry struct {
+	key      string
+	state    ConnState
+	lastUsed time.Time
+}
+
+// FlowTable tracks the transport connection for each UDP peer. It is safe for
+// concurrent use. Flows that are idle for too long are closed, and the least
+// recently used flow is closed when the table is full.
+type FlowTable struct {
+	mutex   sync.Mutex
+	limits  FlowLimits
+	flows   map[string]*list.Element
+	lru     *list.List
+	onClose []FlowCloseHandler
+	done    chan struct{}
+	closed  bool
+}
+
+func NewFlowTable(limits FlowLimits) *FlowTable {
+	table := &FlowTable{
+		limits: limits,
+		flows:  make(map[string]*list.Element),
+		lru:    list.New(),
+		done:   make(chan struct{}),
+	}
+
+	if limits.IdleTimeout > 0 {
+		go table.expireLoop()
+	}
+
+	return table
+}
+
+// OnClose registers a handler that is called whenever a flow is closed.
+func (table *FlowTable) OnClose(handler FlowCloseHandler) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	table.onClose = append(table.onClose, handler)
+}
+
+// Get returns the state of a flow and marks it as used.
+func (table *FlowTable) Get(key string) (ConnState, bool) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	element, ok := table.flows[key]
+	if !ok {
+		return ConnState{}, false
+	}
+
+	table.touch(element)
+	return element.Value.(*flowEntry).state, true
+}
+
+// Touch marks a flow as used, so that it is not closed for being idle.
+func (table *FlowTable) Touch(key string) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	if element, ok := table.flows[key]; ok {
+		table.touch(element)
+	}
+}
+
+// Add starts tracking a new flow, closing any existing flow with the same key,
+// and the least recently used flow if the table is full. It returns false if
+// the table has been closed.
+func (table *FlowTable) Add(key string, state ConnState) bool {
+	var removed []*flowEntry
+
+	table.mutex.Lock()
+	if table.closed {
+		table.mutex.Unlock()
+		return false
+	}
+
+	if element, ok := table.flows[key]; ok {
+		removed = append(removed, table.remove(element))
+	}
+	for table.limits.MaxFlows > 0 && table.lru.Len() >= table.limits.MaxFlows {
+		removed = append(removed, table.remove(table.lru.Back()))
+	}
+
+	table.flows[key] = table.lru.PushFront(&flowEntry{key, state, time.Now()})
+	table.mutex.Unlock()
+
+	table.finish(removed)
+	return true
+}
+
+// Update replaces the state of a flow, as long as it is still the flow that
+// owns pending. It returns false if that flow has since been closed.
+func (table *FlowTable) Update(key string, pending *PendingQueue, state ConnState) bool {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	element, ok := table.flows[key]
+	if !ok || element.Value.(*flowEntry).state.Pending != pending {
+		return false
+	}
+
+	element.Value.(*flowEntry).state = state
+	table.touch(element)
+	return true
+}
+
+// Remove closes a flow.
+func (table *FlowTable) Remove(key string) {
+	table.RemoveIf(key, nil)
+}
+
+// RemoveIf closes a flow if it is the flow that owns pending, or closes it
+// unconditionally if pending is nil.
+func (table *FlowTable) RemoveIf(key string, pending *PendingQueue) {
+	var removed []*flowEntry
+
+	table.mutex.Lock()
+	element, ok := table.flows[key]
+	if ok && (pending == nil || element.Value.(*flowEntry).state.Pending == pending) {
+		removed = append(removed, table.remove(element))
+	}
+	table.mutex.Unlock()
+
+	table.finish(removed)
+}
+
+// Len returns the number of flows being tracked.
+func (table *FlowTable) Len() int {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	return table.lru.Len()
+}
+
+// Expire closes the flows that have been idle since before the idle timeout.
+func (table *FlowTable) Expire(now time.Time) {
+	var removed []*flowEntry
+
+	table.mutex.Lock()
+	for element := table.lru.Back(); element != nil; element = table.lru.Back() {
+		if now.Sub(element.Value.(*flowEntry).lastUsed) < table.limits.IdleTimeout {
+			break
+		}
+		removed = append(removed, table.remove(element))
+	}
+	table.mutex.Unlock()
+
+	table.finish(removed)
+}
+
+// Close closes every flow and stops tracking new ones.
+func (table *FlowTable) Close() {
+	var removed []*flowEntry
+
+	table.mutex.Lock()
+	if table.closed {
+		table.mutex.Unlock()
+		return
+	}
+	table.closed = true
+	close(table.done)
+	for element := table.lru.Back(); element != nil; element = table.lru.Back() {
+		removed = append(removed, table.remove(element))
+	}
+	table.mutex.Unlock()
+
+	table.finish(removed)
+}
+
+func (table *FlowTable) expireLoop() {
+	ticker := time.NewTicker(table.limits.IdleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			table.Expire(now)
+		case <-table.done:
+			return
+		}
+	}
+}
+
+// touch and remove must be called with the mutex held.
+func (table *FlowTable) touch(element *list.Element) {
+	element.Value.(*flowEntry).lastUsed = time.Now()
+	table.lru.MoveToFront(element)
+}
+
+func (table *FlowTable) remove(element *list.Element) *flowEntry {
+	entry := table.lru.Remove(element).(*flowEntry)
+	delete(table.flows, entry.key)
+
+	return entry
+}
+
+// finish closes removed flows. It is called without the mutex held, since
+// closing a flow takes the lock of its pending queue, and the queue calls
+// back into the table while holding that lock.
+func (table *FlowTable) finish(removed []*flowEntry) {
+	if len(removed) == 0 {
+		return
+	}
+
+	table.mutex.Lock()
+	handlers := table.onClose
+	table.mutex.Unlock()
+
+	for _, entry := range removed {
+		if entry.state.Pending != nil {
+			entry.state.Pending.Discard()
+		}
+		if entry.state.Conn != nil {
+			_ = entry.state.Conn.Close()
+		}
+		for _, handler := range handlers {
+			handler(entry.key, entry.state)
+		}
+	}
+}
+
+// flowConn marks its flow as used whenever data arrives from the server, so
+// that flows with only return traffic are not closed for being idle.
+type flowConn struct {
+	net.Conn
+	table *FlowTable
+	key   string
+}
+
+func (conn *flowConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	if n > 0 {
+		conn.table.Touch(conn.key)
+	}
+
+	return n, err
+}
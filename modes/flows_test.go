@@ -0,0 +1,141 @@
+package modes
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func openFlow(t *testing.T, table *FlowTable, key string) (ConnState, net.Conn) {
+	local, remote := net.Pipe()
+	t.Cleanup(func() { local.Close() })
+
+	state := NewConnState(DefaultPendingLimits)
+	if !table.Add(key, state) {
+		t.Fatal("Add failed")
+	}
+	state = ConnState{Conn: remote, Pending: state.Pending}
+	if !table.Update(key, state.Pending, state) {
+		t.Fatal("Update failed")
+	}
+
+	return state, local
+}
+
+func TestFlowTableEvictsLeastRecentlyUsed(t *testing.T) {
+	table := NewFlowTable(FlowLimits{MaxFlows: 2})
+	defer table.Close()
+
+	var closed []string
+	table.OnClose(func(key string, state ConnState) {
+		closed = append(closed, key)
+	})
+
+	_, firstLocal := openFlow(t, table, "first")
+	openFlow(t, table, "second")
+	table.Get("first")
+	openFlow(t, table, "third")
+
+	if len(closed) != 1 || closed[0] != "second" {
+		t.Fatalf("closed %v, expected [second]", closed)
+	}
+	if _, ok := table.Get("second"); ok {
+		t.Error("evicted flow is still tracked")
+	}
+	if table.Len() != 2 {
+		t.Errorf("table has %d flows", table.Len())
+	}
+
+	table.Close()
+	if _, err := firstLocal.Write([]byte("x")); err == nil {
+		t.Error("Close left a transport connection open")
+	}
+}
+
+func TestFlowTableExpiresIdleFlows(t *testing.T) {
+	table := NewFlowTable(FlowLimits{IdleTimeout: 20 * time.Millisecond})
+	defer table.Close()
+
+	closed := make(chan string, 1)
+	table.OnClose(func(key string, state ConnState) {
+		closed <- key
+	})
+
+	openFlow(t, table, "idle")
+
+	select {
+	case key := <-closed:
+		if key != "idle" {
+			t.Errorf("closed %s", key)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle flow was not closed")
+	}
+}
+
+func TestFlowTableIgnoresStaleUpdates(t *testing.T) {
+	table := NewFlowTable(DefaultFlowLimits)
+	defer table.Close()
+
+	stale := NewConnState(DefaultPendingLimits)
+	table.Add("peer", stale)
+	current := NewConnState(DefaultPendingLimits)
+	table.Add("peer", current)
+
+	if table.Update("peer", stale.Pending, ConnState{Pending: stale.Pending}) {
+		t.Error("Update accepted a replaced flow")
+	}
+	table.RemoveIf("peer", stale.Pending)
+	if state, ok := table.Get("peer"); !ok || !state.Waiting {
+		t.Error("RemoveIf removed the current flow")
+	}
+}
+
+func TestFlowTableConcurrentUse(t *testing.T) {
+	table := NewFlowTable(FlowLimits{IdleTimeout: time.Millisecond, MaxFlows: 8})
+	defer table.Close()
+
+	closed := 0
+	var closedMutex sync.Mutex
+	table.OnClose(func(key string, state ConnState) {
+		closedMutex.Lock()
+		closed++
+		closedMutex.Unlock()
+	})
+
+	var workers sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		workers.Add(1)
+		go func(worker int) {
+			defer workers.Done()
+			for i := 0; i < 200; i++ {
+				key := fmt.Sprintf("peer-%d", (worker+i)%16)
+				state, ok := table.Get(key)
+				if !ok {
+					state = NewConnState(DefaultPendingLimits)
+					table.Add(key, state)
+					table.Update(key, state.Pending, ConnState{Pending: state.Pending})
+					continue
+				}
+				table.Touch(key)
+				if i%7 == 0 {
+					table.RemoveIf(key, state.Pending)
+				}
+				table.Expire(time.Now())
+				_ = table.Len()
+			}
+		}(worker)
+	}
+	workers.Wait()
+
+	if table.Len() > 8 {
+		t.Errorf("table has %d flows, more than the limit", table.Len())
+	}
+	closedMutex.Lock()
+	defer closedMutex.Unlock()
+	if closed == 0 {
+		t.Error("no flows were closed")
+	}
+}
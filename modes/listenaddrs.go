@@ -0,0 +1,159 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
+)
+
+// DefaultListenAddr is where a client transport listens when no address is
+// given for it. The port is assigned automatically, and announced on the
+// transport's CMETHOD line.
+const DefaultListenAddr = "127.0.0.1:0"
+
+// ClientListenAddrs returns the address each transport in names listens on.
+//
+// listenAddr is either one address, or a comma-separated list of
+// <transport>-<address> pairs like -bindaddr:
+//
+//	shadow-127.0.0.1:1080,replicant-127.0.0.1:1081
+//
+// With one address, the first transport listens on it and the others listen on
+// automatically assigned ports on the same host, unless they share a SOCKS
+// listener (see SharedListenAddr). A Unix socket, written as unix:/path, can
+// only be used by one transport. Transports left out of a list listen on
+// DefaultListenAddr.
+func ClientListenAddrs(listenAddr string, names []string) (map[string]string, error) {
+	addrs := make(map[string]string)
+	if listenAddr == "" {
+		listenAddr = DefaultListenAddr
+	}
+
+	if isListenAddrList(listenAddr, names) {
+		for _, pair := range strings.Split(listenAddr, ",") {
+			name, addr, found := strings.Cut(pair, "-")
+			if !found {
+				return nil, fmt.Errorf("%q: doesn't contain \"-\"", pair)
+			}
+			if err := checkListenAddr(addr); err != nil {
+				return nil, fmt.Errorf("%q: %s", pair, err)
+			}
+			for _, configured := range names {
+				if strings.EqualFold(configured, name) {
+					addrs[configured] = addr
+				}
+			}
+		}
+		for _, name := range names {
+			if _, ok := addrs[name]; !ok {
+				addrs[name] = DefaultListenAddr
+			}
+		}
+
+		return addrs, nil
+	}
+
+	if err := checkListenAddr(listenAddr); err != nil {
+		return nil, err
+	}
+	if IsUnixAddr(listenAddr) && len(names) > 1 {
+		return nil, fmt.Errorf("%q: a Unix socket can only be used by one transport", listenAddr)
+	}
+
+	host, _, _ := net.SplitHostPort(listenAddr)
+	for index, name := range names {
+		if index == 0 {
+			addrs[name] = listenAddr
+		} else {
+			addrs[name] = net.JoinHostPort(host, "0")
+		}
+	}
+
+	return addrs, nil
+}
+
+// SharedListenAddr reports whether the transports in names share one SOCKS
+// listener on listenAddr, which is the case when there is more than one of
+// them and listenAddr is a single Unix socket or address with a fixed port.
+// Each connection then names its transport in the SOCKS arguments.
+func SharedListenAddr(listenAddr string, names []string) bool {
+	if len(names) < 2 || listenAddr == "" || isListenAddrList(listenAddr, names) {
+		return false
+	}
+	if IsUnixAddr(listenAddr) {
+		return true
+	}
+
+	_, port, err := net.SplitHostPort(listenAddr)
+	return err == nil && port != "0"
+}
+
+// checkListenAddr checks that addr is a host and port, or a Unix socket path.
+func checkListenAddr(addr string) error {
+	if IsUnixAddr(addr) {
+		if strings.TrimPrefix(addr, UnixPrefix) == "" {
+			return errors.New("the Unix socket path is empty")
+		}
+		return nil
+	}
+
+	_, _, err := net.SplitHostPort(addr)
+	return err
+}
+
+// ReportListenAddrError reports a listen address that could not be parsed for
+// each of the client transports in names.
+func ReportListenAddrError(names []string, mode string, err error) {
+	for _, name := range names {
+		TransportLog(name, mode).WithError(err).Errorf("invalid listen address")
+		pt_extras.PtCmethodError(name, "invalid listen address: "+err.Error())
+	}
+}
+
+// isListenAddrList reports whether listenAddr is a list of
+// <transport>-<address> pairs rather than one address. Host names may contain
+// "-" too, so a single pair is only recognised by its transport name.
+func isListenAddrList(listenAddr string, names []string) bool {
+	if strings.Contains(listenAddr, ",") {
+		return true
+	}
+
+	name, _, found := strings.Cut(listenAddr, "-")
+	if !found {
+		return false
+	}
+	for _, configured := range names {
+		if strings.EqualFold(configured, name) {
+			return true
+		}
+	}
+
+	return false
+}
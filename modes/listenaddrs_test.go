@@ -0,0 +1,60 @@
+package modes
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClientListenAddrs(t *testing.T) {
+	names := []string{"shadow", "replicant", "starbridge"}
+	tests := []struct {
+		listenAddr string
+		expected   map[string]string
+	}{
+		{"", map[string]string{"shadow": DefaultListenAddr, "replicant": DefaultListenAddr, "starbridge": DefaultListenAddr}},
+		{"127.0.0.1:1443", map[string]string{"shadow": "127.0.0.1:1443", "replicant": "127.0.0.1:0", "starbridge": "127.0.0.1:0"}},
+		{"my-host:1443", map[string]string{"shadow": "my-host:1443", "replicant": "my-host:0", "starbridge": "my-host:0"}},
+		{"Shadow-127.0.0.1:1443,replicant-[::1]:1444,optimizer-127.0.0.1:1445", map[string]string{"shadow": "127.0.0.1:1443", "replicant": "[::1]:1444", "starbridge": DefaultListenAddr}},
+		{"replicant-127.0.0.1:1444", map[string]string{"shadow": DefaultListenAddr, "replicant": "127.0.0.1:1444", "starbridge": DefaultListenAddr}},
+		{"shadow-unix:/tmp/shadow.sock,replicant-127.0.0.1:1444", map[string]string{"shadow": "unix:/tmp/shadow.sock", "replicant": "127.0.0.1:1444", "starbridge": DefaultListenAddr}},
+	}
+
+	for _, test := range tests {
+		addrs, err := ClientListenAddrs(test.listenAddr, names)
+		if err != nil {
+			t.Errorf("%q: %s", test.listenAddr, err)
+			continue
+		}
+		if !reflect.DeepEqual(addrs, test.expected) {
+			t.Errorf("%q: got %v, expected %v", test.listenAddr, addrs, test.expected)
+		}
+	}
+
+	for _, invalid := range []string{"127.0.0.1", "shadow-127.0.0.1:1443,replicant", "shadow-127.0.0.1", "unix:/tmp/dispatcher.sock", "shadow-unix:"} {
+		if _, err := ClientListenAddrs(invalid, names); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestSharedListenAddr(t *testing.T) {
+	tests := []struct {
+		listenAddr string
+		names      []string
+		shared     bool
+	}{
+		{"127.0.0.1:1443", []string{"shadow", "replicant"}, true},
+		{"127.0.0.1:1443", []string{"shadow"}, false},
+		{"127.0.0.1:0", []string{"shadow", "replicant"}, false},
+		{"", []string{"shadow", "replicant"}, false},
+		{"shadow-127.0.0.1:1443", []string{"shadow", "replicant"}, false},
+		{"unix:/tmp/dispatcher.sock", []string{"shadow", "replicant"}, true},
+		{"unix:/tmp/dispatcher.sock", []string{"shadow"}, false},
+	}
+
+	for _, test := range tests {
+		if shared := SharedListenAddr(test.listenAddr, test.names); shared != test.shared {
+			t.Errorf("SharedListenAddr(%q, %v) = %v", test.listenAddr, test.names, shared)
+		}
+	}
+}
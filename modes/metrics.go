@@ -0,0 +1,162 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	commonLog "github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/metrics"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/socks5"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/transports"
+)
+
+// The modes a listener can run in. They label sessions and metrics, and are
+// the names transports list their supported modes by.
+const (
+	ModeSocks5         = transports.ModeSocks5
+	ModeTransparentTCP = transports.ModeTransparentTCP
+	ModeTransparentUDP = transports.ModeTransparentUDP
+	ModeSTUNUDP        = transports.ModeSTUNUDP
+)
+
+// The directions CopyLoop copies in. The transport side is the transport
+// connection, and the local side is the application, ORPort or target.
+const (
+	directionToTransport   = "to_transport"
+	directionFromTransport = "from_transport"
+)
+
+var (
+	acceptedConnections = metrics.NewCounter("dispatcher_connections_accepted_total",
+		"Connections accepted by the listeners. For UDP modes, flows opened.", "transport", "mode")
+	dials = metrics.NewCounter("dispatcher_dials_total",
+		"Outgoing connections by result: succeeded, or the SOCKS reply code for the failure.", "transport", "mode", "result")
+	dialDuration = metrics.NewHistogram("dispatcher_dial_duration_seconds",
+		"Time taken to open outgoing connections, including the transport handshake.", metrics.DefaultBuckets, "transport", "mode")
+	copiedBytes = metrics.NewCounter("dispatcher_bytes_total",
+		"Bytes copied between local connections and transport connections.", "transport", "mode", "direction")
+	activeSessions = metrics.NewGauge("dispatcher_sessions_active",
+		"Sessions that are open.", "transport", "mode")
+	droppedDatagrams = metrics.NewCounter("dispatcher_datagrams_dropped_total",
+		"UDP datagrams that were not relayed, by reason.", "transport", "mode", "reason")
+	_ = metrics.NewGaugeFunc("dispatcher_udp_flows",
+		"UDP flows being tracked.", collectFlows, "transport", "mode")
+)
+
+// RecordAccepted counts a connection accepted by a listener.
+func RecordAccepted(name string, mode string) {
+	acceptedConnections.Inc(name, mode)
+}
+
+// ErrorToReplyCode converts an error from setting up or dialing a transport
+// to the SOCKS reply code that best describes it.
+func ErrorToReplyCode(err error) socks5.ReplyCode {
+	// Errors from building the transport out of the per-connection arguments.
+	switch {
+	case errors.Is(err, pt_extras.ErrMissingOptions), errors.Is(err, pt_extras.ErrInvalidOptions):
+		return socks5.ReplyConnectionNotAllowed
+	case errors.Is(err, pt_extras.ErrInvalidServerAddress):
+		return socks5.ReplyAddressNotSupported
+	case errors.Is(err, pt_extras.ErrUnknownTransport):
+		return socks5.ReplyCommandNotSupported
+	}
+
+	return socks5.ErrorToReplyCode(err)
+}
+
+// RecordDial counts an outgoing connection that started at started, and
+// records how long it took.
+func RecordDial(name string, mode string, started time.Time, err error) {
+	code := socks5.ReplySucceeded
+	if err != nil {
+		code = ErrorToReplyCode(err)
+		reportStatus(name, StatusDialFailed, "MODE", mode, "ERROR", commonLog.ElideError(err), "ERRORCLASS", commonLog.ErrorClass(err))
+	}
+
+	recordDial(name, mode, started, code)
+}
+
+// RecordDialReply is RecordDial for callers that already have the reply code
+// for the result.
+func RecordDialReply(name string, mode string, started time.Time, code socks5.ReplyCode) {
+	if code != socks5.ReplySucceeded {
+		reportStatus(name, StatusDialFailed, "MODE", mode, "ERROR", code.String())
+	}
+
+	recordDial(name, mode, started, code)
+}
+
+func recordDial(name string, mode string, started time.Time, code socks5.ReplyCode) {
+	dials.Inc(name, mode, code.String())
+	dialDuration.Observe(time.Since(started).Seconds(), name, mode)
+}
+
+// Reasons for dropping datagrams.
+const (
+	DropQueue     = "queue"
+	DropNotSTUN   = "not_stun"
+	DropTransport = "transport_error"
+)
+
+// RecordDroppedDatagrams counts datagrams that were dropped for reason.
+func RecordDroppedDatagrams(name string, mode string, reason string, count int) {
+	if count > 0 {
+		droppedDatagrams.Add(float64(count), name, mode, reason)
+	}
+}
+
+// Flow tables are registered while their client listener runs, so their
+// sizes can be read when metrics are scraped.
+var flowTables = struct {
+	sync.Mutex
+	tables map[*FlowTable][2]string
+}{tables: make(map[*FlowTable][2]string)}
+
+// TrackFlows reports the size of a client listener's flow table in metrics.
+// The returned function must be called once the table is closed.
+func TrackFlows(flows *FlowTable, name string, mode string) (untrack func()) {
+	flowTables.Lock()
+	flowTables.tables[flows] = [2]string{name, mode}
+	flowTables.Unlock()
+
+	return func() {
+		flowTables.Lock()
+		delete(flowTables.tables, flows)
+		flowTables.Unlock()
+	}
+}
+
+func collectFlows(set func(value float64, labelValues ...string)) {
+	flowTables.Lock()
+	defer flowTables.Unlock()
+
+	for flows, labels := range flowTables.tables {
+		set(float64(flows.Len()), labels[0], labels[1])
+	}
+}
@@ -0,0 +1,125 @@
+package modes
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/socks5"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/transports"
+)
+
+func TestCopyLoopCountsBytes(t *testing.T) {
+	resetRegistry(t)
+
+	// The counters are global, so only their changes are checked.
+	sentBefore := copiedBytes.Value("metrics", ModeTransparentTCP, directionToTransport)
+	receivedBefore := copiedBytes.Value("metrics", ModeTransparentTCP, directionFromTransport)
+
+	local, localPeer := net.Pipe()
+	transport, transportPeer := net.Pipe()
+	untrack := TrackSession("metrics", ModeTransparentTCP, transport)
+	if active := activeSessions.Value("metrics", ModeTransparentTCP); active != 1 {
+		t.Errorf("unexpected active sessions %v", active)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- CopyLoop(local, transport) }()
+
+	// Echo on the far side of the transport.
+	go func() { _, _ = io.Copy(transportPeer, transportPeer) }()
+
+	message := []byte("hello")
+	if _, err := localPeer.Write(message); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(localPeer, make([]byte, len(message))); err != nil {
+		t.Fatal(err)
+	}
+	localPeer.Close()
+	transportPeer.Close()
+	<-done
+	untrack()
+
+	if sent := copiedBytes.Value("metrics", ModeTransparentTCP, directionToTransport) - sentBefore; sent != 5 {
+		t.Errorf("unexpected bytes sent %v", sent)
+	}
+	if received := copiedBytes.Value("metrics", ModeTransparentTCP, directionFromTransport) - receivedBefore; received != 5 {
+		t.Errorf("unexpected bytes received %v", received)
+	}
+	if active := activeSessions.Value("metrics", ModeTransparentTCP); active != 0 {
+		t.Errorf("unexpected active sessions %v", active)
+	}
+}
+
+func TestRecordDial(t *testing.T) {
+	results := []string{"succeeded", "command_not_supported", "general_failure"}
+	before := make(map[string]float64)
+	for _, result := range results {
+		before[result] = dials.Value("metrics", ModeSocks5, result)
+	}
+	countBefore := dialDuration.Count("metrics", ModeSocks5)
+
+	RecordDial("metrics", ModeSocks5, time.Now(), nil)
+	RecordDial("metrics", ModeSocks5, time.Now(), pt_extras.ErrUnknownTransport)
+	RecordDial("metrics", ModeSocks5, time.Now(), errors.New("unexpected"))
+
+	for _, result := range results {
+		if count := dials.Value("metrics", ModeSocks5, result) - before[result]; count != 1 {
+			t.Errorf("%s dials = %v, expected 1", result, count)
+		}
+	}
+	if count := dialDuration.Count("metrics", ModeSocks5) - countBefore; count != 3 {
+		t.Errorf("unexpected dial latency count %d", count)
+	}
+}
+
+func TestFlowsGauge(t *testing.T) {
+	flows := NewFlowTable(DefaultFlowLimits)
+	defer flows.Close()
+	untrack := TrackFlows(flows, "metrics", ModeTransparentUDP)
+	defer untrack()
+
+	flows.Add("192.0.2.1:1234", NewConnState(DefaultPendingLimits))
+	flows.Add("192.0.2.2:1234", NewConnState(DefaultPendingLimits))
+
+	var got float64
+	collectFlows(func(value float64, labelValues ...string) {
+		if labelValues[0] == "metrics" && labelValues[1] == ModeTransparentUDP {
+			got += value
+		}
+	})
+	if got != 2 {
+		t.Errorf("unexpected flow count %v", got)
+	}
+}
+
+// TestErrorToReplyCodeArgs tests the reply codes for per-connection argument errors.
+func TestErrorToReplyCodeArgs(t *testing.T) {
+	if _, err := pt_extras.ArgsFromSocks(nil); ErrorToReplyCode(err) != socks5.ReplyConnectionNotAllowed {
+		t.Error("missing arguments did not map to ReplyConnectionNotAllowed:", err)
+	}
+
+	args := map[string]interface{}{"serverAddress": "no-port"}
+	if _, err := pt_extras.ArgsFromSocks(args); ErrorToReplyCode(err) != socks5.ReplyAddressNotSupported {
+		t.Error("invalid server address did not map to ReplyAddressNotSupported:", err)
+	}
+
+	args = map[string]interface{}{"serverAddress": "127.0.0.1:1234", "serverPublicKey": "", "transport": "shadow"}
+	options, err := pt_extras.ArgsFromSocks(args)
+	if err != nil {
+		t.Fatal("ArgsFromSocks failed:", err)
+	}
+	if _, err = pt_extras.ArgsToDialer("nonexistent", options, nil, false, ""); ErrorToReplyCode(err) != socks5.ReplyCommandNotSupported {
+		t.Error("unknown transport did not map to ReplyCommandNotSupported:", err)
+	}
+	if _, ok := transports.Lookup("shadow"); !ok {
+		t.Skip("built without shadow")
+	}
+	if _, err = pt_extras.ArgsToDialer("shadow", options, nil, false, ""); ErrorToReplyCode(err) != socks5.ReplyConnectionNotAllowed {
+		t.Error("invalid shadow arguments did not map to ReplyConnectionNotAllowed:", err)
+	}
+}
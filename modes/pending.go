@@ -0,0 +1,139 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"sync"
+	"time"
+)
+
+// PendingLimits bounds the datagrams held for a flow while its transport
+// connection is being dialed.
+type PendingLimits struct {
+	// MaxPackets is the largest number of datagrams held per flow.
+	MaxPackets int
+	// MaxAge is how long a datagram may wait before it is dropped.
+	MaxAge time.Duration
+}
+
+// DefaultPendingLimits is used when no limits are configured.
+var DefaultPendingLimits = PendingLimits{MaxPackets: 32, MaxAge: 5 * time.Second}
+
+type pendingPacket struct {
+	datagram []byte
+	received time.Time
+}
+
+// PendingQueue holds datagrams for a flow until its transport connection is
+// open. It is safe for concurrent use.
+type PendingQueue struct {
+	mutex   sync.Mutex
+	limits  PendingLimits
+	packets []pendingPacket
+	closed  bool
+	dropped int
+}
+
+func NewPendingQueue(limits PendingLimits) *PendingQueue {
+	return &PendingQueue{limits: limits}
+}
+
+// Push queues a copy of a datagram. A datagram that does not fit within the
+// limits is dropped and counted. Push returns false if the queue has already
+// been flushed or discarded, in which case the caller must send the datagram
+// itself.
+func (queue *PendingQueue) Push(datagram []byte) bool {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if queue.closed {
+		return false
+	}
+
+	now := time.Now()
+	queue.expire(now)
+
+	if len(queue.packets) >= queue.limits.MaxPackets {
+		queue.dropped++
+		return true
+	}
+
+	queue.packets = append(queue.packets, pendingPacket{append([]byte{}, datagram...), now})
+	return true
+}
+
+// Flush sends the queued datagrams in order and closes the queue. opened is
+// called before the lock is released, so that no datagram can be queued once
+// the flow has stopped waiting. Flush returns the number of datagrams dropped
+// because of the limits.
+func (queue *PendingQueue) Flush(write func(datagram []byte) error, opened func()) (dropped int, err error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	queue.expire(time.Now())
+
+	for index, packet := range queue.packets {
+		if err = write(packet.datagram); err != nil {
+			queue.dropped += len(queue.packets) - index
+			break
+		}
+	}
+
+	if err == nil {
+		opened()
+	}
+
+	return queue.close(), err
+}
+
+// Discard drops the queued datagrams, closes the queue, and returns the number
+// of datagrams that were dropped in total.
+func (queue *PendingQueue) Discard() int {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	queue.dropped += len(queue.packets)
+
+	return queue.close()
+}
+
+func (queue *PendingQueue) close() int {
+	queue.packets = nil
+	queue.closed = true
+
+	return queue.dropped
+}
+
+func (queue *PendingQueue) expire(now time.Time) {
+	expired := 0
+	for expired < len(queue.packets) && now.Sub(queue.packets[expired].received) > queue.limits.MaxAge {
+		expired++
+	}
+
+	if expired > 0 {
+		queue.dropped += expired
+		queue.packets = queue.packets[expired:]
+	}
+}
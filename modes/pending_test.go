@@ -0,0 +1,73 @@
+package modes
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPendingQueueFlushInOrder(t *testing.T) {
+	queue := NewPendingQueue(PendingLimits{MaxPackets: 2, MaxAge: time.Minute})
+	for _, datagram := range []string{"one", "two", "three"} {
+		if !queue.Push([]byte(datagram)) {
+			t.Fatal("queue closed before flush")
+		}
+	}
+
+	var sent []string
+	opened := false
+	dropped, err := queue.Flush(func(datagram []byte) error {
+		sent = append(sent, string(datagram))
+		return nil
+	}, func() { opened = true })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sent) != 2 || sent[0] != "one" || sent[1] != "two" {
+		t.Errorf("unexpected datagrams sent: %v", sent)
+	}
+	if dropped != 1 || !opened {
+		t.Errorf("dropped %d, opened %v", dropped, opened)
+	}
+	if queue.Push([]byte("four")) {
+		t.Error("Push succeeded after flush")
+	}
+}
+
+func TestPendingQueueExpiresOldPackets(t *testing.T) {
+	queue := NewPendingQueue(PendingLimits{MaxPackets: 10, MaxAge: 10 * time.Millisecond})
+	queue.Push([]byte("old"))
+	time.Sleep(20 * time.Millisecond)
+	queue.Push([]byte("new"))
+
+	var sent []string
+	dropped, _ := queue.Flush(func(datagram []byte) error {
+		sent = append(sent, string(datagram))
+		return nil
+	}, func() {})
+
+	if len(sent) != 1 || sent[0] != "new" || dropped != 1 {
+		t.Errorf("sent %v, dropped %d", sent, dropped)
+	}
+}
+
+func TestPendingQueueFailures(t *testing.T) {
+	queue := NewPendingQueue(DefaultPendingLimits)
+	queue.Push([]byte("one"))
+	queue.Push([]byte("two"))
+
+	opened := false
+	dropped, err := queue.Flush(func(datagram []byte) error {
+		return errors.New("closed")
+	}, func() { opened = true })
+	if err == nil || opened || dropped != 2 {
+		t.Errorf("err %v, opened %v, dropped %d", err, opened, dropped)
+	}
+
+	queue = NewPendingQueue(DefaultPendingLimits)
+	queue.Push([]byte("one"))
+	if dropped = queue.Discard(); dropped != 1 {
+		t.Errorf("Discard dropped %d", dropped)
+	}
+}
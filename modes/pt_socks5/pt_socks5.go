@@ -30,55 +30,153 @@
 package pt_socks5
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"net/url"
+	"os"
+	"strings"
+	"time"
 
 	locketgo "github.com/OperatorFoundation/locket-go"
 	commonLog "github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/socks5"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
-	"github.com/kataras/golog"
-	"golang.org/x/net/proxy"
 )
 
-func ClientSetup(socksAddr string, ptClientProxy *url.URL, names []string, options string, enableLocket bool, stateDir string) (launched bool) {
+// ClientSetup starts the SOCKS listeners for names. With sendTarget, each
+// connection asks the server for the SOCKS CONNECT target, which the server
+// must accept with -allowedTargets.
+func ClientSetup(socksAddr string, socketMode os.FileMode, ptClientProxy *url.URL, names []string, options string, sendTarget bool, enableLocket bool, stateDir string) (launched bool) {
+	if modes.SharedListenAddr(socksAddr, names) {
+		return sharedClientSetup(socksAddr, socketMode, ptClientProxy, names, options, sendTarget, enableLocket, stateDir)
+	}
+
+	listenAddrs, err := modes.ClientListenAddrs(socksAddr, names)
+	if err != nil {
+		modes.ReportListenAddrError(names, modes.ModeSocks5, err)
+		return false
+	}
+
 	// Launch each of the client listeners.
 	for _, name := range names {
-		ln, err := net.Listen("tcp", socksAddr)
+		name := name
+		if err := pt_extras.CheckTransport(name, modes.ModeSocks5, false); err != nil {
+			modes.TransportLog(name, modes.ModeSocks5).WithError(err).Errorf("cannot run the transport")
+			pt_extras.PtCmethodError(name, commonLog.ElideError(err))
+			continue
+		}
+		transportOptions, optionsErr := pt_extras.TransportOptions(options, name)
+		if optionsErr != nil {
+			modes.TransportLog(name, modes.ModeSocks5).WithError(optionsErr).Errorf("invalid transport options")
+			pt_extras.PtCmethodError(name, "invalid transport options: "+commonLog.ElideError(optionsErr))
+			continue
+		}
+		liveOptions := modes.NewLiveOptions(name, transportOptions)
+
+		ln, err := modes.Listen(listenAddrs[name], socketMode)
 		if err != nil {
-			golog.Error(err)
+			modes.TransportLog(name, modes.ModeSocks5).WithError(err).Errorf("failed to listen on %s", listenAddrs[name])
+			pt_extras.PtCmethodError(name, "failed to listen: "+commonLog.ElideError(err))
 			continue
 		}
 
-		go clientAcceptLoop(name, ln, ptClientProxy, options, enableLocket, stateDir)
+		tracked := modes.TrackListener(name, modes.ModeSocks5, ln)
+		go func() {
+			defer tracked.Untrack()
+			clientAcceptLoop(name, tracked, ln, enableLocket, stateDir, func(conn net.Conn) {
+				modes.RecordAccepted(name, modes.ModeSocks5)
+				clientHandler(name, conn, ptClientProxy, liveOptions.Get(), sendTarget, enableLocket, stateDir)
+			})
+		}()
 
-		golog.Infof("%s - registered listener: %s", name, ln.Addr())
+		tracked.Log().Infof("registered listener: %s", ln.Addr())
+		pt_extras.PtCmethod(name, modes.ModeSocks5, ln.Addr())
 
 		launched = true
 	}
-	fmt.Println("CMETHODS DONE")
 
 	return
 }
 
-func clientAcceptLoop(name string, ln net.Listener, proxyURI *url.URL, options string, enableLocket bool, stateDir string) {
+// sharedClientSetup starts one SOCKS listener for all of names. Each
+// connection picks its transport with the "transport" SOCKS argument, and is
+// refused if it does not.
+func sharedClientSetup(socksAddr string, socketMode os.FileMode, ptClientProxy *url.URL, names []string, options string, sendTarget bool, enableLocket bool, stateDir string) (launched bool) {
+	transports := make(map[string]*modes.LiveOptions)
+	for _, name := range names {
+		if err := pt_extras.CheckTransport(name, modes.ModeSocks5, false); err != nil {
+			modes.TransportLog(name, modes.ModeSocks5).WithError(err).Errorf("cannot run the transport")
+			pt_extras.PtCmethodError(name, commonLog.ElideError(err))
+			continue
+		}
+		transportOptions, optionsErr := pt_extras.TransportOptions(options, name)
+		if optionsErr != nil {
+			modes.TransportLog(name, modes.ModeSocks5).WithError(optionsErr).Errorf("invalid transport options")
+			pt_extras.PtCmethodError(name, "invalid transport options: "+commonLog.ElideError(optionsErr))
+			continue
+		}
+		transports[name] = modes.NewLiveOptions(name, transportOptions)
+	}
+	if len(transports) == 0 {
+		return false
+	}
+
+	listenerName := strings.Join(names, ",")
+	ln, err := modes.Listen(socksAddr, socketMode)
+	if err != nil {
+		modes.TransportLog(listenerName, modes.ModeSocks5).WithError(err).Errorf("failed to listen on %s", socksAddr)
+		for name := range transports {
+			pt_extras.PtCmethodError(name, "failed to listen: "+commonLog.ElideError(err))
+		}
+		return false
+	}
+
+	tracked := modes.TrackListener(listenerName, modes.ModeSocks5, ln)
+	go func() {
+		defer tracked.Untrack()
+		clientAcceptLoop(listenerName, tracked, ln, enableLocket, stateDir, func(conn net.Conn) {
+			sharedClientHandler(listenerName, conn, ptClientProxy, transports, sendTarget, enableLocket, stateDir)
+		})
+	}()
+
+	tracked.Log().Infof("registered listener: %s", ln.Addr())
+	for _, name := range names {
+		if _, ok := transports[name]; ok {
+			pt_extras.PtCmethod(name, modes.ModeSocks5, ln.Addr())
+		}
+	}
+
+	return true
+}
+
+// clientAcceptLoop accepts connections on ln and hands each of them to handle
+// in a new session named after the listener.
+func clientAcceptLoop(name string, listener *modes.TrackedListener, ln net.Listener, enableLocket bool, stateDir string, handle func(conn net.Conn)) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
 			if e, ok := err.(net.Error); ok && !e.Temporary() {
-				golog.Errorf("serverAcceptLoop failed")
+				if !errors.Is(err, net.ErrClosed) {
+					listener.Log().WithError(err).Errorf("the listener failed")
+				}
 				_ = ln.Close()
 				return
 			}
+			listener.Log().WithError(err).Warnf("failed to accept a connection")
+			continue
+		}
+		if listener.Paused() {
+			listener.Log().Debugf("closed a new connection, the listener is paused")
+			_ = conn.Close()
 			continue
 		}
 
 		if enableLocket {
 			locketConn, err := locketgo.NewLocketConn(conn, stateDir, "DispatcherClient")
 			if err != nil {
-				golog.Error("client failed to enable Locket")
+				listener.Log().WithError(err).Errorf("failed to enable Locket")
 				conn.Close()
 				return
 			}
@@ -86,118 +184,252 @@ func clientAcceptLoop(name string, ln net.Listener, proxyURI *url.URL, options s
 			conn = locketConn
 		}
 
-		go clientHandler(name, conn, proxyURI, options, enableLocket, stateDir)
+		go func() {
+			untrack := modes.TrackSession(name, modes.ModeSocks5, conn)
+			defer untrack()
+
+			handle(conn)
+		}()
 	}
 }
 
-func clientHandler(name string, conn net.Conn, proxyURI *url.URL, options string, enableLocket bool, logDir string) {
+func clientHandler(name string, conn net.Conn, proxyURI *url.URL, options string, sendTarget bool, enableLocket bool, logDir string) {
 	var needOptions = options == ""
+	sessionLog := modes.SessionLog(name, modes.ModeSocks5, conn)
+	sessionLog.Infof("new connection")
 
 	// Read the client's SOCKS handshake.
 	socksReq, err := socks5.Handshake(conn, needOptions)
 	if err != nil {
-		golog.Errorf("%s - client failed socks handshake: %s", name, err)
+		sessionLog.WithError(err).Errorf("client failed socks handshake")
 		conn.Close()
 		return
 	}
-	addrStr := commonLog.ElideAddr(socksReq.Target)
 
-	var dialer proxy.Dialer = proxy.Direct
+	connectTransport(name, conn, socksReq, proxyURI, options, sendTarget, enableLocket, logDir, sessionLog)
+}
 
-	// Deal with arguments.
+// sharedClientHandler handles a connection to a shared listener, which names
+// its transport in the SOCKS arguments.
+func sharedClientHandler(listenerName string, conn net.Conn, proxyURI *url.URL, transports map[string]*modes.LiveOptions, sendTarget bool, enableLocket bool, logDir string) {
+	sessionLog := modes.SessionLog(listenerName, modes.ModeSocks5, conn)
+	sessionLog.Infof("new connection")
 
-	transport, argsToDialerErr := pt_extras.ArgsToDialer(name, options, dialer, enableLocket, logDir)
-	if argsToDialerErr != nil {
-		golog.Errorf("Error creating a transport with the provided options: %s", options)
-		golog.Errorf("Error: %s", argsToDialerErr)
+	socksReq, err := socks5.Handshake(conn, true)
+	if err != nil {
+		sessionLog.WithError(err).Errorf("client failed socks handshake")
 		conn.Close()
+		return
+	}
 
+	name, args, err := selectTransport(socksReq.Args, transports)
+	if err != nil {
+		sessionLog.WithError(err).Errorf("could not pick a transport")
+		_ = socksReq.Reply(modes.ErrorToReplyCode(err))
+		conn.Close()
 		return
 	}
-	// Obtain the proxy dialer if any, and create the outgoing TCP connection.
-	if proxyURI != nil {
-		var proxyErr error
-		dialer, proxyErr = proxy.FromURL(proxyURI, proxy.Direct)
-		if proxyErr != nil {
-			// This should basically never happen, since config protocol
-			// verifies this.
-			golog.Errorf("%s(%s) - failed to obtain proxy dialer: %s", name, addrStr, commonLog.ElideError(err))
-			_ = socksReq.Reply(socks5.ReplyGeneralFailure)
+	socksReq.Args = args
+
+	// The session moves to the transport it picked, so it is counted and
+	// listed against that transport.
+	modes.RetagSession(conn, name)
+	modes.RecordAccepted(name, modes.ModeSocks5)
+	sessionLog = modes.SessionLog(name, modes.ModeSocks5, conn)
+	sessionLog.Infof("picked the %s transport", name)
+
+	connectTransport(name, conn, socksReq, proxyURI, transports[name].Get(), sendTarget, enableLocket, logDir, sessionLog)
+}
+
+// errNoTransport is returned for a connection to a shared listener that does
+// not name its transport.
+var errNoTransport = fmt.Errorf("%w: no transport argument", pt_extras.ErrMissingOptions)
+
+// selectTransport returns the transport named by the "transport" SOCKS
+// argument, and the other arguments.
+func selectTransport(args map[string]interface{}, transports map[string]*modes.LiveOptions) (string, map[string]interface{}, error) {
+	requested, ok := args["transport"].(string)
+	if !ok {
+		return "", nil, errNoTransport
+	}
+
+	for name := range transports {
+		if !strings.EqualFold(name, requested) {
+			continue
+		}
+
+		remaining := make(map[string]interface{}, len(args))
+		for key, value := range args {
+			if key != "transport" {
+				remaining[key] = value
+			}
+		}
+
+		return name, remaining, nil
+	}
+
+	return "", nil, fmt.Errorf("%w: %s", pt_extras.ErrUnknownTransport, requested)
+}
+
+// connectTransport connects over the transport called name, asking the server
+// for the target the client wants if sendTarget is set, and relays the
+// connection.
+func connectTransport(name string, conn net.Conn, socksReq *socks5.Request, proxyURI *url.URL, options string, sendTarget bool, enableLocket bool, logDir string, sessionLog *commonLog.Logger) {
+	sessionLog = sessionLog.With(commonLog.FieldTarget, commonLog.ElideAddr(socksReq.Target))
+
+	// Obtain the proxy dialer if any, so the transport's outgoing TCP
+	// connection goes through it.
+	dialer, proxyErr := pt_extras.ProxyDialer(proxyURI)
+	if proxyErr != nil {
+		// This should basically never happen, since config protocol
+		// verifies this.
+		sessionLog.WithError(proxyErr).Errorf("failed to obtain proxy dialer")
+		_ = socksReq.Reply(socks5.ReplyGeneralFailure)
+		conn.Close()
+		return
+	}
+
+	// Deal with arguments. Without global options, the transport is configured
+	// by the PT 2.x arguments the client sent in the SOCKS authentication block.
+	if options == "" {
+		var argsErr error
+		options, argsErr = pt_extras.ArgsFromSocks(socksReq.Args)
+		if argsErr != nil {
+			sessionLog.WithError(argsErr).Errorf("invalid per-connection arguments")
+			_ = socksReq.Reply(modes.ErrorToReplyCode(argsErr))
 			conn.Close()
+
 			return
 		}
 	}
 
+	started := time.Now()
+	transport, argsToDialerErr := pt_extras.ArgsToDialer(name, options, dialer, enableLocket, logDir)
+	if argsToDialerErr != nil {
+		modes.RecordDial(name, modes.ModeSocks5, started, argsToDialerErr)
+		sessionLog.WithError(argsToDialerErr).Errorf("could not create a transport with the provided options")
+		_ = socksReq.Reply(modes.ErrorToReplyCode(argsToDialerErr))
+		conn.Close()
+
+		return
+	}
 	remote, err2 := transport.Dial()
+	modes.RecordDial(name, modes.ModeSocks5, started, err2)
 	if err2 != nil {
-		golog.Errorf("%s(%s) - outgoing connection failed: %s", name, addrStr, commonLog.ElideError(err2))
-		_ = socksReq.Reply(socks5.ErrorToReplyCode(err2))
+		sessionLog.WithError(err2).Errorf("outgoing connection failed")
+		_ = socksReq.Reply(modes.ErrorToReplyCode(err2))
 		conn.Close()
 		return
 	}
-	err = socksReq.Reply(socks5.ReplySucceeded)
+
+	// Ask the server to connect to the requested target. Without
+	// sendTarget, the server decides where the connection goes.
+	if sendTarget {
+		code, targetErr := requestTarget(remote, socksReq.Target)
+		if targetErr != nil {
+			sessionLog.WithError(targetErr).Errorf("target request failed, check that the server is started with -allowedTargets")
+			_ = socksReq.Reply(socks5.ReplyGeneralFailure)
+			remote.Close()
+			conn.Close()
+			return
+		}
+		if code != socks5.ReplySucceeded {
+			sessionLog.Errorf("server could not connect to target: %s", code)
+			_ = socksReq.Reply(code)
+			remote.Close()
+			conn.Close()
+			return
+		}
+	}
+
+	err := socksReq.Reply(socks5.ReplySucceeded)
 	if err != nil {
-		golog.Errorf("%s(%s) - SOCKS reply failed: %s", name, addrStr, commonLog.ElideError(err))
+		sessionLog.WithError(err).Errorf("SOCKS reply failed")
 		conn.Close()
 		return
 	}
 
 	if err = modes.CopyLoop(conn, remote); err != nil {
-		golog.Warnf("%s(%s) - closed connection: %s", name, addrStr, commonLog.ElideError(err))
+		sessionLog.WithError(err).Warnf("closed connection")
 	} else {
-		golog.Infof("%s(%s) - closed connection", name, addrStr)
+		sessionLog.Infof("closed connection")
 	}
 }
 
-func ServerSetup(ptServerInfo pt_extras.ServerInfo, stateDir string, options string, enableLocket bool) (launched bool) {
+func ServerSetup(ptServerInfo pt_extras.ServerInfo, stateDir string, enableLocket bool) (launched bool) {
 	for _, bindaddr := range ptServerInfo.Bindaddrs {
-		name := bindaddr.MethodName
-
-		// Deal with arguments.
-		listen, parseError := pt_extras.ArgsToListener(name, stateDir, options, enableLocket, stateDir)
-		if parseError != nil {
-			return false
+		// A listener that cannot start is reported, and the others still start.
+		if err := modes.ServeBindaddr(bindaddr, &ptServerInfo, modes.ModeSocks5, serverHandler, stateDir, enableLocket); err != nil {
+			continue
 		}
 
-		go func() {
-			for {
-				transportLn, LnError := listen()
-				if LnError != nil {
-					continue
-				}
-				golog.Infof("%s - registered listener: %s", name, commonLog.ElideAddr(bindaddr.Addr.String()))
-				modes.ServerAcceptLoop(name, transportLn, &ptServerInfo, serverHandler, enableLocket, stateDir)
-				transportLnErr := transportLn.Close()
-				if transportLnErr != nil {
-					golog.Errorf("Listener close error: %s", transportLnErr.Error())
-				}
-			}
-		}()
-
 		launched = true
 	}
-	fmt.Println("SMETHODS DONE")
 
 	return
 }
 
 func serverHandler(name string, remote net.Conn, info *pt_extras.ServerInfo) {
+	sessionLog := modes.SessionLog(name, modes.ModeSocks5, remote)
+	sessionLog.Infof("new connection")
+
+	// Only a server with an allowlist reads a target from its clients, which
+	// must be started with -sendTarget. Others connect to the orport.
+	if len(info.AllowedTargets) == 0 {
+		started := time.Now()
+		orConn, err := pt_extras.DialOr(info, remote.RemoteAddr().String(), name)
+		modes.RecordDial(name, modes.ModeSocks5, started, err)
+		if err != nil {
+			sessionLog.WithError(err).Errorf("failed to connect to ORPort")
+			remote.Close()
+			return
+		}
+
+		if err = modes.CopyLoop(orConn, remote); err != nil {
+			sessionLog.WithError(err).Warnf("closed connection")
+		} else {
+			sessionLog.Infof("closed connection")
+		}
+		return
+	}
 
-	addrStr := commonLog.ElideAddr(remote.RemoteAddr().String())
-	golog.Infof("%s(%s) - new connection", name, addrStr)
+	// Read the target requested by the client.
+	_ = remote.SetDeadline(time.Now().Add(targetTimeout))
+	target, err := readTargetRequest(remote)
+	if err != nil {
+		sessionLog.WithError(err).Errorf("failed to read target request")
+		remote.Close()
+
+		return
+	}
+	sessionLog = sessionLog.With(commonLog.FieldTarget, commonLog.ElideAddr(target))
 
-	// Connect to the orport.
-	orConn, err := pt_extras.DialOr(info, remote.RemoteAddr().String(), name)
+	// Connect to the target if the allowlist allows it.
+	started := time.Now()
+	orConn, err := dialTarget(info, target)
 	if err != nil {
-		golog.Errorf("%s(%s) - failed to connect to ORPort: %s", name, addrStr, commonLog.ElideError(err))
+		sessionLog.WithError(err).Errorf("failed to connect to the target")
+		modes.RecordDialReply(name, modes.ModeSocks5, started, targetErrorToReplyCode(err))
+		_ = writeTargetReply(remote, targetErrorToReplyCode(err))
+		remote.Close()
+
+		return
+	}
+
+	modes.RecordDialReply(name, modes.ModeSocks5, started, socks5.ReplySucceeded)
+
+	if err = writeTargetReply(remote, socks5.ReplySucceeded); err != nil {
+		sessionLog.WithError(err).Errorf("failed to send target reply")
+		orConn.Close()
 		remote.Close()
 
 		return
 	}
+	_ = remote.SetDeadline(time.Time{})
 
 	if err = modes.CopyLoop(orConn, remote); err != nil {
-		golog.Warnf("%s(%s) - closed connection: %s", name, addrStr, commonLog.ElideError(err))
+		sessionLog.WithError(err).Warnf("closed connection")
 	} else {
-		golog.Infof("%s(%s) - closed connection", name, addrStr)
+		sessionLog.Infof("closed connection")
 	}
 }
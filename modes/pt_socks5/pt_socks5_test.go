@@ -0,0 +1,32 @@
+package pt_socks5
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
+)
+
+func TestSelectTransport(t *testing.T) {
+	transports := map[string]*modes.LiveOptions{
+		"shadow":    modes.NewLiveOptions("shadow", ""),
+		"replicant": modes.NewLiveOptions("replicant", ""),
+	}
+
+	name, args, err := selectTransport(map[string]interface{}{"transport": "Shadow", "cipherName": "darkstar"}, transports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "shadow" || !reflect.DeepEqual(args, map[string]interface{}{"cipherName": "darkstar"}) {
+		t.Errorf("unexpected transport %s with args %v", name, args)
+	}
+
+	if _, _, err = selectTransport(map[string]interface{}{"cipherName": "darkstar"}, transports); !errors.Is(err, pt_extras.ErrMissingOptions) {
+		t.Errorf("expected ErrMissingOptions without a transport, got %v", err)
+	}
+	if _, _, err = selectTransport(map[string]interface{}{"transport": "starbridge"}, transports); !errors.Is(err, pt_extras.ErrUnknownTransport) {
+		t.Errorf("expected ErrUnknownTransport for a transport that is not configured, got %v", err)
+	}
+}
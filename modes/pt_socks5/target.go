@@ -0,0 +1,176 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package pt_socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/socks5"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
+)
+
+// With -sendTarget on the client and -allowedTargets on the server, the SOCKS
+// CONNECT target is carried to the server inside the transport connection,
+// ahead of the application data. Both ends must enable it, since neither can
+// tell whether the other does.
+//
+// The client sends the target request:
+//
+//	uint16_t len (big endian)
+//	uint8_t  target[len] ("host:port")
+//
+// The server answers with the outcome of connecting to the target:
+//
+//	uint8_t  rep (a SOCKS 5 reply code)
+const (
+	maxTargetLength = 255 + len(":65535")
+	targetTimeout   = 30 * time.Second
+)
+
+var errTargetNotAllowed = errors.New("target is not in the allowlist")
+
+func writeTargetRequest(conn net.Conn, target string) error {
+	if len(target) == 0 || len(target) > maxTargetLength {
+		return fmt.Errorf("invalid target length %d", len(target))
+	}
+
+	request := make([]byte, 2+len(target))
+	binary.BigEndian.PutUint16(request, uint16(len(target)))
+	copy(request[2:], target)
+
+	_, err := conn.Write(request)
+	return err
+}
+
+func readTargetRequest(conn net.Conn) (string, error) {
+	var lengthBuf [2]byte
+	if _, err := io.ReadFull(conn, lengthBuf[:]); err != nil {
+		return "", err
+	}
+
+	length := int(binary.BigEndian.Uint16(lengthBuf[:]))
+	if length == 0 || length > maxTargetLength {
+		return "", fmt.Errorf("invalid target length %d", length)
+	}
+
+	target := make([]byte, length)
+	if _, err := io.ReadFull(conn, target); err != nil {
+		return "", err
+	}
+
+	return string(target), nil
+}
+
+func writeTargetReply(conn net.Conn, code socks5.ReplyCode) error {
+	_, err := conn.Write([]byte{byte(code)})
+	return err
+}
+
+func readTargetReply(conn net.Conn) (socks5.ReplyCode, error) {
+	var reply [1]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return socks5.ReplyGeneralFailure, err
+	}
+
+	return socks5.ReplyCode(reply[0]), nil
+}
+
+// requestTarget asks the server to connect to target and waits for its reply.
+func requestTarget(conn net.Conn, target string) (socks5.ReplyCode, error) {
+	if err := conn.SetDeadline(time.Now().Add(targetTimeout)); err != nil {
+		return socks5.ReplyGeneralFailure, err
+	}
+
+	if err := writeTargetRequest(conn, target); err != nil {
+		return socks5.ReplyGeneralFailure, err
+	}
+
+	code, err := readTargetReply(conn)
+	if err != nil {
+		return code, err
+	}
+
+	return code, conn.SetDeadline(time.Time{})
+}
+
+// dialTarget connects to the requested target if the server's allowlist
+// allows it.
+func dialTarget(info *pt_extras.ServerInfo, target string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return nil, fmt.Errorf("invalid target port %q", portStr)
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		ips, err = net.LookupIP(host)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !info.AllowedTargets.Allows(host, int(port), ips) {
+		return nil, errTargetNotAllowed
+	}
+
+	// Dial the addresses that were checked rather than the name, so that a
+	// second lookup cannot return something different.
+	var dialErr error
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, dialErr = net.DialTimeout("tcp", net.JoinHostPort(ip.String(), portStr), targetTimeout)
+		if dialErr == nil {
+			return conn, nil
+		}
+	}
+
+	return nil, dialErr
+}
+
+func targetErrorToReplyCode(err error) socks5.ReplyCode {
+	if errors.Is(err, errTargetNotAllowed) {
+		return socks5.ReplyConnectionNotAllowed
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return socks5.ReplyHostUnreachable
+	}
+
+	return modes.ErrorToReplyCode(err)
+}
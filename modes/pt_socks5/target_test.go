@@ -0,0 +1,64 @@
+package pt_socks5
+
+import (
+	"net"
+	"testing"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/socks5"
+)
+
+func TestTargetRequestRoundTrip(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		target, err := readTargetRequest(server)
+		if err != nil || target != "[2001:db8::1]:443" {
+			_ = writeTargetReply(server, socks5.ReplyGeneralFailure)
+			return
+		}
+		_ = writeTargetReply(server, socks5.ReplyConnectionNotAllowed)
+	}()
+
+	code, err := requestTarget(client, "[2001:db8::1]:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != socks5.ReplyConnectionNotAllowed {
+		t.Errorf("unexpected reply code %d", code)
+	}
+}
+
+func TestDialTargetAllowlist(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, acceptErr := ln.Accept()
+		if acceptErr == nil {
+			conn.Close()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	allowlist, err := pt_extras.ParseTargetAllowlist("127.0.0.0/8:" + port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &pt_extras.ServerInfo{AllowedTargets: allowlist}
+
+	conn, err := dialTarget(info, ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	_, err = dialTarget(info, "127.0.0.1:1")
+	if targetErrorToReplyCode(err) != socks5.ReplyConnectionNotAllowed {
+		t.Errorf("expected a disallowed target, got %v", err)
+	}
+}
@@ -0,0 +1,375 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	commonLog "github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
+	"github.com/kataras/golog"
+	"golang.org/x/net/proxy"
+)
+
+// Transport options can be replaced while the dispatcher runs. Listeners read
+// their options for every new connection, so a reload only affects sessions
+// that start after it. Sessions that are already open keep the transport they
+// were started with.
+var reloadables = struct {
+	sync.Mutex
+	items []reloadable
+}{}
+
+// reloadable is a listener whose options can be replaced. prepare checks the
+// new options and returns a function that switches to them, or nil if there
+// is nothing to change.
+type reloadable interface {
+	transport() string
+	prepare(options string) (apply func(), err error)
+}
+
+func trackReloadable(item reloadable) {
+	reloadables.Lock()
+	reloadables.items = append(reloadables.items, item)
+	reloadables.Unlock()
+}
+
+// ReloadOptions replaces the options of every listener. options uses the same
+// format as -options, either one transport's options or an object keyed by
+// transport name. The new options are only used if they are valid for every
+// listener; otherwise nothing changes and the errors are returned.
+func ReloadOptions(options string) error {
+	reloadables.Lock()
+	defer reloadables.Unlock()
+
+	var applies []func()
+	var applied []string
+	var failures []string
+	for _, item := range reloadables.items {
+		apply, err := item.prepare(options)
+		if err != nil {
+			failures = append(failures, err.Error())
+			reportStatus(item.transport(), StatusReloadFailed, "ERROR", err.Error())
+			continue
+		}
+		if apply != nil {
+			applies = append(applies, apply)
+			applied = append(applied, item.transport())
+		}
+	}
+
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+
+	for i, apply := range applies {
+		apply()
+		reportStatus(applied[i], StatusReloaded)
+	}
+	golog.Infof("reloaded transport options for %d listeners", len(applies))
+
+	return nil
+}
+
+// LiveOptions holds the options a client listener uses for new connections.
+type LiveOptions struct {
+	name    string
+	mutex   sync.RWMutex
+	options string
+}
+
+// NewLiveOptions returns the options for a client listener of the named
+// transport, and registers them to be replaced by ReloadOptions. A listener
+// started without options takes them from each SOCKS request instead, and is
+// left alone by reloads.
+func NewLiveOptions(name string, options string) *LiveOptions {
+	live := &LiveOptions{name: name, options: options}
+	if options != "" {
+		trackReloadable(live)
+	}
+
+	return live
+}
+
+// Get returns the current options.
+func (live *LiveOptions) Get() string {
+	live.mutex.RLock()
+	defer live.mutex.RUnlock()
+
+	return live.options
+}
+
+func (live *LiveOptions) transport() string {
+	return live.name
+}
+
+func (live *LiveOptions) prepare(options string) (func(), error) {
+	transportOptions, err := pt_extras.TransportOptions(options, live.name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", live.name, err)
+	}
+	if transportOptions == live.Get() {
+		return nil, nil
+	}
+
+	// Parsing the options is enough to check them, nothing is dialed here.
+	if _, err = pt_extras.ArgsToDialer(live.name, transportOptions, proxy.Direct, false, ""); err != nil {
+		return nil, fmt.Errorf("%s: %w", live.name, err)
+	}
+
+	return func() {
+		live.mutex.Lock()
+		live.options = transportOptions
+		live.mutex.Unlock()
+	}, nil
+}
+
+// serverListener runs the transport listener for one bindaddr. When its
+// options are reloaded, the current transport listener is closed and a new
+// one is opened with the new options. If that fails, the previous options are
+// put back.
+type serverListener struct {
+	name         string
+	mode         string
+	bindaddr     net.Addr
+	stateDir     string
+	enableLocket bool
+
+	mutex    sync.Mutex
+	options  string
+	listen   func() (net.Listener, error)
+	previous *serverOptions
+	current  net.Listener
+	closed   bool
+}
+
+// errListenerClosed is returned by open once the listener has been closed.
+var errListenerClosed = errors.New("listener closed")
+
+type serverOptions struct {
+	options string
+	listen  func() (net.Listener, error)
+}
+
+// ServeBindaddr starts a transport listener for bindaddr and hands each
+// accepted connection to serverHandler. The listener is announced to the
+// parent process on an SMETHOD line with the address it is bound to. It
+// returns an error if the bindaddr options are not valid for its transport, or
+// the listener could not be opened.
+func ServeBindaddr(bindaddr pt_extras.Bindaddr, info *pt_extras.ServerInfo, mode string, serverHandler ServerHandler, stateDir string, enableLocket bool) error {
+	name := bindaddr.MethodName
+	if err := pt_extras.CheckTransport(name, mode, true); err != nil {
+		TransportLog(name, mode).WithError(err).Errorf("cannot run the transport")
+		pt_extras.PtSmethodError(name, commonLog.ElideError(err))
+		return err
+	}
+
+	listen, err := pt_extras.ArgsToListener(name, stateDir, bindaddr.Options, enableLocket, stateDir)
+	if err != nil {
+		TransportLog(name, mode).WithError(err).Errorf("could not parse the transport options")
+		pt_extras.PtSmethodError(name, "invalid transport options: "+commonLog.ElideError(err))
+		return err
+	}
+
+	listener := &serverListener{
+		name:         name,
+		mode:         mode,
+		bindaddr:     bindaddr.Addr,
+		stateDir:     stateDir,
+		enableLocket: enableLocket,
+		options:      bindaddr.Options,
+		listen:       listen,
+	}
+	transportLn, err := listener.open()
+	if err != nil {
+		TransportLog(name, mode).WithError(err).Errorf("could not listen")
+		pt_extras.PtSmethodError(name, "failed to listen: "+commonLog.ElideError(err))
+		return err
+	}
+
+	clientArgs, err := pt_extras.ArgsToClientArgs(name, bindaddr.Options, stateDir)
+	if err != nil {
+		TransportLog(name, mode).WithError(err).Warnf("could not work out the client options to announce")
+	}
+	pt_extras.PtSmethod(name, transportLn.Addr(), clientArgs)
+
+	// The listener is tracked once rather than for each transport listener,
+	// so it keeps its ID and paused state across reloads.
+	tracked := TrackListener(name, mode, listener)
+	trackReloadable(listener)
+	go listener.serve(tracked, transportLn, info, serverHandler)
+
+	return nil
+}
+
+// serve accepts connections on transportLn, and on a new transport listener
+// each time the options are reloaded, until the listener is closed.
+func (listener *serverListener) serve(tracked *TrackedListener, transportLn net.Listener, info *pt_extras.ServerInfo, serverHandler ServerHandler) {
+	defer tracked.Untrack()
+
+	for {
+		if transportLn == nil {
+			var err error
+			transportLn, err = listener.open()
+			if err == errListenerClosed {
+				return
+			}
+			if err != nil {
+				if listener.rollBack() {
+					tracked.Log().WithError(err).Errorf("could not listen with the reloaded options, going back to the previous ones")
+					reportStatus(listener.name, StatusReloadFailed, "ERROR", commonLog.ElideError(err))
+					continue
+				}
+				tracked.Log().WithError(err).Errorf("could not listen")
+				return
+			}
+		}
+
+		tracked.Log().Infof("registered listener: %s", commonLog.ElideAddr(transportLn.Addr().String()))
+
+		ServerAcceptLoop(tracked, transportLn, info, serverHandler, listener.enableLocket, listener.stateDir)
+
+		listener.mutex.Lock()
+		listener.current = nil
+		listener.mutex.Unlock()
+
+		_ = transportLn.Close()
+		transportLn = nil
+	}
+}
+
+// Addr returns the address the current transport listener is bound to, or
+// the bind address when there is none.
+func (listener *serverListener) Addr() net.Addr {
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+
+	if listener.current != nil {
+		return listener.current.Addr()
+	}
+
+	return listener.bindaddr
+}
+
+// Close closes the current transport listener, and stops serve from
+// listening again.
+func (listener *serverListener) Close() error {
+	listener.mutex.Lock()
+	listener.closed = true
+	current := listener.current
+	listener.mutex.Unlock()
+
+	if current != nil {
+		return current.Close()
+	}
+
+	return nil
+}
+
+// open starts a transport listener with the current options.
+func (listener *serverListener) open() (net.Listener, error) {
+	listener.mutex.Lock()
+	if listener.closed {
+		listener.mutex.Unlock()
+		return nil, errListenerClosed
+	}
+	listen := listener.listen
+	listener.mutex.Unlock()
+
+	transportLn, err := listen()
+	if err != nil {
+		return nil, err
+	}
+
+	listener.mutex.Lock()
+	if listener.closed {
+		listener.mutex.Unlock()
+		_ = transportLn.Close()
+		return nil, errListenerClosed
+	}
+	listener.current = transportLn
+	listener.previous = nil
+	listener.mutex.Unlock()
+
+	return transportLn, nil
+}
+
+// rollBack puts back the options from before the last reload, if there are
+// any.
+func (listener *serverListener) rollBack() bool {
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+
+	if listener.previous == nil {
+		return false
+	}
+	listener.options = listener.previous.options
+	listener.listen = listener.previous.listen
+	listener.previous = nil
+
+	return true
+}
+
+func (listener *serverListener) transport() string {
+	return listener.name
+}
+
+func (listener *serverListener) prepare(options string) (func(), error) {
+	transportOptions, err := pt_extras.TransportOptions(options, listener.name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", listener.name, err)
+	}
+
+	listener.mutex.Lock()
+	unchanged := transportOptions == listener.options
+	listener.mutex.Unlock()
+	if unchanged {
+		return nil, nil
+	}
+
+	listen, err := pt_extras.ArgsToListener(listener.name, listener.stateDir, transportOptions, listener.enableLocket, listener.stateDir)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", listener.name, err)
+	}
+
+	return func() {
+		listener.mutex.Lock()
+		listener.previous = &serverOptions{listener.options, listener.listen}
+		listener.options = transportOptions
+		listener.listen = listen
+		current := listener.current
+		listener.mutex.Unlock()
+
+		// Closing the transport listener ends its accept loop, and serve
+		// listens again with the new options.
+		if current != nil {
+			_ = current.Close()
+		}
+	}, nil
+}
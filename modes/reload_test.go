@@ -0,0 +1,106 @@
+package modes
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/transports"
+)
+
+func resetReloadables(t *testing.T) {
+	t.Cleanup(func() {
+		reloadables.Lock()
+		reloadables.items = nil
+		reloadables.Unlock()
+	})
+}
+
+func TestReloadClientOptions(t *testing.T) {
+	if _, ok := transports.Lookup("shadow"); !ok {
+		t.Skip("built without shadow")
+	}
+	resetReloadables(t)
+
+	first := `{"serverAddress":"192.0.2.1:1234","serverPublicKey":"AAAA","cipherName":"darkstar"}`
+	second := `{"serverAddress":"192.0.2.2:1234","serverPublicKey":"AAAA","cipherName":"darkstar"}`
+	live := NewLiveOptions("shadow", first)
+	perConnection := NewLiveOptions("shadow", "")
+
+	if err := ReloadOptions(`{"serverAddress":"192.0.2.2:1234","serverPublicKey":"!"}`); err == nil {
+		t.Error("invalid options were accepted")
+	}
+	if live.Get() != first {
+		t.Errorf("a failed reload changed the options to %s", live.Get())
+	}
+
+	if err := ReloadOptions(second); err != nil {
+		t.Fatal(err)
+	}
+	if live.Get() != second {
+		t.Errorf("unexpected options after reload %s", live.Get())
+	}
+
+	if err := ReloadOptions(`{"Shadow":` + first + `}`); err != nil {
+		t.Fatal(err)
+	}
+	if live.Get() != first {
+		t.Errorf("unexpected options after reload %s", live.Get())
+	}
+
+	if err := ReloadOptions(`{"replicant":` + first + `}`); err == nil {
+		t.Error("options without the listener's transport were accepted")
+	}
+	if perConnection.Get() != "" {
+		t.Errorf("a listener without options was given %s", perConnection.Get())
+	}
+}
+
+func TestServerListenerRollsBack(t *testing.T) {
+	resetRegistry(t)
+
+	listenTCP := func() (net.Listener, error) { return net.Listen("tcp", "127.0.0.1:0") }
+	listener := &serverListener{name: "test", bindaddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, options: "old", listen: listenTCP}
+	go listener.serve(TrackListener("test", "", listener), nil, nil, func(name string, remote net.Conn, info *pt_extras.ServerInfo) { remote.Close() })
+
+	current := waitForListener(t, listener, nil)
+
+	// Switch to options that cannot listen, the way a reload does.
+	listener.mutex.Lock()
+	listener.previous = &serverOptions{listener.options, listener.listen}
+	listener.options = "new"
+	listener.listen = func() (net.Listener, error) { return nil, errors.New("bind failed") }
+	listener.mutex.Unlock()
+	_ = current.Close()
+
+	waitForListener(t, listener, current)
+
+	listener.mutex.Lock()
+	options := listener.options
+	listener.mutex.Unlock()
+	if options != "old" {
+		t.Errorf("the listener kept the failed options %s", options)
+	}
+
+	Shutdown(time.Second)
+}
+
+// waitForListener waits for listener to be listening on something other than
+// previous, and returns the new transport listener.
+func waitForListener(t *testing.T, listener *serverListener, previous net.Listener) net.Listener {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		listener.mutex.Lock()
+		current := listener.current
+		listener.mutex.Unlock()
+		if current != nil && current != previous {
+			return current
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("the listener did not start")
+	return nil
+}
@@ -0,0 +1,226 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"time"
+
+	commonLog "github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+)
+
+// These functions let the control API inspect and manage the listeners and
+// sessions in the registry.
+
+var (
+	ErrNotFound       = errors.New("no listener or session with that ID")
+	ErrCannotPause    = errors.New("only TCP listeners can be paused")
+	ErrAlreadyStopped = errors.New("the dispatcher is shutting down")
+)
+
+// SessionInfo describes an open session. Peer is elided following the
+// logging rules.
+type SessionInfo struct {
+	ID                 uint64    `json:"id"`
+	Transport          string    `json:"transport"`
+	Mode               string    `json:"mode"`
+	Peer               string    `json:"peer"`
+	BytesToTransport   uint64    `json:"bytesToTransport"`
+	BytesFromTransport uint64    `json:"bytesFromTransport"`
+	Started            time.Time `json:"started"`
+	AgeSeconds         float64   `json:"ageSeconds"`
+}
+
+// ListenerInfo describes a listener. Addr is the local address it listens on.
+type ListenerInfo struct {
+	ID        uint64 `json:"id"`
+	Transport string `json:"transport"`
+	Mode      string `json:"mode"`
+	Addr      string `json:"addr"`
+	Paused    bool   `json:"paused"`
+}
+
+// Sessions lists the open sessions, oldest first.
+func Sessions() []SessionInfo {
+	registry.Lock()
+	sessions := make([]*trackedSession, 0, len(registry.sessions))
+	for tracked := range registry.sessions {
+		sessions = append(sessions, tracked)
+	}
+	registry.Unlock()
+
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].id < sessions[j].id })
+
+	now := time.Now()
+	result := make([]SessionInfo, 0, len(sessions))
+	for _, tracked := range sessions {
+		result = append(result, SessionInfo{
+			ID:                 tracked.id,
+			Transport:          tracked.transport(),
+			Mode:               tracked.mode,
+			Peer:               commonLog.ElideAddr(tracked.peer),
+			BytesToTransport:   tracked.toTransport.Load(),
+			BytesFromTransport: tracked.fromTransport.Load(),
+			Started:            tracked.started,
+			AgeSeconds:         now.Sub(tracked.started).Seconds(),
+		})
+	}
+
+	return result
+}
+
+// CloseSession closes the connections of a session, which ends it.
+func CloseSession(id uint64) error {
+	registry.Lock()
+	var found *trackedSession
+	for tracked := range registry.sessions {
+		if tracked.id == id {
+			found = tracked
+			break
+		}
+	}
+	registry.Unlock()
+
+	if found == nil {
+		return ErrNotFound
+	}
+
+	found.log().Infof("closing the session on request")
+	found.close()
+
+	return nil
+}
+
+// Listeners lists the listeners that are open.
+func Listeners() []ListenerInfo {
+	registry.Lock()
+	listeners := make([]*TrackedListener, 0, len(registry.listeners))
+	for tracked := range registry.listeners {
+		listeners = append(listeners, tracked)
+	}
+	registry.Unlock()
+
+	sort.Slice(listeners, func(i, j int) bool { return listeners[i].id < listeners[j].id })
+
+	result := make([]ListenerInfo, 0, len(listeners))
+	for _, tracked := range listeners {
+		result = append(result, ListenerInfo{
+			ID:        tracked.id,
+			Transport: tracked.name,
+			Mode:      tracked.mode,
+			Addr:      tracked.addr,
+			Paused:    tracked.Paused(),
+		})
+	}
+
+	return result
+}
+
+// SetListenerPaused pauses or resumes a listener. A paused listener closes
+// new connections as soon as it accepts them, while sessions that are
+// already open carry on.
+func SetListenerPaused(id uint64, paused bool) error {
+	if Stopping() {
+		return ErrAlreadyStopped
+	}
+
+	registry.Lock()
+	var found *TrackedListener
+	for tracked := range registry.listeners {
+		if tracked.id == id {
+			found = tracked
+			break
+		}
+	}
+	registry.Unlock()
+
+	if found == nil {
+		return ErrNotFound
+	}
+	if _, isPacketConn := found.listener.(net.PacketConn); isPacketConn {
+		return ErrCannotPause
+	}
+
+	found.paused.Store(paused)
+	if paused {
+		found.Log().Infof("paused the listener")
+	} else {
+		found.Log().Infof("resumed the listener")
+	}
+
+	return nil
+}
+
+// SessionLog returns a logger for the session that conn belongs to, which adds
+// the session ID, transport and mode to everything it logs. Handlers use it so
+// that the handshake, dial and copy of a session can be followed in the logs.
+// If conn is not part of a tracked session, only name and mode are added.
+func SessionLog(name string, mode string, conn io.Closer) *commonLog.Logger {
+	if tracked, ok := findSession(conn); ok {
+		return tracked.log()
+	}
+
+	return TransportLog(name, mode)
+}
+
+// TransportLog returns a logger that adds the transport name and mode to
+// everything it logs, for entries that do not belong to a session.
+func TransportLog(name string, mode string) *commonLog.Logger {
+	return commonLog.With(commonLog.Fields{commonLog.FieldTransport: name, commonLog.FieldMode: mode})
+}
+
+// NewFlowLog returns a logger for a new UDP flow from peer. Flows are not
+// tracked as sessions, but are numbered from the same sequence so their IDs
+// do not collide.
+func NewFlowLog(name string, mode string, peer net.Addr) *commonLog.Logger {
+	return commonLog.With(commonLog.Fields{
+		commonLog.FieldSession:   lastID.Add(1),
+		commonLog.FieldTransport: name,
+		commonLog.FieldMode:      mode,
+		commonLog.FieldPeer:      commonLog.ElideAddr(peer.String()),
+	})
+}
+
+func (tracked *trackedSession) log() *commonLog.Logger {
+	return commonLog.With(commonLog.Fields{
+		commonLog.FieldSession:   tracked.id,
+		commonLog.FieldTransport: tracked.transport(),
+		commonLog.FieldMode:      tracked.mode,
+		commonLog.FieldPeer:      commonLog.ElideAddr(tracked.peer),
+	})
+}
+
+// Log returns a logger that adds the listener ID, transport and mode to
+// everything it logs.
+func (tracked *TrackedListener) Log() *commonLog.Logger {
+	return commonLog.With(commonLog.Fields{
+		commonLog.FieldListener:  tracked.id,
+		commonLog.FieldTransport: tracked.name,
+		commonLog.FieldMode:      tracked.mode,
+	})
+}
@@ -0,0 +1,244 @@
+package modes
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
+	"github.com/kataras/golog"
+	"golang.org/x/net/proxy"
+)
+
+func TestPausedListenerClosesConnections(t *testing.T) {
+	resetRegistry(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracked := TrackListener("pause", ModeTransparentTCP, ln)
+	defer tracked.Untrack()
+
+	handled := make(chan struct{}, 2)
+	go ServerAcceptLoop(tracked, ln, nil, func(name string, remote net.Conn, info *pt_extras.ServerInfo) {
+		handled <- struct{}{}
+		remote.Close()
+	}, false, "")
+	defer ln.Close()
+
+	if err = SetListenerPaused(tracked.id, true); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err == nil {
+		t.Error("a paused listener kept a connection open")
+	}
+	conn.Close()
+
+	if err = SetListenerPaused(tracked.id, false); err != nil {
+		t.Fatal(err)
+	}
+	conn, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the resumed listener did not handle the connection")
+	}
+	if len(handled) != 0 {
+		t.Error("the paused listener handled a connection")
+	}
+}
+
+func TestPauseUDPListener(t *testing.T) {
+	resetRegistry(t)
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tracked := TrackListener("pause", ModeTransparentUDP, conn)
+	defer tracked.Untrack()
+
+	if err = SetListenerPaused(tracked.id, true); err != ErrCannotPause {
+		t.Errorf("unexpected error %v pausing a UDP listener", err)
+	}
+	if err = SetListenerPaused(0, true); err != ErrNotFound {
+		t.Errorf("unexpected error %v pausing a missing listener", err)
+	}
+
+	listeners := Listeners()
+	if len(listeners) != 1 || listeners[0].Addr != conn.LocalAddr().String() || listeners[0].Mode != ModeTransparentUDP {
+		t.Errorf("unexpected listeners %+v", listeners)
+	}
+}
+
+func TestSessionLogCarriesSessionID(t *testing.T) {
+	resetRegistry(t)
+
+	var buf bytes.Buffer
+	golog.SetOutput(&buf)
+	defer golog.SetOutput(os.Stderr)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	untrack := TrackSession("shadow", ModeSocks5, server)
+	defer untrack()
+	sessions := Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("expected 1 session, got %d", len(sessions))
+	}
+
+	SessionLog("shadow", ModeSocks5, server).Infof("new connection")
+	SessionLog("shadow", ModeSocks5, client).Infof("not a session")
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", buf.String())
+	}
+
+	var entry struct {
+		Session   *uint64 `json:"session"`
+		Transport string  `json:"transport"`
+		Mode      string  `json:"mode"`
+	}
+	if err := json.Unmarshal(lines[0], &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Session == nil || *entry.Session != sessions[0].ID || entry.Transport != "shadow" || entry.Mode != ModeSocks5 {
+		t.Errorf("unexpected session entry %s", lines[0])
+	}
+
+	entry.Session = nil
+	if err := json.Unmarshal(lines[1], &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Session != nil || entry.Transport != "shadow" {
+		t.Errorf("unexpected entry %s", lines[1])
+	}
+}
+
+func TestRetagSession(t *testing.T) {
+	resetRegistry(t)
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	sharedBefore := activeSessions.Value("a,b", ModeSocks5)
+	pickedBefore := activeSessions.Value("a", ModeSocks5)
+
+	untrack := TrackSession("a,b", ModeSocks5, conn)
+	RetagSession(conn, "a")
+
+	var listed []SessionInfo
+	for _, session := range Sessions() {
+		if session.Transport == "a" || session.Transport == "a,b" {
+			listed = append(listed, session)
+		}
+	}
+	if len(listed) != 1 || listed[0].Transport != "a" {
+		t.Errorf("unexpected sessions %+v", listed)
+	}
+	if shared, picked := activeSessions.Value("a,b", ModeSocks5)-sharedBefore, activeSessions.Value("a", ModeSocks5)-pickedBefore; shared != 0 || picked != 1 {
+		t.Errorf("unexpected active sessions %v for the listener and %v for the transport", shared, picked)
+	}
+
+	untrack()
+	if picked := activeSessions.Value("a", ModeSocks5) - pickedBefore; picked != 0 {
+		t.Errorf("unexpected active sessions %v after the session ended", picked)
+	}
+}
+
+// nextHopListener accepts connections that are passed on to next, as a chain
+// server's are.
+type nextHopListener struct {
+	net.Listener
+	next string
+}
+
+func (ln nextHopListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return nextHopConn{conn, ln.next}, nil
+}
+
+type nextHopConn struct {
+	net.Conn
+	next string
+}
+
+func (conn nextHopConn) DialNext(dialer proxy.Dialer) (net.Conn, error) {
+	return dialer.Dial("tcp", conn.next)
+}
+
+func TestServerAcceptLoopRelaysNextHop(t *testing.T) {
+	resetRegistry(t)
+
+	next, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer next.Close()
+	go func() {
+		conn, err := next.Accept()
+		if err == nil {
+			defer conn.Close()
+			_, _ = io.Copy(conn, conn)
+		}
+	}()
+
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := nextHopListener{tcpLn, next.Addr().String()}
+	defer ln.Close()
+	tracked := TrackListener("chain", ModeTransparentTCP, ln)
+	defer tracked.Untrack()
+
+	dialsBefore := dials.Value("chain", ModeTransparentTCP, "succeeded")
+	go ServerAcceptLoop(tracked, ln, &pt_extras.ServerInfo{}, func(name string, remote net.Conn, info *pt_extras.ServerInfo) {
+		t.Error("the mode handled a connection meant for the next hop")
+		remote.Close()
+	}, false, "")
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	echoed := make([]byte, 5)
+	if _, err = io.ReadFull(conn, echoed); err != nil || string(echoed) != "hello" {
+		t.Fatalf("got %q, %v", echoed, err)
+	}
+
+	sessions := Sessions()
+	if len(sessions) != 1 || sessions[0].Transport != "chain" {
+		t.Errorf("unexpected sessions %+v", sessions)
+	}
+	if count := dials.Value("chain", ModeTransparentTCP, "succeeded") - dialsBefore; count != 1 {
+		t.Errorf("%v dials recorded, expected 1", count)
+	}
+}
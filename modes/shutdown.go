@@ -0,0 +1,293 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+// The registry tracks every listener and proxied session in the process, so
+// that they can be shut down together: listeners are closed first so no new
+// sessions start, then sessions are given time to finish.
+var registry = struct {
+	sync.Mutex
+	listeners map[*TrackedListener]struct{}
+	sessions  map[*trackedSession]struct{}
+	// byConn finds the session a connection belongs to.
+	byConn   map[io.Closer]*trackedSession
+	stopping bool
+	drained  chan struct{}
+}{
+	listeners: make(map[*TrackedListener]struct{}),
+	sessions:  make(map[*trackedSession]struct{}),
+	byConn:    make(map[io.Closer]*trackedSession),
+}
+
+// Listeners and sessions are numbered so the control API can refer to them.
+var lastID atomic.Uint64
+
+// TrackedListener is a listener registered with TrackListener.
+type TrackedListener struct {
+	id       uint64
+	name     string
+	mode     string
+	addr     string
+	listener io.Closer
+	paused   atomic.Bool
+}
+
+type trackedSession struct {
+	id uint64
+	// name is guarded by the registry, since RetagSession can change it.
+	name    string
+	mode    string
+	peer    string
+	started time.Time
+	// conns and closed are guarded by the registry, since CopyLoop attaches
+	// the connections a session opens.
+	conns  []io.Closer
+	closed bool
+
+	// Bytes copied by CopyLoop.
+	toTransport   atomic.Uint64
+	fromTransport atomic.Uint64
+}
+
+// TrackListener registers a listener to be closed on shutdown. If shutdown has
+// already started, the listener is closed right away. Untrack must be called
+// once the listener is closed for another reason.
+func TrackListener(name string, mode string, listener io.Closer) *TrackedListener {
+	tracked := &TrackedListener{id: lastID.Add(1), name: name, mode: mode, listener: listener}
+	switch ln := listener.(type) {
+	case interface{ Addr() net.Addr }:
+		tracked.addr = ln.Addr().String()
+	case interface{ LocalAddr() net.Addr }:
+		tracked.addr = ln.LocalAddr().String()
+	}
+
+	registry.Lock()
+	if registry.stopping {
+		registry.Unlock()
+		_ = listener.Close()
+		return tracked
+	}
+	registry.listeners[tracked] = struct{}{}
+	registry.Unlock()
+	reportStatus(name, StatusListenerUp, "MODE", mode, "ADDRESS", tracked.addr)
+
+	return tracked
+}
+
+// Untrack removes the listener from the registry.
+func (tracked *TrackedListener) Untrack() {
+	registry.Lock()
+	delete(registry.listeners, tracked)
+	registry.Unlock()
+	reportStatus(tracked.name, StatusListenerDown, "MODE", tracked.mode, "ADDRESS", tracked.addr)
+}
+
+// Paused reports whether the listener has been paused. Accept loops close new
+// connections while their listener is paused.
+func (tracked *TrackedListener) Paused() bool {
+	return tracked.paused.Load()
+}
+
+// TrackSession registers the connections of a proxied session. On shutdown,
+// the session is allowed to finish until the grace period ends, and then its
+// connections are closed. The returned function must be called when the
+// session ends.
+func TrackSession(name string, mode string, conns ...io.Closer) (untrack func()) {
+	tracked := &trackedSession{id: lastID.Add(1), name: name, mode: mode, started: time.Now(), conns: conns}
+	if len(conns) > 0 {
+		if conn, ok := conns[0].(net.Conn); ok && conn.RemoteAddr() != nil {
+			tracked.peer = conn.RemoteAddr().String()
+		}
+	}
+
+	registry.Lock()
+	registry.sessions[tracked] = struct{}{}
+	for _, conn := range conns {
+		registry.byConn[conn] = tracked
+	}
+	registry.Unlock()
+	activeSessions.Inc(name, mode)
+
+	return func() {
+		registry.Lock()
+		defer registry.Unlock()
+
+		activeSessions.Dec(tracked.name, mode)
+		delete(registry.sessions, tracked)
+		for _, conn := range tracked.conns {
+			if registry.byConn[conn] == tracked {
+				delete(registry.byConn, conn)
+			}
+		}
+		if registry.drained != nil && len(registry.sessions) == 0 {
+			close(registry.drained)
+			registry.drained = nil
+		}
+	}
+}
+
+// RetagSession moves the session conn belongs to over to the transport called
+// name, for listeners that only learn the transport once the session has
+// started. It does nothing if conn is not tracked.
+func RetagSession(conn io.Closer, name string) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	tracked, ok := registry.byConn[conn]
+	if !ok || tracked.name == name {
+		return
+	}
+
+	activeSessions.Dec(tracked.name, tracked.mode)
+	activeSessions.Inc(name, tracked.mode)
+	tracked.name = name
+}
+
+// transport returns the name of the transport the session belongs to.
+func (tracked *trackedSession) transport() string {
+	registry.Lock()
+	defer registry.Unlock()
+
+	return tracked.name
+}
+
+// attach adds connections the session opened, such as its transport or
+// ORPort connection, so that closing the session closes them too. They are
+// closed right away if the session has already been closed.
+func (tracked *trackedSession) attach(conns ...io.Closer) {
+	registry.Lock()
+	closed := tracked.closed
+	for _, conn := range conns {
+		if registry.byConn[conn] == tracked {
+			continue
+		}
+		tracked.conns = append(tracked.conns, conn)
+		registry.byConn[conn] = tracked
+	}
+	registry.Unlock()
+
+	if closed {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}
+}
+
+// close closes every connection of the session.
+func (tracked *trackedSession) close() {
+	registry.Lock()
+	tracked.closed = true
+	conns := append([]io.Closer(nil), tracked.conns...)
+	registry.Unlock()
+
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+}
+
+// findSession returns the tracked session that any of conns belongs to.
+func findSession(conns ...io.Closer) (*trackedSession, bool) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	for _, conn := range conns {
+		if tracked, ok := registry.byConn[conn]; ok {
+			return tracked, true
+		}
+	}
+
+	return nil, false
+}
+
+// Stopping reports whether shutdown has started. Listener loops check it so
+// they do not listen again after their listener is closed.
+func Stopping() bool {
+	registry.Lock()
+	defer registry.Unlock()
+
+	return registry.stopping
+}
+
+// Shutdown closes every listener, waits up to grace for sessions to finish,
+// and then closes the sessions that are left. It returns the number of
+// sessions that had to be closed.
+func Shutdown(grace time.Duration) int {
+	registry.Lock()
+	if registry.stopping {
+		registry.Unlock()
+		return 0
+	}
+	registry.stopping = true
+
+	listeners := registry.listeners
+	registry.listeners = make(map[*TrackedListener]struct{})
+
+	drained := make(chan struct{})
+	if len(registry.sessions) == 0 {
+		close(drained)
+	} else {
+		registry.drained = drained
+	}
+	golog.Infof("shutting down: closing %d listeners, draining %d sessions", len(listeners), len(registry.sessions))
+	registry.Unlock()
+
+	for tracked := range listeners {
+		if err := tracked.listener.Close(); err != nil {
+			tracked.Log().WithError(err).Warnf("failed to close the listener")
+		}
+	}
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+
+	select {
+	case <-drained:
+		return 0
+	case <-timer.C:
+	}
+
+	registry.Lock()
+	sessions := registry.sessions
+	registry.sessions = make(map[*trackedSession]struct{})
+	registry.drained = nil
+	registry.Unlock()
+
+	for tracked := range sessions {
+		tracked.log().Warnf("closing a session that did not finish during shutdown")
+		tracked.close()
+	}
+
+	return len(sessions)
+}
@@ -0,0 +1,73 @@
+package modes
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func resetRegistry(t *testing.T) {
+	t.Cleanup(func() {
+		registry.Lock()
+		registry.listeners = make(map[*TrackedListener]struct{})
+		registry.sessions = make(map[*trackedSession]struct{})
+		registry.byConn = make(map[io.Closer]*trackedSession)
+		registry.stopping = false
+		registry.drained = nil
+		registry.Unlock()
+	})
+}
+
+func TestShutdownDrainsSessions(t *testing.T) {
+	resetRegistry(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	TrackListener("test", ModeTransparentTCP, ln)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	untrack := TrackSession("test", ModeTransparentTCP, server)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		untrack()
+	}()
+
+	if closed := Shutdown(5 * time.Second); closed != 0 {
+		t.Errorf("Shutdown closed %d sessions that finished on their own", closed)
+	}
+	if !Stopping() {
+		t.Error("Stopping is false after Shutdown")
+	}
+	if _, err = ln.Accept(); err == nil {
+		t.Error("the listener was not closed")
+	}
+
+	// Listeners opened after shutdown are closed right away.
+	late, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	TrackListener("late", ModeTransparentTCP, late)
+	if _, err = late.Accept(); err == nil {
+		t.Error("a listener opened during shutdown was not closed")
+	}
+}
+
+func TestShutdownClosesSessionsAfterGrace(t *testing.T) {
+	resetRegistry(t)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	TrackSession("test", ModeTransparentTCP, server)
+
+	if closed := Shutdown(10 * time.Millisecond); closed != 1 {
+		t.Errorf("Shutdown closed %d sessions, expected 1", closed)
+	}
+	if _, err := client.Write([]byte("x")); err == nil {
+		t.Error("the session connection is still open")
+	}
+}
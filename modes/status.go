@@ -0,0 +1,52 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	commonLog "github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
+)
+
+// Events reported to the parent process on PT IPC STATUS lines, so it can
+// watch the health of each transport.
+const (
+	StatusListenerUp   = "listener-up"
+	StatusListenerDown = "listener-down"
+	StatusDialFailed   = "dial-failed"
+	StatusReloaded     = "reloaded"
+	StatusReloadFailed = "reload-failed"
+)
+
+// reportStatus sends a STATUS line for the named transport. keyValues holds
+// more keys and values to send after the event. Nothing is sent while the IPC
+// log is off, so a dispatcher that is not managed by a parent process keeps
+// its stdout quiet.
+func reportStatus(name string, event string, keyValues ...string) {
+	if commonLog.IPCLevel() == commonLog.LevelNone {
+		return
+	}
+
+	pt_extras.PtStatus(name, append([]string{"EVENT", event}, keyValues...)...)
+}
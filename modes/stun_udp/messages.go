@@ -0,0 +1,194 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package stun_udp
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+
+	common "github.com/willscott/goturn/common"
+)
+
+// STUN messages carry their own length, so they are sent over transport
+// connections as they are. TURN ChannelData messages are also accepted, and
+// are padded to a multiple of 4 bytes on the transport as RFC 5766 requires
+// for stream connections.
+//
+// A STUN message:
+//
+//	uint16_t type (the top two bits are 0)
+//	uint16_t len (big endian, a multiple of 4)
+//	uint32_t magic cookie (0x2112A442)
+//	uint8_t  transaction id[12]
+//	uint8_t  attributes[len]
+//
+// A ChannelData message:
+//
+//	uint16_t channel number (0x4000 - 0x7FFF)
+//	uint16_t len (big endian)
+//	uint8_t  data[len]
+const (
+	stunHeaderLength        = 20
+	channelDataHeaderLength = 4
+)
+
+// Message classes.
+const (
+	classRequest         = 0x0
+	classIndication      = 0x1
+	classSuccessResponse = 0x2
+	classErrorResponse   = 0x3
+)
+
+// Message methods from RFC 5389, RFC 5766 and RFC 6062.
+const (
+	methodBinding           = 0x001
+	methodAllocate          = 0x003
+	methodRefresh           = 0x004
+	methodSend              = 0x006
+	methodData              = 0x007
+	methodCreatePermission  = 0x008
+	methodChannelBind       = 0x009
+	methodConnect           = 0x00a
+	methodConnectionBind    = 0x00b
+	methodConnectionAttempt = 0x00c
+)
+
+var errNotSTUN = errors.New("not a STUN or ChannelData message")
+
+// checkDatagram checks that a datagram received on a UDP socket holds exactly
+// one valid message.
+func checkDatagram(datagram []byte) error {
+	if len(datagram) < channelDataHeaderLength {
+		return errNotSTUN
+	}
+
+	length := int(binary.BigEndian.Uint16(datagram[2:]))
+	if isChannelData(datagram) {
+		// Padding is optional over UDP.
+		if len(datagram) != channelDataHeaderLength+length && len(datagram) != channelDataHeaderLength+padded(length) {
+			return errNotSTUN
+		}
+
+		return nil
+	}
+
+	if len(datagram) != stunHeaderLength+length {
+		return errNotSTUN
+	}
+
+	return checkHeader(datagram)
+}
+
+// checkHeader validates the magic cookie, length and message type of a STUN
+// header.
+func checkHeader(header []byte) error {
+	var decoded common.Header
+	if err := decoded.Decode(header); err != nil {
+		return errNotSTUN
+	}
+
+	if !validMessageType(uint16(decoded.Type)) {
+		return errNotSTUN
+	}
+
+	return nil
+}
+
+func validMessageType(messageType uint16) bool {
+	method := messageType&0x000f | (messageType&0x00e0)>>1 | (messageType&0x3e00)>>2
+	class := (messageType&0x0010)>>4 | (messageType&0x0100)>>7
+
+	switch method {
+	case methodBinding:
+		return true
+	case methodAllocate, methodRefresh, methodCreatePermission, methodChannelBind, methodConnect, methodConnectionBind:
+		return class != classIndication
+	case methodSend, methodData, methodConnectionAttempt:
+		return class == classIndication
+	default:
+		return false
+	}
+}
+
+func isChannelData(message []byte) bool {
+	return message[0]&0xc0 == 0x40
+}
+
+func padded(length int) int {
+	return (length + 3) &^ 3
+}
+
+// writeMessage sends a datagram that passed checkDatagram over a transport
+// connection.
+func writeMessage(conn net.Conn, datagram []byte) error {
+	if isChannelData(datagram) {
+		length := int(binary.BigEndian.Uint16(datagram[2:]))
+		message := make([]byte, channelDataHeaderLength+padded(length))
+		copy(message, datagram)
+		datagram = message
+	}
+
+	_, err := conn.Write(datagram)
+	return err
+}
+
+// readMessage receives one message from a transport connection. ChannelData
+// padding is removed. An invalid message is an error, since the stream can
+// not be resynchronized after it.
+func readMessage(conn net.Conn) ([]byte, error) {
+	header := make([]byte, stunHeaderLength)
+	if _, err := io.ReadFull(conn, header[:channelDataHeaderLength]); err != nil {
+		return nil, err
+	}
+
+	length := int(binary.BigEndian.Uint16(header[2:]))
+	if isChannelData(header) {
+		message := make([]byte, channelDataHeaderLength+padded(length))
+		copy(message, header[:channelDataHeaderLength])
+		if _, err := io.ReadFull(conn, message[channelDataHeaderLength:]); err != nil {
+			return nil, err
+		}
+
+		return message[:channelDataHeaderLength+length], nil
+	}
+
+	if _, err := io.ReadFull(conn, header[channelDataHeaderLength:]); err != nil {
+		return nil, err
+	}
+	if err := checkHeader(header); err != nil {
+		return nil, err
+	}
+
+	message := make([]byte, stunHeaderLength+length)
+	copy(message, header)
+	if _, err := io.ReadFull(conn, message[stunHeaderLength:]); err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
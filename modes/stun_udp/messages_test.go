@@ -0,0 +1,148 @@
+package stun_udp
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/metrics"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
+	"github.com/willscott/goturn"
+)
+
+// droppedNotSTUN returns the datagrams the transport called name dropped for
+// not being STUN, from the dispatcher_datagrams_dropped_total metric.
+func droppedNotSTUN(t *testing.T, name string) float64 {
+	var out bytes.Buffer
+	metrics.WriteTo(&out)
+
+	prefix := fmt.Sprintf(`dispatcher_datagrams_dropped_total{transport=%q,mode=%q,reason=%q} `, name, modes.ModeSTUNUDP, modes.DropNotSTUN)
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.HasPrefix(line, prefix) {
+			value, err := strconv.ParseFloat(strings.TrimPrefix(line, prefix), 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return value
+		}
+	}
+
+	return 0
+}
+
+func bindingRequest(t *testing.T) []byte {
+	request, err := goturn.NewBindingRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := request.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return encoded
+}
+
+func TestCheckDatagram(t *testing.T) {
+	request := bindingRequest(t)
+	if err := checkDatagram(request); err != nil {
+		t.Errorf("binding request rejected: %s", err)
+	}
+
+	badCookie := append([]byte{}, request...)
+	badCookie[4] ^= 0xff
+
+	badType := append([]byte{}, request...)
+	badType[0], badType[1] = 0x00, 0x06 // a Send request, which must be an indication
+
+	truncated := append(append([]byte{}, request[:2]...), 0, 4)
+	truncated = append(truncated, request[4:]...)
+
+	for _, datagram := range [][]byte{[]byte("GET / HTTP/1.1\r\n\r\n"), badCookie, badType, truncated, {0x40}} {
+		if err := checkDatagram(datagram); err != errNotSTUN {
+			t.Errorf("datagram %x was not rejected", datagram)
+		}
+	}
+
+	channelData := []byte{0x40, 0x00, 0x00, 0x03, 'a', 'b', 'c'}
+	if err := checkDatagram(channelData); err != nil {
+		t.Errorf("ChannelData rejected: %s", err)
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	messages := [][]byte{bindingRequest(t), {0x40, 0x01, 0x00, 0x03, 'a', 'b', 'c'}}
+	go func() {
+		for _, message := range messages {
+			_ = writeMessage(client, message)
+		}
+	}()
+
+	for _, expected := range messages {
+		message, err := readMessage(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(message, expected) {
+			t.Errorf("read %x, expected %x", message, expected)
+		}
+	}
+}
+
+func TestServerHandlerRelaysResponses(t *testing.T) {
+	stunServer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stunServer.Close()
+
+	// Answer each request with a binding response, after a datagram that is
+	// not STUN and must not reach the client.
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			numBytes, addr, readErr := stunServer.ReadFromUDP(buf)
+			if readErr != nil {
+				return
+			}
+			response := append([]byte{}, buf[:numBytes]...)
+			response[0], response[1] = 0x01, 0x01
+			_, _ = stunServer.WriteToUDP([]byte("noise"), addr)
+			_, _ = stunServer.WriteToUDP(response, addr)
+		}
+	}()
+
+	serverAddr := stunServer.LocalAddr().(*net.UDPAddr)
+	info := &pt_extras.ServerInfo{OrAddr: &net.TCPAddr{IP: serverAddr.IP, Port: serverAddr.Port}}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go serverHandler("test", server, info)
+
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	request := bindingRequest(t)
+	rejected := droppedNotSTUN(t, "test")
+	if err = writeMessage(client, request); err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := readMessage(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response[0] != 0x01 || response[1] != 0x01 || !bytes.Equal(response[8:20], request[8:20]) {
+		t.Errorf("unexpected response %x", response)
+	}
+	if dropped := droppedNotSTUN(t, "test") - rejected; dropped != 1 {
+		t.Errorf("expected one rejected datagram, counted %v", dropped)
+	}
+}
@@ -30,143 +30,150 @@
 package stun_udp
 
 import (
-	"fmt"
+	"errors"
 	"io"
-	golog "log"
 	"net"
 	"net/url"
+	"time"
 
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
-	common "github.com/willscott/goturn/common"
-
-	"github.com/willscott/goturn"
 
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
 )
 
-func ClientSetup(socksAddr string, ptClientProxy *url.URL, names []string, options string) bool {
-	return modes.ClientSetupUDP(socksAddr, ptClientProxy, names, options, clientHandler)
+func ClientSetup(socksAddr string, ptClientProxy *url.URL, names []string, options string, config modes.UDPConfig) bool {
+	return modes.ClientSetupUDP(socksAddr, ptClientProxy, names, options, config, modes.ModeSTUNUDP, clientHandler)
 }
 
-func clientHandler(name string, options string, conn *net.UDPConn, proxyURI *url.URL) {
-
-	//defers are never called due to infinite loop
-
-	fmt.Println("@@@ handling...")
-
-	tracker := make(modes.ConnTracker)
-
-	fmt.Println("Transport is", name)
+func clientHandler(name string, options *modes.LiveOptions, conn *net.UDPConn, proxyURI *url.URL, config modes.UDPConfig) {
+	flows := modes.NewFlowTable(config.Flows)
+	defer flows.Close()
+	untrack := modes.TrackFlows(flows, name, modes.ModeSTUNUDP)
+	defer untrack()
+	relay := modes.UDPRelay{Mode: modes.ModeSTUNUDP, Limits: config.Pending, WriteFrame: writeMessage, OnConnected: func(remote net.Conn, peer *net.UDPAddr, flowLog *log.Logger) {
+		relayToPeer(name, flowLog, remote, conn, peer)
+	}}
 
-	buf := make([]byte, 1024)
+	buf := make([]byte, modes.MaxDatagramSize)
 
 	// Receive UDP packets and forward them over transport connections forever
 	for {
 		numBytes, addr, err := conn.ReadFromUDP(buf)
-		fmt.Println("Received ", string(buf[0:numBytes]), " from ", addr)
-
 		if err != nil {
-			fmt.Println("Error: ", err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			modes.TransportLog(name, modes.ModeSTUNUDP).WithError(err).Errorf("failed to read from the local socket")
+			continue
 		}
 
-		goodBytes := buf[:numBytes]
+		if checkErr := checkDatagram(buf[:numBytes]); checkErr != nil {
+			modes.RecordDroppedDatagrams(name, modes.ModeSTUNUDP, modes.DropNotSTUN, 1)
+			modes.TransportLog(name, modes.ModeSTUNUDP).With(log.FieldPeer, log.ElideAddr(addr.String())).Debugf("dropped a datagram that is not STUN")
+			continue
+		}
 
-		fmt.Println(tracker)
+		modes.RelayDatagram(flows, addr, buf[:numBytes], name, options.Get(), proxyURI, relay)
+	}
+}
 
-		if state, ok := tracker[addr.String()]; ok {
-			// There is an open transport connection, or a connection attempt is in progress.
+// relayToPeer sends STUN responses coming back through the transport to the
+// local peer that opened the connection.
+func relayToPeer(name string, flowLog *log.Logger, remote net.Conn, conn *net.UDPConn, peer *net.UDPAddr) {
+	defer remote.Close()
 
-			if state.Waiting {
-				// The connection attempt is in progress.
-				// Drop the packet.
-				fmt.Println("recv: waiting")
-			} else {
-				// There is an open transport connection.
-				// Send the packet through the transport.
-				fmt.Println("recv: write")
-				//ignoring failed writes because packets can be dropped
-				_, _ = state.Conn.Write(goodBytes)
+	for {
+		message, err := readMessage(remote)
+		if err != nil {
+			if err == errNotSTUN {
+				modes.RecordDroppedDatagrams(name, modes.ModeSTUNUDP, modes.DropNotSTUN, 1)
 			}
-		} else {
-			// There is not an open transport connection and a connection attempt is not in progress.
-			// Open a transport connection.
-
-			fmt.Println("Opening connection to ")
-
-			modes.OpenConnection(&tracker, addr.String(), name, options, proxyURI, false, "")
+			if err != io.EOF {
+				flowLog.WithError(err).Errorf("failed to read from the transport")
+			}
+			return
+		}
 
-			// Drop the packet.
-			fmt.Println("recv: Open")
+		if _, err = conn.WriteToUDP(message, peer); err != nil {
+			flowLog.WithError(err).Errorf("failed to write to the local peer")
 		}
 	}
 }
 
-func ServerSetup(ptServerInfo pt_extras.ServerInfo, stateDir string, options string) (launched bool) {
-	return modes.ServerSetupUDP(ptServerInfo, stateDir, options, serverHandler)
+func ServerSetup(ptServerInfo pt_extras.ServerInfo, stateDir string) (launched bool) {
+	return modes.ServerSetupUDP(ptServerInfo, stateDir, modes.ModeSTUNUDP, serverHandler)
 }
 
 func serverHandler(name string, remote net.Conn, info *pt_extras.ServerInfo) {
-	var header *common.Message
-
-	addrStr := log.ElideAddr(remote.RemoteAddr().String())
-	fmt.Println("### handling", name)
-	log.Infof("%s(%s) - new connection", name, addrStr)
+	defer remote.Close()
 
-	serverAddr, err := net.ResolveUDPAddr("udp", info.OrAddr.String())
-	if err != nil {
-		_ = remote.Close()
+	sessionLog := modes.SessionLog(name, modes.ModeSTUNUDP, remote)
+	sessionLog.Infof("new connection")
 
-		golog.Fatal(err)
+	if info.OrAddr == nil {
+		sessionLog.Errorf("no STUN server address is configured")
+		return
 	}
 
-	localAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	// Each transport connection gets its own socket, so responses find their
+	// way back to the client that sent the request.
+	serverAddr := &net.UDPAddr{IP: info.OrAddr.IP, Port: info.OrAddr.Port, Zone: info.OrAddr.Zone}
+	started := time.Now()
+	dest, err := net.DialUDP("udp", nil, serverAddr)
+	modes.RecordDial(name, modes.ModeSTUNUDP, started, err)
 	if err != nil {
-		_ = remote.Close()
-		golog.Fatal(err)
+		sessionLog.WithError(err).Errorf("failed to open the STUN server socket")
+		return
 	}
+	defer dest.Close()
 
-	dest, err := net.DialUDP("udp", localAddr, serverAddr)
-	if err != nil {
-		_ = remote.Close()
-		golog.Fatal(err)
-	}
-
-	fmt.Println("pumping")
-
-	headerBuffer := make([]byte, 20)
+	go relayToClient(name, sessionLog, dest, remote)
 
 	for {
-		fmt.Println("reading...")
-		// Read the incoming connection into the buffer.
-		_, err := io.ReadFull(remote, headerBuffer)
-		if err != nil {
-			fmt.Println("read error")
-			break
+		message, readErr := readMessage(remote)
+		if readErr != nil {
+			if readErr == errNotSTUN {
+				modes.RecordDroppedDatagrams(name, modes.ModeSTUNUDP, modes.DropNotSTUN, 1)
+			}
+			if readErr != io.EOF {
+				sessionLog.WithError(readErr).Errorf("failed to read from the transport")
+			}
+			return
 		}
 
-		header, err = goturn.ParseStun(headerBuffer)
-		if err != nil {
-			fmt.Println("parse error")
-			break
+		if _, writeErr := dest.Write(message); writeErr != nil {
+			sessionLog.WithError(writeErr).Errorf("failed to write to the STUN server")
 		}
+	}
+}
 
-		fmt.Println(header.Length)
-
-		fmt.Println("reading data")
+// relayToClient sends STUN responses from the server back through the
+// transport. It returns when the server socket is closed.
+func relayToClient(name string, sessionLog *log.Logger, dest *net.UDPConn, remote net.Conn) {
+	buf := make([]byte, modes.MaxDatagramSize)
 
-		readBuffer := make([]byte, header.Length)
-		_, err = io.ReadFull(remote, readBuffer)
+	for {
+		numBytes, err := dest.Read(buf)
 		if err != nil {
-			fmt.Println("read error")
-			break
+			if !errors.Is(err, net.ErrClosed) {
+				sessionLog.WithError(err).Errorf("failed to read from the STUN server")
+			}
+			_ = remote.Close()
+			return
 		}
 
-		writeBuffer := append(headerBuffer, readBuffer...)
+		response := buf[:numBytes]
+		if checkErr := checkDatagram(response); checkErr != nil {
+			modes.RecordDroppedDatagrams(name, modes.ModeSTUNUDP, modes.DropNotSTUN, 1)
+			sessionLog.Debugf("dropped a response that is not STUN")
+			continue
+		}
 
-		_, _ = dest.Write(writeBuffer)
+		if err = writeMessage(remote, response); err != nil {
+			sessionLog.WithError(err).Errorf("failed to write to the transport")
+			_ = dest.Close()
+			return
+		}
 	}
-
-	_ = dest.Close()
-	_ = remote.Close()
 }
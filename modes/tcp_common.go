@@ -26,53 +26,85 @@ package modes
 
 import (
 	"errors"
-	"fmt"
 	"io"
 	"net"
 	"net/url"
 	"os"
+	"sync/atomic"
 
 	locketgo "github.com/OperatorFoundation/locket-go"
 	commonLog "github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/metrics"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
-	"github.com/kataras/golog"
 )
 
-func ClientSetupTCP(socksAddr string, ptClientProxy *url.URL, names []string, options string, clientHandler ClientHandlerTCP, enableLocket bool, stateDir string) (launched bool) {
+func ClientSetupTCP(socksAddr string, socketMode os.FileMode, ptClientProxy *url.URL, names []string, options string, mode string, clientHandler ClientHandlerTCP, enableLocket bool, stateDir string) (launched bool) {
+	listenAddrs, err := ClientListenAddrs(socksAddr, names)
+	if err != nil {
+		ReportListenAddrError(names, mode, err)
+		return false
+	}
+
 	// Launch each of the client listeners.
 	for _, name := range names {
-		ln, err := net.Listen("tcp", socksAddr)
+		name := name
+		if err := pt_extras.CheckTransport(name, mode, false); err != nil {
+			TransportLog(name, mode).WithError(err).Errorf("cannot run the transport")
+			pt_extras.PtCmethodError(name, commonLog.ElideError(err))
+			continue
+		}
+		transportOptions, optionsErr := pt_extras.TransportOptions(options, name)
+		if optionsErr != nil {
+			TransportLog(name, mode).WithError(optionsErr).Errorf("invalid transport options")
+			pt_extras.PtCmethodError(name, "invalid transport options: "+commonLog.ElideError(optionsErr))
+			continue
+		}
+		liveOptions := NewLiveOptions(name, transportOptions)
+
+		ln, err := Listen(listenAddrs[name], socketMode)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "failed to listen %s %s", name, err.Error())
-			golog.Errorf("failed to listen %s %s", name, err.Error())
+			TransportLog(name, mode).WithError(err).Errorf("failed to listen on %s", listenAddrs[name])
+			pt_extras.PtCmethodError(name, "failed to listen: "+commonLog.ElideError(err))
 			continue
 		}
 
-		go clientAcceptLoop(name, options, ln, ptClientProxy, clientHandler, enableLocket, stateDir)
-		golog.Infof("%s - registered listener: %s", name, ln.Addr())
+		tracked := TrackListener(name, mode, ln)
+		go func() {
+			defer tracked.Untrack()
+			clientAcceptLoop(tracked, liveOptions, ln, ptClientProxy, clientHandler, enableLocket, stateDir)
+		}()
+		tracked.Log().Infof("registered listener: %s", ln.Addr())
+		pt_extras.PtCmethod(name, mode, ln.Addr())
 		launched = true
 	}
 
 	return
 }
 
-func clientAcceptLoop(name string, options string, ln net.Listener, proxyURI *url.URL, clientHandler ClientHandlerTCP, enableLocket bool, stateDir string) {
+func clientAcceptLoop(listener *TrackedListener, options *LiveOptions, ln net.Listener, proxyURI *url.URL, clientHandler ClientHandlerTCP, enableLocket bool, stateDir string) {
+	name, mode := listener.name, listener.mode
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
 			if e, ok := err.(net.Error); ok && !e.Temporary() {
-				fmt.Fprintf(os.Stderr, "Fatal listener error: %s", err.Error())
-				golog.Errorf("Fatal listener error: %s", err.Error())
+				if !errors.Is(err, net.ErrClosed) {
+					listener.Log().WithError(err).Errorf("the listener failed")
+				}
 				return
 			}
-			golog.Warnf("Failed to accept connection: %s", err.Error())
+			listener.Log().WithError(err).Warnf("failed to accept a connection")
+			continue
+		}
+		if listener.Paused() {
+			listener.Log().Debugf("closed a new connection, the listener is paused")
+			_ = conn.Close()
 			continue
 		}
 
 		if enableLocket {
 			locketConn, err := locketgo.NewLocketConn(conn, stateDir, "DispatcherClient")
 			if err != nil {
-				golog.Error("client failed to enable Locket")
+				listener.Log().WithError(err).Errorf("failed to enable Locket")
 				conn.Close()
 				return
 			}
@@ -80,45 +112,28 @@ func clientAcceptLoop(name string, options string, ln net.Listener, proxyURI *ur
 			conn = locketConn
 		}
 
-		go clientHandler(name, options, conn, proxyURI, enableLocket, stateDir)
+		RecordAccepted(name, mode)
+
+		// Read the options now so that a reload cannot change them partway
+		// through the session.
+		sessionOptions := options.Get()
+		go func() {
+			untrack := TrackSession(name, mode, conn)
+			defer untrack()
+
+			clientHandler(name, sessionOptions, conn, proxyURI, enableLocket, stateDir)
+		}()
 	}
 }
 
-func ServerSetupTCP(ptServerInfo pt_extras.ServerInfo, stateDir string, options string, serverHandler ServerHandler, enableLocket bool) (launched bool) {
+func ServerSetupTCP(ptServerInfo pt_extras.ServerInfo, stateDir string, mode string, serverHandler ServerHandler, enableLocket bool) (launched bool) {
 	// Launch each of the server listeners.
 	for _, bindaddr := range ptServerInfo.Bindaddrs {
-		name := bindaddr.MethodName
-
-		// Deal with arguments.
-		listen, parseError := pt_extras.ArgsToListener(name, stateDir, options, enableLocket, stateDir)
-		if parseError != nil {
-			return false
+		// A listener that cannot start is reported, and the others still start.
+		if err := ServeBindaddr(bindaddr, &ptServerInfo, mode, serverHandler, stateDir, enableLocket); err != nil {
+			continue
 		}
 
-		go func() {
-			for {
-				transportLn, LnError := listen()
-				if LnError != nil {
-					print(LnError)
-					break
-				}
-
-				print(name)
-				print(" listening on ")
-				println(bindaddr.Addr.String())
-
-				golog.Infof("%s - registered listener: %s", name, commonLog.ElideAddr(bindaddr.Addr.String()))
-
-				ServerAcceptLoop(name, transportLn, &ptServerInfo, serverHandler, enableLocket, stateDir)
-
-				transportLnErr := transportLn.Close()
-				if transportLnErr != nil {
-					fmt.Fprintf(os.Stderr, "Listener close error: %s", transportLnErr.Error())
-					golog.Errorf("Listener close error: %s", transportLnErr.Error())
-				}
-			}
-		}()
-
 		launched = true
 	}
 
@@ -127,14 +142,10 @@ func ServerSetupTCP(ptServerInfo pt_extras.ServerInfo, stateDir string, options
 
 func CopyLoop(client net.Conn, server net.Conn) error {
 	if server == nil {
-		println("--> Copy loop has a nil server connection.")
-		fmt.Fprintln(os.Stderr, "--> Copy loop has a nil server connection (b).")
 		return errors.New("copy loop has a nil connection (b)")
 	}
 
 	if client == nil {
-		println("--> Copy loop has a nil client connection.")
-		fmt.Fprintln(os.Stderr, "--> Copy loop has a nil connection (a).")
 		return errors.New("copy loop has a nil connection (a)")
 	}
 
@@ -143,8 +154,23 @@ func CopyLoop(client net.Conn, server net.Conn) error {
 	okToCloseServerChannel := make(chan bool)
 	copyErrorChannel := make(chan error)
 
-	go CopyClientToServer(client, server, okToCloseClientChannel, copyErrorChannel)
-	go CopyServerToClient(client, server, okToCloseServerChannel, copyErrorChannel)
+	// Count the bytes copied against the session the connections belong to.
+	name, mode := "unknown", "unknown"
+	var toTransport, fromTransport *atomic.Uint64
+	sessionLog := TransportLog(name, mode)
+	if session, ok := findSession(client, server); ok {
+		// Closing the session has to close both sides, or the copy from
+		// the side that stays open never ends.
+		session.attach(client, server)
+		name, mode = session.transport(), session.mode
+		toTransport, fromTransport = &session.toTransport, &session.fromTransport
+		sessionLog = session.log()
+	}
+	countedClient := &countingConn{client, copiedBytes, []string{name, mode, directionFromTransport}, fromTransport}
+	countedServer := &countingConn{server, copiedBytes, []string{name, mode, directionToTransport}, toTransport}
+
+	go CopyClientToServer(client, countedServer, okToCloseClientChannel, copyErrorChannel)
+	go CopyServerToClient(countedClient, server, okToCloseServerChannel, copyErrorChannel)
 
 	serverRunning := true
 	clientRunning := true
@@ -157,7 +183,7 @@ func CopyLoop(client net.Conn, server net.Conn) error {
 		case <-okToCloseServerChannel:
 			serverRunning = false
 		case copyError = <-copyErrorChannel:
-			golog.Errorf("Error while copying", copyError)
+			sessionLog.WithError(copyError).Errorf("error while copying")
 		}
 	}
 
@@ -167,12 +193,31 @@ func CopyLoop(client net.Conn, server net.Conn) error {
 	return copyError
 }
 
+// countingConn counts the bytes written to it, in metrics and in the session
+// total if there is one.
+type countingConn struct {
+	net.Conn
+	counter     *metrics.Counter
+	labelValues []string
+	total       *atomic.Uint64
+}
+
+func (conn *countingConn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	if n > 0 {
+		conn.counter.Add(float64(n), conn.labelValues...)
+		if conn.total != nil {
+			conn.total.Add(uint64(n))
+		}
+	}
+
+	return n, err
+}
+
 func CopyClientToServer(client net.Conn, server net.Conn, okToCloseClient chan bool, errorChannel chan error) {
 	_, copyError := io.Copy(server, client)
 	okToCloseClient <- true
 	if copyError != nil {
-		println("!! CopyClientToServer received an error from io.Copy: ")
-		println(copyError)
 		errorChannel <- copyError
 	}
 }
@@ -181,7 +226,6 @@ func CopyServerToClient(client net.Conn, server net.Conn, okToCloseServer chan b
 	_, copyError := io.Copy(client, server)
 	okToCloseServer <- true
 	if copyError != nil {
-		fmt.Printf("\n!! CopyServerToClient received an error: %s", commonLog.ElideError(copyError))
 		errorChannel <- copyError
 	}
 }
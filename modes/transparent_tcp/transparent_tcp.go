@@ -30,101 +30,85 @@
 package transparent_tcp
 
 import (
-	"fmt"
 	"net"
 	"net/url"
+	"os"
+	"time"
 
-	commonLog "github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
-	"github.com/kataras/golog"
-	"golang.org/x/net/proxy"
 )
 
-func ClientSetup(socksAddr string, ptClientProxy *url.URL, names []string, options string, enableLocket bool, stateDir string) (launched bool) {
-	return modes.ClientSetupTCP(socksAddr, ptClientProxy, names, options, clientHandler, enableLocket, stateDir)
+func ClientSetup(socksAddr string, socketMode os.FileMode, ptClientProxy *url.URL, names []string, options string, enableLocket bool, stateDir string) (launched bool) {
+	return modes.ClientSetupTCP(socksAddr, socketMode, ptClientProxy, names, options, modes.ModeTransparentTCP, clientHandler, enableLocket, stateDir)
 }
 
 func clientHandler(name string, options string, conn net.Conn, proxyURI *url.URL, enableLocket bool, logDir string) {
-	var dialer proxy.Dialer
-	dialer = proxy.Direct
-	if proxyURI != nil {
-		var err error
-		dialer, err = proxy.FromURL(proxyURI, proxy.Direct)
-		if err != nil {
-			// This should basically never happen, since config protocol
-			// verifies this.
-			fmt.Println("-> failed to obtain dialer", proxyURI, proxy.Direct)
-			golog.Errorf("(%s) - failed to obtain proxy dialer: %s", commonLog.ElideError(err))
-			conn.Close()
-			return
-		}
+	sessionLog := modes.SessionLog(name, modes.ModeTransparentTCP, conn)
+	sessionLog.Infof("new connection")
+
+	dialer, err := pt_extras.ProxyDialer(proxyURI)
+	if err != nil {
+		// This should basically never happen, since config protocol
+		// verifies this.
+		sessionLog.WithError(err).Errorf("failed to obtain proxy dialer")
+		conn.Close()
+		return
 	}
 
 	// Deal with arguments.
+	started := time.Now()
 	transport, argsToDialerErr := pt_extras.ArgsToDialer(name, options, dialer, enableLocket, logDir)
 	if argsToDialerErr != nil {
-		golog.Errorf("Error creating a transport with the provided options: %v", options)
-		golog.Errorf("Error: %v", argsToDialerErr.Error())
-		println("-> Error creating a transport with the provided options: ", options)
-		println("-> Error: ", argsToDialerErr.Error())
+		modes.RecordDial(name, modes.ModeTransparentTCP, started, argsToDialerErr)
+		sessionLog.WithError(argsToDialerErr).Errorf("could not create a transport with the provided options")
 		conn.Close()
 
 		return
 	}
 
-	if conn == nil {
-		println("--> Application connection is nil")
-		golog.Errorf("%s - closed connection. Application connection is nil", name)
-	}
-
-	fmt.Println("Dialing ")
 	remote, dialErr := transport.Dial()
+	modes.RecordDial(name, modes.ModeTransparentTCP, started, dialErr)
 	if dialErr != nil {
-
-		println("--> Unable to dial transport server: ", dialErr.Error())
-		println("-> Name: ", name)
-		println("-> Options: ", options)
-		golog.Errorf("--> Unable to dial transport server: %v", dialErr.Error())
+		sessionLog.WithError(dialErr).Errorf("unable to dial transport server")
 		conn.Close()
 		return
 	}
 
 	if remote == nil {
-		println("--> Transport server connection is nil.")
-		golog.Errorf("%s - closed connection. Transport server connection is nil", name)
+		sessionLog.Errorf("closed connection, the transport server connection is nil")
 		conn.Close()
+		return
 	}
 
 	if err := modes.CopyLoop(conn, remote); err != nil {
-		golog.Warnf("%s(%s) - closed connection: %s", name, commonLog.ElideError(err))
-		println("%s(%s) - closed connection: %s", name, commonLog.ElideError(err))
+		sessionLog.WithError(err).Warnf("closed connection")
 	} else {
-		golog.Infof("%s(%s) - closed connection", name)
-		println("%s(%s) - closed connection", name)
+		sessionLog.Infof("closed connection")
 	}
 }
 
-func ServerSetup(ptServerInfo pt_extras.ServerInfo, statedir string, options string, enableLocket bool) (launched bool) {
-	return modes.ServerSetupTCP(ptServerInfo, statedir, options, serverHandler, enableLocket)
+func ServerSetup(ptServerInfo pt_extras.ServerInfo, statedir string, enableLocket bool) (launched bool) {
+	return modes.ServerSetupTCP(ptServerInfo, statedir, modes.ModeTransparentTCP, serverHandler, enableLocket)
 }
 
 func serverHandler(name string, remote net.Conn, info *pt_extras.ServerInfo) {
+	sessionLog := modes.SessionLog(name, modes.ModeTransparentTCP, remote)
+	sessionLog.Infof("new connection")
+
 	// Connect to the orport.
+	started := time.Now()
 	orConn, err := pt_extras.DialOr(info, remote.RemoteAddr().String(), name)
+	modes.RecordDial(name, modes.ModeTransparentTCP, started, err)
 	if err != nil {
-		print("failed to connect to ORPort: ")
-		println(commonLog.ElideError(err))
-		golog.Errorf("%s - failed to connect to ORPort: %s", name, commonLog.ElideError(err))
+		sessionLog.WithError(err).Errorf("failed to connect to ORPort")
 		remote.Close()
 		return
 	}
 
 	if err = modes.CopyLoop(orConn, remote); err != nil {
-		print("closed a connection: ")
-		println(commonLog.ElideError(err))
-		golog.Warnf("%s - closed connection: %s", name, commonLog.ElideError(err))
+		sessionLog.WithError(err).Warnf("closed connection")
 	} else {
-		golog.Infof("%s - closed connection", name)
+		sessionLog.Infof("closed connection")
 	}
 }
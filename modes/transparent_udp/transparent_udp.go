@@ -30,144 +30,130 @@
 package transparent_udp
 
 import (
-	"bytes"
-	"encoding/binary"
-	"fmt"
+	"errors"
 	"io"
 	"net"
 	"net/url"
+	"time"
 
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
-	"github.com/kataras/golog"
 )
 
-func ClientSetup(socksAddr string, ptClientProxy *url.URL, names []string, options string) bool {
-	return modes.ClientSetupUDP(socksAddr, ptClientProxy, names, options, clientHandler)
+func ClientSetup(socksAddr string, ptClientProxy *url.URL, names []string, options string, config modes.UDPConfig) bool {
+	return modes.ClientSetupUDP(socksAddr, ptClientProxy, names, options, config, modes.ModeTransparentUDP, clientHandler)
 }
 
-func clientHandler(name string, options string, conn *net.UDPConn, proxyURI *url.URL) {
-	var length16 uint16
+func clientHandler(name string, options *modes.LiveOptions, conn *net.UDPConn, proxyURI *url.URL, config modes.UDPConfig) {
+	flows := modes.NewFlowTable(config.Flows)
+	defer flows.Close()
+	untrack := modes.TrackFlows(flows, name, modes.ModeTransparentUDP)
+	defer untrack()
+	relay := modes.UDPRelay{Mode: modes.ModeTransparentUDP, Limits: config.Pending, WriteFrame: modes.WriteUDPFrame, OnConnected: func(remote net.Conn, peer *net.UDPAddr, flowLog *log.Logger) {
+		relayToPeer(flowLog, remote, conn, peer)
+	}}
 
-	tracker := make(modes.ConnTracker)
-
-	buf := make([]byte, 1024)
+	buf := make([]byte, modes.MaxDatagramSize)
 
 	// Receive UDP packets and forward them over transport connections forever
 	for {
 		numBytes, addr, err := conn.ReadFromUDP(buf)
 		if err != nil {
-			fmt.Println("Error: ", err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			modes.TransportLog(name, modes.ModeTransparentUDP).WithError(err).Errorf("failed to read from the local socket")
+			continue
 		}
 
-		goodBytes := buf[:numBytes]
-
-		fmt.Println(tracker)
-
-		if state, ok := tracker[addr.String()]; ok {
-			// There is an open transport connection, or a connection attempt is in progress.
-
-			if state.Waiting {
-				// The connection attempt is in progress.
-				// Drop the packet.
-			} else {
-				// There is an open transport connection.
-				// Send the packet through the transport.
-				length16 = uint16(numBytes)
-				lengthBuf := new(bytes.Buffer)
-				err = binary.Write(lengthBuf, binary.LittleEndian, length16)
-				if err != nil {
-					fmt.Println("binary.Write failed:", err)
-				} else {
-					println("writing data to server")
-					println(len(lengthBuf.Bytes()))
-					_, writErr := state.Conn.Write(lengthBuf.Bytes())
-					if writErr != nil {
-						continue
-					} else {
-						println("writing data to server")
-						println(len(goodBytes))
-						_, writeBufErr := state.Conn.Write(goodBytes)
-						if writeBufErr != nil {
-							_ = state.Conn.Close()
-							_ = conn.Close()
-						}
-
-					}
-				}
+		modes.RelayDatagram(flows, addr, buf[:numBytes], name, options.Get(), proxyURI, relay)
+	}
+}
+
+// relayToPeer sends datagrams coming back through the transport to the local
+// peer that opened the connection.
+func relayToPeer(flowLog *log.Logger, remote net.Conn, conn *net.UDPConn, peer *net.UDPAddr) {
+	defer remote.Close()
+
+	for {
+		datagram, err := modes.ReadUDPFrame(remote)
+		if err != nil {
+			if err != io.EOF {
+				flowLog.WithError(err).Errorf("failed to read from the transport")
 			}
-		} else {
-			// There is not an open transport connection and a connection attempt is not in progress.
-			// Open a transport connection.
-			modes.OpenConnection(&tracker, addr.String(), name, options, proxyURI, false, "")
-			// Drop the packet.
+			return
+		}
+
+		if _, err = conn.WriteToUDP(datagram, peer); err != nil {
+			flowLog.WithError(err).Errorf("failed to write to the local peer")
 		}
 	}
 }
 
-func ServerSetup(ptServerInfo pt_extras.ServerInfo, stateDir string, options string) (launched bool) {
-	return modes.ServerSetupUDP(ptServerInfo, stateDir, options, serverHandler)
+func ServerSetup(ptServerInfo pt_extras.ServerInfo, stateDir string) (launched bool) {
+	return modes.ServerSetupUDP(ptServerInfo, stateDir, modes.ModeTransparentUDP, serverHandler)
 }
 
 func serverHandler(name string, remote net.Conn, info *pt_extras.ServerInfo) {
-	var length16 uint16
-
-	addrStr := log.ElideAddr(remote.RemoteAddr().String())
-	fmt.Println("### handling", name)
-	golog.Infof("%s(%s) - new connection", name, addrStr)
+	defer remote.Close()
 
-	serverAddr, err := net.ResolveUDPAddr("udp", info.OrAddr.String())
-	if err != nil {
-		golog.Fatal(err)
-	}
+	sessionLog := modes.SessionLog(name, modes.ModeTransparentUDP, remote)
+	sessionLog.Infof("new connection")
 
-	localAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
-	if err != nil {
-		golog.Fatal(err)
+	if info.OrAddr == nil {
+		sessionLog.Errorf("no target address is configured")
+		return
 	}
 
-	dest, err := net.DialUDP("udp", localAddr, serverAddr)
+	// Each transport connection gets its own socket, so replies find their way
+	// back to the client that sent the request.
+	targetAddr := &net.UDPAddr{IP: info.OrAddr.IP, Port: info.OrAddr.Port, Zone: info.OrAddr.Zone}
+	started := time.Now()
+	dest, err := net.DialUDP("udp", nil, targetAddr)
+	modes.RecordDial(name, modes.ModeTransparentUDP, started, err)
 	if err != nil {
-		golog.Fatal(err)
+		sessionLog.WithError(err).Errorf("failed to open the target socket")
+		return
 	}
+	defer dest.Close()
 
-	fmt.Println("pumping")
-
-	lengthBuffer := make([]byte, 2)
+	go relayToClient(sessionLog, dest, remote)
 
 	for {
-		fmt.Println("reading...")
-		// Read the incoming connection into the buffer.
-		readLen, err := io.ReadFull(remote, lengthBuffer)
-		if err != nil {
-			fmt.Println("read error")
-			break
+		datagram, readErr := modes.ReadUDPFrame(remote)
+		if readErr != nil {
+			if readErr != io.EOF {
+				sessionLog.WithError(readErr).Errorf("failed to read from the transport")
+			}
+			return
+		}
+
+		if _, writeErr := dest.Write(datagram); writeErr != nil {
+			sessionLog.WithError(writeErr).Errorf("failed to write to the target")
 		}
+	}
+}
 
-		fmt.Println(readLen)
+// relayToClient frames datagrams coming back from the target and sends them
+// through the transport. It returns when the target socket is closed.
+func relayToClient(sessionLog *log.Logger, dest *net.UDPConn, remote net.Conn) {
+	buf := make([]byte, modes.MaxDatagramSize)
 
-		err = binary.Read(bytes.NewReader(lengthBuffer), binary.LittleEndian, &length16)
+	for {
+		numBytes, err := dest.Read(buf)
 		if err != nil {
-			fmt.Println("deserialization error")
-			_ = dest.Close()
+			if !errors.Is(err, net.ErrClosed) {
+				sessionLog.WithError(err).Errorf("failed to read from the target")
+			}
+			_ = remote.Close()
 			return
 		}
 
-		fmt.Println("reading data")
-		fmt.Println(length16)
-		readBuffer := make([]byte, length16)
-		readLen, err = io.ReadFull(remote, readBuffer)
-		if err != nil {
-			fmt.Println("read error")
-			break
-		}
-		if readLen != int(length16) {
-			println("short read")
-			break
+		if err = modes.WriteUDPFrame(remote, buf[:numBytes]); err != nil {
+			sessionLog.WithError(err).Errorf("failed to write to the transport")
+			_ = dest.Close()
+			return
 		}
-		_, _ = dest.Write(readBuffer)
 	}
-
-	_ = dest.Close()
 }
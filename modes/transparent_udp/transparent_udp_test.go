@@ -0,0 +1,51 @@
+package transparent_udp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/modes"
+)
+
+func TestServerHandlerRelaysReplies(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+
+	go func() {
+		buf := make([]byte, modes.MaxDatagramSize)
+		for {
+			numBytes, addr, readErr := echo.ReadFromUDP(buf)
+			if readErr != nil {
+				return
+			}
+			_, _ = echo.WriteToUDP(buf[:numBytes], addr)
+		}
+	}()
+
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+	info := &pt_extras.ServerInfo{OrAddr: &net.TCPAddr{IP: echoAddr.IP, Port: echoAddr.Port}}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go serverHandler("test", server, info)
+
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	for _, message := range [][]byte{[]byte("first"), bytes.Repeat([]byte{0xab}, 1500), {}} {
+		if err = modes.WriteUDPFrame(client, message); err != nil {
+			t.Fatal(err)
+		}
+		reply, readErr := modes.ReadUDPFrame(client)
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		if !bytes.Equal(reply, message) {
+			t.Errorf("unexpected reply of %d bytes, expected %d", len(reply), len(message))
+		}
+	}
+}
@@ -25,69 +25,159 @@ SOFTWARE.
 package modes
 
 import (
+	"encoding/binary"
+	"errors"
+	"io"
 	"net"
 	"net/url"
 
 	commonLog "github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
 	"github.com/OperatorFoundation/shapeshifter-dispatcher/common/pt_extras"
-	"github.com/kataras/golog"
 )
 
-func ClientSetupUDP(socksAddr string, ptClientProxy *url.URL, names []string, options string, clientHandler ClientHandlerUDP) bool {
+// UDPConfig holds the client settings shared by the UDP modes.
+type UDPConfig struct {
+	Pending PendingLimits
+	Flows   FlowLimits
+}
+
+func ClientSetupUDP(socksAddr string, ptClientProxy *url.URL, names []string, options string, config UDPConfig, mode string, clientHandler ClientHandlerUDP) bool {
+	listenAddrs, err := ClientListenAddrs(socksAddr, names)
+	if err != nil {
+		ReportListenAddrError(names, mode, err)
+		return false
+	}
+
 	// Launch each of the client listeners.
 	for _, name := range names {
-		udpAddr, err := net.ResolveUDPAddr("udp", socksAddr)
+		name := name
+		if err := pt_extras.CheckTransport(name, mode, false); err != nil {
+			TransportLog(name, mode).WithError(err).Errorf("cannot run the transport")
+			pt_extras.PtCmethodError(name, commonLog.ElideError(err))
+			continue
+		}
+		transportOptions, optionsErr := pt_extras.TransportOptions(options, name)
+		if optionsErr != nil {
+			TransportLog(name, mode).WithError(optionsErr).Errorf("invalid transport options")
+			pt_extras.PtCmethodError(name, "invalid transport options: "+commonLog.ElideError(optionsErr))
+			continue
+		}
+		liveOptions := NewLiveOptions(name, transportOptions)
+
+		if IsUnixAddr(listenAddrs[name]) {
+			TransportLog(name, mode).Errorf("cannot listen on a Unix socket in %s mode", mode)
+			pt_extras.PtCmethodError(name, "Unix sockets are only supported in the socks5 and transparent-tcp modes")
+			continue
+		}
+
+		udpAddr, err := net.ResolveUDPAddr("udp", listenAddrs[name])
 		if err != nil {
-			golog.Errorf("Error resolving address %s", socksAddr)
+			TransportLog(name, mode).WithError(err).Errorf("failed to resolve %s", listenAddrs[name])
+			pt_extras.PtCmethodError(name, "failed to resolve the listen address: "+commonLog.ElideError(err))
+			continue
 		}
 
 		ln, err := net.ListenUDP("udp", udpAddr)
 		if err != nil {
-			golog.Errorf("failed to listen %s %s", name, err.Error())
+			TransportLog(name, mode).WithError(err).Errorf("failed to listen on %s", listenAddrs[name])
+			pt_extras.PtCmethodError(name, "failed to listen: "+commonLog.ElideError(err))
 			continue
 		}
 
-		golog.Infof("%s - registered listener", name)
-
-		go clientHandler(name, options, ln, ptClientProxy)
+		tracked := TrackListener(name, mode, ln)
+		tracked.Log().Infof("registered listener: %s", ln.LocalAddr())
+		pt_extras.PtCmethod(name, mode, ln.LocalAddr())
+		go func() {
+			defer tracked.Untrack()
+			clientHandler(name, liveOptions, ln, ptClientProxy, config)
+		}()
 	}
 
 	return true
 }
 
-func ServerSetupUDP(ptServerInfo pt_extras.ServerInfo, stateDir string, options string, serverHandler ServerHandler) (launched bool) {
+func ServerSetupUDP(ptServerInfo pt_extras.ServerInfo, stateDir string, mode string, serverHandler ServerHandler) (launched bool) {
 	// Launch each of the server listeners.
 	for _, bindaddr := range ptServerInfo.Bindaddrs {
-		name := bindaddr.MethodName
-
-		// Deal with arguments.
-		listen, parseError := pt_extras.ArgsToListener(name, stateDir, options, false, "")
-		if parseError != nil {
-			return false
+		// A listener that cannot start is reported, and the others still start.
+		if err := ServeBindaddr(bindaddr, &ptServerInfo, mode, serverHandler, stateDir, false); err != nil {
+			continue
 		}
 
-		go func() {
-			for {
-				transportLn, LnError := listen()
-				if LnError != nil {
-					continue
-				}
-
-				print(name)
-				print(" listening on ")
-				println(bindaddr.Addr.String())
-
-				golog.Infof("%s - registered listener: %s", name, commonLog.ElideAddr(bindaddr.Addr.String()))
-				ServerAcceptLoop(name, transportLn, &ptServerInfo, serverHandler, false, "")
-				transportLnErr := transportLn.Close()
-				if transportLnErr != nil {
-					golog.Errorf("Listener close error: %s", transportLnErr.Error())
-				}
-			}
-		}()
-
 		launched = true
 	}
 
 	return
 }
+
+// RelayDatagram sends a datagram from a local peer over the peer's transport
+// connection. If there is no connection yet, one is opened, and the datagram is
+// queued until it is ready.
+func RelayDatagram(flows *FlowTable, peer *net.UDPAddr, datagram []byte, name string, options string, proxyURI *url.URL, relay UDPRelay) {
+	addr := peer.String()
+
+	state, ok := flows.Get(addr)
+	if !ok {
+		// There is not an open transport connection and a connection attempt is not in progress.
+		// Open a transport connection.
+		OpenConnection(flows, peer, datagram, name, options, proxyURI, false, "", relay)
+		return
+	}
+
+	if state.Waiting {
+		// The connection attempt is in progress.
+		if state.Pending.Push(datagram) {
+			return
+		}
+
+		// The connection opened while the datagram was being queued.
+		if state, ok = flows.Get(addr); !ok || state.Waiting {
+			return
+		}
+	}
+
+	// There is an open transport connection.
+	// Send the packet through the transport.
+	if writeErr := relay.WriteFrame(state.Conn, datagram); writeErr != nil {
+		// Forget the connection so the next packet from this peer opens a new one.
+		state.Log.WithError(writeErr).Errorf("failed to write to the transport")
+		RecordDroppedDatagrams(name, relay.Mode, DropTransport, 1)
+		flows.RemoveIf(addr, state.Pending)
+	}
+}
+
+// MaxDatagramSize is the largest UDP payload that can be relayed.
+const MaxDatagramSize = 65535
+
+// Datagrams are carried over transport connections with a length prefix.
+//  uint16_t len (little endian)
+//  uint8_t  data[len]
+
+// WriteUDPFrame sends one datagram over a transport connection.
+func WriteUDPFrame(conn net.Conn, datagram []byte) error {
+	if len(datagram) > MaxDatagramSize {
+		return errors.New("datagram is too large to frame")
+	}
+
+	frame := make([]byte, 2+len(datagram))
+	binary.LittleEndian.PutUint16(frame, uint16(len(datagram)))
+	copy(frame[2:], datagram)
+
+	_, err := conn.Write(frame)
+	return err
+}
+
+// ReadUDPFrame receives one datagram from a transport connection.
+func ReadUDPFrame(conn net.Conn) ([]byte, error) {
+	var lengthBuf [2]byte
+	if _, err := io.ReadFull(conn, lengthBuf[:]); err != nil {
+		return nil, err
+	}
+
+	datagram := make([]byte, binary.LittleEndian.Uint16(lengthBuf[:]))
+	if _, err := io.ReadFull(conn, datagram); err != nil {
+		return nil, err
+	}
+
+	return datagram, nil
+}
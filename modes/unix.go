@@ -0,0 +1,153 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package modes
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// UnixPrefix marks a listen address as the path of a Unix socket.
+const UnixPrefix = "unix:"
+
+// DefaultSocketMode gives only the user the dispatcher runs as access to its
+// Unix sockets.
+const DefaultSocketMode os.FileMode = 0600
+
+// IsUnixAddr reports whether addr is the path of a Unix socket.
+func IsUnixAddr(addr string) bool {
+	return strings.HasPrefix(addr, UnixPrefix)
+}
+
+// ParseSocketMode parses the octal permissions of a Unix socket, like "0660".
+// An empty string is DefaultSocketMode.
+func ParseSocketMode(mode string) (os.FileMode, error) {
+	if mode == "" {
+		return DefaultSocketMode, nil
+	}
+
+	bits, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || bits > 0777 {
+		return 0, errors.New("the socket mode must be octal permissions, like 0660")
+	}
+
+	return os.FileMode(bits), nil
+}
+
+// Listen opens a TCP listener on addr, or a Unix socket with the permissions
+// mode if addr is "unix:" followed by a path. A socket left behind by a
+// previous run is replaced, but not one that another process is listening
+// on, and the socket is removed when the listener is closed.
+func Listen(addr string, mode os.FileMode) (net.Listener, error) {
+	if !IsUnixAddr(addr) {
+		return net.Listen("tcp", addr)
+	}
+
+	socketPath := strings.TrimPrefix(addr, UnixPrefix)
+	if socketPath == "" {
+		return nil, errors.New("the Unix socket path is empty")
+	}
+	if err := checkStaleSocket(socketPath); err != nil {
+		return nil, err
+	}
+
+	// The socket is made in a directory only we can enter, and moved into
+	// place once it has its permissions, so that nobody can connect to it
+	// while it still has the permissions of the umask.
+	dir, err := os.MkdirTemp(filepath.Dir(socketPath), ".dispatcher-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tempPath := filepath.Join(dir, "socket")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: tempPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	ln.SetUnlinkOnClose(false)
+
+	if err = os.Chmod(tempPath, mode); err == nil {
+		err = os.Rename(tempPath, socketPath)
+	}
+	if err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+
+	return &unixListener{UnixListener: ln, addr: &net.UnixAddr{Name: socketPath, Net: "unix"}}, nil
+}
+
+// checkStaleSocket returns nil if nothing is at socketPath, or if it is a
+// socket that nobody is listening on.
+func checkStaleSocket(socketPath string) error {
+	info, err := os.Lstat(socketPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", socketPath)
+	}
+
+	conn, err := net.Dial("unix", socketPath)
+	if err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("%s is in use by another process", socketPath)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+
+	return nil
+}
+
+// unixListener reports the path the socket was moved to, and removes it when
+// it is closed.
+type unixListener struct {
+	*net.UnixListener
+	addr      *net.UnixAddr
+	closeOnce sync.Once
+}
+
+func (ln *unixListener) Addr() net.Addr {
+	return ln.addr
+}
+
+func (ln *unixListener) Close() error {
+	err := ln.UnixListener.Close()
+	ln.closeOnce.Do(func() { _ = os.Remove(ln.addr.Name) })
+
+	return err
+}
@@ -0,0 +1,102 @@
+package modes
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseSocketMode(t *testing.T) {
+	tests := []struct {
+		mode     string
+		expected os.FileMode
+	}{
+		{"", DefaultSocketMode},
+		{"0660", 0660},
+		{"777", 0777},
+	}
+
+	for _, test := range tests {
+		mode, err := ParseSocketMode(test.mode)
+		if err != nil {
+			t.Errorf("%q: %s", test.mode, err)
+			continue
+		}
+		if mode != test.expected {
+			t.Errorf("%q: got %o, expected %o", test.mode, mode, test.expected)
+		}
+	}
+
+	for _, invalid := range []string{"rw-rw----", "0800", "01777", "-1"} {
+		if _, err := ParseSocketMode(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "dispatcher.sock")
+
+	// Leave a socket behind, as a run that didn't get to close it would.
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	ln, err := Listen(UnixPrefix+socketPath, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ln.Addr().String() != socketPath {
+		t.Errorf("got address %s, expected %s", ln.Addr(), socketPath)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(socketPath)); len(entries) != 1 {
+		t.Errorf("expected only the socket in its directory, found %d entries", len(entries))
+	}
+
+	// A socket that is in use is left alone.
+	if _, err = Listen(UnixPrefix+socketPath, 0660); err == nil {
+		t.Error("expected an error listening on a socket that is in use")
+	}
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("the socket in use was replaced: %s", err)
+	}
+	conn.Close()
+
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0660 {
+		t.Errorf("got mode %o, expected 0660", info.Mode().Perm())
+	}
+
+	if err = ln.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Errorf("expected the socket to be removed, got %v", err)
+	}
+
+	if _, err = Listen(UnixPrefix, DefaultSocketMode); err == nil {
+		t.Error("expected an error for an empty socket path")
+	}
+}
+
+func TestListenUnixKeepsOtherFiles(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "dispatcher.sock")
+	if err := os.WriteFile(filePath, []byte("not a socket"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Listen(UnixPrefix+filePath, DefaultSocketMode); err == nil {
+		t.Error("expected an error listening over a regular file")
+	}
+	if contents, err := os.ReadFile(filePath); err != nil || string(contents) != "not a socket" {
+		t.Errorf("the file was changed: %q, %v", contents, err)
+	}
+}
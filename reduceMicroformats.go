@@ -26,7 +26,9 @@ package main
 
 import (
 	"errors"
-	"github.com/kataras/golog"
+	"time"
+
+	commonLog "github.com/OperatorFoundation/shapeshifter-dispatcher/common/log"
 )
 
 //This is for proposal no.9
@@ -83,14 +85,10 @@ func validateSocksServerBindAddr(serverBindHost *string, serverBindPort *string,
 }
 
 func validateProxyListenAddr(proxyListenHost *string, proxyListenPort *string, proxyListenAddr *string) error {
-	if *proxyListenHost == "" && *proxyListenAddr == "" {
-		return errors.New("you must specify either --proxylistenhost or --proxylistenaddr")
-	}
-
 	if *proxyListenHost != "" && *proxyListenAddr != "" {
-		golog.Infof("proxylistenhost: %s", *proxyListenHost)
-		golog.Infof("proxylistenport: %s", *proxyListenPort)
-		golog.Infof("proxylistenaddr: %s", *proxyListenAddr)
+		commonLog.Infof("proxylistenhost: %s", *proxyListenHost)
+		commonLog.Infof("proxylistenport: %s", *proxyListenPort)
+		commonLog.Infof("proxylistenaddr: %s", *proxyListenAddr)
 		return errors.New("you cannot specify both --proxylistenhost and --proxylistenaddr")
 	}
 
@@ -164,4 +162,28 @@ func validateMode(mode *string, transparent *bool, udp *bool) error {
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+func validateUDPQueueLimits(packets *int, age *time.Duration) error {
+	if *packets < 0 {
+		return errors.New("--udpQueuePackets cannot be negative")
+	}
+
+	if *age < 0 {
+		return errors.New("--udpQueueAge cannot be negative")
+	}
+
+	return nil
+}
+
+func validateUDPFlowLimits(idleTimeout *time.Duration, maxFlows *int) error {
+	if *idleTimeout < 0 {
+		return errors.New("--udpIdleTimeout cannot be negative")
+	}
+
+	if *maxFlows < 0 {
+		return errors.New("--udpMaxFlows cannot be negative")
+	}
+
+	return nil
+}
@@ -0,0 +1,266 @@
+//go:build !nochain
+
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package transports
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+
+	Optimizer "github.com/OperatorFoundation/Optimizer-go/Optimizer/v3"
+	"golang.org/x/net/proxy"
+)
+
+func init() {
+	Register(Transport{
+		Name:          "Chain",
+		Modes:         AllModes,
+		ClientOptions: []Option{{"transports", true}},
+		ServerOptions: []Option{{"server", true}, {"next", false}, {"nextHop", false}},
+		NewClient: func(options string, dialer proxy.Dialer, enableLocket bool, logDir string) (Optimizer.TransportDialer, error) {
+			return ParseArgsChainClient(options, dialer, enableLocket, logDir)
+		},
+		NewServer: func(options string, stateDir string, enableLocket bool, logDir string) (func() (net.Listener, error), error) {
+			server, err := ParseArgsChainServer(options, stateDir, enableLocket, logDir)
+			if err != nil {
+				return nil, err
+			}
+			return server.Listen, nil
+		},
+		ClientArgs: ClientArgsChainServer,
+	})
+}
+
+// ChainClientOptions list the hops of a chain, in the same {"name": ...,
+// "config": {...}} form as Optimizer transports. The first hop is dialed
+// with the dispatcher's dialer and each later hop runs inside a connection
+// made by the hop before it, so each hop's server only sees its own
+// transport.
+type ChainClientOptions struct {
+	Transports []interface{} `json:"transports"`
+	Transport  string        `json:"transport"`
+}
+
+// ChainServerOptions are the options for a chain server, which accepts
+// clients with the server transport and passes their connections on to the
+// next hop. The next hop is dialed with the client transports in Next, as
+// in a chain client, or over plain TCP to NextHop, through the same upstream
+// proxy a client would use.
+type ChainServerOptions struct {
+	Server    map[string]interface{} `json:"server"`
+	Next      []interface{}          `json:"next,omitempty"`
+	NextHop   string                 `json:"nextHop,omitempty"`
+	Transport string                 `json:"transport"`
+}
+
+// ChainClient dials the last hop of a chain.
+type ChainClient struct {
+	Hops []Optimizer.TransportDialer
+}
+
+func (client *ChainClient) Dial() (net.Conn, error) {
+	return client.Hops[len(client.Hops)-1].Dial()
+}
+
+// hopDialer gives a hop the connections made by the hop before it. The
+// address is ignored, since the previous hop's server decides where the
+// connection goes.
+type hopDialer struct {
+	previous Optimizer.TransportDialer
+}
+
+func (dialer hopDialer) Dial(_, _ string) (net.Conn, error) {
+	return dialer.previous.Dial()
+}
+
+func ParseArgsChainClient(args string, dialer proxy.Dialer, enableLocket bool, logDir string) (*ChainClient, error) {
+	var options ChainClientOptions
+	if jsonError := json.Unmarshal([]byte(args), &options); jsonError != nil {
+		return nil, errors.New("chain client options json decoding error")
+	}
+
+	return parseChain(options.Transports, dialer, enableLocket, logDir)
+}
+
+func parseChain(otcs []interface{}, dialer proxy.Dialer, enableLocket bool, logDir string) (*ChainClient, error) {
+	if len(otcs) == 0 {
+		return nil, errors.New("a chain needs at least one transport")
+	}
+
+	client := &ChainClient{}
+	for index, untypedOtc := range otcs {
+		otc, ok := untypedOtc.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unsupported type for chain hop %d", index+1)
+		}
+
+		if index > 0 {
+			name, _ := otc["name"].(string)
+			if transport, ok := Lookup(name); ok && transport.IgnoresDialer {
+				return nil, fmt.Errorf("%s can only be the first hop of a chain", transport.Name)
+			}
+			dialer = hopDialer{client.Hops[index-1]}
+		}
+
+		hop, err := parsedTransport(otc, dialer, enableLocket, logDir)
+		if err != nil {
+			return nil, fmt.Errorf("chain hop %d: %w", index+1, err)
+		}
+		client.Hops = append(client.Hops, hop)
+	}
+
+	return client, nil
+}
+
+// ChainServer accepts clients with one transport and passes them on to the
+// next hop.
+type ChainServer struct {
+	listen       func() (net.Listener, error)
+	next         []interface{}
+	nextHop      string
+	enableLocket bool
+	logDir       string
+}
+
+func parseChainServerOptions(args string) (*ChainServerOptions, *Transport, string, error) {
+	var options ChainServerOptions
+	if jsonError := json.Unmarshal([]byte(args), &options); jsonError != nil {
+		return nil, nil, "", errors.New("chain server options json decoding error")
+	}
+
+	name, _ := options.Server["name"].(string)
+	transport, ok := Lookup(name)
+	if !ok || transport.NewServer == nil {
+		return nil, nil, "", fmt.Errorf("unsupported chain server transport %q", name)
+	}
+	config, ok := options.Server["config"].(map[string]interface{})
+	if !ok {
+		return nil, nil, "", errors.New("missing config for the chain server transport")
+	}
+	serverOptions, err := json.Marshal(config)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if err = CheckOptions(string(serverOptions), transport.ServerOptions); err != nil {
+		return nil, nil, "", fmt.Errorf("%s: %w", transport.Name, err)
+	}
+
+	return &options, &transport, string(serverOptions), nil
+}
+
+func ParseArgsChainServer(args string, stateDir string, enableLocket bool, logDir string) (*ChainServer, error) {
+	options, transport, serverOptions, err := parseChainServerOptions(args)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &ChainServer{next: options.Next, nextHop: options.NextHop, enableLocket: enableLocket, logDir: logDir}
+	switch {
+	case len(options.Next) > 0 && options.NextHop != "":
+		return nil, errors.New("a chain server takes either the next or the nextHop option, not both")
+	case len(options.Next) > 0:
+		// The hops are set up again for each connection, with the dialer
+		// the server mode reaches the next hop through, so this only
+		// checks the options.
+		if _, err = parseChain(options.Next, proxy.Direct, enableLocket, logDir); err != nil {
+			return nil, err
+		}
+	case options.NextHop != "":
+	default:
+		return nil, errors.New("a chain server needs the next or the nextHop option")
+	}
+
+	if server.listen, err = transport.NewServer(serverOptions, stateDir, enableLocket, logDir); err != nil {
+		return nil, err
+	}
+
+	return server, nil
+}
+
+// ClientArgsChainServer returns the client arguments of the chain server's
+// own transport, which is what clients of this hop need.
+func ClientArgsChainServer(options string, stateDir string) (map[string]string, error) {
+	_, transport, serverOptions, err := parseChainServerOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	if transport.ClientArgs == nil {
+		return nil, nil
+	}
+
+	return transport.ClientArgs(serverOptions, stateDir)
+}
+
+// DialNext connects to the next hop through dialer: over plain TCP to
+// NextHop, or with the client transports in Next.
+func (server *ChainServer) DialNext(dialer proxy.Dialer) (net.Conn, error) {
+	if server.nextHop != "" {
+		return dialWithTimeout(dialer, server.nextHop)
+	}
+
+	next, err := parseChain(server.next, dialer, server.enableLocket, server.logDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return next.Dial()
+}
+
+// Listen starts the server transport. The connections it accepts are
+// NextHopConns, which the server mode relays to the next hop.
+func (server *ChainServer) Listen() (net.Listener, error) {
+	ln, err := server.listen()
+	if err != nil {
+		return nil, err
+	}
+
+	return &chainListener{Listener: ln, server: server}, nil
+}
+
+type chainListener struct {
+	net.Listener
+	server *ChainServer
+}
+
+func (listener *chainListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &chainConn{Conn: conn, server: listener.server}, nil
+}
+
+type chainConn struct {
+	net.Conn
+	server *ChainServer
+}
+
+func (conn *chainConn) DialNext(dialer proxy.Dialer) (net.Conn, error) {
+	return conn.server.DialNext(dialer)
+}
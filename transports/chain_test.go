@@ -0,0 +1,171 @@
+//go:build !nochain && !nowebsocket
+
+package transports
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"golang.org/x/net/proxy"
+)
+
+func hop(name string, config map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"name": name, "config": config}
+}
+
+func listenChain(t *testing.T, options map[string]interface{}) net.Listener {
+	args, _ := json.Marshal(options)
+	server, err := ParseArgsChainServer(string(args), t.TempDir(), false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := server.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	return ln
+}
+
+// relayChain relays the connections ln accepts to their next hop, as the
+// server modes do.
+func relayChain(t *testing.T, ln net.Listener) {
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			nextHopConn, ok := conn.(NextHopConn)
+			if !ok {
+				t.Errorf("accepted a %T, want a NextHopConn", conn)
+				conn.Close()
+				return
+			}
+			go func() {
+				defer conn.Close()
+				next, err := nextHopConn.DialNext(proxy.Direct)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer next.Close()
+				go func() { _, _ = io.Copy(next, conn) }()
+				_, _ = io.Copy(conn, next)
+			}()
+		}
+	}()
+}
+
+func dialChain(t *testing.T, hops ...interface{}) net.Conn {
+	args, _ := json.Marshal(map[string]interface{}{"transports": hops})
+	client, err := ParseArgsChainClient(string(args), nil, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := client.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return conn
+}
+
+// The client layers the final hop's transport inside the middle hop's, and
+// the middle hop passes it on over TCP.
+func TestChainNextHop(t *testing.T) {
+	final := listenWebSocket(t, `{"serverAddress": "127.0.0.1:0", "path": "/final"}`)
+	echo(final)
+
+	middle := listenChain(t, map[string]interface{}{
+		"server":  hop("WebSocket", map[string]interface{}{"serverAddress": "127.0.0.1:0", "path": "/middle"}),
+		"nextHop": final.Addr().String(),
+	})
+	relayChain(t, middle)
+
+	conn := dialChain(t,
+		hop("WebSocket", map[string]interface{}{"serverAddress": middle.Addr().String(), "path": "/middle"}),
+		hop("WebSocket", map[string]interface{}{"serverAddress": final.Addr().String(), "path": "/final"}),
+	)
+	checkEcho(t, conn, 64*1024)
+}
+
+// The middle hop dials the final hop with a transport of its own.
+func TestChainNext(t *testing.T) {
+	final := listenWebSocket(t, `{"serverAddress": "127.0.0.1:0", "path": "/final"}`)
+	echo(final)
+
+	options := map[string]interface{}{
+		"server": hop("WebSocket", map[string]interface{}{"serverAddress": "127.0.0.1:0", "path": "/middle"}),
+		"next": []interface{}{
+			hop("WebSocket", map[string]interface{}{"serverAddress": final.Addr().String(), "path": "/final"}),
+		},
+	}
+	middle := listenChain(t, options)
+	relayChain(t, middle)
+
+	conn := dialChain(t, hop("WebSocket", map[string]interface{}{"serverAddress": middle.Addr().String(), "path": "/middle"}))
+	checkEcho(t, conn, 64*1024)
+
+	// Clients of the middle hop are told about its own transport.
+	args, _ := json.Marshal(options)
+	clientArgs, err := ClientArgsChainServer(string(args), "")
+	if err != nil || clientArgs["path"] != "/middle" {
+		t.Errorf("got %v, %v", clientArgs, err)
+	}
+}
+
+func TestChainClose(t *testing.T) {
+	ln := listenChain(t, map[string]interface{}{
+		"server":  hop("WebSocket", map[string]interface{}{"serverAddress": "127.0.0.1:0"}),
+		"nextHop": "127.0.0.1:1",
+	})
+
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := ln.Accept()
+		accepted <- err
+	}()
+	_ = ln.Close()
+
+	if err := <-accepted; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("got %v, want net.ErrClosed", err)
+	}
+}
+
+func TestChainOptions(t *testing.T) {
+	webSocket := hop("WebSocket", map[string]interface{}{"serverAddress": "127.0.0.1:80"})
+
+	invalidClients := [][]interface{}{
+		{},
+		{"WebSocket"},
+		{hop("NoSuchTransport", map[string]interface{}{})},
+	}
+	if _, ok := Lookup("External"); ok {
+		invalidClients = append(invalidClients, []interface{}{webSocket, hop("External", map[string]interface{}{"serverAddress": "127.0.0.1:80", "path": "/bin/true", "methodName": "test"})})
+	}
+	for _, hops := range invalidClients {
+		args, _ := json.Marshal(map[string]interface{}{"transports": hops})
+		if _, err := ParseArgsChainClient(string(args), nil, false, ""); err == nil {
+			t.Errorf("expected %s to be rejected", args)
+		}
+	}
+
+	invalidServers := []map[string]interface{}{
+		{"server": webSocket},
+		{"server": webSocket, "nextHop": "127.0.0.1:80", "next": []interface{}{webSocket}},
+		{"server": hop("WebSocket", map[string]interface{}{}), "nextHop": "127.0.0.1:80"},
+		{"server": hop("NoSuchTransport", map[string]interface{}{}), "nextHop": "127.0.0.1:80"},
+	}
+	for _, options := range invalidServers {
+		args, _ := json.Marshal(options)
+		if _, err := ParseArgsChainServer(string(args), "", false, ""); err == nil {
+			t.Errorf("expected %s to be rejected", args)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package transports
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// The transport libraries open their own TCP connections and ignore the
+// dialer they are given, so the clients here open the connection through the
+// dialer and then run the transport handshake over it. This is what lets the
+// upstream -proxy carry transport traffic.
+
+const dialTimeout = time.Minute * 5
+
+func dialWithTimeout(dialer proxy.Dialer, address string) (net.Conn, error) {
+	if dialer == nil {
+		dialer = proxy.Direct
+	}
+
+	if contextDialer, ok := dialer.(proxy.ContextDialer); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+		defer cancel()
+
+		return contextDialer.DialContext(ctx, "tcp", address)
+	}
+
+	return dialer.Dial("tcp", address)
+}
+
+func splitServerAddress(address string) (string, int, error) {
+	host, portStr, splitErr := net.SplitHostPort(address)
+	if splitErr != nil {
+		return "", 0, splitErr
+	}
+
+	port, portErr := strconv.Atoi(portStr)
+	if portErr != nil {
+		return "", 0, portErr
+	}
+
+	return host, port, nil
+}
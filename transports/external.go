@@ -0,0 +1,196 @@
+//go:build !noexternal
+
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package transports
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+
+	Optimizer "github.com/OperatorFoundation/Optimizer-go/Optimizer/v3"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/transports/external"
+	"golang.org/x/net/proxy"
+)
+
+func init() {
+	Register(Transport{
+		Name:          "External",
+		Modes:         AllModes,
+		ClientOptions: []Option{{"serverAddress", true}, {"path", true}, {"methodName", true}, {"args", false}, {"ptArgs", false}, {"ptVersion", false}, {"proxy", false}},
+		ServerOptions: []Option{{"serverAddress", false}, {"bindAddress", false}, {"path", true}, {"methodName", true}, {"args", false}, {"ptArgs", false}, {"ptVersion", false}},
+		NewClient: func(options string, dialer proxy.Dialer, enableLocket bool, logDir string) (Optimizer.TransportDialer, error) {
+			// Clients are given the state directory as their log directory.
+			client, err := ParseArgsExternalClient(options, logDir)
+			if err != nil {
+				return nil, err
+			}
+			return client, nil
+		},
+		NewServer: func(options string, stateDir string, enableLocket bool, logDir string) (func() (net.Listener, error), error) {
+			server, err := ParseArgsExternalServer(options, stateDir)
+			if err != nil {
+				return nil, err
+			}
+			return server.Listen, nil
+		},
+		ClientArgs:    ClientArgsExternalServer,
+		IgnoresDialer: true,
+	})
+}
+
+// ExternalOptions are the options for a pluggable transport binary that the
+// dispatcher runs as a child process. PTArgs are the transport's own
+// arguments: for a client, the ones in a bridge line, and for a server, its
+// server transport options. The child connects directly, or through Proxy,
+// rather than through the dispatcher's -proxy.
+type ExternalOptions struct {
+	ServerAddress string            `json:"serverAddress"`
+	BindAddress   *string           `json:"bindAddress,omitempty"`
+	Path          string            `json:"path"`
+	Args          []string          `json:"args,omitempty"`
+	MethodName    string            `json:"methodName"`
+	PTArgs        map[string]string `json:"ptArgs,omitempty"`
+	PTVersion     string            `json:"ptVersion,omitempty"`
+	Proxy         string            `json:"proxy,omitempty"`
+	Transport     string            `json:"transport"`
+}
+
+func parseArgsExternal(args string, stateDir string) (*ExternalOptions, external.Config, error) {
+	var options ExternalOptions
+	if jsonError := json.Unmarshal([]byte(args), &options); jsonError != nil {
+		return nil, external.Config{}, errors.New("external transport options json decoding error")
+	}
+
+	config := external.Config{
+		Path:       options.Path,
+		Args:       options.Args,
+		MethodName: options.MethodName,
+		Version:    options.PTVersion,
+		Proxy:      options.Proxy,
+	}
+	// Each method keeps its state apart, as Tor does.
+	if stateDir != "" {
+		config.StateDir = filepath.Join(stateDir, "pt_state", options.MethodName)
+	}
+	if err := config.Check(); err != nil {
+		return nil, config, err
+	}
+
+	return &options, config, nil
+}
+
+func ParseArgsExternalClient(args string, stateDir string) (*external.Client, error) {
+	options, config, err := parseArgsExternal(args, stateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &external.Client{Config: config, ServerAddress: options.ServerAddress, Args: options.PTArgs}, nil
+}
+
+// ExternalServer runs a server transport binary.
+type ExternalServer struct {
+	Address string
+	Config  external.Config
+	Options map[string]string
+}
+
+func ParseArgsExternalServer(args string, stateDir string) (*ExternalServer, error) {
+	options, config, err := parseArgsExternal(args, stateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	address := options.ServerAddress
+	if options.BindAddress != nil {
+		address = *options.BindAddress
+	}
+	if address == "" {
+		return nil, errors.New("the external transport needs a serverAddress or bindAddress to listen on")
+	}
+
+	return &ExternalServer{Address: address, Config: config, Options: options.PTArgs}, nil
+}
+
+var (
+	externalListenersMutex sync.Mutex
+	externalListeners      = make(map[string]*externalListener)
+)
+
+// externalListener takes itself out of externalListeners when it is closed,
+// so that a stopped child's args are not announced.
+type externalListener struct {
+	*external.Listener
+	address string
+}
+
+func (listener *externalListener) Close() error {
+	externalListenersMutex.Lock()
+	if externalListeners[listener.address] == listener {
+		delete(externalListeners, listener.address)
+	}
+	externalListenersMutex.Unlock()
+
+	return listener.Listener.Close()
+}
+
+func (server *ExternalServer) Listen() (net.Listener, error) {
+	ln, err := external.Listen(server.Config, server.Address, server.Options)
+	if err != nil {
+		return nil, err
+	}
+	listener := &externalListener{Listener: ln, address: server.Address}
+
+	// The child announces the args its clients need, so ClientArgs asks the
+	// running listener for them.
+	externalListenersMutex.Lock()
+	externalListeners[server.Address] = listener
+	externalListenersMutex.Unlock()
+
+	return listener, nil
+}
+
+// ClientArgsExternalServer returns the args the server binary started with
+// args announced.
+func ClientArgsExternalServer(args string, stateDir string) (map[string]string, error) {
+	server, err := ParseArgsExternalServer(args, stateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	externalListenersMutex.Lock()
+	listener, ok := externalListeners[server.Address]
+	externalListenersMutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%s is not running on %s", server.Config.MethodName, server.Address)
+	}
+
+	return listener.Args()
+}
@@ -0,0 +1,116 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package external
+
+import (
+	"sort"
+	"strings"
+)
+
+// maxSocksField is the longest a SOCKS5 username or password can be.
+const maxSocksField = 255
+
+// escape escapes the characters in special with a backslash, along with the
+// backslash itself.
+func escape(s string, special string) string {
+	var result strings.Builder
+	for _, c := range []byte(s) {
+		if c == '\\' || strings.IndexByte(special, c) != -1 {
+			result.WriteByte('\\')
+		}
+		result.WriteByte(c)
+	}
+
+	return result.String()
+}
+
+// joinArgs joins args as key=value pairs separated by separator, in key
+// order, with prefix before each pair and the characters in special escaped.
+func joinArgs(args map[string]string, separator string, prefix string, special string) string {
+	keys := make([]string, 0, len(args))
+	for key := range args {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, prefix+escape(key, special)+"="+escape(args[key], special))
+	}
+
+	return strings.Join(pairs, separator)
+}
+
+// serverTransportOptions encodes a server's options for
+// TOR_PT_SERVER_TRANSPORT_OPTIONS, as methodName:key=value pairs separated
+// by semicolons.
+func serverTransportOptions(methodName string, options map[string]string) string {
+	return joinArgs(options, ";", escape(methodName, ":;=")+":", ":;=")
+}
+
+// parseArgs parses the ARGS of an SMETHOD line, key=value pairs separated by
+// commas.
+func parseArgs(s string) map[string]string {
+	args := make(map[string]string)
+	for _, pair := range splitEscaped(s, ',') {
+		parts := splitEscaped(pair, '=')
+		if len(parts) < 2 {
+			continue
+		}
+		args[unescape(parts[0])] = unescape(strings.Join(parts[1:], "="))
+	}
+
+	return args
+}
+
+// splitEscaped splits s at separators that are not escaped with a
+// backslash. Escapes are left in the parts.
+func splitEscaped(s string, separator byte) []string {
+	var parts []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case separator:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, s[start:])
+}
+
+func unescape(s string) string {
+	var result strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		result.WriteByte(s[i])
+	}
+
+	return result.String()
+}
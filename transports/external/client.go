@@ -0,0 +1,77 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package external
+
+import (
+	"net"
+	"sync"
+)
+
+var (
+	clientsMutex sync.Mutex
+	clients      = make(map[string]*process)
+)
+
+// Client dials a server through an external transport's SOCKS5 port.
+// Clients with the same config share a child, which is started by the first
+// Dial and runs until the dispatcher exits.
+type Client struct {
+	Config        Config
+	ServerAddress string
+
+	// Args are passed to the child for each connection, as a bridge line's
+	// arguments would be.
+	Args map[string]string
+}
+
+func (client *Client) Dial() (net.Conn, error) {
+	announced, err := clientProcess(client.Config).wait()
+	if err != nil {
+		return nil, err
+	}
+
+	return socksDial(announced.addr, client.ServerAddress, client.Args, client.Config.Version)
+}
+
+// clientProcess returns the child for config, starting it if there isn't
+// one.
+func clientProcess(config Config) *process {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+
+	key := config.key()
+	if child, ok := clients[key]; ok {
+		return child
+	}
+
+	env := append(config.environment(), "TOR_PT_CLIENT_TRANSPORTS="+config.MethodName)
+	if config.Proxy != "" {
+		env = append(env, "TOR_PT_PROXY="+config.Proxy)
+	}
+	child := startProcess(config, env, false)
+	clients[key] = child
+
+	return child
+}
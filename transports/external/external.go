@@ -0,0 +1,416 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+// Package external runs pluggable transports that are separate binaries, such
+// as obfs4proxy or snowflake-client, as managed child processes speaking the
+// PT 1.0 managed-proxy protocol. Clients dial through the child's SOCKS5
+// port, and servers accept the connections the child forwards to a loopback
+// ORPort. A child that exits is started again.
+package external
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+const (
+	// startTimeout is how long a child has to announce its method.
+	startTimeout = 30 * time.Second
+
+	// stopTimeout is how long a child has to exit once its stdin is closed.
+	stopTimeout = 5 * time.Second
+
+	minRestartDelay = time.Second
+	maxRestartDelay = time.Minute
+
+	// DefaultVersion is the managed-proxy protocol version offered to the
+	// child.
+	DefaultVersion = "1"
+)
+
+// Config describes an external transport binary.
+type Config struct {
+	// Path is the binary, which is looked up in PATH if it has no slash.
+	Path string
+
+	// Args are the binary's command-line arguments.
+	Args []string
+
+	// MethodName is the name of the transport the binary provides, such as
+	// obfs4.
+	MethodName string
+
+	// StateDir is passed as TOR_PT_STATE_LOCATION.
+	StateDir string
+
+	// Version is offered in TOR_PT_MANAGED_TRANSPORT_VER. It defaults to
+	// DefaultVersion.
+	Version string
+
+	// Proxy is passed to clients as TOR_PT_PROXY.
+	Proxy string
+}
+
+// Check checks that the binary exists, without starting it.
+func (config Config) Check() error {
+	if config.Path == "" {
+		return errors.New("no path to the transport binary")
+	}
+	if config.MethodName == "" {
+		return errors.New("no method name for the transport binary")
+	}
+	if _, err := exec.LookPath(config.Path); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// key identifies a child, so that clients with the same config share one.
+func (config Config) key() string {
+	return strings.Join(append([]string{config.Path, config.MethodName, config.StateDir, config.Version, config.Proxy}, config.Args...), "\x00")
+}
+
+// environment returns the PT variables common to clients and servers.
+func (config Config) environment() []string {
+	version := config.Version
+	if version == "" {
+		version = DefaultVersion
+	}
+
+	stateDir := config.StateDir
+	if stateDir == "" {
+		stateDir = filepath.Join(os.TempDir(), "shapeshifter-dispatcher-"+config.MethodName)
+	}
+
+	return []string{
+		"TOR_PT_MANAGED_TRANSPORT_VER=" + version,
+		"TOR_PT_STATE_LOCATION=" + stateDir,
+		"TOR_PT_EXIT_ON_STDIN_CLOSE=1",
+	}
+}
+
+// method is what a child announced in its CMETHOD or SMETHOD line.
+type method struct {
+	addr string
+	args map[string]string
+}
+
+// process supervises one child. Each run of the child closes ready once it
+// has announced its method or failed to.
+type process struct {
+	config Config
+	env    []string
+	server bool
+
+	mutex   sync.Mutex
+	ready   chan struct{}
+	method  method
+	err     error
+	exitErr error
+	// lastErr is the error the last run that exited failed with, for waiters
+	// that only look once the run has already been reset.
+	lastErr error
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	stopped bool
+
+	stop   chan struct{}
+	exited chan struct{}
+}
+
+func startProcess(config Config, env []string, server bool) *process {
+	child := &process{
+		config: config,
+		env:    env,
+		server: server,
+		ready:  make(chan struct{}),
+		stop:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+	go child.supervise()
+
+	return child
+}
+
+func (child *process) log() *golog.Logger {
+	return golog.Child(fmt.Sprintf("[%s %s]", child.config.MethodName, filepath.Base(child.config.Path)))
+}
+
+func (child *process) supervise() {
+	defer close(child.exited)
+
+	delay := minRestartDelay
+	for {
+		started := time.Now()
+		err := child.run()
+
+		// The next run announces again.
+		child.mutex.Lock()
+		child.ready = make(chan struct{})
+		child.method = method{}
+		child.lastErr = child.err
+		child.err = nil
+		child.exitErr = err
+		child.cmd = nil
+		child.stdin = nil
+		stopped := child.stopped
+		child.mutex.Unlock()
+		if stopped {
+			return
+		}
+
+		if time.Since(started) > maxRestartDelay {
+			delay = minRestartDelay
+		}
+		child.log().Warnf("the transport exited (%v), restarting it in %s", err, delay)
+
+		select {
+		case <-child.stop:
+			return
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > maxRestartDelay {
+			delay = maxRestartDelay
+		}
+	}
+}
+
+// run starts the child and reads its output until it exits.
+func (child *process) run() error {
+	cmd := exec.Command(child.config.Path, child.config.Args...)
+	cmd.Env = append(parentEnvironment(), child.env...)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return child.fail(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return child.fail(err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return child.fail(err)
+	}
+	if err = cmd.Start(); err != nil {
+		return child.fail(err)
+	}
+
+	child.mutex.Lock()
+	child.cmd = cmd
+	child.stdin = stdin
+	stopped := child.stopped
+	child.mutex.Unlock()
+	if stopped {
+		_ = stdin.Close()
+	}
+
+	// A child that never announces its method is killed, so it is restarted.
+	timer := time.AfterFunc(startTimeout, func() {
+		if child.fail(errors.New("the transport did not announce its method in time")) != nil {
+			_ = cmd.Process.Kill()
+		}
+	})
+
+	// The pipes have to be read to the end before Wait.
+	var stderrDone sync.WaitGroup
+	stderrDone.Add(1)
+	go func() {
+		defer stderrDone.Done()
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			child.log().Debugf("stderr: %s", scanner.Text())
+		}
+	}()
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		child.handleLine(scanner.Text())
+	}
+	stderrDone.Wait()
+	timer.Stop()
+	err = cmd.Wait()
+	if err == nil {
+		err = errors.New("exit status 0")
+	}
+	_ = child.fail(err)
+
+	return err
+}
+
+// parentEnvironment is the dispatcher's environment without its own PT
+// variables, which are for the dispatcher and not the child.
+func parentEnvironment() []string {
+	var env []string
+	for _, variable := range os.Environ() {
+		if !strings.HasPrefix(variable, "TOR_PT_") {
+			env = append(env, variable)
+		}
+	}
+
+	return env
+}
+
+// handleLine handles a line of the managed-proxy protocol from the child.
+func (child *process) handleLine(line string) {
+	keyword, rest, _ := strings.Cut(line, " ")
+	fields := strings.Fields(rest)
+
+	switch keyword {
+	case "VERSION-ERROR", "ENV-ERROR", "PROXY-ERROR":
+		_ = child.fail(fmt.Errorf("%s %s", keyword, rest))
+	case "CMETHOD":
+		if !child.server && len(fields) >= 3 && fields[0] == child.config.MethodName {
+			if fields[1] != "socks5" {
+				_ = child.fail(fmt.Errorf("the transport offered %s, not socks5", fields[1]))
+				return
+			}
+			child.announce(method{addr: fields[2]})
+		}
+	case "SMETHOD":
+		if child.server && len(fields) >= 2 && fields[0] == child.config.MethodName {
+			announced := method{addr: fields[1]}
+			for _, option := range fields[2:] {
+				if strings.HasPrefix(option, "ARGS:") {
+					announced.args = parseArgs(strings.TrimPrefix(option, "ARGS:"))
+				}
+			}
+			child.announce(announced)
+		}
+	case "CMETHOD-ERROR", "SMETHOD-ERROR":
+		if len(fields) >= 1 && fields[0] == child.config.MethodName {
+			_ = child.fail(fmt.Errorf("%s %s", keyword, rest))
+		}
+	case "CMETHODS", "SMETHODS":
+		// DONE. If the method wasn't announced by now, it never will be.
+		_ = child.fail(fmt.Errorf("the transport does not provide %s", child.config.MethodName))
+	case "LOG", "STATUS":
+		child.log().Debugf("%s", line)
+	}
+}
+
+// announce makes method available to Dial or Listen, unless this run has
+// already announced or failed.
+func (child *process) announce(announced method) {
+	child.mutex.Lock()
+	defer child.mutex.Unlock()
+
+	select {
+	case <-child.ready:
+	default:
+		child.method = announced
+		close(child.ready)
+	}
+}
+
+// fail records err for this run, unless it has already announced or failed.
+// It returns err if it was recorded.
+func (child *process) fail(err error) error {
+	child.mutex.Lock()
+	defer child.mutex.Unlock()
+
+	select {
+	case <-child.ready:
+		return nil
+	default:
+		child.err = err
+		close(child.ready)
+		return err
+	}
+}
+
+// wait returns the method the current run announced, waiting for it if it
+// hasn't yet.
+func (child *process) wait() (method, error) {
+	child.mutex.Lock()
+	ready := child.ready
+	child.mutex.Unlock()
+
+	select {
+	case <-ready:
+	case <-child.exited:
+		return method{}, errors.New("the transport was stopped")
+	case <-time.After(startTimeout):
+		return method{}, errors.New("timed out waiting for the transport")
+	}
+
+	child.mutex.Lock()
+	defer child.mutex.Unlock()
+	if ready != child.ready {
+		// The run that closed ready has exited since.
+		if child.lastErr != nil {
+			return method{}, child.lastErr
+		}
+		return method{}, fmt.Errorf("the transport exited: %v", child.exitErr)
+	}
+
+	return child.method, child.err
+}
+
+// close stops the child: its stdin is closed, which asks it to exit, and it
+// is killed if it doesn't.
+func (child *process) close() {
+	child.mutex.Lock()
+	if child.stopped {
+		child.mutex.Unlock()
+		return
+	}
+	child.stopped = true
+	stdin := child.stdin
+	child.mutex.Unlock()
+
+	close(child.stop)
+	if stdin != nil {
+		_ = stdin.Close()
+	}
+
+	select {
+	case <-child.exited:
+	case <-time.After(stopTimeout):
+		child.kill()
+		<-child.exited
+	}
+}
+
+func (child *process) kill() {
+	child.mutex.Lock()
+	defer child.mutex.Unlock()
+
+	if child.cmd != nil {
+		_ = child.cmd.Process.Kill()
+	}
+}
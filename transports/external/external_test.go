@@ -0,0 +1,361 @@
+package external
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The test binary is also the fake transport: run with fake-pt as its first
+// argument, it speaks the managed-proxy protocol instead of running tests.
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == "fake-pt" {
+		fakePT()
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+func fakeConfig(t *testing.T) Config {
+	return Config{Path: os.Args[0], Args: []string{"fake-pt"}, MethodName: "fake", StateDir: t.TempDir()}
+}
+
+func fakePT() {
+	go func() {
+		_, _ = io.Copy(io.Discard, os.Stdin)
+		os.Exit(0)
+	}()
+
+	version := os.Getenv("TOR_PT_MANAGED_TRANSPORT_VER")
+	if os.Getenv("FAKE_PT_FAIL") != "" || (version != "1" && version != "2") {
+		fmt.Println("VERSION-ERROR no-version")
+		return
+	}
+	fmt.Println("VERSION " + version)
+
+	if bindaddr := os.Getenv("TOR_PT_SERVER_BINDADDR"); bindaddr != "" {
+		ln, err := net.Listen("tcp", strings.TrimPrefix(bindaddr, "fake-"))
+		if err != nil {
+			fmt.Println("SMETHOD-ERROR fake " + err.Error())
+			return
+		}
+		options := escape(os.Getenv("TOR_PT_SERVER_TRANSPORT_OPTIONS"), ",=")
+		fmt.Printf("SMETHOD fake %s ARGS:cert=abc\\,def,options=%s\n", ln.Addr(), options)
+		fmt.Println("SMETHODS DONE")
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			orPort, err := net.Dial("tcp", os.Getenv("TOR_PT_ORPORT"))
+			if err != nil {
+				_ = conn.Close()
+				continue
+			}
+			go relay(conn, orPort)
+		}
+	}
+
+	if os.Getenv("TOR_PT_CLIENT_TRANSPORTS") != "fake" {
+		fmt.Println("ENV-ERROR no transports")
+		return
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Println("CMETHOD-ERROR fake " + err.Error())
+		return
+	}
+	fmt.Printf("CMETHOD fake socks5 %s\n", ln.Addr())
+	fmt.Println("CMETHODS DONE")
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go fakeSocks(conn)
+	}
+}
+
+// fakeSocks serves a SOCKS5 connect, and sends the target the args it was
+// given on a line of their own.
+func fakeSocks(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		_ = conn.Close()
+		return
+	}
+	methods := make([]byte, header[1])
+	_, _ = io.ReadFull(reader, methods)
+
+	args := ""
+	if strings.IndexByte(string(methods), 9) != -1 {
+		_, _ = conn.Write([]byte{5, 9})
+		length := make([]byte, 4)
+		_, _ = io.ReadFull(reader, length)
+		block := make([]byte, binary.BigEndian.Uint32(length))
+		_, _ = io.ReadFull(reader, block)
+		args = string(block)
+	} else if strings.IndexByte(string(methods), 2) != -1 {
+		_, _ = conn.Write([]byte{5, 2})
+		version, _ := reader.ReadByte()
+		userLength, _ := reader.ReadByte()
+		user := make([]byte, userLength)
+		_, _ = io.ReadFull(reader, user)
+		passwordLength, _ := reader.ReadByte()
+		password := make([]byte, passwordLength)
+		_, _ = io.ReadFull(reader, password)
+		_, _ = conn.Write([]byte{version, 0})
+		args = strings.TrimSuffix(string(user)+string(password), "\x00")
+	} else {
+		_, _ = conn.Write([]byte{5, 0})
+	}
+
+	request := make([]byte, 4)
+	_, _ = io.ReadFull(reader, request)
+	var host string
+	switch request[3] {
+	case 1:
+		ip := make([]byte, 4)
+		_, _ = io.ReadFull(reader, ip)
+		host = net.IP(ip).String()
+	case 3:
+		length, _ := reader.ReadByte()
+		name := make([]byte, length)
+		_, _ = io.ReadFull(reader, name)
+		host = string(name)
+	}
+	port := make([]byte, 2)
+	_, _ = io.ReadFull(reader, port)
+
+	target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+	if err != nil {
+		_, _ = conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		_ = conn.Close()
+		return
+	}
+	_, _ = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	_, _ = fmt.Fprintf(target, "args:%s\n", args)
+
+	relay(&bufferedConn{Conn: conn, reader: reader}, target)
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
+
+func relay(a net.Conn, b net.Conn) {
+	go func() {
+		_, _ = io.Copy(a, b)
+		_ = a.Close()
+	}()
+	_, _ = io.Copy(b, a)
+	_ = b.Close()
+}
+
+// echoServer echoes what its clients send after their args line, which it
+// passes on.
+func echoServer(t *testing.T) (net.Listener, chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	argsLines := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				line, _ := reader.ReadString('\n')
+				argsLines <- strings.TrimSuffix(line, "\n")
+				_, _ = io.Copy(conn, reader)
+			}()
+		}
+	}()
+
+	return ln, argsLines
+}
+
+func checkEcho(t *testing.T, conn net.Conn) {
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "hello" {
+		t.Fatalf("got %q, %v", reply, err)
+	}
+}
+
+func TestClient(t *testing.T) {
+	// The child must not see the dispatcher's own PT variables.
+	t.Setenv("TOR_PT_SERVER_BINDADDR", "fake-127.0.0.1:1")
+
+	ln, argsLines := echoServer(t)
+	config := fakeConfig(t)
+	t.Cleanup(func() { clientProcess(config).close() })
+
+	client := &Client{Config: config, ServerAddress: ln.Addr().String(), Args: map[string]string{"cert": "a;b", "iat-mode": "0"}}
+	conn, err := client.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	checkEcho(t, conn)
+
+	if args := <-argsLines; args != `args:cert=a\;b;iat-mode=0` {
+		t.Errorf("the child got %q", args)
+	}
+
+	// Clients with the same config share the child.
+	if clientProcess(config) != clientProcess(Config{Path: config.Path, Args: []string{"fake-pt"}, MethodName: "fake", StateDir: config.StateDir}) {
+		t.Error("a second client started another child")
+	}
+}
+
+func TestClientPT2(t *testing.T) {
+	ln, argsLines := echoServer(t)
+	config := fakeConfig(t)
+	config.Version = "2"
+	t.Cleanup(func() { clientProcess(config).close() })
+
+	client := &Client{Config: config, ServerAddress: ln.Addr().String(), Args: map[string]string{"cert": "a;b"}}
+	conn, err := client.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	checkEcho(t, conn)
+
+	if args := <-argsLines; args != `args:{"cert":"a;b"}` {
+		t.Errorf("the child got %q", args)
+	}
+}
+
+func TestClientRestart(t *testing.T) {
+	ln, _ := echoServer(t)
+	config := fakeConfig(t)
+	child := clientProcess(config)
+	t.Cleanup(child.close)
+
+	client := &Client{Config: config, ServerAddress: ln.Addr().String()}
+	conn, err := client.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, conn)
+	_ = conn.Close()
+
+	child.kill()
+
+	// Dials fail until the child is back.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		conn, err = client.Dial()
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the child did not come back: %s", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	defer conn.Close()
+	checkEcho(t, conn)
+}
+
+func TestListen(t *testing.T) {
+	listener, err := Listen(fakeConfig(t), "127.0.0.1:0", map[string]string{"key": "v"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	args, err := listener.Args()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args["cert"] != "abc,def" || args["options"] != "fake:key=v" {
+		t.Errorf("got args %v", args)
+	}
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+	received := make([]byte, 4)
+	if _, err = io.ReadFull(accepted, received); err != nil || string(received) != "ping" {
+		t.Errorf("got %q, %v", received, err)
+	}
+}
+
+func TestListenFailure(t *testing.T) {
+	t.Setenv("FAKE_PT_FAIL", "1")
+
+	_, err := Listen(fakeConfig(t), "127.0.0.1:0", nil)
+	if err == nil || !strings.Contains(err.Error(), "VERSION-ERROR") {
+		t.Errorf("got %v, want the VERSION-ERROR", err)
+	}
+
+	if _, err = Listen(Config{Path: "/nonexistent/pt", MethodName: "fake"}, "127.0.0.1:0", nil); err == nil {
+		t.Error("expected a missing binary to fail")
+	}
+}
+
+func TestSocksUsernamePassword(t *testing.T) {
+	auth, err := socksUsernamePassword(map[string]string{"b": "2", "a": "x=y"})
+	if err != nil || string(auth) != "\x01\x0aa=x\\=y;b=2\x01\x00" {
+		t.Errorf("got %q, %v", auth, err)
+	}
+
+	// Args that don't fit in the username go on in the password.
+	cert := strings.Repeat("c", 300)
+	auth, err = socksUsernamePassword(map[string]string{"cert": cert})
+	if err != nil || auth[1] != maxSocksField || int(auth[2+maxSocksField]) != len("cert=")+len(cert)-maxSocksField {
+		t.Errorf("got %q, %v", auth, err)
+	}
+
+	if _, err = socksUsernamePassword(map[string]string{"cert": strings.Repeat("c", 600)}); err == nil {
+		t.Error("expected args that don't fit to be rejected")
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	args := parseArgs(`cert=a\,b\=c,iat-mode=0,bad`)
+	if len(args) != 2 || args["cert"] != "a,b=c" || args["iat-mode"] != "0" {
+		t.Errorf("got %v", args)
+	}
+
+	if options := serverTransportOptions("fake", map[string]string{"k": "a;b:c"}); options != `fake:k=a\;b\:c` {
+		t.Errorf("got %q", options)
+	}
+}
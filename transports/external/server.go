@@ -0,0 +1,100 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package external
+
+import (
+	"net"
+)
+
+// Listener accepts connections from an external server transport. The child
+// listens on the bind address and forwards each client to a loopback port,
+// as it would to Tor's ORPort, which the Listener accepts on. The remote
+// address of an accepted connection is the child's, not the client's.
+type Listener struct {
+	orPort net.Listener
+	child  *process
+	addr   net.Addr
+}
+
+// Listen starts the child for config on bindAddress, with options passed as
+// its server transport options, and waits for it to announce its method.
+func Listen(config Config, bindAddress string, options map[string]string) (*Listener, error) {
+	if err := config.Check(); err != nil {
+		return nil, err
+	}
+
+	orPort, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	env := append(config.environment(),
+		"TOR_PT_SERVER_TRANSPORTS="+config.MethodName,
+		"TOR_PT_SERVER_BINDADDR="+config.MethodName+"-"+bindAddress,
+		"TOR_PT_ORPORT="+orPort.Addr().String(),
+	)
+	if len(options) > 0 {
+		env = append(env, "TOR_PT_SERVER_TRANSPORT_OPTIONS="+serverTransportOptions(config.MethodName, options))
+	}
+	child := startProcess(config, env, true)
+
+	announced, err := child.wait()
+	if err == nil {
+		var addr *net.TCPAddr
+		if addr, err = net.ResolveTCPAddr("tcp", announced.addr); err == nil {
+			return &Listener{orPort: orPort, child: child, addr: addr}, nil
+		}
+	}
+
+	child.close()
+	_ = orPort.Close()
+
+	return nil, err
+}
+
+// Args returns the ARGS the child announced, which clients need to connect
+// to it.
+func (listener *Listener) Args() (map[string]string, error) {
+	announced, err := listener.child.wait()
+	return announced.args, err
+}
+
+func (listener *Listener) Accept() (net.Conn, error) {
+	return listener.orPort.Accept()
+}
+
+// Close stops the child. Connections that were accepted stay open, but the
+// child that carried them is gone.
+func (listener *Listener) Close() error {
+	err := listener.orPort.Close()
+	listener.child.close()
+
+	return err
+}
+
+// Addr returns the address the child is listening on.
+func (listener *Listener) Addr() net.Addr {
+	return listener.addr
+}
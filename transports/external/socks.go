@@ -0,0 +1,214 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package external
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	socksVersion = 0x05
+
+	socksAuthNone             = 0x00
+	socksAuthUsernamePassword = 0x02
+	socksAuthJSON             = 0x09
+
+	socksConnect = 0x01
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+
+	// socksTimeout bounds the SOCKS handshake, including the child's
+	// connection to the server.
+	socksTimeout = 2 * time.Minute
+)
+
+// socksDial connects to target through the child's SOCKS5 port at
+// socksAddr. PT 1.0 children are given args as the SOCKS5 username and
+// password, and PT 2.x children as a JSON parameter block.
+func socksDial(socksAddr string, target string, args map[string]string, version string) (net.Conn, error) {
+	host, portString, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %s", target)
+	}
+
+	method := byte(socksAuthNone)
+	var auth []byte
+	if len(args) > 0 {
+		if strings.HasPrefix(version, "2") {
+			method = socksAuthJSON
+			if auth, err = socksJSONAuth(args); err != nil {
+				return nil, err
+			}
+		} else {
+			method = socksAuthUsernamePassword
+			if auth, err = socksUsernamePassword(args); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	conn, err := net.Dial("tcp", socksAddr)
+	if err != nil {
+		return nil, err
+	}
+	if err = conn.SetDeadline(time.Now().Add(socksTimeout)); err == nil {
+		err = socksHandshake(conn, method, auth, host, uint16(port))
+	}
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func socksHandshake(conn net.Conn, method byte, auth []byte, host string, port uint16) error {
+	reader := bufio.NewReader(conn)
+
+	if _, err := conn.Write([]byte{socksVersion, 1, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(reader, reply); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion || reply[1] != method {
+		return fmt.Errorf("the transport did not accept SOCKS5 method %#x", method)
+	}
+
+	if len(auth) > 0 {
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+	}
+	// Only username and password authentication has a reply.
+	if method == socksAuthUsernamePassword {
+		if _, err := io.ReadFull(reader, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("the transport rejected the args")
+		}
+	}
+
+	request := []byte{socksVersion, socksConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("the host name is too long for SOCKS5")
+		}
+		request = append(request, socksAtypDomain, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(request, socksAtypIPv4)
+		request = append(request, ip4...)
+	} else {
+		request = append(request, socksAtypIPv6)
+		request = append(request, ip...)
+	}
+	request = binary.BigEndian.AppendUint16(request, port)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	// VER REP RSV ATYP BND.ADDR BND.PORT
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return err
+	}
+	if header[1] != 0 {
+		return fmt.Errorf("the transport could not connect: SOCKS5 reply %d", header[1])
+	}
+	var addressLength int
+	switch header[3] {
+	case socksAtypIPv4:
+		addressLength = net.IPv4len
+	case socksAtypIPv6:
+		addressLength = net.IPv6len
+	case socksAtypDomain:
+		length, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		addressLength = int(length)
+	default:
+		return fmt.Errorf("invalid SOCKS5 address type %d", header[3])
+	}
+	if _, err := io.ReadFull(reader, make([]byte, addressLength+2)); err != nil {
+		return err
+	}
+
+	// The child can't send anything before it has replied, so nothing is
+	// left in the reader.
+	return nil
+}
+
+// socksUsernamePassword encodes args the way PT 1.0 passes them: key=value
+// pairs separated by semicolons, split across the username and password.
+// The password is a NUL byte if the username holds them all.
+func socksUsernamePassword(args map[string]string) ([]byte, error) {
+	encoded := joinArgs(args, ";", "", "=;")
+	user, password := encoded, "\x00"
+	if len(encoded) > maxSocksField {
+		if len(encoded) > 2*maxSocksField {
+			return nil, errors.New("the transport args are too long to pass over SOCKS5")
+		}
+		user, password = encoded[:maxSocksField], encoded[maxSocksField:]
+	}
+
+	auth := []byte{0x01, byte(len(user))}
+	auth = append(auth, user...)
+	auth = append(auth, byte(len(password)))
+	return append(auth, password...), nil
+}
+
+// socksJSONAuth encodes args the way PT 2.x passes them: a JSON object,
+// after its length as a 32-bit big-endian integer.
+func socksJSONAuth(args map[string]string) ([]byte, error) {
+	encoded, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+
+	auth := binary.BigEndian.AppendUint32(nil, uint32(len(encoded)))
+	return append(auth, encoded...), nil
+}
@@ -0,0 +1,72 @@
+//go:build !noexternal
+
+package transports
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExternalOptions(t *testing.T) {
+	binary, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateDir := t.TempDir()
+
+	client, err := ParseArgsExternalClient(`{"serverAddress": "192.0.2.1:443", "path": "`+binary+`", "methodName": "obfs4", "ptArgs": {"cert": "abc"}}`, stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Config.StateDir != filepath.Join(stateDir, "pt_state", "obfs4") || client.Args["cert"] != "abc" {
+		t.Errorf("got %+v", client)
+	}
+
+	invalid := []string{
+		`{"serverAddress": "192.0.2.1:443", "path": "/nonexistent/obfs4proxy", "methodName": "obfs4"}`,
+		`{"serverAddress": "192.0.2.1:443", "path": "` + binary + `"}`,
+	}
+	for _, options := range invalid {
+		if _, err = ParseArgsExternalClient(options, stateDir); err == nil {
+			t.Errorf("expected %s to be rejected", options)
+		}
+	}
+
+	// A server that isn't running has no args to announce.
+	if _, err = ClientArgsExternalServer(`{"bindAddress": "127.0.0.1:1", "path": "`+binary+`", "methodName": "obfs4"}`, stateDir); err == nil {
+		t.Error("expected an error for a server that is not running")
+	}
+}
+
+// A closed server no longer announces the args of its stopped child.
+func TestExternalServerClose(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "fake-pt")
+	fake := "#!/bin/sh\necho VERSION 1\necho SMETHOD fake 127.0.0.1:1 ARGS:cert=abc\necho SMETHODS DONE\ncat\n"
+	if err := os.WriteFile(script, []byte(fake), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	options := `{"bindAddress": "127.0.0.1:1", "path": "` + script + `", "methodName": "fake"}`
+	stateDir := t.TempDir()
+
+	server, err := ParseArgsExternalServer(options, stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := server.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	args, err := ClientArgsExternalServer(options, stateDir)
+	if err != nil || args["cert"] != "abc" {
+		t.Fatalf("got %v, %v", args, err)
+	}
+
+	if err = listener.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ClientArgsExternalServer(options, stateDir); err == nil || !strings.Contains(err.Error(), "is not running") {
+		t.Errorf("expected a closed server not to be running, got %v", err)
+	}
+}
@@ -0,0 +1,309 @@
+//go:build !noobfs4
+
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package transports
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	Optimizer "github.com/OperatorFoundation/Optimizer-go/Optimizer/v3"
+	locketgo "github.com/OperatorFoundation/locket-go"
+	"github.com/OperatorFoundation/shapeshifter-dispatcher/transports/obfs4"
+	"golang.org/x/net/proxy"
+)
+
+func init() {
+	Register(Transport{
+		Name:          "obfs4",
+		Modes:         AllModes,
+		ClientOptions: []Option{{"serverAddress", true}, {"cert", false}, {"node-id", false}, {"public-key", false}, {"iat-mode", false}},
+		ServerOptions: []Option{{"serverAddress", false}, {"bindAddress", false}, {"node-id", false}, {"private-key", false}, {"drbg-seed", false}, {"iat-mode", false}},
+		NewClient: func(options string, dialer proxy.Dialer, enableLocket bool, logDir string) (Optimizer.TransportDialer, error) {
+			client, err := ParseArgsObfs4Client(options, dialer)
+			if err != nil {
+				return nil, err
+			}
+			if enableLocket {
+				client.LogDir = &logDir
+			}
+			return client, nil
+		},
+		NewServer: func(options string, stateDir string, enableLocket bool, logDir string) (func() (net.Listener, error), error) {
+			server, err := ParseArgsObfs4Server(options, stateDir)
+			if err != nil {
+				return nil, err
+			}
+			return server.Listen, nil
+		},
+		ClientArgs: ClientArgsObfs4Server,
+		GenerateConfigs: func(settings ConfigSettings) error {
+			return CreateObfs4Configs(settings.ServerAddress, settings.BindAddress)
+		},
+	})
+}
+
+// Obfs4ClientOptions are the options for an obfs4 client. The bridge is
+// given either by its cert, as in a bridge line, or by its node ID and
+// public key in hex.
+type Obfs4ClientOptions struct {
+	ServerAddress string      `json:"serverAddress"`
+	Cert          string      `json:"cert,omitempty"`
+	NodeID        string      `json:"node-id,omitempty"`
+	PublicKey     string      `json:"public-key,omitempty"`
+	IATMode       interface{} `json:"iat-mode,omitempty"`
+	Transport     string      `json:"transport"`
+}
+
+// Obfs4ServerOptions are the options for an obfs4 server. Without a node ID
+// and private key, the server uses the identity kept in its state directory.
+type Obfs4ServerOptions struct {
+	ServerAddress string      `json:"serverAddress"`
+	BindAddress   *string     `json:"bindAddress,omitempty"`
+	NodeID        string      `json:"node-id,omitempty"`
+	PrivateKey    string      `json:"private-key,omitempty"`
+	DrbgSeed      string      `json:"drbg-seed,omitempty"`
+	IATMode       interface{} `json:"iat-mode,omitempty"`
+	Transport     string      `json:"transport"`
+}
+
+// Obfs4Client dials an obfs4 server.
+type Obfs4Client struct {
+	ServerAddress string
+	Config        obfs4.ClientConfig
+	Dialer        proxy.Dialer
+	LogDir        *string
+}
+
+func (client *Obfs4Client) Dial() (net.Conn, error) {
+	netConn, dialError := dialWithTimeout(client.Dialer, client.ServerAddress)
+	if dialError != nil {
+		return nil, dialError
+	}
+
+	if client.LogDir != nil {
+		locketConn, locketError := locketgo.NewLocketConn(netConn, *client.LogDir, "Obfs4Client")
+		if locketError != nil {
+			_ = netConn.Close()
+			return nil, locketError
+		}
+		netConn = locketConn
+	}
+
+	transportConn, handshakeError := obfs4.NewClientConn(netConn, client.Config)
+	if handshakeError != nil {
+		_ = netConn.Close()
+		return nil, handshakeError
+	}
+
+	return transportConn, nil
+}
+
+// Obfs4Server listens for obfs4 clients.
+type Obfs4Server struct {
+	Address string
+	Config  obfs4.ServerConfig
+}
+
+func (server *Obfs4Server) Listen() (net.Listener, error) {
+	ln, err := net.Listen("tcp", server.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := obfs4.NewListener(ln, server.Config)
+	if err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+// parseIATMode accepts the iat-mode as a string, as in bridge lines, or as a
+// JSON number.
+func parseIATMode(mode interface{}) (obfs4.IATMode, error) {
+	switch mode := mode.(type) {
+	case nil:
+		return obfs4.IATNone, nil
+	case string:
+		return obfs4.ParseIATMode(mode)
+	case float64:
+		return obfs4.ParseIATMode(strconv.FormatFloat(mode, 'f', -1, 64))
+	default:
+		return obfs4.IATNone, fmt.Errorf("invalid iat-mode %v", mode)
+	}
+}
+
+func ParseArgsObfs4Client(args string, dialer proxy.Dialer) (*Obfs4Client, error) {
+	var options Obfs4ClientOptions
+	if jsonError := json.Unmarshal([]byte(args), &options); jsonError != nil {
+		return nil, errors.New("obfs4 client options json decoding error")
+	}
+
+	iatMode, err := parseIATMode(options.IATMode)
+	if err != nil {
+		return nil, err
+	}
+	config := obfs4.ClientConfig{IATMode: iatMode}
+
+	switch {
+	case options.Cert != "":
+		if err = config.ParseCert(options.Cert); err != nil {
+			return nil, err
+		}
+	case options.NodeID != "" && options.PublicKey != "":
+		if err = obfs4.DecodeHex(config.NodeID[:], "node-id", options.NodeID); err != nil {
+			return nil, err
+		}
+		if err = obfs4.DecodeHex(config.PublicKey[:], "public-key", options.PublicKey); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("obfs4 needs either the cert option or the node-id and public-key options")
+	}
+
+	return &Obfs4Client{ServerAddress: options.ServerAddress, Config: config, Dialer: dialer}, nil
+}
+
+func ParseArgsObfs4Server(args string, stateDir string) (*Obfs4Server, error) {
+	var options Obfs4ServerOptions
+	if jsonError := json.Unmarshal([]byte(args), &options); jsonError != nil {
+		return nil, errors.New("obfs4 server options json decoding error")
+	}
+
+	iatMode, err := parseIATMode(options.IATMode)
+	if err != nil {
+		return nil, err
+	}
+
+	var config obfs4.ServerConfig
+	if options.NodeID == "" && options.PrivateKey == "" {
+		if config, err = obfs4.LoadServerState(stateDir, iatMode); err != nil {
+			return nil, err
+		}
+	} else {
+		config.IATMode = iatMode
+		if err = obfs4.DecodeHex(config.NodeID[:], "node-id", options.NodeID); err != nil {
+			return nil, err
+		}
+		if err = obfs4.DecodeHex(config.PrivateKey[:], "private-key", options.PrivateKey); err != nil {
+			return nil, err
+		}
+		if options.DrbgSeed == "" {
+			return nil, errors.New("obfs4 needs the drbg-seed option along with the private-key option")
+		}
+		if err = obfs4.DecodeHex(config.Seed[:], "drbg-seed", options.DrbgSeed); err != nil {
+			return nil, err
+		}
+	}
+
+	address := options.ServerAddress
+	if options.BindAddress != nil {
+		address = *options.BindAddress
+	}
+	if address == "" {
+		return nil, errors.New("obfs4 needs a serverAddress or bindAddress to listen on")
+	}
+
+	return &Obfs4Server{Address: address, Config: config}, nil
+}
+
+// ClientArgsObfs4Server returns the options an obfs4 client needs to connect
+// to a server started with args, in the form of a bridge line's arguments.
+func ClientArgsObfs4Server(args string, stateDir string) (map[string]string, error) {
+	server, err := ParseArgsObfs4Server(args, stateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := server.Config.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{
+		"cert":     client.Cert(),
+		"iat-mode": strconv.Itoa(int(server.Config.IATMode)),
+	}, nil
+}
+
+func CreateObfs4Configs(address string, bindAddress *string) error {
+	serverConfig, err := obfs4.NewServerConfig(obfs4.IATNone)
+	if err != nil {
+		return err
+	}
+
+	clientConfig, err := serverConfig.ClientConfig()
+	if err != nil {
+		return err
+	}
+
+	obfs4ServerConfig := Obfs4ServerOptions{
+		ServerAddress: address,
+		BindAddress:   bindAddress,
+		NodeID:        hex.EncodeToString(serverConfig.NodeID[:]),
+		PrivateKey:    hex.EncodeToString(serverConfig.PrivateKey[:]),
+		DrbgSeed:      hex.EncodeToString(serverConfig.Seed[:]),
+		IATMode:       "0",
+		Transport:     "obfs4",
+	}
+
+	obfs4ClientConfig := Obfs4ClientOptions{
+		ServerAddress: address,
+		Cert:          clientConfig.Cert(),
+		IATMode:       "0",
+		Transport:     "obfs4",
+	}
+
+	serverJsonBytes, marshalError := json.MarshalIndent(obfs4ServerConfig, "", "  ")
+	if marshalError != nil {
+		return marshalError
+	}
+
+	clientJsonBytes, marshalError := json.MarshalIndent(obfs4ClientConfig, "", "  ")
+	if marshalError != nil {
+		return marshalError
+	}
+
+	// The server config holds the bridge's private key.
+	serverJsonError := os.WriteFile("Obfs4ServerConfig.json", serverJsonBytes, 0600)
+	if serverJsonError != nil {
+		return serverJsonError
+	}
+
+	clientJsonError := os.WriteFile("Obfs4ClientConfig.json", clientJsonBytes, 0644)
+	if clientJsonError != nil {
+		return clientJsonError
+	}
+
+	return nil
+}
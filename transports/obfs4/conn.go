@@ -0,0 +1,442 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+// Package obfs4 implements the obfs4 pluggable transport, as specified in
+// doc/obfs4-spec.txt. It interoperates with obfs4proxy and lyrebird bridges
+// and clients.
+package obfs4
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// IATMode is how much a connection obfuscates the timing of its writes.
+type IATMode int
+
+const (
+	// IATNone writes data as soon as it is sent.
+	IATNone IATMode = iota
+
+	// IATEnabled splits writes into segments with random delays between them.
+	IATEnabled
+
+	// IATParanoid also picks a random size for each segment.
+	IATParanoid
+)
+
+// ParseIATMode parses an iat-mode argument, "0", "1" or "2".
+func ParseIATMode(mode string) (IATMode, error) {
+	switch mode {
+	case "", "0":
+		return IATNone, nil
+	case "1":
+		return IATEnabled, nil
+	case "2":
+		return IATParanoid, nil
+	default:
+		return IATNone, fmt.Errorf("invalid iat-mode %q", mode)
+	}
+}
+
+const (
+	clientHandshakeTimeout = time.Minute
+	serverHandshakeTimeout = 30 * time.Second
+
+	// maxCloseDelay is the longest a server waits, in seconds, before closing
+	// a connection whose handshake failed.
+	maxCloseDelay = 60
+)
+
+// Conn is an obfs4 connection over another connection, once the handshake
+// has finished.
+type Conn struct {
+	net.Conn
+
+	isServer   bool
+	iatMode    IATMode
+	lengthDist *weightedDist
+	iatDist    *weightedDist
+
+	readMutex     sync.Mutex
+	decoder       *frameDecoder
+	receiveBuffer bytes.Buffer
+	decoded       bytes.Buffer
+	readBuffer    []byte
+
+	writeMutex sync.Mutex
+	encoder    *frameEncoder
+}
+
+func newConn(conn net.Conn, isServer bool, iatMode IATMode, seed []byte) *Conn {
+	obfsConn := &Conn{
+		Conn:       conn,
+		isServer:   isServer,
+		iatMode:    iatMode,
+		lengthDist: newWeightedDist(seed, 0, maximumSegmentLength),
+		readBuffer: make([]byte, maxHandshakeLength),
+	}
+	if iatMode != IATNone {
+		obfsConn.iatDist = newWeightedDist(iatSeed(seed), 0, maxIATDelay)
+	}
+
+	return obfsConn
+}
+
+// setKeys starts the frame encoder and decoder with the key material from
+// the handshake. The first half is for the frames the server sends.
+func (conn *Conn) setKeys(keySeed []byte) {
+	keyMaterial := ntorKdf(keySeed, keyLength*2)
+	if conn.isServer {
+		conn.encoder = newFrameEncoder(keyMaterial[:keyLength])
+		conn.decoder = newFrameDecoder(keyMaterial[keyLength:])
+	} else {
+		conn.encoder = newFrameEncoder(keyMaterial[keyLength:])
+		conn.decoder = newFrameDecoder(keyMaterial[:keyLength])
+	}
+}
+
+// NewClientConn runs the client handshake with the bridge described by
+// config over conn, and returns the obfs4 connection.
+func NewClientConn(conn net.Conn, config ClientConfig) (*Conn, error) {
+	// The bridge sends its own seed for the length distribution once the
+	// handshake is done.
+	seed, err := NewSeed()
+	if err != nil {
+		return nil, err
+	}
+	obfsConn := newConn(conn, false, config.IATMode, seed[:])
+
+	ephemeral, err := newKeypair()
+	if err != nil {
+		return nil, err
+	}
+	handshake := &clientHandshake{nodeID: config.NodeID[:], identityPublic: config.PublicKey[:], ephemeral: ephemeral}
+	request, err := handshake.request()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = conn.SetDeadline(time.Now().Add(clientHandshakeTimeout)); err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	for {
+		n, err := conn.Read(obfsConn.readBuffer)
+		if err != nil {
+			return nil, err
+		}
+		obfsConn.receiveBuffer.Write(obfsConn.readBuffer[:n])
+
+		handshakeLength, keySeed, err := handshake.parseResponse(obfsConn.receiveBuffer.Bytes())
+		if err == errMarkNotFoundYet {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		// Anything after the handshake is frames, starting with the seed.
+		obfsConn.receiveBuffer.Next(handshakeLength)
+		obfsConn.setKeys(keySeed)
+		break
+	}
+
+	if err = conn.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+
+	return obfsConn, nil
+}
+
+// Read reads application data, decoding frames off the connection until
+// there is some.
+func (conn *Conn) Read(b []byte) (int, error) {
+	conn.readMutex.Lock()
+	defer conn.readMutex.Unlock()
+
+	var err error
+	for conn.decoded.Len() == 0 && err == nil {
+		err = conn.readPackets()
+	}
+
+	// Hand over whatever was decoded before the error.
+	if conn.decoded.Len() > 0 {
+		n, _ := conn.decoded.Read(b)
+		return n, nil
+	}
+
+	return 0, err
+}
+
+func (conn *Conn) readPackets() error {
+	n, readErr := conn.Conn.Read(conn.readBuffer)
+	conn.receiveBuffer.Write(conn.readBuffer[:n])
+
+	for conn.receiveBuffer.Len() > 0 {
+		packet, err := conn.decoder.decode(&conn.receiveBuffer)
+		if err == errAgain {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		packetType, data, err := parsePacket(packet)
+		if err != nil {
+			return err
+		}
+
+		switch packetType {
+		case packetTypePayload:
+			conn.decoded.Write(data)
+		case packetTypePrngSeed:
+			// Clients take on their bridge's distributions.
+			if len(data) == SeedLength && !conn.isServer {
+				conn.writeMutex.Lock()
+				conn.lengthDist.reset(data)
+				if conn.iatDist != nil {
+					conn.iatDist.reset(iatSeed(data))
+				}
+				conn.writeMutex.Unlock()
+			}
+		default:
+			// Unknown packet types are ignored, for forward compatibility.
+		}
+	}
+
+	return readErr
+}
+
+// Write sends b as payload packets, padded to a length drawn from the
+// length distribution.
+func (conn *Conn) Write(b []byte) (int, error) {
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+
+	var burst bytes.Buffer
+	for remaining := b; len(remaining) > 0; {
+		chunk := remaining
+		if len(chunk) > maxPacketPayloadLength {
+			chunk = chunk[:maxPacketPayloadLength]
+		}
+		if err := appendPacket(&burst, conn.encoder, packetTypePayload, chunk, 0); err != nil {
+			return 0, err
+		}
+		remaining = remaining[len(chunk):]
+	}
+	if err := appendPadding(&burst, conn.encoder, conn.lengthDist.sample()); err != nil {
+		return 0, err
+	}
+
+	// A partial write is fatal, since the encoder has moved on.
+	if conn.iatMode == IATNone {
+		if _, err := conn.Conn.Write(burst.Bytes()); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	for burst.Len() > 0 {
+		segmentLength := maximumSegmentLength
+		if conn.iatMode == IATParanoid {
+			segmentLength = conn.lengthDist.sample()
+			if segmentLength == 0 {
+				segmentLength = 1
+			}
+		}
+		if _, err := conn.Conn.Write(burst.Next(segmentLength)); err != nil {
+			return 0, err
+		}
+		// The delay is in units of 100 microseconds.
+		time.Sleep(time.Duration(conn.iatDist.sample()*100) * time.Microsecond)
+	}
+
+	return len(b), nil
+}
+
+// Listener accepts obfs4 connections. Handshakes run in the background, so
+// Accept returns only connections that completed one.
+type Listener struct {
+	ln         net.Listener
+	config     ServerConfig
+	public     [PublicKeyLength]byte
+	replays    *replayFilter
+	closeDelay time.Duration
+
+	conns  chan *Conn
+	failed chan struct{}
+	err    error
+}
+
+// NewListener accepts obfs4 connections for the bridge described by config
+// on ln.
+func NewListener(ln net.Listener, config ServerConfig) (*Listener, error) {
+	public, err := publicKeyFromPrivate(config.PrivateKey[:])
+	if err != nil {
+		return nil, err
+	}
+
+	// Each bridge waits its own length of time before closing a failed
+	// connection, so the delay does not identify obfs4.
+	delay := rand.New(newHashDrbg(config.Seed[:])).Intn(maxCloseDelay)
+
+	listener := &Listener{
+		ln:         ln,
+		config:     config,
+		public:     public,
+		replays:    newReplayFilter(),
+		closeDelay: time.Duration(delay) * time.Second,
+		conns:      make(chan *Conn),
+		failed:     make(chan struct{}),
+	}
+	go listener.acceptLoop()
+
+	return listener, nil
+}
+
+func (listener *Listener) acceptLoop() {
+	for {
+		conn, err := listener.ln.Accept()
+		if err != nil {
+			listener.err = err
+			close(listener.failed)
+			return
+		}
+
+		go listener.handshake(conn)
+	}
+}
+
+func (listener *Listener) handshake(conn net.Conn) {
+	started := time.Now()
+	obfsConn, err := listener.serverHandshake(conn, started)
+	if err != nil {
+		if err == errInvalidHandshake || err == errReplayedHandshake {
+			listener.closeAfterDelay(conn, started)
+		} else {
+			_ = conn.Close()
+		}
+		return
+	}
+
+	select {
+	case listener.conns <- obfsConn:
+	case <-listener.failed:
+		_ = conn.Close()
+	}
+}
+
+func (listener *Listener) serverHandshake(conn net.Conn, started time.Time) (*Conn, error) {
+	obfsConn := newConn(conn, true, listener.config.IATMode, listener.config.Seed[:])
+	handshake := &serverHandshake{
+		nodeID:          listener.config.NodeID[:],
+		identityPrivate: listener.config.PrivateKey[:],
+		identityPublic:  listener.public[:],
+		replays:         listener.replays,
+	}
+
+	if err := conn.SetDeadline(started.Add(serverHandshakeTimeout)); err != nil {
+		return nil, err
+	}
+
+	for {
+		n, err := conn.Read(obfsConn.readBuffer)
+		if err != nil {
+			return nil, err
+		}
+		obfsConn.receiveBuffer.Write(obfsConn.readBuffer[:n])
+
+		err = handshake.parseRequest(obfsConn.receiveBuffer.Bytes())
+		if err == errMarkNotFoundYet {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		break
+	}
+	obfsConn.receiveBuffer.Reset()
+
+	response, keySeed, err := handshake.response()
+	if err != nil {
+		return nil, err
+	}
+	obfsConn.setKeys(keySeed)
+
+	// The seed frame goes out with the response, which is why the response
+	// can have less padding.
+	var out bytes.Buffer
+	out.Write(response)
+	if err = appendPacket(&out, obfsConn.encoder, packetTypePrngSeed, listener.config.Seed[:], 0); err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write(out.Bytes()); err != nil {
+		return nil, err
+	}
+
+	if err = conn.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+
+	return obfsConn, nil
+}
+
+// closeAfterDelay reads and throws away data from a connection whose
+// handshake failed, then closes it, so that a prober can't tell from when
+// the connection closes that the server speaks obfs4.
+func (listener *Listener) closeAfterDelay(conn net.Conn, started time.Time) {
+	defer conn.Close()
+
+	deadline := started.Add(serverHandshakeTimeout + listener.closeDelay)
+	if time.Now().After(deadline) || conn.SetReadDeadline(deadline) != nil {
+		return
+	}
+	_, _ = io.Copy(io.Discard, conn)
+}
+
+// Accept returns the next connection that completed the handshake.
+func (listener *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-listener.conns:
+		return conn, nil
+	case <-listener.failed:
+		return nil, listener.err
+	}
+}
+
+// Close stops the listener. Handshakes that are still running are dropped.
+func (listener *Listener) Close() error {
+	return listener.ln.Close()
+}
+
+// Addr returns the address the listener is bound to.
+func (listener *Listener) Addr() net.Addr {
+	return listener.ln.Addr()
+}
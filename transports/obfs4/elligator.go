@@ -0,0 +1,200 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package obfs4
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+
+	"filippo.io/edwards25519"
+	"filippo.io/edwards25519/field"
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	// PublicKeyLength is the length of a Curve25519 public key.
+	PublicKeyLength = 32
+
+	// PrivateKeyLength is the length of a Curve25519 private key.
+	PrivateKeyLength = 32
+
+	// RepresentativeLength is the length of the Elligator 2 representative
+	// of a public key.
+	RepresentativeLength = 32
+)
+
+// Curve25519 as a Montgomery curve, v² = u³ + A·u² + u over GF(2²⁵⁵ - 19).
+// The arithmetic is constant time, since it runs on private keys.
+var (
+	feOne    = new(field.Element).One()
+	feA      = new(field.Element).Mult32(feOne, 486662)
+	feNegA   = new(field.Element).Negate(feA)
+	feNegTwo = new(field.Element).Negate(new(field.Element).Mult32(feOne, 2))
+
+	// lowOrderPoint is a point of order 8 on the Edwards form of the curve.
+	lowOrderPoint = mustPoint("26e8958fc2b227b045c3f489f2ef98f0d5dfac05d3c63339b13802886d53fc05")
+)
+
+func mustPoint(encoded string) *edwards25519.Point {
+	bytes, err := hex.DecodeString(encoded)
+	if err != nil {
+		panic(err)
+	}
+	point, err := new(edwards25519.Point).SetBytes(bytes)
+	if err != nil {
+		panic(err)
+	}
+
+	return point
+}
+
+// keypair is a Curve25519 keypair whose public key has an Elligator 2
+// representative, so that it can be sent as uniformly random bytes.
+type keypair struct {
+	private        [PrivateKeyLength]byte
+	public         [PublicKeyLength]byte
+	representative [RepresentativeLength]byte
+}
+
+// newKeypair returns a keypair for a random private key. About half of all
+// public keys have a representative, so it tries until it finds one.
+func newKeypair() (*keypair, error) {
+	for tries := 0; tries < 128; tries++ {
+		var pair keypair
+		if _, err := rand.Read(pair.private[:]); err != nil {
+			return nil, err
+		}
+		// The tweak picks one of the two representatives of the public key,
+		// and fills the top two bits, which are always clear, with random
+		// bits that the other side ignores.
+		var tweak [1]byte
+		if _, err := rand.Read(tweak[:]); err != nil {
+			return nil, err
+		}
+
+		u := dirtyPublicKey(&pair.private)
+		representative, ok := publicKeyToRepresentative(u, tweak[0])
+		if !ok {
+			continue
+		}
+		copy(pair.public[:], u.Bytes())
+		pair.representative = representative
+
+		return &pair, nil
+	}
+
+	return nil, errors.New("could not generate a representable keypair")
+}
+
+// dirtyPublicKey returns the public key for private with a low order
+// component added, picked by the three low bits that clamping clears. A
+// clean public key is always in the prime order subgroup, which tells its
+// representative apart from random bytes. X25519 clears the same bits of
+// the private key, so the component drops out of every shared secret.
+func dirtyPublicKey(private *[PrivateKeyLength]byte) *field.Element {
+	// Clamping only fails for a scalar of the wrong length.
+	scalar, _ := edwards25519.NewScalar().SetBytesWithClamping(private[:])
+	point := new(edwards25519.Point).ScalarBaseMult(scalar)
+
+	var lowBits [32]byte
+	lowBits[0] = private[0] & 7
+	lowScalar, _ := edwards25519.NewScalar().SetCanonicalBytes(lowBits[:])
+	point.Add(point, new(edwards25519.Point).ScalarMult(lowScalar, lowOrderPoint))
+
+	u, _ := new(field.Element).SetBytes(point.BytesMontgomery())
+	return u
+}
+
+// publicKeyFromPrivate returns the public key for a static private key, such
+// as a bridge's identity key.
+func publicKeyFromPrivate(private []byte) ([PublicKeyLength]byte, error) {
+	var public [PublicKeyLength]byte
+	key, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return public, err
+	}
+	copy(public[:], key)
+
+	return public, nil
+}
+
+// publicKeyToRepresentative is the inverse of the Elligator 2 map. The point
+// u has the representatives r = √(-u / 2(u + A)) and r = √(-(u + A) / 2u)
+// when -2u(u + A) is a square, and the low bit of tweak picks one. Of the
+// two roots, the one no greater than (p - 1) / 2 is used, and the top two
+// bits of tweak fill the top two bits of the representative.
+func publicKeyToRepresentative(u *field.Element, tweak byte) ([RepresentativeLength]byte, bool) {
+	var representative [RepresentativeLength]byte
+
+	uPlusA := new(field.Element).Add(u, feA)
+	denominator := new(field.Element).Multiply(u, uPlusA)
+	denominator.Multiply(denominator, feNegTwo)
+	inverseRoot, isSquare := new(field.Element).SqrtRatio(feOne, denominator)
+
+	r := new(field.Element).Select(uPlusA, u, int(tweak&1))
+	r.Multiply(r, inverseRoot)
+	// r > (p - 1) / 2 exactly when 2r wraps around p, which makes it odd.
+	doubled := new(field.Element).Add(r, r)
+	r.Select(new(field.Element).Negate(r), r, doubled.IsNegative())
+
+	copy(representative[:], r.Bytes())
+	representative[31] |= tweak & 0xc0
+	return representative, isSquare == 1
+}
+
+// representativeToPublicKey is the Elligator 2 map, with the non-square 2:
+//
+//	w = -A / (1 + 2r²)
+//	u = w if w³ + A·w² + w is a square, and -w - A if not
+//
+// The top two bits of the representative are ignored.
+func representativeToPublicKey(representative []byte) [PublicKeyLength]byte {
+	var clamped [RepresentativeLength]byte
+	copy(clamped[:], representative)
+	clamped[31] &= 0x3f
+	r, _ := new(field.Element).SetBytes(clamped[:])
+
+	w := new(field.Element).Square(r)
+	w.Add(w, w)
+	w.Add(w, feOne)
+	w.Invert(w)
+	w.Multiply(w, feNegA)
+
+	// w³ + A·w² + w = w·(w·(w + A) + 1)
+	curve := new(field.Element).Add(w, feA)
+	curve.Multiply(curve, w)
+	curve.Add(curve, feOne)
+	curve.Multiply(curve, w)
+	_, isSquare := new(field.Element).SqrtRatio(curve, feOne)
+
+	other := new(field.Element).Negate(w)
+	other.Subtract(other, feA)
+	u := new(field.Element).Select(w, other, isSquare)
+
+	var public [PublicKeyLength]byte
+	copy(public[:], u.Bytes())
+	return public
+}
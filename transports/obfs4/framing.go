@@ -0,0 +1,202 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package obfs4
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"math/big"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	// maximumSegmentLength is the largest frame, sized to fit a TCP segment.
+	maximumSegmentLength = 1500 - (40 + 12)
+
+	lengthLength = 2
+
+	// frameOverhead is the obfuscated length and the secretbox tag.
+	frameOverhead = lengthLength + secretbox.Overhead
+
+	// maximumFramePayloadLength is the largest packet a frame can carry.
+	maximumFramePayloadLength = maximumSegmentLength - frameOverhead
+
+	minFrameLength = frameOverhead - lengthLength
+	maxFrameLength = maximumSegmentLength - lengthLength
+
+	secretboxKeyLength = 32
+	noncePrefixLength  = 16
+
+	// keyLength is the key material for one direction: the secretbox key,
+	// the nonce prefix and the length obfuscation DRBG seed.
+	keyLength = secretboxKeyLength + noncePrefixLength + SeedLength
+)
+
+var (
+	// errAgain is returned by decode when a whole frame has not arrived yet.
+	errAgain = errors.New("obfs4: more data is needed")
+
+	errTagMismatch     = errors.New("obfs4: frame failed to authenticate")
+	errCounterWrapped  = errors.New("obfs4: frame counter wrapped")
+	errPayloadTooLarge = errors.New("obfs4: frame payload is too large")
+)
+
+// frameNonce is the secretbox nonce, a fixed prefix and a big-endian counter
+// that starts at 1 and is never sent.
+type frameNonce struct {
+	prefix  [noncePrefixLength]byte
+	counter uint64
+}
+
+func (nonce *frameNonce) next() ([24]byte, error) {
+	var out [24]byte
+	if nonce.counter == 0 {
+		return out, errCounterWrapped
+	}
+	copy(out[:], nonce.prefix[:])
+	binary.BigEndian.PutUint64(out[noncePrefixLength:], nonce.counter)
+	nonce.counter++
+
+	return out, nil
+}
+
+// frameEncoder seals packets in frames with obfuscated lengths.
+type frameEncoder struct {
+	key   [secretboxKeyLength]byte
+	nonce frameNonce
+	drbg  *hashDrbg
+}
+
+func newFrameEncoder(keyMaterial []byte) *frameEncoder {
+	encoder := &frameEncoder{nonce: frameNonce{counter: 1}}
+	copy(encoder.key[:], keyMaterial[:secretboxKeyLength])
+	copy(encoder.nonce.prefix[:], keyMaterial[secretboxKeyLength:secretboxKeyLength+noncePrefixLength])
+	encoder.drbg = newHashDrbg(keyMaterial[secretboxKeyLength+noncePrefixLength : keyLength])
+
+	return encoder
+}
+
+// encode appends a frame holding payload to out.
+func (encoder *frameEncoder) encode(out *bytes.Buffer, payload []byte) error {
+	if len(payload) > maximumFramePayloadLength {
+		return errPayloadTooLarge
+	}
+
+	nonce, err := encoder.nonce.next()
+	if err != nil {
+		return err
+	}
+	box := secretbox.Seal(nil, payload, &nonce, &encoder.key)
+
+	mask := encoder.drbg.NextBlock()
+	var length [lengthLength]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(box))^binary.BigEndian.Uint16(mask[:]))
+	out.Write(length[:])
+	out.Write(box)
+
+	return nil
+}
+
+// frameDecoder opens the frames a frameEncoder made.
+type frameDecoder struct {
+	key   [secretboxKeyLength]byte
+	nonce frameNonce
+	drbg  *hashDrbg
+
+	nextNonce         [24]byte
+	nextLength        int
+	nextLengthInvalid bool
+}
+
+func newFrameDecoder(keyMaterial []byte) *frameDecoder {
+	decoder := &frameDecoder{nonce: frameNonce{counter: 1}}
+	copy(decoder.key[:], keyMaterial[:secretboxKeyLength])
+	copy(decoder.nonce.prefix[:], keyMaterial[secretboxKeyLength:secretboxKeyLength+noncePrefixLength])
+	decoder.drbg = newHashDrbg(keyMaterial[secretboxKeyLength+noncePrefixLength : keyLength])
+
+	return decoder
+}
+
+// decode takes the next frame off frames and returns its payload, or
+// errAgain if the frame has not all arrived.
+func (decoder *frameDecoder) decode(frames *bytes.Buffer) ([]byte, error) {
+	if decoder.nextLength == 0 {
+		if frames.Len() < lengthLength {
+			return nil, errAgain
+		}
+
+		nonce, err := decoder.nonce.next()
+		if err != nil {
+			return nil, err
+		}
+		decoder.nextNonce = nonce
+
+		mask := decoder.drbg.NextBlock()
+		length := int(binary.BigEndian.Uint16(frames.Next(lengthLength)) ^ binary.BigEndian.Uint16(mask[:]))
+		if length < minFrameLength || length > maxFrameLength {
+			// Rather than fail at once, which would tell a prober where the
+			// length was, wait for a random amount of data and fail the tag
+			// check then.
+			decoder.nextLengthInvalid = true
+			length = minFrameLength + randomInt(maxFrameLength-minFrameLength+1)
+		}
+		decoder.nextLength = length
+	}
+
+	if frames.Len() < decoder.nextLength {
+		return nil, errAgain
+	}
+
+	payload, ok := secretbox.Open(nil, frames.Next(decoder.nextLength), &decoder.nextNonce, &decoder.key)
+	if !ok || decoder.nextLengthInvalid {
+		return nil, errTagMismatch
+	}
+	decoder.nextLength = 0
+
+	return payload, nil
+}
+
+// randomUint64 returns a random uint64.
+func randomUint64() uint64 {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic("obfs4: could not read random bytes: " + err.Error())
+	}
+
+	return binary.BigEndian.Uint64(buf[:])
+}
+
+// randomInt returns a uniformly random int in [0, n).
+func randomInt(n int) int {
+	value, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		panic("obfs4: could not read random bytes: " + err.Error())
+	}
+
+	return int(value.Int64())
+}
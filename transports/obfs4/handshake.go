@@ -0,0 +1,286 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package obfs4
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	maxHandshakeLength = 8192
+
+	markLength = sha256.Size / 2
+	macLength  = sha256.Size / 2
+
+	clientMinHandshakeLength = RepresentativeLength + markLength + macLength
+	serverMinHandshakeLength = RepresentativeLength + authLength + markLength + macLength
+
+	// The smallest request and response are the same size. The server's
+	// padding can be shorter than the spec's ServerMinPadLength because the
+	// PRNG seed frame always follows it.
+	clientMinPadLength = (serverMinHandshakeLength + inlineSeedFrameLength) - clientMinHandshakeLength
+	clientMaxPadLength = maxHandshakeLength - clientMinHandshakeLength
+	serverMinPadLength = 0
+	serverMaxPadLength = maxHandshakeLength - (serverMinHandshakeLength + inlineSeedFrameLength)
+)
+
+var (
+	// errMarkNotFoundYet means the handshake may still be valid once more of
+	// it arrives.
+	errMarkNotFoundYet = errors.New("obfs4: handshake mark not found yet")
+
+	errInvalidHandshake  = errors.New("obfs4: invalid handshake")
+	errReplayedHandshake = errors.New("obfs4: replayed handshake")
+	errNtorFailed        = errors.New("obfs4: ntor handshake failed")
+)
+
+// epochHour is E, the hours since the UNIX epoch, as a decimal string.
+func epochHour(offset int64) []byte {
+	return []byte(strconv.FormatInt(time.Now().Unix()/3600+offset, 10))
+}
+
+// handshakeMAC is HMAC-SHA256-128 keyed with B | NODEID.
+func handshakeMAC(identityPublic []byte, nodeID []byte, parts ...[]byte) []byte {
+	key := make([]byte, 0, len(identityPublic)+len(nodeID))
+	key = append(key, identityPublic...)
+	key = append(key, nodeID...)
+
+	mac := hmac.New(sha256.New, key)
+	for _, part := range parts {
+		_, _ = mac.Write(part)
+	}
+	return mac.Sum(nil)[:macLength]
+}
+
+// clientHandshake is the client's half of the handshake.
+type clientHandshake struct {
+	nodeID         []byte
+	identityPublic []byte
+	ephemeral      *keypair
+	epochHour      []byte
+}
+
+// request returns X' | P_C | M_C | MAC_C.
+func (handshake *clientHandshake) request() ([]byte, error) {
+	padding := make([]byte, clientMinPadLength+randomInt(clientMaxPadLength-clientMinPadLength+1))
+	if _, err := rand.Read(padding); err != nil {
+		return nil, err
+	}
+
+	var request bytes.Buffer
+	request.Write(handshake.ephemeral.representative[:])
+	request.Write(padding)
+	request.Write(handshakeMAC(handshake.identityPublic, handshake.nodeID, handshake.ephemeral.representative[:]))
+
+	handshake.epochHour = epochHour(0)
+	request.Write(handshakeMAC(handshake.identityPublic, handshake.nodeID, request.Bytes(), handshake.epochHour))
+
+	return request.Bytes(), nil
+}
+
+// parseResponse checks the server's Y' | AUTH | P_S | M_S | MAC_S. It returns
+// how much of response the handshake took up, and KEY_SEED.
+func (handshake *clientHandshake) parseResponse(response []byte) (int, []byte, error) {
+	if len(response) < serverMinHandshakeLength {
+		return 0, nil, errMarkNotFoundYet
+	}
+
+	representative := response[:RepresentativeLength]
+	serverAuth := response[RepresentativeLength : RepresentativeLength+authLength]
+	mark := handshakeMAC(handshake.identityPublic, handshake.nodeID, representative)
+
+	// The server's data can follow the handshake, so the mark has to be
+	// searched for.
+	position := findMark(mark, response, RepresentativeLength+authLength+serverMinPadLength, false)
+	if position == -1 {
+		if len(response) >= maxHandshakeLength {
+			return 0, nil, errInvalidHandshake
+		}
+		return 0, nil, errMarkNotFoundYet
+	}
+
+	end := position + markLength
+	expected := handshakeMAC(handshake.identityPublic, handshake.nodeID, response[:end], handshake.epochHour)
+	if !hmac.Equal(expected, response[end:end+macLength]) {
+		return 0, nil, errInvalidHandshake
+	}
+
+	serverPublic := representativeToPublicKey(representative)
+	keySeed, auth, ok := ntorClient(handshake.ephemeral, serverPublic[:], handshake.identityPublic, handshake.nodeID)
+	if !ok || !authEqual(auth, serverAuth) {
+		return 0, nil, errNtorFailed
+	}
+
+	return end + macLength, keySeed, nil
+}
+
+// serverHandshake is the server's half of the handshake.
+type serverHandshake struct {
+	nodeID          []byte
+	identityPrivate []byte
+	identityPublic  []byte
+	replays         *replayFilter
+
+	clientPublic [PublicKeyLength]byte
+	epochHour    []byte
+}
+
+// parseRequest checks the client's X' | P_C | M_C | MAC_C.
+func (handshake *serverHandshake) parseRequest(request []byte) error {
+	if len(request) < clientMinHandshakeLength {
+		return errMarkNotFoundYet
+	}
+
+	representative := request[:RepresentativeLength]
+	mark := handshakeMAC(handshake.identityPublic, handshake.nodeID, representative)
+
+	// The client can't send anything more until the server answers, so the
+	// mark and MAC are the last thing it sent.
+	position := findMark(mark, request, RepresentativeLength+clientMinPadLength, true)
+	if position == -1 {
+		if len(request) >= maxHandshakeLength {
+			return errInvalidHandshake
+		}
+		return errMarkNotFoundYet
+	}
+
+	end := position + markLength
+	received := request[end : end+macLength]
+	found := false
+	// Allow for the clocks being up to an hour apart. All three MACs are
+	// checked so the time taken does not depend on which matched.
+	for _, offset := range []int64{0, -1, 1} {
+		hour := epochHour(offset)
+		if hmac.Equal(handshakeMAC(handshake.identityPublic, handshake.nodeID, request[:end], hour), received) {
+			found = true
+			handshake.epochHour = hour
+		}
+	}
+	if !found {
+		return errInvalidHandshake
+	}
+	if handshake.replays.seen(received) {
+		return errReplayedHandshake
+	}
+
+	handshake.clientPublic = representativeToPublicKey(representative)
+	return nil
+}
+
+// response completes the ntor handshake and returns Y' | AUTH | P_S | M_S |
+// MAC_S, and KEY_SEED.
+func (handshake *serverHandshake) response() ([]byte, []byte, error) {
+	ephemeral, err := newKeypair()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keySeed, auth, ok := ntorServer(handshake.clientPublic[:], ephemeral, handshake.identityPrivate, handshake.identityPublic, handshake.nodeID)
+	if !ok {
+		return nil, nil, errNtorFailed
+	}
+
+	padding := make([]byte, serverMinPadLength+randomInt(serverMaxPadLength-serverMinPadLength+1))
+	if _, err = rand.Read(padding); err != nil {
+		return nil, nil, err
+	}
+
+	var response bytes.Buffer
+	response.Write(ephemeral.representative[:])
+	response.Write(auth)
+	response.Write(padding)
+	response.Write(handshakeMAC(handshake.identityPublic, handshake.nodeID, ephemeral.representative[:]))
+	response.Write(handshakeMAC(handshake.identityPublic, handshake.nodeID, response.Bytes(), handshake.epochHour))
+
+	return response.Bytes(), keySeed, nil
+}
+
+// findMark returns where mark is in buf, with room for the MAC after it,
+// searching from start. If atEnd is set, the mark and MAC must end buf.
+func findMark(mark []byte, buf []byte, start int, atEnd bool) int {
+	end := len(buf)
+	if end > maxHandshakeLength {
+		end = maxHandshakeLength
+	}
+	if start > end || end-start < markLength+macLength {
+		return -1
+	}
+
+	if atEnd {
+		position := end - (markLength + macLength)
+		if !hmac.Equal(buf[position:position+markLength], mark) {
+			return -1
+		}
+		return position
+	}
+
+	position := bytes.Index(buf[start:end], mark)
+	if position == -1 || start+position+markLength+macLength > end {
+		return -1
+	}
+
+	return start + position
+}
+
+// replayFilter remembers the MACs of recent client handshakes, so that a
+// prober can't replay one to find out whether a server speaks obfs4.
+type replayFilter struct {
+	mutex sync.Mutex
+	macs  map[string]time.Time
+}
+
+// replayWindow covers every epoch hour a MAC can be accepted in.
+const replayWindow = 3 * time.Hour
+
+func newReplayFilter() *replayFilter {
+	return &replayFilter{macs: make(map[string]time.Time)}
+}
+
+// seen records mac and reports whether it was already recorded.
+func (filter *replayFilter) seen(mac []byte) bool {
+	filter.mutex.Lock()
+	defer filter.mutex.Unlock()
+
+	now := time.Now()
+	for key, added := range filter.macs {
+		if now.Sub(added) > replayWindow {
+			delete(filter.macs, key)
+		}
+	}
+
+	if _, ok := filter.macs[string(mac)]; ok {
+		return true
+	}
+	filter.macs[string(mac)] = now
+
+	return false
+}
@@ -0,0 +1,135 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package obfs4
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// NodeIDLength is the length of a bridge's node ID.
+const NodeIDLength = 20
+
+const authLength = sha256.Size
+
+var (
+	protoID = []byte("ntor-curve25519-sha256-1")
+	tMac    = []byte("ntor-curve25519-sha256-1:mac")
+	tKey    = []byte("ntor-curve25519-sha256-1:key_extract")
+	tVerify = []byte("ntor-curve25519-sha256-1:key_verify")
+	mExpand = []byte("ntor-curve25519-sha256-1:key_expand")
+)
+
+// ntorServer completes the server side of the ntor handshake with the
+// client's public key X, the server's ephemeral keypair (Y, y) and identity
+// keypair (B, b). It returns KEY_SEED and AUTH, and false if either shared
+// secret is zero.
+func ntorServer(clientPublic []byte, ephemeral *keypair, identityPrivate []byte, identityPublic []byte, nodeID []byte) ([]byte, []byte, bool) {
+	var secretInput bytes.Buffer
+	ok := writeSharedSecret(&secretInput, ephemeral.private[:], clientPublic)
+	ok = writeSharedSecret(&secretInput, identityPrivate, clientPublic) && ok
+
+	keySeed, auth := ntorCommon(secretInput, nodeID, identityPublic, clientPublic, ephemeral.public[:])
+	return keySeed, auth, ok
+}
+
+// ntorClient completes the client side of the ntor handshake with the
+// client's ephemeral keypair (X, x), the server's ephemeral public key Y and
+// the bridge's identity public key B.
+func ntorClient(ephemeral *keypair, serverPublic []byte, identityPublic []byte, nodeID []byte) ([]byte, []byte, bool) {
+	var secretInput bytes.Buffer
+	ok := writeSharedSecret(&secretInput, ephemeral.private[:], serverPublic)
+	ok = writeSharedSecret(&secretInput, ephemeral.private[:], identityPublic) && ok
+
+	keySeed, auth := ntorCommon(secretInput, nodeID, identityPublic, ephemeral.public[:], serverPublic)
+	return keySeed, auth, ok
+}
+
+func writeSharedSecret(secretInput *bytes.Buffer, private []byte, public []byte) bool {
+	shared, err := curve25519.X25519(private, public)
+	if err != nil {
+		// X25519 fails only when the result is all zeros.
+		secretInput.Write(make([]byte, curve25519.PointSize))
+		return false
+	}
+	secretInput.Write(shared)
+
+	return true
+}
+
+// ntorCommon derives KEY_SEED and AUTH from the two shared secrets in
+// secretInput. obfs4 differs from Tor's ntor here: the common suffix of
+// secret_input and auth_input is B | B | X | Y | PROTOID | ID, and that is
+// what both sides of every obfs4 implementation use.
+func ntorCommon(secretInput bytes.Buffer, nodeID []byte, identityPublic []byte, clientPublic []byte, serverPublic []byte) ([]byte, []byte) {
+	var suffix bytes.Buffer
+	suffix.Write(identityPublic)
+	suffix.Write(identityPublic)
+	suffix.Write(clientPublic)
+	suffix.Write(serverPublic)
+	suffix.Write(protoID)
+	suffix.Write(nodeID)
+	secretInput.Write(suffix.Bytes())
+
+	// KEY_SEED = H(secret_input, t_key)
+	keySeed := hmacSHA256(tKey, secretInput.Bytes())
+
+	// verify = H(secret_input, t_verify)
+	verify := hmacSHA256(tVerify, secretInput.Bytes())
+
+	// auth_input = verify | suffix | "Server"
+	authInput := bytes.NewBuffer(verify)
+	authInput.Write(suffix.Bytes())
+	authInput.WriteString("Server")
+	auth := hmacSHA256(tMac, authInput.Bytes())
+
+	return keySeed, auth
+}
+
+// ntorKdf extracts and expands KEY_SEED into length bytes of key material
+// with HKDF-SHA256.
+func ntorKdf(keySeed []byte, length int) []byte {
+	keyMaterial := make([]byte, length)
+	// HKDF only fails when asked for more than 255 hashes of output.
+	_, _ = io.ReadFull(hkdf.New(sha256.New, keySeed, tKey, mExpand), keyMaterial)
+
+	return keyMaterial
+}
+
+func hmacSHA256(key []byte, message []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write(message)
+	return mac.Sum(nil)
+}
+
+func authEqual(a []byte, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
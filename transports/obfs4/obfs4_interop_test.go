@@ -0,0 +1,175 @@
+package obfs4
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// These tests run against obfs4proxy, or lyrebird, which is its new name.
+// Set OBFS4PROXY to the path of the binary if it isn't on the PATH. The obfs4
+// interop workflow installs obfs4proxy and runs them.
+
+func lookPathObfs4proxy(t *testing.T) string {
+	if path := os.Getenv("OBFS4PROXY"); path != "" {
+		return path
+	}
+	for _, name := range []string{"obfs4proxy", "lyrebird"} {
+		if path, err := exec.LookPath(name); err == nil {
+			return path
+		}
+	}
+	t.Skip("obfs4proxy is not installed")
+
+	return ""
+}
+
+// runObfs4proxy starts obfs4proxy as a managed transport with env, and
+// returns the fields of the first line it writes that starts with method.
+func runObfs4proxy(t *testing.T, method string, env ...string) []string {
+	cmd := exec.Command(lookPathObfs4proxy(t))
+	cmd.Env = append(os.Environ(),
+		"TOR_PT_MANAGED_TRANSPORT_VER=1",
+		"TOR_PT_STATE_LOCATION="+t.TempDir(),
+		"TOR_PT_EXIT_ON_STDIN_CLOSE=1")
+	cmd.Env = append(cmd.Env, env...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = stdin.Close()
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+
+	lines := bufio.NewScanner(stdout)
+	for lines.Scan() {
+		fields := strings.Fields(lines.Text())
+		switch {
+		case len(fields) > 0 && fields[0] == method:
+			// Keep reading, so obfs4proxy never blocks on a full pipe.
+			go func() { _, _ = io.Copy(io.Discard, stdout) }()
+			return fields
+		case len(fields) > 0 && strings.HasSuffix(fields[0], "-ERROR"):
+			t.Fatalf("obfs4proxy failed: %s", lines.Text())
+		}
+	}
+	t.Fatalf("obfs4proxy exited without a %s line", method)
+
+	return nil
+}
+
+func echoListener(t *testing.T, ln net.Listener) {
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+}
+
+func checkInteropEcho(t *testing.T, conn net.Conn) {
+	sent := make([]byte, 64*1024)
+	_, _ = rand.Read(sent)
+	go func() { _, _ = conn.Write(sent) }()
+
+	received := make([]byte, len(sent))
+	_ = conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	if _, err := io.ReadFull(conn, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sent, received) {
+		t.Error("echoed data differs")
+	}
+}
+
+// An obfs4proxy bridge accepts this client.
+func TestInteropObfs4proxyServer(t *testing.T) {
+	orPort, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer orPort.Close()
+	echoListener(t, orPort)
+
+	// SMETHOD obfs4 127.0.0.1:port ARGS:cert=...,iat-mode=0
+	fields := runObfs4proxy(t, "SMETHOD",
+		"TOR_PT_SERVER_TRANSPORTS=obfs4",
+		"TOR_PT_SERVER_BINDADDR=obfs4-127.0.0.1:0",
+		"TOR_PT_ORPORT="+orPort.Addr().String())
+	if len(fields) < 4 || !strings.HasPrefix(fields[3], "ARGS:") {
+		t.Fatalf("unexpected SMETHOD line %q", fields)
+	}
+	var config ClientConfig
+	for _, arg := range strings.Split(strings.TrimPrefix(fields[3], "ARGS:"), ",") {
+		if cert := strings.TrimPrefix(arg, "cert="); cert != arg {
+			if err = config.ParseCert(cert); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	conn, err := net.Dial("tcp", fields[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	obfsConn, err := NewClientConn(conn, config)
+	if err != nil {
+		t.Fatalf("handshake with obfs4proxy failed: %s", err)
+	}
+	checkInteropEcho(t, obfsConn)
+}
+
+// An obfs4proxy client connects to this bridge.
+func TestInteropObfs4proxyClient(t *testing.T) {
+	server, err := NewServerConfig(IATNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := listen(t, server)
+	echoListener(t, listener)
+	client, _ := server.ClientConfig()
+
+	// CMETHOD obfs4 socks5 127.0.0.1:port
+	fields := runObfs4proxy(t, "CMETHOD", "TOR_PT_CLIENT_TRANSPORTS=obfs4")
+	if len(fields) < 4 {
+		t.Fatalf("unexpected CMETHOD line %q", fields)
+	}
+
+	// The bridge arguments go in the SOCKS username, with a NUL password.
+	auth := &proxy.Auth{User: "cert=" + client.Cert() + ";iat-mode=0", Password: "\x00"}
+	dialer, err := proxy.SOCKS5("tcp", fields[3], auth, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("obfs4proxy could not connect: %s", err)
+	}
+	defer conn.Close()
+	checkInteropEcho(t, conn)
+}
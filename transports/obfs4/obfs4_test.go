@@ -0,0 +1,461 @@
+package obfs4
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/edwards25519/field"
+	"golang.org/x/crypto/curve25519"
+)
+
+// doc/obfs4-spec.txt has no test vectors. These tests check SipHash and
+// Elligator 2 against published vectors, check ntor and the frame encoding
+// against values computed separately from the spec, and check that both sides
+// of each step agree. obfs4_interop_test.go runs against obfs4proxy itself.
+
+func mustHex(t *testing.T, encoded string) []byte {
+	decoded, err := hex.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return decoded
+}
+
+// The SipHash-2-4 vectors from the SipHash paper, with the key 00 01 .. 0f.
+func TestSipHash(t *testing.T) {
+	key := make([]byte, 16)
+	for i := range key {
+		key[i] = byte(i)
+	}
+
+	tests := []struct {
+		length int
+		want   uint64
+	}{
+		{0, 0x726fdb47dd0e0e31},
+		{15, 0xa129ca6149be45e5},
+	}
+	for _, test := range tests {
+		input := make([]byte, test.length)
+		for i := range input {
+			input[i] = byte(i)
+		}
+
+		hash := newSipHash(key)
+		// Write a byte at a time to check the streaming.
+		for i := range input {
+			_, _ = hash.Write(input[i : i+1])
+		}
+		if got := hash.Sum64(); got != test.want {
+			t.Errorf("SipHash of %d bytes = %#x, want %#x", test.length, got, test.want)
+		}
+	}
+}
+
+func TestHashDrbgDeterministic(t *testing.T) {
+	seed, err := NewSeed()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, second := newHashDrbg(seed[:]), newHashDrbg(seed[:])
+	for i := 0; i < 16; i++ {
+		if first.NextBlock() != second.NextBlock() {
+			t.Fatalf("block %d differs between DRBGs with the same seed", i)
+		}
+	}
+}
+
+// The edwards25519_XMD:SHA-512_ELL2_NU_ vectors from RFC 9380 whose field
+// element fits in a representative, with the Montgomery u of Q, in little
+// endian. The Edwards map of that suite is Elligator 2 on Curve25519.
+var elligatorVectors = []struct {
+	representative string
+	public         string
+}{
+	{"3b256e551a20cde58be94db087671cb7f6763a5d0f4a595694d59bd70aa3cf09", "f2a8dfadd7e40dc7e6c64e8af5e023090c767e109f8b94323f1f040c4f6adb36"},
+	{"3dd095ac149892f6cd1ba963078db82814f51f7d389f33ec2acb1bd58b1c9a04", "fb2d63e502946680191ca4d80a6244d9c5714285690de22df121df16ff7fe67c"},
+	{"a04fd250072f2a364abe81277b78aaee7e8d857ca5a3795bface37818a17b03c", "5ee9a1a73f3a5cc11ab786c420b95f253effb2176699b399ec2e492c5b9edf68"},
+}
+
+func TestElligatorVectors(t *testing.T) {
+	for _, vector := range elligatorVectors {
+		representative := mustHex(t, vector.representative)
+		public := representativeToPublicKey(representative)
+		if hex.EncodeToString(public[:]) != vector.public {
+			t.Errorf("representative %s maps to %x, want %s", vector.representative, public, vector.public)
+		}
+
+		// Each tweak gives one of the two representatives of u.
+		u, _ := new(field.Element).SetBytes(mustHex(t, vector.public))
+		found := false
+		for tweak := byte(0); tweak < 2; tweak++ {
+			inverse, ok := publicKeyToRepresentative(u, tweak)
+			if !ok {
+				t.Fatalf("%s has no representative", vector.public)
+			}
+			if representativeToPublicKey(inverse[:]) != public {
+				t.Errorf("tweak %d: representative %x does not map back to %s", tweak, inverse, vector.public)
+			}
+			found = found || bytes.Equal(inverse[:], representative)
+		}
+		if !found {
+			t.Errorf("neither representative of %s is %s", vector.public, vector.representative)
+		}
+	}
+}
+
+func TestElligatorRoundTrip(t *testing.T) {
+	for i := 0; i < 16; i++ {
+		pair, err := newKeypair()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		public := representativeToPublicKey(pair.representative[:])
+		if public != pair.public {
+			t.Fatalf("representative %x maps to %x, want %x", pair.representative, public, pair.public)
+		}
+
+		// The top two bits are random padding.
+		flipped := pair.representative
+		flipped[31] ^= 0xc0
+		if representativeToPublicKey(flipped[:]) != pair.public {
+			t.Fatal("the top bits of the representative changed the public key")
+		}
+	}
+}
+
+// Public keys carry a low order component picked by the bits of the private
+// key that clamping clears, which leaves shared secrets unchanged.
+func TestDirtyPublicKey(t *testing.T) {
+	var private, peer [PrivateKeyLength]byte
+	_, _ = rand.Read(private[:])
+	_, _ = rand.Read(peer[:])
+	peerPublic, _ := publicKeyFromPrivate(peer[:])
+
+	for lowBits := byte(0); lowBits < 8; lowBits++ {
+		private[0] = private[0]&^7 | lowBits
+		clean, _ := publicKeyFromPrivate(private[:])
+		dirty := dirtyPublicKey(&private).Bytes()
+
+		if (lowBits == 0) != bytes.Equal(dirty, clean[:]) {
+			t.Errorf("low bits %d: dirty key %x, clean key %x", lowBits, dirty, clean)
+		}
+		cleanShared, _ := curve25519.X25519(peer[:], clean[:])
+		dirtyShared, _ := curve25519.X25519(peer[:], dirty)
+		ownShared, _ := curve25519.X25519(private[:], peerPublic[:])
+		if !bytes.Equal(cleanShared, dirtyShared) || !bytes.Equal(cleanShared, ownShared) {
+			t.Errorf("low bits %d changed the shared secret", lowBits)
+		}
+	}
+}
+
+func TestNtorAgreement(t *testing.T) {
+	identity, err := newKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientEphemeral, _ := newKeypair()
+	serverEphemeral, _ := newKeypair()
+	nodeID := make([]byte, NodeIDLength)
+	_, _ = rand.Read(nodeID)
+
+	serverSeed, serverAuth, ok := ntorServer(clientEphemeral.public[:], serverEphemeral, identity.private[:], identity.public[:], nodeID)
+	if !ok {
+		t.Fatal("server side of ntor failed")
+	}
+	clientSeed, clientAuth, ok := ntorClient(clientEphemeral, serverEphemeral.public[:], identity.public[:], nodeID)
+	if !ok {
+		t.Fatal("client side of ntor failed")
+	}
+
+	if !bytes.Equal(serverSeed, clientSeed) || !bytes.Equal(serverAuth, clientAuth) {
+		t.Error("client and server did not agree")
+	}
+}
+
+// KEY_SEED, AUTH and the key material for the private keys x = 00 01 .. 1f,
+// y = 20 21 .. 3f and b = 40 41 .. 5f and the node ID 60 61 .. 73.
+func TestNtorVector(t *testing.T) {
+	sequence := func(start byte, length int) []byte {
+		out := make([]byte, length)
+		for i := range out {
+			out[i] = start + byte(i)
+		}
+		return out
+	}
+	keypairFor := func(private []byte) *keypair {
+		pair := &keypair{}
+		copy(pair.private[:], private)
+		pair.public, _ = publicKeyFromPrivate(private)
+		return pair
+	}
+	client, server, identity := keypairFor(sequence(0, 32)), keypairFor(sequence(32, 32)), keypairFor(sequence(64, 32))
+	nodeID := sequence(96, NodeIDLength)
+
+	wantSeed := "78ec7c57ba839fa331ef80c0f30ec0a11e61ad2a6aa7b52bd9c1301d6f02462a"
+	wantAuth := "7408ede649e49ebb980813900a4e5a02d67e5c2670620b0e2f3b4079d407e468"
+	serverSeed, serverAuth, ok := ntorServer(client.public[:], server, identity.private[:], identity.public[:], nodeID)
+	if !ok || hex.EncodeToString(serverSeed) != wantSeed || hex.EncodeToString(serverAuth) != wantAuth {
+		t.Errorf("server got KEY_SEED %x, AUTH %x, %v", serverSeed, serverAuth, ok)
+	}
+	clientSeed, clientAuth, ok := ntorClient(client, server.public[:], identity.public[:], nodeID)
+	if !ok || hex.EncodeToString(clientSeed) != wantSeed || hex.EncodeToString(clientAuth) != wantAuth {
+		t.Errorf("client got KEY_SEED %x, AUTH %x, %v", clientSeed, clientAuth, ok)
+	}
+
+	wantKeys := "37fe549bb1f0fc7f4d5b0a8a693831ddc81038cce0cd486f3c566f0cc35019048fd8f4affd6feaf4b9c63a155d8314383241d43d2214c3c12df378cad36649510435ede0b462d81522035f6894115985b4a9a92f82aa9fc81ac9dec09f5743d6cb213bdab4b2431a9624ccabdf937aa24c4eb0dc7bf48b855f4e625c5712d0bbc7e1e33d526abc6413fca8d1ede86b71"
+	if keys := ntorKdf(serverSeed, keyLength*2); hex.EncodeToString(keys) != wantKeys {
+		t.Errorf("got key material %x", keys)
+	}
+}
+
+// The frames for "obfs4", an empty payload and "frame three", with the key
+// material 80 81 .. c7.
+func TestFrameVector(t *testing.T) {
+	keyMaterial := make([]byte, keyLength)
+	for i := range keyMaterial {
+		keyMaterial[i] = 0x80 + byte(i)
+	}
+	want := "2e280b280db00e643af4252adfcaabfdee9aec85feb18f0f99885530bf896dd79c2deebe8bbd5014e6f6425f5bbe49663e3c0f661dff29764f6271f6b7cf0c234cc61064922b"
+
+	var frames bytes.Buffer
+	encoder := newFrameEncoder(keyMaterial)
+	for _, payload := range []string{"obfs4", "", "frame three"} {
+		if err := encoder.encode(&frames, []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := hex.EncodeToString(frames.Bytes()); got != want {
+		t.Errorf("got frames %s", got)
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	keyMaterial := make([]byte, keyLength)
+	_, _ = rand.Read(keyMaterial)
+	encoder, decoder := newFrameEncoder(keyMaterial), newFrameDecoder(keyMaterial)
+
+	var frames bytes.Buffer
+	payloads := [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte{7}, maximumFramePayloadLength)}
+	for _, payload := range payloads {
+		if err := encoder.encode(&frames, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, want := range payloads {
+		got, err := decoder.decode(&frames)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("decoded %d bytes, want %d", len(got), len(want))
+		}
+	}
+	if _, err := decoder.decode(&frames); err != errAgain {
+		t.Errorf("decoding an empty buffer returned %v", err)
+	}
+}
+
+func TestFrameTampered(t *testing.T) {
+	keyMaterial := make([]byte, keyLength)
+	_, _ = rand.Read(keyMaterial)
+
+	var frames bytes.Buffer
+	if err := newFrameEncoder(keyMaterial).encode(&frames, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	frames.Bytes()[frames.Len()-1] ^= 1
+
+	if _, err := newFrameDecoder(keyMaterial).decode(&frames); err != errTagMismatch {
+		t.Errorf("decoding a tampered frame returned %v", err)
+	}
+}
+
+func TestCert(t *testing.T) {
+	server, err := NewServerConfig(IATNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := server.ClientConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := client.Cert()
+	if len(cert) != 70 || strings.HasSuffix(cert, "=") {
+		t.Errorf("unexpected cert %q", cert)
+	}
+
+	var parsed ClientConfig
+	if err = parsed.ParseCert(cert); err != nil {
+		t.Fatal(err)
+	}
+	if parsed.NodeID != client.NodeID || parsed.PublicKey != client.PublicKey {
+		t.Error("parsed cert does not match")
+	}
+
+	if err = parsed.ParseCert(cert[:60]); err == nil {
+		t.Error("expected a short cert to be rejected")
+	}
+}
+
+func TestLoadServerState(t *testing.T) {
+	stateDir := t.TempDir()
+
+	first, err := LoadServerState(stateDir, IATNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := LoadServerState(stateDir, IATParanoid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.NodeID != second.NodeID || first.PrivateKey != second.PrivateKey || first.Seed != second.Seed {
+		t.Error("identity changed when it was loaded again")
+	}
+	if second.IATMode != IATParanoid {
+		t.Errorf("got iat-mode %d, want %d", second.IATMode, IATParanoid)
+	}
+
+	bridgeLine, err := os.ReadFile(filepath.Join(stateDir, BridgeLineFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _ := second.ClientConfig()
+	if !strings.Contains(string(bridgeLine), "cert="+client.Cert()+" iat-mode=2") {
+		t.Errorf("unexpected bridge line %q", bridgeLine)
+	}
+
+	if _, err = LoadServerState("", IATNone); err == nil {
+		t.Error("expected an error without a state directory")
+	}
+}
+
+func TestReplayedHandshake(t *testing.T) {
+	identity, err := newKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ephemeral, _ := newKeypair()
+	nodeID := make([]byte, NodeIDLength)
+
+	client := &clientHandshake{nodeID: nodeID, identityPublic: identity.public[:], ephemeral: ephemeral}
+	request, err := client.request()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replays := newReplayFilter()
+	for _, want := range []error{nil, errReplayedHandshake} {
+		server := &serverHandshake{nodeID: nodeID, identityPrivate: identity.private[:], identityPublic: identity.public[:], replays: replays}
+		if err = server.parseRequest(request); err != want {
+			t.Errorf("got %v, want %v", err, want)
+		}
+	}
+
+	// The request is incomplete until the MAC arrives.
+	server := &serverHandshake{nodeID: nodeID, identityPrivate: identity.private[:], identityPublic: identity.public[:], replays: newReplayFilter()}
+	if err = server.parseRequest(request[:len(request)-1]); err != errMarkNotFoundYet {
+		t.Errorf("parsing a partial request returned %v", err)
+	}
+}
+
+func listen(t *testing.T, config ServerConfig) *Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := NewListener(ln, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	return listener
+}
+
+func TestConnEcho(t *testing.T) {
+	for _, iatMode := range []IATMode{IATNone, IATEnabled, IATParanoid} {
+		server, err := NewServerConfig(iatMode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener := listen(t, server)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			_, _ = io.Copy(conn, conn)
+		}()
+
+		client, _ := server.ClientConfig()
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		obfsConn, err := NewClientConn(conn, client)
+		if err != nil {
+			t.Fatalf("iat-mode %d: handshake failed: %s", iatMode, err)
+		}
+
+		sent := make([]byte, 64*1024)
+		_, _ = rand.Read(sent)
+		go func() { _, _ = obfsConn.Write(sent) }()
+
+		received := make([]byte, len(sent))
+		_ = obfsConn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		if _, err = io.ReadFull(obfsConn, received); err != nil {
+			t.Fatalf("iat-mode %d: %s", iatMode, err)
+		}
+		if !bytes.Equal(sent, received) {
+			t.Errorf("iat-mode %d: echoed data differs", iatMode)
+		}
+		_ = obfsConn.Close()
+	}
+}
+
+func TestWrongCert(t *testing.T) {
+	server, err := NewServerConfig(IATNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := listen(t, server)
+	go func() { _, _ = listener.Accept() }()
+
+	other, _ := NewServerConfig(IATNone)
+	client, _ := other.ClientConfig()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The server never answers, so don't wait for it to give up.
+	_ = conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err = NewClientConn(&deadlineConn{conn}, client); err == nil {
+		t.Error("handshake succeeded with the wrong cert")
+	}
+}
+
+// deadlineConn keeps the deadline the test set, rather than the handshake's.
+type deadlineConn struct {
+	net.Conn
+}
+
+func (conn *deadlineConn) SetDeadline(time.Time) error {
+	return nil
+}
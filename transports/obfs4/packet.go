@@ -0,0 +1,172 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package obfs4
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+)
+
+const (
+	packetTypePayload  = 0x00
+	packetTypePrngSeed = 0x01
+
+	// packetOverhead is the type and the payload length.
+	packetOverhead = 1 + 2
+
+	maxPacketPayloadLength = maximumFramePayloadLength - packetOverhead
+	maxPacketPaddingLength = maxPacketPayloadLength
+
+	// packetHeaderLength is the smallest frame, one with an empty packet.
+	packetHeaderLength = frameOverhead + packetOverhead
+
+	// inlineSeedFrameLength is the length of the unpadded TYPE_PRNG_SEED
+	// frame the server sends straight after its handshake.
+	inlineSeedFrameLength = packetHeaderLength + SeedLength
+
+	// maxIATDelay is the longest delay between writes, in units of 100
+	// microseconds.
+	maxIATDelay = 100
+)
+
+var errInvalidPacket = errors.New("obfs4: invalid packet")
+
+// appendPacket frames a packet of the given type holding data followed by
+// padLength bytes of padding, and appends the frame to out.
+func appendPacket(out *bytes.Buffer, encoder *frameEncoder, packetType byte, data []byte, padLength int) error {
+	packet := make([]byte, packetOverhead+len(data)+padLength)
+	packet[0] = packetType
+	binary.BigEndian.PutUint16(packet[1:], uint16(len(data)))
+	copy(packet[packetOverhead:], data)
+
+	return encoder.encode(out, packet)
+}
+
+// parsePacket returns the type and data of a decoded packet.
+func parsePacket(packet []byte) (byte, []byte, error) {
+	if len(packet) < packetOverhead {
+		return 0, nil, errInvalidPacket
+	}
+	dataLength := int(binary.BigEndian.Uint16(packet[1:]))
+	if dataLength > len(packet)-packetOverhead {
+		return 0, nil, errInvalidPacket
+	}
+
+	return packet[0], packet[packetOverhead : packetOverhead+dataLength], nil
+}
+
+// appendPadding pads burst so that its last segment is toPadTo bytes long.
+func appendPadding(burst *bytes.Buffer, encoder *frameEncoder, toPadTo int) error {
+	tailLength := burst.Len() % maximumSegmentLength
+
+	padLength := toPadTo - tailLength
+	if toPadTo < tailLength {
+		padLength += maximumSegmentLength
+	}
+
+	if padLength > packetHeaderLength {
+		return appendPacket(burst, encoder, packetTypePayload, nil, padLength-packetHeaderLength)
+	} else if padLength > 0 {
+		// Too little for a frame of its own, so fill a whole segment and
+		// pad the one after it.
+		if err := appendPacket(burst, encoder, packetTypePayload, nil, maxPacketPaddingLength); err != nil {
+			return err
+		}
+		return appendPacket(burst, encoder, packetTypePayload, nil, padLength)
+	}
+
+	return nil
+}
+
+// weightedDist is the ScrambleSuit style distribution that packet lengths and
+// delays are drawn from. Its values and weights come from a seed, so each
+// bridge has its own, and the bridge sends the seed to its clients.
+type weightedDist struct {
+	minValue int
+	maxValue int
+	values   []int
+	weights  []float64
+	total    float64
+	random   *rand.Rand
+}
+
+func newWeightedDist(seed []byte, minValue int, maxValue int) *weightedDist {
+	dist := &weightedDist{minValue: minValue, maxValue: maxValue, random: rand.New(cryptoSource{})}
+	dist.reset(seed)
+
+	return dist
+}
+
+// reset draws new values and weights from seed.
+func (dist *weightedDist) reset(seed []byte) {
+	seeded := rand.New(newHashDrbg(seed))
+
+	count := dist.maxValue - dist.minValue + 1
+	if count > 100 {
+		count = 100
+	}
+	count = 1 + seeded.Intn(count)
+
+	dist.values = make([]int, count)
+	dist.weights = make([]float64, count)
+	dist.total = 0
+	for i := range dist.values {
+		dist.values[i] = dist.minValue + seeded.Intn(dist.maxValue-dist.minValue+1)
+		dist.weights[i] = seeded.Float64()
+		dist.total += dist.weights[i]
+	}
+}
+
+// sample returns a random value from the distribution.
+func (dist *weightedDist) sample() int {
+	target := dist.random.Float64() * dist.total
+	for i, weight := range dist.weights {
+		if target < weight {
+			return dist.values[i]
+		}
+		target -= weight
+	}
+
+	return dist.values[len(dist.values)-1]
+}
+
+// iatSeed returns the seed for the delay distribution, which is derived from
+// the length distribution's seed.
+func iatSeed(lengthSeed []byte) []byte {
+	sum := sha256.Sum256(lengthSeed)
+	return sum[:SeedLength]
+}
+
+// cryptoSource is a math/rand Source that reads crypto/rand, for sampling.
+type cryptoSource struct{}
+
+func (cryptoSource) Int63() int64 {
+	return int64(randomUint64() & (1<<63 - 1))
+}
+
+func (cryptoSource) Seed(int64) {}
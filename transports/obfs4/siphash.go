@@ -0,0 +1,159 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package obfs4
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"math/bits"
+)
+
+// SeedLength is the length of a DRBG seed: a SipHash-2-4 key followed by the
+// OFB initialization vector.
+const SeedLength = 16 + 8
+
+// sipHash is a streaming SipHash-2-4.
+type sipHash struct {
+	v0, v1, v2, v3 uint64
+	tail           [8]byte
+	tailLen        int
+	length         uint64
+}
+
+func newSipHash(key []byte) *sipHash {
+	k0 := binary.LittleEndian.Uint64(key[0:8])
+	k1 := binary.LittleEndian.Uint64(key[8:16])
+
+	return &sipHash{
+		v0: k0 ^ 0x736f6d6570736575,
+		v1: k1 ^ 0x646f72616e646f6d,
+		v2: k0 ^ 0x6c7967656e657261,
+		v3: k1 ^ 0x7465646279746573,
+	}
+}
+
+func (hash *sipHash) round() {
+	hash.v0 += hash.v1
+	hash.v1 = bits.RotateLeft64(hash.v1, 13)
+	hash.v1 ^= hash.v0
+	hash.v0 = bits.RotateLeft64(hash.v0, 32)
+	hash.v2 += hash.v3
+	hash.v3 = bits.RotateLeft64(hash.v3, 16)
+	hash.v3 ^= hash.v2
+	hash.v0 += hash.v3
+	hash.v3 = bits.RotateLeft64(hash.v3, 21)
+	hash.v3 ^= hash.v0
+	hash.v2 += hash.v1
+	hash.v1 = bits.RotateLeft64(hash.v1, 17)
+	hash.v1 ^= hash.v2
+	hash.v2 = bits.RotateLeft64(hash.v2, 32)
+}
+
+func (hash *sipHash) compress(m uint64) {
+	hash.v3 ^= m
+	hash.round()
+	hash.round()
+	hash.v0 ^= m
+}
+
+func (hash *sipHash) Write(p []byte) (int, error) {
+	n := len(p)
+	hash.length += uint64(n)
+
+	if hash.tailLen > 0 {
+		copied := copy(hash.tail[hash.tailLen:], p)
+		hash.tailLen += copied
+		p = p[copied:]
+		if hash.tailLen < 8 {
+			return n, nil
+		}
+		hash.compress(binary.LittleEndian.Uint64(hash.tail[:]))
+		hash.tailLen = 0
+	}
+	for len(p) >= 8 {
+		hash.compress(binary.LittleEndian.Uint64(p))
+		p = p[8:]
+	}
+	hash.tailLen = copy(hash.tail[:], p)
+
+	return n, nil
+}
+
+// Sum64 returns the hash of everything written so far, without changing the
+// state, so more can be written after it.
+func (hash *sipHash) Sum64() uint64 {
+	final := *hash
+
+	var last [8]byte
+	copy(last[:], final.tail[:final.tailLen])
+	last[7] = byte(final.length)
+	final.compress(binary.LittleEndian.Uint64(last[:]))
+
+	final.v2 ^= 0xff
+	final.round()
+	final.round()
+	final.round()
+	final.round()
+
+	return final.v0 ^ final.v1 ^ final.v2 ^ final.v3
+}
+
+// hashDrbg is the SipHash-2-4 OFB generator obfs4 uses to mask frame lengths
+// and to seed the length and timing distributions. Each block is the hash of
+// the initialization vector and every block before it.
+type hashDrbg struct {
+	sip *sipHash
+	ofb [8]byte
+}
+
+func newHashDrbg(seed []byte) *hashDrbg {
+	drbg := &hashDrbg{sip: newSipHash(seed[:16])}
+	copy(drbg.ofb[:], seed[16:SeedLength])
+
+	return drbg
+}
+
+// NextBlock returns the next 8 bytes of output.
+func (drbg *hashDrbg) NextBlock() [8]byte {
+	_, _ = drbg.sip.Write(drbg.ofb[:])
+	binary.LittleEndian.PutUint64(drbg.ofb[:], drbg.sip.Sum64())
+
+	return drbg.ofb
+}
+
+// Int63 and Seed make the generator a math/rand Source.
+func (drbg *hashDrbg) Int63() int64 {
+	block := drbg.NextBlock()
+	return int64(binary.BigEndian.Uint64(block[:]) & (1<<63 - 1))
+}
+
+func (drbg *hashDrbg) Seed(int64) {}
+
+// NewSeed returns a random DRBG seed.
+func NewSeed() ([SeedLength]byte, error) {
+	var seed [SeedLength]byte
+	_, err := rand.Read(seed[:])
+	return seed, err
+}
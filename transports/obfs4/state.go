@@ -0,0 +1,214 @@
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package obfs4
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// StateFileName is where a bridge keeps its identity in the state
+	// directory.
+	StateFileName = "obfs4_state.json"
+
+	// BridgeLineFileName is where a bridge writes the line clients need to
+	// connect to it.
+	BridgeLineFileName = "obfs4_bridgeline.txt"
+
+	certLength = NodeIDLength + PublicKeyLength
+)
+
+// ClientConfig is what a client needs to know about a bridge.
+type ClientConfig struct {
+	NodeID    [NodeIDLength]byte
+	PublicKey [PublicKeyLength]byte
+	IATMode   IATMode
+}
+
+// ServerConfig is a bridge's identity.
+type ServerConfig struct {
+	NodeID     [NodeIDLength]byte
+	PrivateKey [PrivateKeyLength]byte
+	Seed       [SeedLength]byte
+	IATMode    IATMode
+}
+
+// NewServerConfig returns a new random bridge identity.
+func NewServerConfig(iatMode IATMode) (ServerConfig, error) {
+	config := ServerConfig{IATMode: iatMode}
+	if _, err := rand.Read(config.NodeID[:]); err != nil {
+		return config, err
+	}
+	if _, err := rand.Read(config.PrivateKey[:]); err != nil {
+		return config, err
+	}
+	seed, err := NewSeed()
+	if err != nil {
+		return config, err
+	}
+	config.Seed = seed
+
+	return config, nil
+}
+
+// ClientConfig returns what clients of the bridge need to know.
+func (config ServerConfig) ClientConfig() (ClientConfig, error) {
+	public, err := publicKeyFromPrivate(config.PrivateKey[:])
+	if err != nil {
+		return ClientConfig{}, err
+	}
+
+	return ClientConfig{NodeID: config.NodeID, PublicKey: public, IATMode: config.IATMode}, nil
+}
+
+// Cert returns the node ID and public key in the form obfs4 bridge lines
+// use, base64 without the trailing padding.
+func (config ClientConfig) Cert() string {
+	cert := make([]byte, 0, certLength)
+	cert = append(cert, config.NodeID[:]...)
+	cert = append(cert, config.PublicKey[:]...)
+
+	return strings.TrimSuffix(base64.StdEncoding.EncodeToString(cert), "==")
+}
+
+// ParseCert sets the node ID and public key from a cert argument.
+func (config *ClientConfig) ParseCert(cert string) error {
+	decoded, err := base64.StdEncoding.DecodeString(cert + "==")
+	if err != nil {
+		return fmt.Errorf("invalid cert: %s", err)
+	}
+	if len(decoded) != certLength {
+		return fmt.Errorf("invalid cert length %d", len(decoded))
+	}
+
+	copy(config.NodeID[:], decoded[:NodeIDLength])
+	copy(config.PublicKey[:], decoded[NodeIDLength:])
+
+	return nil
+}
+
+// DecodeHex decodes a hex key or ID argument into out, which it has to fill
+// exactly.
+func DecodeHex(out []byte, name string, value string) error {
+	decoded, err := hex.DecodeString(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %s", name, err)
+	}
+	if len(decoded) != len(out) {
+		return fmt.Errorf("%s should be %d bytes, not %d", name, len(out), len(decoded))
+	}
+	copy(out, decoded)
+
+	return nil
+}
+
+// serverState is the state file's format, which is the same as obfs4proxy's
+// so that a bridge can move over with its identity.
+type serverState struct {
+	NodeID     string `json:"node-id"`
+	PrivateKey string `json:"private-key"`
+	PublicKey  string `json:"public-key"`
+	DrbgSeed   string `json:"drbg-seed"`
+	IATMode    int    `json:"iat-mode"`
+}
+
+// LoadServerState reads the bridge identity kept in stateDir, or makes a
+// new one and saves it there. Either way it writes the bridge line for the
+// identity next to it. iatMode replaces the saved mode.
+func LoadServerState(stateDir string, iatMode IATMode) (ServerConfig, error) {
+	if stateDir == "" {
+		return ServerConfig{}, errors.New("obfs4 needs a state directory to keep its keys in")
+	}
+
+	statePath := filepath.Join(stateDir, StateFileName)
+	data, err := os.ReadFile(statePath)
+	var config ServerConfig
+	switch {
+	case err == nil:
+		var state serverState
+		if err = json.Unmarshal(data, &state); err != nil {
+			return config, fmt.Errorf("could not parse %s: %s", statePath, err)
+		}
+		if err = DecodeHex(config.NodeID[:], "node-id", state.NodeID); err != nil {
+			return config, err
+		}
+		if err = DecodeHex(config.PrivateKey[:], "private-key", state.PrivateKey); err != nil {
+			return config, err
+		}
+		if err = DecodeHex(config.Seed[:], "drbg-seed", state.DrbgSeed); err != nil {
+			return config, err
+		}
+		config.IATMode = iatMode
+	case os.IsNotExist(err):
+		if config, err = NewServerConfig(iatMode); err != nil {
+			return config, err
+		}
+		if err = saveServerState(statePath, config); err != nil {
+			return config, err
+		}
+	default:
+		return config, err
+	}
+
+	clientConfig, err := config.ClientConfig()
+	if err != nil {
+		return config, err
+	}
+	bridgeLine := fmt.Sprintf("Bridge obfs4 <IP ADDRESS>:<PORT> <FINGERPRINT> cert=%s iat-mode=%d\n", clientConfig.Cert(), config.IATMode)
+	if err = os.WriteFile(filepath.Join(stateDir, BridgeLineFileName), []byte(bridgeLine), 0644); err != nil {
+		return config, err
+	}
+
+	return config, nil
+}
+
+func saveServerState(statePath string, config ServerConfig) error {
+	clientConfig, err := config.ClientConfig()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(serverState{
+		NodeID:     hex.EncodeToString(config.NodeID[:]),
+		PrivateKey: hex.EncodeToString(config.PrivateKey[:]),
+		PublicKey:  hex.EncodeToString(clientConfig.PublicKey[:]),
+		DrbgSeed:   hex.EncodeToString(config.Seed[:]),
+		IATMode:    int(config.IATMode),
+	})
+	if err != nil {
+		return err
+	}
+
+	// The private key is in here.
+	return os.WriteFile(statePath, data, 0600)
+}
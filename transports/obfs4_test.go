@@ -0,0 +1,82 @@
+//go:build !noobfs4
+
+package transports
+
+import (
+	"encoding/json"
+	"io"
+	"testing"
+)
+
+func TestObfs4ClientArgs(t *testing.T) {
+	stateDir := t.TempDir()
+	serverOptions := `{"transport": "obfs4", "serverAddress": "127.0.0.1:0", "iat-mode": 1}`
+
+	server, err := ParseArgsObfs4Server(serverOptions, stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args, err := ClientArgsObfs4Server(serverOptions, stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args["iat-mode"] != "1" {
+		t.Errorf("got iat-mode %q, want 1", args["iat-mode"])
+	}
+
+	listen, err := server.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go func() {
+		conn, err := listen.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	// A client configured from the announced args reaches the server.
+	args["serverAddress"] = listen.Addr().String()
+	clientOptions, _ := json.Marshal(args)
+	client, err := ParseArgsObfs4Client(string(clientOptions), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := client.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 4)
+	if _, err = io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+		t.Errorf("got %q, %v", reply, err)
+	}
+}
+
+func TestObfs4Options(t *testing.T) {
+	invalid := []string{
+		`{"serverAddress": "127.0.0.1:1234"}`,
+		`{"serverAddress": "127.0.0.1:1234", "cert": "short"}`,
+		`{"serverAddress": "127.0.0.1:1234", "node-id": "00", "public-key": "00"}`,
+		`{"serverAddress": "127.0.0.1:1234", "cert": "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", "iat-mode": "3"}`,
+	}
+	for _, options := range invalid {
+		if _, err := ParseArgsObfs4Client(options, nil); err == nil {
+			t.Errorf("expected %s to be rejected", options)
+		}
+	}
+
+	if _, err := ParseArgsObfs4Server(`{"serverAddress": "127.0.0.1:1234"}`, ""); err == nil {
+		t.Error("expected an error with neither keys nor a state directory")
+	}
+	if _, err := ParseArgsObfs4Server(`{"bindAddress": "127.0.0.1:1234", "node-id": "00", "private-key": "00"}`, ""); err == nil {
+		t.Error("expected short keys to be rejected")
+	}
+}
@@ -0,0 +1,129 @@
+//go:build !nooptimizer
+
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package transports
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	Optimizer "github.com/OperatorFoundation/Optimizer-go/Optimizer/v3"
+	"golang.org/x/net/proxy"
+)
+
+func init() {
+	// Optimizer only dials the transports it is configured with, so it has
+	// no server.
+	Register(Transport{
+		Name:          "Optimizer",
+		Modes:         AllModes,
+		ClientOptions: []Option{{"transports", true}, {"strategy", true}},
+		NewClient: func(options string, dialer proxy.Dialer, enableLocket bool, logDir string) (Optimizer.TransportDialer, error) {
+			client, err := ParseArgsOptimizer(options, dialer, enableLocket, logDir)
+			if err != nil {
+				return nil, err
+			}
+			return client, nil
+		},
+	})
+}
+
+type OptimizerConfig struct {
+	Transports []interface{} `json:"transports"`
+	Strategy   string        `json:"strategy"`
+}
+
+type OptimizerArgs struct {
+	Address string                 `json:"address"`
+	Name    string                 `json:"name"`
+	Config  map[string]interface{} `json:"config"`
+}
+
+func ParseArgsOptimizer(jsonConfig string, dialer proxy.Dialer, enableLocket bool, logDir string) (*Optimizer.Client, error) {
+	var config OptimizerConfig
+	var transports []Optimizer.TransportDialer
+	var strategy Optimizer.Strategy
+	jsonByte := []byte(jsonConfig)
+	parseErr := json.Unmarshal(jsonByte, &config)
+	if parseErr != nil {
+		return nil, errors.New("could not marshal optimizer config")
+	}
+	transports, parseErr = parseTransports(config.Transports, dialer, enableLocket, logDir)
+	if parseErr != nil {
+		return nil, fmt.Errorf("could not parse transports: %w", parseErr)
+	}
+
+	strategy, parseErr = parseStrategy(config.Strategy, transports)
+	if parseErr != nil {
+		return nil, errors.New("could not parse strategy")
+	}
+
+	transport := Optimizer.NewOptimizerClient(transports, strategy)
+
+	return transport, nil
+}
+
+func parseStrategy(strategyString string, transports []Optimizer.TransportDialer) (Optimizer.Strategy, error) {
+	switch strategyString {
+	case "first":
+		strategy := Optimizer.NewFirstStrategy(transports)
+		return strategy, nil
+	case "random":
+		strategy := Optimizer.NewRandomStrategy(transports)
+		return strategy, nil
+	case "rotate":
+		strategy := Optimizer.NewRotateStrategy(transports)
+		return strategy, nil
+	case "track":
+		return Optimizer.NewTrackStrategy(transports), nil
+	case "minimizeDialDuration":
+		return Optimizer.NewMinimizeDialDuration(transports), nil
+
+	default:
+		return nil, errors.New("invalid strategy")
+	}
+}
+
+func parseTransports(otcs []interface{}, dialer proxy.Dialer, enableLocket bool, logDir string) ([]Optimizer.TransportDialer, error) {
+	transports := make([]Optimizer.TransportDialer, len(otcs))
+	for index, untypedOtc := range otcs {
+		switch untypedOtc.(type) {
+		case map[string]interface{}:
+			otc := untypedOtc.(map[string]interface{})
+			transport, err := parsedTransport(otc, dialer, enableLocket, logDir)
+			if err != nil {
+				return nil, errors.New("transport could not parse config")
+				//this error sucks and is uninformative
+			}
+			transports[index] = transport
+		default:
+			return nil, errors.New("unsupported type for transport")
+		}
+
+	}
+	return transports, nil
+}
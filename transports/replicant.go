@@ -0,0 +1,262 @@
+//go:build !noreplicant
+
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package transports
+
+import (
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+
+	Optimizer "github.com/OperatorFoundation/Optimizer-go/Optimizer/v3"
+	replicant "github.com/OperatorFoundation/Replicant-go/Replicant/v3"
+	"github.com/OperatorFoundation/Replicant-go/Replicant/v3/toneburst"
+	shadowsocks "github.com/OperatorFoundation/go-shadowsocks2/darkstar"
+	"github.com/aead/ecdh"
+	"github.com/kataras/golog"
+	"golang.org/x/net/proxy"
+)
+
+func init() {
+	Register(Transport{
+		Name:          "Replicant",
+		Modes:         AllModes,
+		ClientOptions: []Option{{"serverAddress", true}, {"toneburst", false}, {"polish", false}},
+		ServerOptions: []Option{{"serverAddress", false}, {"toneburst", false}, {"polish", false}, {"bindAddress", false}},
+		NewClient: func(options string, dialer proxy.Dialer, enableLocket bool, logDir string) (Optimizer.TransportDialer, error) {
+			client, err := ParseArgsReplicantClient(options, dialer)
+			if err != nil {
+				return nil, err
+			}
+			return client, nil
+		},
+		NewServer: func(options string, stateDir string, enableLocket bool, logDir string) (func() (net.Listener, error), error) {
+			config, err := ParseArgsReplicantServer(options)
+			if err != nil {
+				return nil, errors.New("could not parse Replicant options")
+			}
+			return config.Listen, nil
+		},
+		ClientArgs: func(options string, stateDir string) (map[string]string, error) {
+			return ClientArgsReplicantServer(options)
+		},
+		GenerateConfigs: func(settings ConfigSettings) error {
+			return CreateReplicantConfigs(settings.ServerAddress, settings.Toneburst, settings.Polish, settings.BindAddress)
+		},
+	})
+}
+
+// ReplicantClient dials a Replicant server.
+type ReplicantClient struct {
+	Config replicant.ClientConfig
+	Dialer proxy.Dialer
+}
+
+func (client *ReplicantClient) Dial() (net.Conn, error) {
+	conn, dialErr := dialWithTimeout(client.Dialer, client.Config.ServerAddress)
+	if dialErr != nil {
+		return nil, dialErr
+	}
+
+	transportConn, err := replicant.NewClientConnection(conn, client.Config)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return transportConn, nil
+}
+
+func CreateDefaultReplicantServer() replicant.ServerConfig {
+	config := replicant.ServerConfig{
+		Toneburst: nil,
+		Polish:    nil,
+	}
+
+	return config
+}
+
+func ParseArgsReplicantClient(args string, dialer proxy.Dialer) (*ReplicantClient, error) {
+	config, jsonError := replicant.UnmarshalClientConfig([]byte(args))
+	if jsonError != nil {
+		return nil, jsonError
+	}
+
+	transport := ReplicantClient{
+		Config: *config,
+		Dialer: dialer,
+	}
+
+	return &transport, nil
+}
+
+// target string, dialer proxy.Dialer
+func ParseArgsReplicantServer(args string) (*replicant.ServerConfig, error) {
+	config, jsonError := replicant.UnmarshalServerConfig([]byte(args))
+	if jsonError != nil {
+		return nil, jsonError
+	}
+
+	return config, nil
+}
+
+// ClientArgsReplicantServer returns the options a Replicant client needs to
+// connect to a server started with args. Only the DarkStar polish has any.
+func ClientArgsReplicantServer(args string) (map[string]string, error) {
+	var config replicant.ServerJsonConfig
+	if err := json.Unmarshal([]byte(args), &config); err != nil {
+		return nil, errors.New("replicant server options json decoding error")
+	}
+	if config.Polish.ServerPrivateKey == "" {
+		return map[string]string{}, nil
+	}
+
+	privateKeyBytes, err := base64.StdEncoding.DecodeString(config.Polish.ServerPrivateKey)
+	if err != nil {
+		return nil, errors.New("private key bytes were not base64 compatible")
+	}
+	if len(privateKeyBytes) < 2 {
+		return nil, errors.New("private key is too short")
+	}
+
+	publicKey, err := publicKeyFor(base64.StdEncoding.EncodeToString(privateKeyBytes[1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{"serverPublicKey": publicKey}, nil
+}
+
+func CreateReplicantConfigs(address string, isToneburst bool, isPolish bool, bindAddress *string) error {
+	var polishClient *replicant.DarkStarPolishClientJsonConfig = nil
+	var polishServer *replicant.DarkStarPolishServerJsonConfig = nil
+	var toneburstClient *toneburst.StarburstConfig = nil
+	var toneburstServer *toneburst.StarburstConfig = nil
+	if isPolish {
+		keyExchange := ecdh.Generic(elliptic.P256())
+
+		ephemeralPrivateKey, ephemeralPublicKey, keyError := keyExchange.GenerateKey(rand.Reader)
+		if keyError != nil {
+			return keyError
+		}
+
+		point, ok := ephemeralPublicKey.(ecdh.Point)
+		if !ok {
+			return errors.New("could not convert client public key to point")
+		}
+
+		bytes := elliptic.Marshal(elliptic.P256(), point.X, point.Y)
+		if bytes == nil {
+			return errors.New("MarshalCompressed returned nil")
+		}
+
+		privateKeyBytes, ok := ephemeralPrivateKey.([]byte)
+		if !ok {
+			return errors.New("could not convert private key to bytes")
+		}
+
+		publicKeyBytes, keyByteError := shadowsocks.PublicKeyToKeychainFormatBytes(ephemeralPublicKey)
+		if keyByteError != nil {
+			return keyByteError
+		}
+
+		privateKeyString := base64.StdEncoding.EncodeToString(privateKeyBytes)
+		publicKeyString := base64.StdEncoding.EncodeToString(publicKeyBytes)
+
+		polishClient = &replicant.DarkStarPolishClientJsonConfig{
+			ServerAddress:   address,
+			ServerPublicKey: publicKeyString,
+		}
+
+		polishServer = &replicant.DarkStarPolishServerJsonConfig{
+			ServerAddress:    address,
+			ServerPrivateKey: privateKeyString,
+		}
+
+	} else {
+		golog.Info("Invalid polish name.  Setting value to nil")
+		polishClient = nil
+		polishServer = nil
+	}
+
+	if isToneburst {
+		toneburstClient = &toneburst.StarburstConfig{
+			Type: "starbridge",
+			Mode: "SMTPClient",
+		}
+
+		toneburstServer = &toneburst.StarburstConfig{
+			Type: "starbridge",
+			Mode: "SMTPServer",
+		}
+
+	} else {
+		golog.Info("Invalid toneburst name.  Setting value to nil")
+		toneburstClient = nil
+		toneburstServer = nil
+	}
+
+	replicantServerConfig := replicant.ServerJsonConfig{
+		ServerAddress: address,
+		Toneburst:     *toneburstServer,
+		Polish:        *polishServer,
+		Transport:     "Replicant",
+		BindAddress:   bindAddress,
+	}
+
+	replicantClientConfig := replicant.ClientJsonConfig{
+		ServerAddress: address,
+		Toneburst:     *toneburstClient,
+		Polish:        *polishClient,
+		Transport:     "Replicant",
+	}
+
+	serverJsonBytes, marshalError := json.MarshalIndent(replicantServerConfig, "", "  ")
+	if marshalError != nil {
+		return marshalError
+	}
+
+	clientJsonBytes, marshalError := json.MarshalIndent(replicantClientConfig, "", "  ")
+	if marshalError != nil {
+		return marshalError
+	}
+
+	serverJsonError := os.WriteFile("ReplicantServerConfig.json", serverJsonBytes, 0777)
+	if serverJsonError != nil {
+		return serverJsonError
+	}
+
+	clientJsonError := os.WriteFile("ReplicantClientConfig.json", clientJsonBytes, 0777)
+	if clientJsonError != nil {
+		return clientJsonError
+	}
+
+	return nil
+}
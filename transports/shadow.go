@@ -0,0 +1,257 @@
+//go:build !noshadow
+
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package transports
+
+import (
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+
+	Optimizer "github.com/OperatorFoundation/Optimizer-go/Optimizer/v3"
+	"github.com/OperatorFoundation/Shadow-go/shadow/v3"
+	"github.com/OperatorFoundation/go-shadowsocks2/darkstar"
+	locketgo "github.com/OperatorFoundation/locket-go"
+	"github.com/aead/ecdh"
+	"golang.org/x/net/proxy"
+)
+
+func init() {
+	Register(Transport{
+		Name:          "shadow",
+		Modes:         AllModes,
+		ClientOptions: []Option{{"serverAddress", true}, {"serverPublicKey", true}, {"cipherName", true}},
+		ServerOptions: []Option{{"serverAddress", false}, {"serverPrivateKey", true}, {"cipherName", true}, {"bindAddress", false}},
+		NewClient: func(options string, dialer proxy.Dialer, enableLocket bool, logDir string) (Optimizer.TransportDialer, error) {
+			client, err := ParseArgsShadow(options, dialer, enableLocket, logDir)
+			if err != nil {
+				return nil, err
+			}
+			return client, nil
+		},
+		NewServer: func(options string, stateDir string, enableLocket bool, logDir string) (func() (net.Listener, error), error) {
+			config, err := ParseArgsShadowServer(options, enableLocket, logDir)
+			if err != nil {
+				return nil, err
+			}
+			return config.Listen, nil
+		},
+		ClientArgs: func(options string, stateDir string) (map[string]string, error) {
+			return ClientArgsShadowServer(options)
+		},
+		GenerateConfigs: func(settings ConfigSettings) error {
+			return CreateShadowConfigs(settings.ServerAddress, settings.BindAddress)
+		},
+	})
+}
+
+// ShadowClient dials a Shadow server.
+type ShadowClient struct {
+	Transport shadow.Transport
+	Dialer    proxy.Dialer
+}
+
+func (client *ShadowClient) Dial() (net.Conn, error) {
+	host, port, splitErr := splitServerAddress(client.Transport.ServerAddress)
+	if splitErr != nil {
+		return nil, splitErr
+	}
+
+	darkStarClient := darkstar.NewDarkStarClient(client.Transport.ServerKey, host, port)
+	if darkStarClient == nil {
+		return nil, errors.New("failed to create a DarkStarClient with the provided password")
+	}
+
+	netConn, dialError := dialWithTimeout(client.Dialer, client.Transport.ServerAddress)
+	if dialError != nil {
+		return nil, dialError
+	}
+
+	if client.Transport.LogDir != nil {
+		locketConn, locketError := locketgo.NewLocketConn(netConn, *client.Transport.LogDir, "ShadowClient")
+		if locketError != nil {
+			_ = netConn.Close()
+			return nil, locketError
+		}
+		netConn = locketConn
+	}
+
+	transportConn, handshakeError := darkStarClient.StreamConn(netConn)
+	if handshakeError != nil {
+		_ = netConn.Close()
+		return nil, handshakeError
+	}
+
+	return transportConn, nil
+}
+
+func ParseArgsShadow(args string, dialer proxy.Dialer, enableLocket bool, logDir string) (*ShadowClient, error) {
+	var config shadow.ClientConfig
+
+	if enableLocket {
+		config.LogDir = &logDir
+	} else {
+		config.LogDir = nil
+	}
+
+	bytes := []byte(args)
+	jsonError := json.Unmarshal(bytes, &config)
+	if jsonError != nil {
+		return nil, errors.New("shadow options json decoding error")
+	}
+
+	publicKeyBytes, decodeError := base64.StdEncoding.DecodeString(config.ServerPublicKey)
+	if decodeError != nil {
+		return nil, errors.New("public key bytes were not base64 compatible")
+	}
+	if len(publicKeyBytes) < 2 {
+		return nil, errors.New("public key is too short")
+	}
+
+	trimmedPublicKeyBytes := publicKeyBytes[1:]
+	trimmedPublicKeyString := base64.StdEncoding.EncodeToString(trimmedPublicKeyBytes)
+
+	transport := shadow.NewTransport(config.ServerAddress, trimmedPublicKeyString, config.CipherName, config.LogDir)
+
+	return &ShadowClient{Transport: transport, Dialer: dialer}, nil
+}
+
+func ParseArgsShadowServer(args string, enableLocket bool, logDir string) (*shadow.ServerConfig, error) {
+	var config shadow.ServerConfig
+
+	if enableLocket {
+		config.LogDir = &logDir
+	} else {
+		config.LogDir = nil
+	}
+
+	bytes := []byte(args)
+	jsonError := json.Unmarshal(bytes, &config)
+	if jsonError != nil {
+		return nil, errors.New("shadow server options json decoding error")
+	}
+
+	privateKeyBytes, decodeError := base64.StdEncoding.DecodeString(config.ServerPrivateKey)
+	if decodeError != nil {
+		return nil, errors.New("private key bytes were not base64 compatible")
+	}
+	if len(privateKeyBytes) < 2 {
+		return nil, errors.New("private key is too short")
+	}
+	trimmedPrivateKeyBytes := privateKeyBytes[1:]
+	config.ServerPrivateKey = base64.StdEncoding.EncodeToString(trimmedPrivateKeyBytes)
+
+	return &config, nil
+}
+
+// ClientArgsShadowServer returns the options a Shadow client needs to connect
+// to a server started with args.
+func ClientArgsShadowServer(args string) (map[string]string, error) {
+	config, err := ParseArgsShadowServer(args, false, "")
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, err := publicKeyFor(config.ServerPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{"serverPublicKey": publicKey, "cipherName": config.CipherName}, nil
+}
+
+func CreateShadowConfigs(address string, bindAddress *string) error {
+	keyExchange := ecdh.Generic(elliptic.P256())
+
+	ephemeralPrivateKey, ephemeralPublicKey, keyError := keyExchange.GenerateKey(rand.Reader)
+	if keyError != nil {
+		return keyError
+	}
+
+	point, ok := ephemeralPublicKey.(ecdh.Point)
+	if !ok {
+		return errors.New("could not convert client public key to point")
+	}
+
+	bytes := elliptic.Marshal(elliptic.P256(), point.X, point.Y)
+	if bytes == nil {
+		return errors.New("MarshalCompressed returned nil")
+	}
+
+	privateKeyBytes, ok := ephemeralPrivateKey.([]byte)
+	if !ok {
+		return errors.New("could not convert private key to bytes")
+	}
+
+	publicKeyBytes, keyByteError := darkstar.PublicKeyToKeychainFormatBytes(ephemeralPublicKey)
+	if keyByteError != nil {
+		return keyByteError
+	}
+
+	privateKeyString := base64.StdEncoding.EncodeToString(privateKeyBytes)
+	publicKeyString := base64.StdEncoding.EncodeToString(publicKeyBytes)
+
+	shadowServerConfig := shadow.ServerConfig{
+		ServerAddress:    address,
+		ServerPrivateKey: privateKeyString,
+		CipherName:       "darkstar",
+		Transport:        "Shadow",
+		BindAddress:      bindAddress,
+	}
+
+	serverJsonBytes, marshalError := json.MarshalIndent(shadowServerConfig, "", "  ")
+	if marshalError != nil {
+		return marshalError
+	}
+
+	shadowClientConfig := shadow.ClientConfig{
+		ServerAddress:   address,
+		ServerPublicKey: publicKeyString,
+		CipherName:      "darkstar",
+		Transport:       "Shadow",
+	}
+
+	clientJsonBytes, marshalError := json.MarshalIndent(shadowClientConfig, "", "  ")
+	if marshalError != nil {
+		return marshalError
+	}
+
+	serverJsonError := os.WriteFile("ShadowServerConfig.json", serverJsonBytes, 0777)
+	if serverJsonError != nil {
+		return serverJsonError
+	}
+
+	clientJsonError := os.WriteFile("ShadowClientConfig.json", clientJsonBytes, 0777)
+	if clientJsonError != nil {
+		return clientJsonError
+	}
+
+	return nil
+}
@@ -0,0 +1,251 @@
+//go:build !nostarbridge
+
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package transports
+
+import (
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+
+	Optimizer "github.com/OperatorFoundation/Optimizer-go/Optimizer/v3"
+	replicant "github.com/OperatorFoundation/Replicant-go/Replicant/v3"
+	"github.com/OperatorFoundation/Replicant-go/Replicant/v3/polish"
+	"github.com/OperatorFoundation/Replicant-go/Replicant/v3/toneburst"
+	"github.com/OperatorFoundation/Starbridge-go/Starbridge/v3"
+	"github.com/OperatorFoundation/go-shadowsocks2/darkstar"
+	"github.com/aead/ecdh"
+	"golang.org/x/net/proxy"
+)
+
+func init() {
+	Register(Transport{
+		Name:          "Starbridge",
+		Modes:         AllModes,
+		ClientOptions: []Option{{"serverAddress", true}, {"serverPublicKey", true}},
+		ServerOptions: []Option{{"serverAddress", false}, {"serverPrivateKey", true}, {"bindAddress", false}},
+		NewClient: func(options string, dialer proxy.Dialer, enableLocket bool, logDir string) (Optimizer.TransportDialer, error) {
+			client, err := ParseArgsStarbridgeClient(options, dialer)
+			if err != nil {
+				return nil, err
+			}
+			return client, nil
+		},
+		NewServer: func(options string, stateDir string, enableLocket bool, logDir string) (func() (net.Listener, error), error) {
+			config, err := ParseArgsStarbridgeServer(options)
+			if err != nil {
+				return nil, errors.New("could not parse Starbridge options")
+			}
+			return config.Listen, nil
+		},
+		ClientArgs: func(options string, stateDir string) (map[string]string, error) {
+			return ClientArgsStarbridgeServer(options)
+		},
+		GenerateConfigs: func(settings ConfigSettings) error {
+			return CreateStarbridgeConfigs(settings.ServerAddress, settings.BindAddress)
+		},
+	})
+}
+
+// StarbridgeClient dials a Starbridge server.
+type StarbridgeClient struct {
+	Config Starbridge.ClientConfig
+	Dialer proxy.Dialer
+}
+
+func (client *StarbridgeClient) Dial() (net.Conn, error) {
+	keyBytes, keyError := base64.StdEncoding.DecodeString(client.Config.ServerPublicKey)
+	if keyError != nil {
+		return nil, keyError
+	}
+
+	keyCheckError := Starbridge.CheckPublicKey(darkstar.KeychainFormatBytesToPublicKey(keyBytes))
+	if keyCheckError != nil {
+		return nil, keyCheckError
+	}
+
+	// This matches the Replicant configuration Starbridge uses internally.
+	replicantConfig := replicant.ClientConfig{
+		Toneburst: toneburst.StarburstConfig{
+			Mode: "SMTPClient",
+		},
+		Polish: polish.DarkStarPolishClientConfig{
+			ServerAddress:   client.Config.ServerAddress,
+			ServerPublicKey: base64.StdEncoding.EncodeToString(keyBytes),
+		},
+	}
+
+	conn, dialErr := dialWithTimeout(client.Dialer, client.Config.ServerAddress)
+	if dialErr != nil {
+		return nil, dialErr
+	}
+
+	transportConn, err := Starbridge.NewClientConnection(replicantConfig, conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return transportConn, nil
+}
+
+func ParseArgsStarbridgeClient(args string, dialer proxy.Dialer) (*StarbridgeClient, error) {
+	var config Starbridge.ClientConfig
+	bytes := []byte(args)
+	jsonError := json.Unmarshal(bytes, &config)
+	if jsonError != nil {
+		return nil, errors.New("starbridge client options json decoding error")
+	}
+
+	publicKeyBytes, decodeError := base64.StdEncoding.DecodeString(config.ServerPublicKey)
+	if decodeError != nil {
+		return nil, errors.New("public key bytes were not base64 compatible")
+	}
+	if len(publicKeyBytes) < 2 {
+		return nil, errors.New("public key is too short")
+	}
+
+	trimmedPublicKeyBytes := publicKeyBytes[1:]
+	config.ServerPublicKey = base64.StdEncoding.EncodeToString(trimmedPublicKeyBytes)
+
+	transport := StarbridgeClient{
+		Config: config,
+		Dialer: dialer,
+	}
+
+	return &transport, nil
+}
+
+func ParseArgsStarbridgeServer(args string) (*Starbridge.ServerConfig, error) {
+	var config Starbridge.ServerConfig
+
+	bytes := []byte(args)
+	jsonError := json.Unmarshal(bytes, &config)
+
+	privateKeyBytes, decodeError := base64.StdEncoding.DecodeString(config.ServerPrivateKey)
+	if decodeError != nil {
+		return nil, errors.New("private key bytes were not base64 compatible")
+	}
+	if len(privateKeyBytes) < 2 {
+		return nil, errors.New("private key is too short")
+	}
+
+	trimmedPrivateKeyBytes := privateKeyBytes[1:]
+	config.ServerPrivateKey = base64.StdEncoding.EncodeToString(trimmedPrivateKeyBytes)
+
+	if jsonError != nil {
+		return nil, errors.New("starbridge server options json decoding error")
+	}
+
+	return &config, nil
+}
+
+// ClientArgsStarbridgeServer returns the options a Starbridge client needs to
+// connect to a server started with args.
+func ClientArgsStarbridgeServer(args string) (map[string]string, error) {
+	config, err := ParseArgsStarbridgeServer(args)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, err := publicKeyFor(config.ServerPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{"serverPublicKey": publicKey}, nil
+}
+
+func CreateStarbridgeConfigs(address string, bindAddress *string) error {
+	keyExchange := ecdh.Generic(elliptic.P256())
+
+	ephemeralPrivateKey, ephemeralPublicKey, keyError := keyExchange.GenerateKey(rand.Reader)
+	if keyError != nil {
+		return keyError
+	}
+
+	point, ok := ephemeralPublicKey.(ecdh.Point)
+	if !ok {
+		return errors.New("could not convert client public key to point")
+	}
+
+	bytes := elliptic.Marshal(elliptic.P256(), point.X, point.Y)
+	if bytes == nil {
+		return errors.New("MarshalCompressed returned nil")
+	}
+
+	privateKeyBytes, ok := ephemeralPrivateKey.([]byte)
+	if !ok {
+		return errors.New("could not convert private key to bytes")
+	}
+
+	publicKeyBytes, keyByteError := darkstar.PublicKeyToKeychainFormatBytes(ephemeralPublicKey)
+	if keyByteError != nil {
+		return keyByteError
+	}
+
+	privateKeyString := base64.StdEncoding.EncodeToString(privateKeyBytes)
+	publicKeyString := base64.StdEncoding.EncodeToString(publicKeyBytes)
+
+	starbridgeClientConfig := Starbridge.ClientConfig{
+		ServerAddress:   address,
+		ServerPublicKey: publicKeyString,
+		Transport:       "Starbridge",
+	}
+
+	starbridgeServerConfig := Starbridge.ServerConfig{
+		ServerAddress:    address,
+		ServerPrivateKey: privateKeyString,
+		Transport:        "Starbridge",
+		BindAddress:      bindAddress,
+	}
+
+	serverJsonBytes, marshalError := json.MarshalIndent(starbridgeServerConfig, "", "  ")
+	if marshalError != nil {
+		return marshalError
+	}
+
+	clientJsonBytes, marshalError := json.MarshalIndent(starbridgeClientConfig, "", "  ")
+	if marshalError != nil {
+		return marshalError
+	}
+
+	serverJsonError := os.WriteFile("StarbridgeServerConfig.json", serverJsonBytes, 0777)
+	if serverJsonError != nil {
+		return serverJsonError
+	}
+
+	clientJsonError := os.WriteFile("StarbridgeClientConfig.json", clientJsonBytes, 0777)
+	if clientJsonError != nil {
+		return clientJsonError
+	}
+
+	return nil
+}
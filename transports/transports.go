@@ -27,243 +27,159 @@
 
 // Package transports provides a interface to query supported pluggable
 // transports.
+//
+// Each transport registers itself from its own file, which has a build tag so
+// that the dispatcher can be built without it, for example with
+// -tags noreplicant,nostarbridge. The tags are noshadow, noreplicant,
+// nostarbridge, noobfs4, nowebsocket, noexternal, nooptimizer and nochain.
 package transports
 
 import (
-	"crypto/elliptic"
-	"crypto/rand"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
-	"os"
+	"fmt"
+	"net"
+	"sort"
 	"strings"
 
 	Optimizer "github.com/OperatorFoundation/Optimizer-go/Optimizer/v3"
-	replicant "github.com/OperatorFoundation/Replicant-go/Replicant/v3"
-	"github.com/OperatorFoundation/Replicant-go/Replicant/v3/toneburst"
-	"github.com/OperatorFoundation/Shadow-go/shadow/v3"
-	"github.com/OperatorFoundation/Starbridge-go/Starbridge/v3"
-	shadowsocks "github.com/OperatorFoundation/go-shadowsocks2/darkstar"
-	"github.com/aead/ecdh"
-	"github.com/kataras/golog"
 	"golang.org/x/net/proxy"
 )
 
-// Transports returns the list of registered transport protocols.
-func Transports() []string {
-	return []string{"shadow", "Replicant", "Starbridge", "Optimizer"}
-}
-
-func ParseArgsShadow(args string, enableLocket bool, logDir string) (*shadow.Transport, error) {
-	var config shadow.ClientConfig
-
-	if enableLocket {
-		config.LogDir = &logDir
-	} else {
-		config.LogDir = nil
-	}
+// The modes a transport can run in. These are the mode names used by the
+// modes package.
+const (
+	ModeSocks5         = "socks5"
+	ModeTransparentTCP = "transparent-tcp"
+	ModeTransparentUDP = "transparent-udp"
+	ModeSTUNUDP        = "stun-udp"
+)
 
-	bytes := []byte(args)
-	jsonError := json.Unmarshal(bytes, &config)
-	if jsonError != nil {
-		return nil, errors.New("shadow options json decoding error")
-	}
+// AllModes lists every mode, for transports that run in all of them.
+var AllModes = []string{ModeSocks5, ModeTransparentTCP, ModeTransparentUDP, ModeSTUNUDP}
 
-	publicKeyBytes, decodeError := base64.StdEncoding.DecodeString(config.ServerPublicKey)
-	if decodeError != nil {
-		return nil, errors.New("public key bytes were not base64 compatible")
-	}
-
-	trimmedPublicKeyBytes := publicKeyBytes[1:]
-	trimmedPublicKeyString := base64.StdEncoding.EncodeToString(trimmedPublicKeyBytes)
-	
-	transport := shadow.NewTransport(config.ServerAddress, trimmedPublicKeyString, config.CipherName, config.LogDir)
+// Option is one of the keys in a transport's JSON options.
+type Option struct {
+	Name     string
+	Required bool
+}
 
-	return &transport, nil
+// ConfigSettings holds the -generateConfig flags a config generator uses.
+type ConfigSettings struct {
+	ServerAddress string
+	BindAddress   *string
+	Toneburst     bool
+	Polish        bool
 }
 
-func ParseArgsShadowServer(args string, enableLocket bool, logDir string) (*shadow.ServerConfig, error) {
-	var config shadow.ServerConfig
+// Transport describes a pluggable transport the dispatcher can run. A
+// transport that can't run as a client or server leaves that factory nil.
+type Transport struct {
+	// Name is the transport's name in -transports and in the options. Names
+	// are matched without regard to case.
+	Name string
 
-	if enableLocket {
-		config.LogDir = &logDir
-	} else {
-		config.LogDir = nil
-	}
+	// Modes lists the modes the transport can run in.
+	Modes []string
 
-	bytes := []byte(args)
-	jsonError := json.Unmarshal(bytes, &config)
-	if jsonError != nil {
-		return nil, errors.New("shadow server options json decoding error")
-	}
+	// ClientOptions and ServerOptions describe the options each side takes.
+	ClientOptions []Option
+	ServerOptions []Option
 
-	privateKeyBytes, decodeError := base64.StdEncoding.DecodeString(config.ServerPrivateKey)
-	if decodeError != nil {
-		return nil, errors.New("private key bytes were not base64 compatible")
-	}
-	trimmedPrivateKeyBytes := privateKeyBytes[1:]
-	config.ServerPrivateKey = base64.StdEncoding.EncodeToString(trimmedPrivateKeyBytes)
+	// NewClient returns a dialer for the client options, which connects
+	// through dialer.
+	NewClient func(options string, dialer proxy.Dialer, enableLocket bool, logDir string) (Optimizer.TransportDialer, error)
 
-	return &config, nil
-}
+	// NewServer returns a function that opens a listener for the server
+	// options. Transports that keep state between runs keep it in stateDir.
+	NewServer func(options string, stateDir string, enableLocket bool, logDir string) (func() (net.Listener, error), error)
 
-func CreateDefaultReplicantServer() replicant.ServerConfig {
-	config := replicant.ServerConfig{
-		Toneburst: nil,
-		Polish:    nil,
-	}
+	// ClientArgs returns the options a client needs to connect to a server
+	// started with options, which servers announce in their SMETHOD lines.
+	ClientArgs func(options string, stateDir string) (map[string]string, error)
 
-	return config
-}
+	// GenerateConfigs writes a matching pair of client and server configs.
+	GenerateConfigs func(settings ConfigSettings) error
 
-func ParseArgsReplicantClient(args string, dialer proxy.Dialer) (*replicant.TransportClient, error) {
-	config, jsonError := replicant.UnmarshalClientConfig([]byte(args))
-	if jsonError != nil {
-		return nil, jsonError
-	}
-
-	transport := replicant.TransportClient{
-		Config:  *config,
-		Address: config.ServerAddress,
-		Dialer:  dialer,
-	}
-
-	return &transport, nil
+	// IgnoresDialer is set for transports whose connections don't go through
+	// the dialer NewClient is given, so they can only be the first hop of a
+	// chain.
+	IgnoresDialer bool
 }
 
-//  target string, dialer proxy.Dialer
-func ParseArgsReplicantServer(args string) (*replicant.ServerConfig, error) {
-	config, jsonError := replicant.UnmarshalServerConfig([]byte(args))
-	if jsonError != nil {
-		return nil, jsonError
-	}
+// NextHopConn is a connection accepted by a server that passes its clients on
+// to another hop, such as a chain server. The server modes relay it to the
+// next hop instead of their target.
+type NextHopConn interface {
+	net.Conn
 
-	return config, nil
+	// DialNext connects to the next hop, reaching it through dialer.
+	DialNext(dialer proxy.Dialer) (net.Conn, error)
 }
 
-func ParseArgsStarbridgeClient(args string, dialer proxy.Dialer) (*Starbridge.TransportClient, error) {
-	var config Starbridge.ClientConfig
-	bytes := []byte(args)
-	jsonError := json.Unmarshal(bytes, &config)
-	if jsonError != nil {
-		return nil, errors.New("starbridge client options json decoding error")
-	}
+var registry = make(map[string]Transport)
 
-	publicKeyBytes, decodeError := base64.StdEncoding.DecodeString(config.ServerPublicKey)
-	if decodeError != nil {
-		return nil, errors.New("public key bytes were not base64 compatible")
-	}
-	
-	trimmedPublicKeyBytes := publicKeyBytes[1:]
-	config.ServerPublicKey = base64.StdEncoding.EncodeToString(trimmedPublicKeyBytes)
-
-	transport := Starbridge.TransportClient{
-		Config:  config,
-		Address: config.ServerAddress,
-		Dialer:  dialer,
+// Register adds transport to the transports the dispatcher can run. It is
+// called from init, and panics if a transport with the same name is already
+// registered.
+func Register(transport Transport) {
+	key := strings.ToLower(transport.Name)
+	if _, exists := registry[key]; exists {
+		panic("transports: Register called twice for " + transport.Name)
 	}
 
-	return &transport, nil
+	registry[key] = transport
 }
 
-func ParseArgsStarbridgeServer(args string) (*Starbridge.ServerConfig, error) {
-	var config Starbridge.ServerConfig
-
-	bytes := []byte(args)
-	jsonError := json.Unmarshal(bytes, &config)
-
-	privateKeyBytes, decodeError := base64.StdEncoding.DecodeString(config.ServerPrivateKey)
-	if decodeError != nil {
-		return nil, errors.New("private key bytes were not base64 compatible")
-	}
-	
-	trimmedPrivateKeyBytes := privateKeyBytes[1:]
-	config.ServerPrivateKey = base64.StdEncoding.EncodeToString(trimmedPrivateKeyBytes)
-
-	if jsonError != nil {
-		return nil, errors.New("starbridge server options json decoding error")
-	}
-
-	return &config, nil
+// Lookup returns the registered transport called name.
+func Lookup(name string) (Transport, bool) {
+	transport, ok := registry[strings.ToLower(name)]
+	return transport, ok
 }
 
-type OptimizerConfig struct {
-	Transports []interface{} `json:"transports"`
-	Strategy   string        `json:"strategy"`
-}
+// Transports returns the list of registered transport protocols.
+func Transports() []string {
+	names := make([]string, 0, len(registry))
+	for _, transport := range registry {
+		names = append(names, transport.Name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return strings.ToLower(names[i]) < strings.ToLower(names[j])
+	})
 
-type OptimizerArgs struct {
-	Address string                 `json:"address"`
-	Name    string                 `json:"name"`
-	Config  map[string]interface{} `json:"config"`
+	return names
 }
 
-func ParseArgsOptimizer(jsonConfig string, dialer proxy.Dialer, enableLocket bool, logDir string) (*Optimizer.Client, error) {
-	var config OptimizerConfig
-	var transports []Optimizer.TransportDialer
-	var strategy Optimizer.Strategy
-	jsonByte := []byte(jsonConfig)
-	parseErr := json.Unmarshal(jsonByte, &config)
-	if parseErr != nil {
-		return nil, errors.New("could not marshal optimizer config")
-	}
-	transports, parseErr = parseTransports(config.Transports, dialer, enableLocket, logDir)
-	if parseErr != nil {
-		println("this is the returned error from parseTransports:", parseErr)
-		return nil, errors.New("could not parse transports")
-	}
-
-	strategy, parseErr = parseStrategy(config.Strategy, transports)
-	if parseErr != nil {
-		return nil, errors.New("could not parse strategy")
+// Supports reports whether the transport can run in mode.
+func (transport Transport) Supports(mode string) bool {
+	for _, supported := range transport.Modes {
+		if strings.EqualFold(supported, mode) {
+			return true
+		}
 	}
 
-	transport := Optimizer.NewOptimizerClient(transports, strategy)
-
-	return transport, nil
+	return false
 }
 
-func parseStrategy(strategyString string, transports []Optimizer.TransportDialer) (Optimizer.Strategy, error) {
-	switch strategyString {
-	case "first":
-		strategy := Optimizer.NewFirstStrategy(transports)
-		return strategy, nil
-	case "random":
-		strategy := Optimizer.NewRandomStrategy(transports)
-		return strategy, nil
-	case "rotate":
-		strategy := Optimizer.NewRotateStrategy(transports)
-		return strategy, nil
-	case "track":
-		return Optimizer.NewTrackStrategy(transports), nil
-	case "minimizeDialDuration":
-		return Optimizer.NewMinimizeDialDuration(transports), nil
-
-	default:
-		return nil, errors.New("invalid strategy")
+// CheckOptions checks that the JSON options include every required option in
+// schema.
+func CheckOptions(options string, schema []Option) error {
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(options), &keys); err != nil {
+		return fmt.Errorf("options are not a JSON object: %s", err)
 	}
-}
 
-func parseTransports(otcs []interface{}, dialer proxy.Dialer, enableLocket bool, logDir string) ([]Optimizer.TransportDialer, error) {
-	transports := make([]Optimizer.TransportDialer, len(otcs))
-	for index, untypedOtc := range otcs {
-		switch untypedOtc.(type) {
-		case map[string]interface{}:
-			otc := untypedOtc.(map[string]interface{})
-			transport, err := parsedTransport(otc, dialer, enableLocket, logDir)
-			if err != nil {
-				return nil, errors.New("transport could not parse config")
-				//this error sucks and is uninformative
-			}
-			transports[index] = transport
-		default:
-			return nil, errors.New("unsupported type for transport")
+	for _, option := range schema {
+		if _, ok := keys[option.Name]; option.Required && !ok {
+			return fmt.Errorf("missing the %s option", option.Name)
 		}
-
 	}
-	return transports, nil
+
+	return nil
 }
 
+// parsedTransport returns a dialer for otc, a {"name": ..., "config": {...}}
+// entry naming a client transport and its options, as in Optimizer configs.
 func parsedTransport(otc map[string]interface{}, dialer proxy.Dialer, enableLocket bool, logDir string) (Optimizer.TransportDialer, error) {
 	var config map[string]interface{}
 
@@ -299,277 +215,14 @@ func parsedTransport(otc map[string]interface{}, dialer proxy.Dialer, enableLock
 		return nil, errors.New("could not marshal Optimizer config")
 	}
 	jsonConfigString := string(jsonConfigBytes)
-	switch strings.ToLower(PartialConfig.Name) {
-	case "shadow":
-		shadowTransport, parseErr := ParseArgsShadow(jsonConfigString, enableLocket, logDir)
-		if parseErr != nil {
-			return nil, errors.New("could not parse shadow Args")
-		}
-		return shadowTransport, nil
-	case "replicant":
-		replicantTransport, parseErr := ParseArgsReplicantClient(jsonConfigString, dialer)
-		if parseErr != nil {
-			return nil, errors.New("could not parse replicant Args")
-		}
-		return replicantTransport, nil
-	case "starbridge":
-		starbridgeTransport, parseErr := ParseArgsStarbridgeClient(jsonConfigString, dialer)
-		if parseErr != nil {
-			return nil, errors.New("could not parse starbridge Args")
-		}
-		return starbridgeTransport, nil
-	case "optimizer":
-		optimizerTransport, parseErr := ParseArgsOptimizer(jsonConfigString, dialer, enableLocket, logDir)
-		if parseErr != nil {
-			return nil, errors.New("could not parse Optimizer Args")
-		}
-		return optimizerTransport, nil
-	default:
-		println("unsupported transport name")
+	transport, ok := Lookup(PartialConfig.Name)
+	if !ok || transport.NewClient == nil {
 		return nil, errors.New("unsupported transport name")
 	}
-}
-
-func CreateShadowConfigs(address string, bindAddress *string) error {
-	keyExchange := ecdh.Generic(elliptic.P256())
-	
-	ephemeralPrivateKey, ephemeralPublicKey, keyError := keyExchange.GenerateKey(rand.Reader)
-	if keyError != nil {
-		return keyError
-	}
-
-	point, ok := ephemeralPublicKey.(ecdh.Point)
-	if !ok {
-		return errors.New("could not convert client public key to point")
-	}
-
-	bytes := elliptic.Marshal(elliptic.P256(), point.X, point.Y)
-	if bytes == nil {
-		return errors.New("MarshalCompressed returned nil")
-	}
-
-	privateKeyBytes, ok := ephemeralPrivateKey.([]byte)
-	if !ok {
-		return errors.New("could not convert private key to bytes")
-	}
-
-	publicKeyBytes, keyByteError := shadowsocks.PublicKeyToKeychainFormatBytes(ephemeralPublicKey)
-	if keyByteError != nil {
-		return keyByteError
-	}
-	
-	privateKeyString := base64.StdEncoding.EncodeToString(privateKeyBytes)
-	publicKeyString := base64.StdEncoding.EncodeToString(publicKeyBytes)
-
-	shadowServerConfig := shadow.ServerConfig{
-		ServerAddress: 	  address,
-		ServerPrivateKey: privateKeyString,
-		CipherName:		  "darkstar",
-		Transport: 		  "Shadow",
-		BindAddress: 	  bindAddress,
-	}
-
-	serverJsonBytes, marshalError := json.MarshalIndent(shadowServerConfig, "", "  ")
-	if marshalError != nil {
-		return marshalError
-	}
-
-	shadowClientConfig := shadow.ClientConfig{
-		ServerAddress:   address,
-		ServerPublicKey: publicKeyString,
-		CipherName: 	 "darkstar",
-		Transport: 		 "Shadow",
-	}
-
-	clientJsonBytes, marshalError := json.MarshalIndent(shadowClientConfig, "", "  ")
-	if marshalError != nil {
-		return marshalError
-	}
-
-	serverJsonError := os.WriteFile("ShadowServerConfig.json", serverJsonBytes, 0777)
-	if serverJsonError != nil {
-		return serverJsonError
-	}
-	
-	clientJsonError := os.WriteFile("ShadowClientConfig.json", clientJsonBytes, 0777)
-	if clientJsonError != nil {
-		return clientJsonError
-	}
-
-	return nil
-}
-
-func CreateStarbridgeConfigs(address string, bindAddress *string) error {
-		keyExchange := ecdh.Generic(elliptic.P256())
-	
-	ephemeralPrivateKey, ephemeralPublicKey, keyError := keyExchange.GenerateKey(rand.Reader)
-	if keyError != nil {
-		return keyError
-	}
-
-	point, ok := ephemeralPublicKey.(ecdh.Point)
-	if !ok {
-		return errors.New("could not convert client public key to point")
-	}
-
-	bytes := elliptic.Marshal(elliptic.P256(), point.X, point.Y)
-	if bytes == nil {
-		return errors.New("MarshalCompressed returned nil")
-	}
-
-	privateKeyBytes, ok := ephemeralPrivateKey.([]byte)
-	if !ok {
-		return errors.New("could not convert private key to bytes")
-	}
-
-	publicKeyBytes, keyByteError := shadowsocks.PublicKeyToKeychainFormatBytes(ephemeralPublicKey)
-	if keyByteError != nil {
-		return keyByteError
-	}
-	
-	privateKeyString := base64.StdEncoding.EncodeToString(privateKeyBytes)
-	publicKeyString := base64.StdEncoding.EncodeToString(publicKeyBytes)
-
-	starbridgeClientConfig := Starbridge.ClientConfig {
-		ServerAddress: address,
-		ServerPublicKey: publicKeyString,
-		Transport: "Starbridge",
-	}
-
-	starbridgeServerConfig := Starbridge.ServerConfig {
-		ServerAddress: address,
-		ServerPrivateKey: privateKeyString,
-		Transport: "Starbridge",
-		BindAddress: bindAddress,
-	}
-
-	serverJsonBytes, marshalError := json.MarshalIndent(starbridgeServerConfig, "", "  ")
-	if marshalError != nil {
-		return marshalError
-	}
-
-	clientJsonBytes, marshalError := json.MarshalIndent(starbridgeClientConfig, "", "  ")
-	if marshalError != nil {
-		return marshalError
-	}
-
-	serverJsonError := os.WriteFile("StarbridgeServerConfig.json", serverJsonBytes, 0777)
-	if serverJsonError != nil {
-		return serverJsonError
-	}
-	
-	clientJsonError := os.WriteFile("StarbridgeClientConfig.json", clientJsonBytes, 0777)
-	if clientJsonError != nil {
-		return clientJsonError
-	}
-
-	return nil
-}
-
-func CreateReplicantConfigs(address string, isToneburst bool, isPolish bool, bindAddress *string) error {
-	var polishClient *replicant.DarkStarPolishClientJsonConfig = nil 
-	var polishServer *replicant.DarkStarPolishServerJsonConfig = nil 
-	var toneburstClient *toneburst.StarburstConfig = nil
-	var toneburstServer *toneburst.StarburstConfig = nil
-	if isPolish {
-			keyExchange := ecdh.Generic(elliptic.P256())
-	
-	ephemeralPrivateKey, ephemeralPublicKey, keyError := keyExchange.GenerateKey(rand.Reader)
-	if keyError != nil {
-		return keyError
-	}
-
-	point, ok := ephemeralPublicKey.(ecdh.Point)
-	if !ok {
-		return errors.New("could not convert client public key to point")
-	}
-
-	bytes := elliptic.Marshal(elliptic.P256(), point.X, point.Y)
-	if bytes == nil {
-		return errors.New("MarshalCompressed returned nil")
-	}
-
-	privateKeyBytes, ok := ephemeralPrivateKey.([]byte)
-	if !ok {
-		return errors.New("could not convert private key to bytes")
-	}
-
-	publicKeyBytes, keyByteError := shadowsocks.PublicKeyToKeychainFormatBytes(ephemeralPublicKey)
-	if keyByteError != nil {
-		return keyByteError
-	}
-	
-	privateKeyString := base64.StdEncoding.EncodeToString(privateKeyBytes)
-	publicKeyString := base64.StdEncoding.EncodeToString(publicKeyBytes)
-
-		polishClient = &replicant.DarkStarPolishClientJsonConfig {
-			ServerAddress: address,
-			ServerPublicKey: publicKeyString,
-		}
-
-		polishServer = &replicant.DarkStarPolishServerJsonConfig {
-			ServerAddress: address,
-			ServerPrivateKey: privateKeyString,
-		}
-
-	} else {
-		golog.Info("Invalid polish name.  Setting value to nil")
-		polishClient = nil
-		polishServer = nil
-	}
 
-
-	if isToneburst {
-		toneburstClient = &toneburst.StarburstConfig{
-			Type: "starbridge",
-			Mode: "SMTPClient",
-		}
-
-		toneburstServer = &toneburst.StarburstConfig{
-			Type: "starbridge",
-			Mode: "SMTPServer",
-		}
-		
-	}  else {
-		golog.Info("Invalid toneburst name.  Setting value to nil")
-			toneburstClient = nil
-			toneburstServer = nil
-	}
-	
-	replicantServerConfig := replicant.ServerJsonConfig {
-		ServerAddress: address,
-		Toneburst: *toneburstServer,
-		Polish: *polishServer,
-		Transport: "Replicant",
-		BindAddress: bindAddress,
-	}
-	
-	replicantClientConfig := replicant.ClientJsonConfig {
-		ServerAddress: address,
-		Toneburst: *toneburstClient,
-		Polish: *polishClient,
-		Transport: "Replicant",
-	}
-
-	serverJsonBytes, marshalError := json.MarshalIndent(replicantServerConfig, "", "  ")
-	if marshalError != nil {
-		return marshalError
-	}
-
-	clientJsonBytes, marshalError := json.MarshalIndent(replicantClientConfig, "", "  ")
-	if marshalError != nil {
-		return marshalError
-	}
-
-	serverJsonError := os.WriteFile("ReplicantServerConfig.json", serverJsonBytes, 0777)
-	if serverJsonError != nil {
-		return serverJsonError
-	}
-	
-	clientJsonError := os.WriteFile("ReplicantClientConfig.json", clientJsonBytes, 0777)
-	if clientJsonError != nil {
-		return clientJsonError
+	transportDialer, parseErr := transport.NewClient(jsonConfigString, dialer, enableLocket, logDir)
+	if parseErr != nil {
+		return nil, fmt.Errorf("could not parse %s Args", transport.Name)
 	}
-
-	return nil
+	return transportDialer, nil
 }
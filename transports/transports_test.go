@@ -0,0 +1,75 @@
+package transports
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	for _, name := range Transports() {
+		for _, spelling := range []string{name, strings.ToLower(name), strings.ToUpper(name)} {
+			transport, ok := Lookup(spelling)
+			if !ok {
+				t.Errorf("%s is listed but Lookup(%q) failed", name, spelling)
+				continue
+			}
+			if transport.Name != name {
+				t.Errorf("Lookup(%q) returned %s", spelling, transport.Name)
+			}
+		}
+	}
+
+	if _, ok := Lookup("obfs2"); ok {
+		t.Error("Lookup found a transport that is not registered")
+	}
+}
+
+func TestTransportsSorted(t *testing.T) {
+	names := Transports()
+	if len(names) != len(registry) {
+		t.Errorf("got %d names for %d transports", len(names), len(registry))
+	}
+	if !sort.SliceIsSorted(names, func(i, j int) bool { return strings.ToLower(names[i]) < strings.ToLower(names[j]) }) {
+		t.Errorf("names are not sorted: %v", names)
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a name twice did not panic")
+		}
+	}()
+
+	Register(Transport{Name: "test"})
+	defer delete(registry, "test")
+	Register(Transport{Name: "TEST"})
+}
+
+func TestSupports(t *testing.T) {
+	transport := Transport{Name: "test", Modes: []string{ModeSocks5, ModeTransparentTCP}}
+	if !transport.Supports(ModeSocks5) || !transport.Supports("Transparent-TCP") {
+		t.Error("expected the listed modes to be supported")
+	}
+	if transport.Supports(ModeSTUNUDP) {
+		t.Error("expected stun-udp not to be supported")
+	}
+}
+
+func TestCheckOptions(t *testing.T) {
+	schema := []Option{{"serverAddress", true}, {"serverPublicKey", true}, {"cipherName", false}}
+
+	if err := CheckOptions(`{"serverAddress": "127.0.0.1:1234", "serverPublicKey": "AB+c="}`, schema); err != nil {
+		t.Error(err)
+	}
+
+	err := CheckOptions(`{"serverAddress": "127.0.0.1:1234", "cipherName": "darkstar"}`, schema)
+	if err == nil || !strings.Contains(err.Error(), "serverPublicKey") {
+		t.Errorf("expected an error naming serverPublicKey, got %v", err)
+	}
+
+	if err = CheckOptions(`["serverAddress"]`, schema); err == nil {
+		t.Error("expected an error for options that are not an object")
+	}
+}
@@ -0,0 +1,457 @@
+//go:build !nowebsocket
+
+/*
+MIT License
+
+Copyright (c) 2020 Operator Foundation
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NON-INFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package transports
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	Optimizer "github.com/OperatorFoundation/Optimizer-go/Optimizer/v3"
+	locketgo "github.com/OperatorFoundation/locket-go"
+	"golang.org/x/net/proxy"
+	"golang.org/x/net/websocket"
+)
+
+func init() {
+	Register(Transport{
+		Name:          "WebSocket",
+		Modes:         AllModes,
+		ClientOptions: []Option{{"serverAddress", true}, {"path", false}, {"host", false}, {"headers", false}, {"tls", false}, {"serverName", false}},
+		ServerOptions: []Option{{"serverAddress", false}, {"bindAddress", false}, {"path", false}, {"coverPage", false}, {"certFile", false}, {"keyFile", false}},
+		NewClient: func(options string, dialer proxy.Dialer, enableLocket bool, logDir string) (Optimizer.TransportDialer, error) {
+			client, err := ParseArgsWebSocketClient(options, dialer)
+			if err != nil {
+				return nil, err
+			}
+			if enableLocket {
+				client.LogDir = &logDir
+			}
+			return client, nil
+		},
+		NewServer: func(options string, stateDir string, enableLocket bool, logDir string) (func() (net.Listener, error), error) {
+			server, err := ParseArgsWebSocketServer(options)
+			if err != nil {
+				return nil, err
+			}
+			return server.Listen, nil
+		},
+		ClientArgs: func(options string, stateDir string) (map[string]string, error) {
+			return ClientArgsWebSocketServer(options)
+		},
+		GenerateConfigs: func(settings ConfigSettings) error {
+			return CreateWebSocketConfigs(settings.ServerAddress, settings.BindAddress)
+		},
+	})
+}
+
+// webSocketHandshakeTimeout bounds the TLS and HTTP upgrade handshakes.
+const webSocketHandshakeTimeout = time.Minute
+
+// defaultCoverPage is served to HTTP requests that are not WebSocket
+// upgrades, when the server has no cover page of its own.
+const defaultCoverPage = `<!DOCTYPE html>
+<html>
+<head><title>Welcome</title></head>
+<body><p>This site is under construction.</p></body>
+</html>
+`
+
+// WebSocketClientOptions are the options for a WebSocket client. Host,
+// which defaults to the host in ServerAddress, is sent as the HTTP Host
+// header, so the server can be reached through a reverse proxy or CDN that
+// routes on it.
+type WebSocketClientOptions struct {
+	ServerAddress string            `json:"serverAddress"`
+	Path          string            `json:"path,omitempty"`
+	Host          string            `json:"host,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	TLS           bool              `json:"tls,omitempty"`
+	ServerName    string            `json:"serverName,omitempty"`
+	Transport     string            `json:"transport"`
+}
+
+// WebSocketServerOptions are the options for a WebSocket server. Requests
+// for anything but a WebSocket upgrade on Path get the cover page. The
+// server speaks TLS if it is given a certificate, and plain HTTP otherwise,
+// for running behind a proxy that terminates TLS.
+type WebSocketServerOptions struct {
+	ServerAddress string  `json:"serverAddress"`
+	BindAddress   *string `json:"bindAddress,omitempty"`
+	Path          string  `json:"path,omitempty"`
+	CoverPage     string  `json:"coverPage,omitempty"`
+	CertFile      string  `json:"certFile,omitempty"`
+	KeyFile       string  `json:"keyFile,omitempty"`
+	Transport     string  `json:"transport"`
+}
+
+// WebSocketClient dials a WebSocket server.
+type WebSocketClient struct {
+	Options WebSocketClientOptions
+	Dialer  proxy.Dialer
+	LogDir  *string
+	config  *websocket.Config
+}
+
+func (client *WebSocketClient) Dial() (net.Conn, error) {
+	netConn, dialError := dialWithTimeout(client.Dialer, client.Options.ServerAddress)
+	if dialError != nil {
+		return nil, dialError
+	}
+
+	if client.LogDir != nil {
+		locketConn, locketError := locketgo.NewLocketConn(netConn, *client.LogDir, "WebSocketClient")
+		if locketError != nil {
+			_ = netConn.Close()
+			return nil, locketError
+		}
+		netConn = locketConn
+	}
+
+	transportConn, handshakeError := client.handshake(netConn)
+	if handshakeError != nil {
+		_ = netConn.Close()
+		return nil, handshakeError
+	}
+
+	return transportConn, nil
+}
+
+func (client *WebSocketClient) handshake(netConn net.Conn) (net.Conn, error) {
+	if err := netConn.SetDeadline(time.Now().Add(webSocketHandshakeTimeout)); err != nil {
+		return nil, err
+	}
+
+	if client.Options.TLS {
+		tlsConn := tls.Client(netConn, &tls.Config{ServerName: client.Options.ServerName})
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, err
+		}
+		netConn = tlsConn
+	}
+
+	ws, err := websocket.NewClient(client.config, netConn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = netConn.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+
+	return newWebSocketConn(ws, netConn.LocalAddr(), netConn.RemoteAddr()), nil
+}
+
+func ParseArgsWebSocketClient(args string, dialer proxy.Dialer) (*WebSocketClient, error) {
+	var options WebSocketClientOptions
+	if jsonError := json.Unmarshal([]byte(args), &options); jsonError != nil {
+		return nil, errors.New("websocket client options json decoding error")
+	}
+
+	if _, _, err := net.SplitHostPort(options.ServerAddress); err != nil {
+		return nil, err
+	}
+	if options.Host == "" {
+		options.Host = options.ServerAddress
+	}
+	if options.ServerName == "" {
+		options.ServerName = options.Host
+		if host, _, err := net.SplitHostPort(options.Host); err == nil {
+			options.ServerName = host
+		}
+	}
+
+	path, err := webSocketPath(options.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	scheme, originScheme := "ws", "http"
+	if options.TLS {
+		scheme, originScheme = "wss", "https"
+	}
+	location := &url.URL{Scheme: scheme, Host: options.Host, Path: path}
+	config, err := websocket.NewConfig(location.String(), originScheme+"://"+options.Host)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range options.Headers {
+		config.Header.Set(name, value)
+	}
+
+	return &WebSocketClient{Options: options, Dialer: dialer, config: config}, nil
+}
+
+// webSocketPath checks the path option, which defaults to /.
+func webSocketPath(path string) (string, error) {
+	if path == "" {
+		return "/", nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		return "", errors.New("the websocket path has to start with /")
+	}
+
+	return path, nil
+}
+
+// WebSocketServer listens for WebSocket clients.
+type WebSocketServer struct {
+	Address   string
+	Path      string
+	CoverPage []byte
+	TLSConfig *tls.Config
+}
+
+func ParseArgsWebSocketServer(args string) (*WebSocketServer, error) {
+	var options WebSocketServerOptions
+	if jsonError := json.Unmarshal([]byte(args), &options); jsonError != nil {
+		return nil, errors.New("websocket server options json decoding error")
+	}
+
+	path, err := webSocketPath(options.Path)
+	if err != nil {
+		return nil, err
+	}
+	server := &WebSocketServer{Address: options.ServerAddress, Path: path, CoverPage: []byte(defaultCoverPage)}
+	if options.BindAddress != nil {
+		server.Address = *options.BindAddress
+	}
+	if server.Address == "" {
+		return nil, errors.New("websocket needs a serverAddress or bindAddress to listen on")
+	}
+
+	if options.CoverPage != "" {
+		if server.CoverPage, err = os.ReadFile(options.CoverPage); err != nil {
+			return nil, err
+		}
+	}
+
+	if options.CertFile != "" || options.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	}
+
+	return server, nil
+}
+
+func (server *WebSocketServer) Listen() (net.Listener, error) {
+	ln, err := net.Listen("tcp", server.Address)
+	if err != nil {
+		return nil, err
+	}
+	if server.TLSConfig != nil {
+		ln = tls.NewListener(ln, server.TLSConfig)
+	}
+
+	listener := &webSocketListener{
+		ln:     ln,
+		server: server,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	listener.http = &http.Server{Handler: listener, ReadHeaderTimeout: webSocketHandshakeTimeout}
+	go listener.serve()
+
+	return listener, nil
+}
+
+// ClientArgsWebSocketServer returns the options a WebSocket client needs to
+// connect to a server started with args.
+func ClientArgsWebSocketServer(args string) (map[string]string, error) {
+	server, err := ParseArgsWebSocketServer(args)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{"path": server.Path}, nil
+}
+
+// webSocketListener serves HTTP, handing each WebSocket upgrade on the
+// server's path to Accept and answering every other request with the cover
+// page.
+type webSocketListener struct {
+	ln     net.Listener
+	server *WebSocketServer
+	http   *http.Server
+	conns  chan net.Conn
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	err       error
+}
+
+func (listener *webSocketListener) serve() {
+	err := listener.http.Serve(listener.ln)
+	if err == http.ErrServerClosed {
+		err = &net.OpError{Op: "accept", Net: "tcp", Addr: listener.ln.Addr(), Err: net.ErrClosed}
+	}
+
+	listener.closeOnce.Do(func() {
+		listener.err = err
+		close(listener.closed)
+	})
+}
+
+func (listener *webSocketListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != listener.server.Path || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write(listener.server.CoverPage)
+		return
+	}
+
+	// Handshake is left unset so that clients don't need to send an Origin.
+	websocket.Server{Handler: listener.handle}.ServeHTTP(w, r)
+}
+
+// handle passes a connection to Accept, and keeps it open until it is
+// closed, since the websocket package closes it when this returns.
+func (listener *webSocketListener) handle(ws *websocket.Conn) {
+	request := ws.Request()
+	_ = ws.SetDeadline(time.Time{})
+
+	local, _ := request.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	remote, err := net.ResolveTCPAddr("tcp", request.RemoteAddr)
+	if err != nil {
+		return
+	}
+	conn := newWebSocketConn(ws, local, remote)
+
+	select {
+	case listener.conns <- conn:
+	case <-listener.closed:
+		return
+	}
+
+	<-conn.done
+}
+
+func (listener *webSocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-listener.conns:
+		return conn, nil
+	case <-listener.closed:
+		return nil, listener.err
+	}
+}
+
+// Close stops accepting connections. Connections that were accepted stay
+// open.
+func (listener *webSocketListener) Close() error {
+	return listener.http.Close()
+}
+
+func (listener *webSocketListener) Addr() net.Addr {
+	return listener.ln.Addr()
+}
+
+// webSocketConn sends data as binary WebSocket messages, and reports the
+// addresses of the connection it runs over rather than URLs.
+type webSocketConn struct {
+	*websocket.Conn
+	local  net.Addr
+	remote net.Addr
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newWebSocketConn(ws *websocket.Conn, local net.Addr, remote net.Addr) *webSocketConn {
+	ws.PayloadType = websocket.BinaryFrame
+
+	return &webSocketConn{Conn: ws, local: local, remote: remote, done: make(chan struct{})}
+}
+
+func (conn *webSocketConn) Close() error {
+	err := conn.Conn.Close()
+	conn.closeOnce.Do(func() { close(conn.done) })
+
+	return err
+}
+
+func (conn *webSocketConn) LocalAddr() net.Addr {
+	return conn.local
+}
+
+func (conn *webSocketConn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+func CreateWebSocketConfigs(address string, bindAddress *string) error {
+	// A random path keeps probers that don't know it on the cover page.
+	pathBytes := make([]byte, 16)
+	if _, err := rand.Read(pathBytes); err != nil {
+		return err
+	}
+	path := "/" + hex.EncodeToString(pathBytes)
+
+	webSocketServerConfig := WebSocketServerOptions{
+		ServerAddress: address,
+		BindAddress:   bindAddress,
+		Path:          path,
+		Transport:     "WebSocket",
+	}
+
+	webSocketClientConfig := WebSocketClientOptions{
+		ServerAddress: address,
+		Path:          path,
+		Transport:     "WebSocket",
+	}
+
+	serverJsonBytes, marshalError := json.MarshalIndent(webSocketServerConfig, "", "  ")
+	if marshalError != nil {
+		return marshalError
+	}
+
+	clientJsonBytes, marshalError := json.MarshalIndent(webSocketClientConfig, "", "  ")
+	if marshalError != nil {
+		return marshalError
+	}
+
+	serverJsonError := os.WriteFile("WebSocketServerConfig.json", serverJsonBytes, 0644)
+	if serverJsonError != nil {
+		return serverJsonError
+	}
+
+	clientJsonError := os.WriteFile("WebSocketClientConfig.json", clientJsonBytes, 0644)
+	if clientJsonError != nil {
+		return clientJsonError
+	}
+
+	return nil
+}
@@ -0,0 +1,187 @@
+//go:build !nowebsocket
+
+package transports
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/websocket"
+)
+
+func echo(ln net.Listener) {
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+}
+
+func checkEcho(t *testing.T, conn net.Conn, length int) {
+	sent := make([]byte, length)
+	_, _ = rand.Read(sent)
+	go func() { _, _ = conn.Write(sent) }()
+
+	received := make([]byte, length)
+	if _, err := io.ReadFull(conn, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sent, received) {
+		t.Error("echoed data differs")
+	}
+}
+
+func listenWebSocket(t *testing.T, options string) net.Listener {
+	server, err := ParseArgsWebSocketServer(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := server.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	return ln
+}
+
+func TestWebSocketEcho(t *testing.T) {
+	ln := listenWebSocket(t, `{"transport": "WebSocket", "serverAddress": "127.0.0.1:0", "path": "/tunnel"}`)
+	echo(ln)
+
+	client, err := ParseArgsWebSocketClient(fmt.Sprintf(`{"serverAddress": %q, "path": "/tunnel"}`, ln.Addr()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := client.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, ok := conn.RemoteAddr().(*net.TCPAddr); !ok {
+		t.Errorf("got remote address %v, want the TCP address", conn.RemoteAddr())
+	}
+	checkEcho(t, conn, 256*1024)
+}
+
+func TestWebSocketCoverPage(t *testing.T) {
+	coverPage := filepath.Join(t.TempDir(), "index.html")
+	if err := os.WriteFile(coverPage, []byte("<p>cover</p>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ln := listenWebSocket(t, fmt.Sprintf(`{"serverAddress": "127.0.0.1:0", "path": "/tunnel", "coverPage": %q}`, coverPage))
+
+	// Neither plain requests for the path nor upgrades elsewhere get through.
+	for _, path := range []string{"/", "/tunnel", "/other"} {
+		response, err := http.Get("http://" + ln.Addr().String() + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(response.Body)
+		_ = response.Body.Close()
+		if response.StatusCode != http.StatusOK || string(body) != "<p>cover</p>" {
+			t.Errorf("GET %s: got %d %q", path, response.StatusCode, body)
+		}
+	}
+
+	client, _ := ParseArgsWebSocketClient(fmt.Sprintf(`{"serverAddress": %q, "path": "/other"}`, ln.Addr()), nil)
+	if conn, err := client.Dial(); err == nil {
+		_ = conn.Close()
+		t.Error("upgraded a request for the wrong path")
+	}
+}
+
+// A client has to work through an ordinary HTTP server, which is what a
+// reverse proxy or CDN hands the upgrade to.
+func TestWebSocketClientHeaders(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	server := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+		requests <- ws.Request()
+		_, _ = io.Copy(ws, ws)
+	}})
+	defer server.Close()
+
+	options := fmt.Sprintf(`{"serverAddress": %q, "path": "/ws", "host": "cdn.example.com", "headers": {"X-Test": "yes"}}`, server.Listener.Addr())
+	client, err := ParseArgsWebSocketClient(options, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := client.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	checkEcho(t, conn, 4096)
+
+	request := <-requests
+	if request.Host != "cdn.example.com" || request.URL.Path != "/ws" || request.Header.Get("X-Test") != "yes" {
+		t.Errorf("got Host %q, path %q, X-Test %q", request.Host, request.URL.Path, request.Header.Get("X-Test"))
+	}
+}
+
+func TestWebSocketOptimizer(t *testing.T) {
+	optimizer, ok := Lookup("Optimizer")
+	if !ok {
+		t.Skip("built without Optimizer")
+	}
+	ln := listenWebSocket(t, `{"serverAddress": "127.0.0.1:0"}`)
+	echo(ln)
+
+	config, _ := json.Marshal(map[string]interface{}{
+		"strategy": "first",
+		"transports": []interface{}{map[string]interface{}{
+			"name":   "WebSocket",
+			"config": map[string]interface{}{"serverAddress": ln.Addr().String()},
+		}},
+	})
+	client, err := optimizer.NewClient(string(config), nil, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := client.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	checkEcho(t, conn, 4096)
+}
+
+func TestWebSocketOptions(t *testing.T) {
+	if _, err := ParseArgsWebSocketClient(`{"serverAddress": "127.0.0.1:80", "path": "ws"}`, nil); err == nil {
+		t.Error("expected a path without a leading / to be rejected")
+	}
+	if _, err := ParseArgsWebSocketServer(`{"path": "/ws"}`); err == nil {
+		t.Error("expected an error without an address")
+	}
+
+	args, err := ClientArgsWebSocketServer(`{"serverAddress": "127.0.0.1:80"}`)
+	if err != nil || args["path"] != "/" {
+		t.Errorf("got %v, %v", args, err)
+	}
+
+	client, err := ParseArgsWebSocketClient(`{"serverAddress": "192.0.2.1:443", "host": "example.com", "tls": true}`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Options.ServerName != "example.com" || !strings.HasPrefix(client.config.Location.String(), "wss://example.com/") {
+		t.Errorf("got server name %q and location %s", client.Options.ServerName, client.config.Location)
+	}
+}